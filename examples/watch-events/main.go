@@ -0,0 +1,38 @@
+/*
+ * watch-events
+ *
+ * Connects to the /events stream of a sniffer running with -http and prints
+ * the queries as they complete. Any filters go in the URL:
+ *
+ *     watch-events -url 'ws://localhost:8080/events?min_latency=50ms'
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/zorkian/mysql-sniffer/pkg/sniffer"
+)
+
+func main() {
+	var url *string = flag.String("url", "ws://localhost:8080/events",
+		"The sniffer's /events URL, with any filters")
+	flag.Parse()
+
+	err := sniffer.WatchEvents(*url, func(ev *sniffer.Event) {
+		status := "ok"
+		if ev.ErrorCode != 0 {
+			status = fmt.Sprintf("error %d", ev.ErrorCode)
+		}
+		fmt.Printf("%s  %-21s %-21s %9.2fms %8db  %s  %s\n    %s\n",
+			ev.Time.Format("15:04:05.000"), ev.Client, ev.Server, ev.LatencyMs, ev.Bytes,
+			ev.Hash, status, ev.Query)
+	})
+	if err != nil {
+		log.Fatalf("Failed to watch %s: %s", *url, err.Error())
+	}
+}
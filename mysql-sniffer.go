@@ -4,11 +4,7 @@
  * A straightforward program for sniffing MySQL query streams and providing
  * diagnostic information on the realtime queries your database is handling.
  *
- * FIXME: this assumes IPv4.
- * FIXME: tokenizer doesn't handle negative numbers or floating points.
- * FIXME: canonicalizer should collapse "IN (?,?,?,?)" and "VALUES (?,?,?,?)"
- * FIXME: tokenizer breaks on '"' or similarly embedded quotes
- * FIXME: tokenizer parses numbers in words wrong, i.e. s2compiled -> s?compiled
+ * The work is done by the sniffer package; this is just the command line.
  *
  * written by Mark Smith <mark@qq.is>
  *
@@ -20,657 +16,404 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
-	"fmt"
-	"github.com/akrennmair/gopcap"
-	_ "github.com/davecgh/go-spew/spew"
 	"log"
 	"math/rand"
-	"sort"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
-)
-
-const (
-	TOKEN_WORD       = 0
-	TOKEN_QUOTE      = 1
-	TOKEN_NUMBER     = 2
-	TOKEN_WHITESPACE = 3
-	TOKEN_OTHER      = 4
-
-	// Internal tuning
-	TIME_BUCKETS = 10000
-
-	// ANSI colors
-	COLOR_RED     = "\x1b[31m"
-	COLOR_GREEN   = "\x1b[32m"
-	COLOR_YELLOW  = "\x1b[33m"
-	COLOR_CYAN    = "\x1b[36m"
-	COLOR_WHITE   = "\x1b[37m"
-	COLOR_DEFAULT = "\x1b[39m"
 
-	// MySQL packet types
-	COM_QUERY = 3
-
-	// These are used for formatting outputs
-	F_NONE = iota
-	F_QUERY
-	F_ROUTE
-	F_SOURCE
-	F_SOURCEIP
+	"github.com/zorkian/mysql-sniffer/pkg/sniffer"
 )
 
-type packet struct {
-	request bool // request or response
-	data    []byte
-}
-
-type sortable struct {
-	value float64
-	line  string
-}
-type sortableSlice []sortable
-
-type source struct {
-	src       string
-	srcip     string
-	synced    bool
-	reqbuffer []byte
-	resbuffer []byte
-	reqSent   *time.Time
-	reqTimes  [TIME_BUCKETS]uint64
-	qbytes    uint64
-	qdata     *queryData
-	qtext     string
-}
-
-type queryData struct {
-	count uint64
-	bytes uint64
-	times [TIME_BUCKETS]uint64
-}
-
-var start int64 = UnixNow()
-var qbuf map[string]*queryData = make(map[string]*queryData)
-var querycount int
-var chmap map[string]*source = make(map[string]*source)
-var verbose bool = false
-var noclean bool = false
-var dirty bool = false
-var format []interface{}
-var port uint16
-var times [TIME_BUCKETS]uint64
-
-var stats struct {
-	packets struct {
-		rcvd      uint64
-		rcvd_sync uint64
-	}
-	desyncs uint64
-	streams uint64
-}
-
-func UnixNow() int64 {
-	return time.Now().Unix()
-}
-
 func main() {
+	opts := sniffer.DefaultOptions()
+
 	var lport *int = flag.Int("P", 3306, "MySQL port to use")
+	flag.Var(&opts.ServerGroups, "server-group",
+		"Report these server addresses as one, e.g. 10.0.0.5,10.0.0.6=primary-1 (repeatable)")
+	flag.StringVar(&opts.Proxy, "proxy", "",
+		"Sniff a proxy host: frontend:backend ports (e.g. 6033:3306), reported separately")
 	var eth *string = flag.String("i", "eth0", "Interface to sniff")
+	var offline *string = flag.String("r", "",
+		"Read packets from this pcap file (or the files in a directory or glob) instead of sniffing")
+	flag.StringVar(&opts.From, "from", "",
+		"With -r, skip packets before this time (RFC3339, or an offset like +20m)")
+	flag.StringVar(&opts.To, "to", "",
+		"With -r, stop reading after this time (RFC3339, or an offset like +35m)")
+	flag.Float64Var(&opts.ReplaySpeed, "replay-speed", 0,
+		"With -r, replay at this multiple of the original speed (0 for as fast as possible)")
 	var ldirty *bool = flag.Bool("u", false, "Unsanitized -- do not canonicalize queries")
 	var period *int = flag.Int("t", 10, "Seconds between outputting status")
 	var displaycount *int = flag.Int("d", 15, "Display this many queries in status updates")
 	var doverbose *bool = flag.Bool("v", false, "Print every query received (spammy)")
 	var nocleanquery *bool = flag.Bool("n", false, "no clean queries")
-	var formatstr *string = flag.String("f", "#s:#q", "Format for output aggregation")
-	var sortby *string = flag.String("s", "count", "Sort by: count, max, avg, maxbytes, avgbytes")
+	var formatstr *string = flag.String("f", "#s:#q",
+		"Format for output aggregation: #s source, #i source IP, #D server, #u user, "+
+			"#d database, #p program, #r route, #q query")
+	flag.BoolVar(&opts.SplitErrors, "split-errors", false,
+		"Aggregate successful and failed executions (by error code) separately")
+	flag.BoolVar(&opts.IncludeEmpty, "include-empty", false,
+		"Include statements of only whitespace and comments in the latencies")
+	flag.BoolVar(&opts.ClientPorts, "client-ports", false,
+		"Identify clients by ip:port instead of IP, for clients sharing an IP")
+	var sortby *string = flag.String("s", "count",
+		"Sort by: count, max, avg, maxbytes, avgbytes, apdex, conc, growth, burst, respp95, "+
+			"rows, returned, errors, warnings")
+	var growthby *string = flag.String("growth", "abs",
+		"With -s growth, compare rates absolutely (abs) or relatively (rel)")
+	var sections *string = flag.String("report", "",
+		"Extra status sections, comma separated: users, clients, warnings, mirror, blind, think")
 	var cutoff *int = flag.Int("c", 0, "Only show queries over count/second")
+	var group *string = flag.String("group", "fingerprint",
+		"Group by: fingerprint, shape (verb and tables)")
+	flag.StringVar(&opts.FoldColumns, "fold-insert-columns", "",
+		"Fold INSERT column lists so their order doesn't matter (sort) or at all (collapse)")
+	var drill *string = flag.String("drill", "",
+		"With -group shape, list the fingerprints in this shape (e.g. \"select a,b\")")
+	var onlyverbs *string = flag.String("only-verbs", "",
+		"Only aggregate these verbs (comma separated, 'read' and 'write' are aliases)")
+	var skipverbs *string = flag.String("skip-verbs", "",
+		"Don't aggregate these verbs (comma separated, 'read' and 'write' are aliases)")
+	flag.Var(&opts.OnlyClients, "client", "Only look at traffic from this IP or CIDR (repeatable)")
+	flag.Var(&opts.SkipClients, "skip-client", "Ignore traffic from this IP or CIDR (repeatable)")
+	var onlyusers *string = flag.String("only-user", "",
+		"Only aggregate queries from these MySQL users (comma separated)")
+	var skipusers *string = flag.String("skip-user", "",
+		"Don't aggregate queries from these MySQL users (comma separated)")
+	flag.BoolVar(&opts.UnknownUsers, "unknown-user", true,
+		"Aggregate queries from connections whose user is unknown")
+	flag.BoolVar(&opts.Antipatterns, "antipatterns", false,
+		"Report queries matching known anti-patterns")
+	var patternfile *string = flag.String("antipattern-file", "",
+		"File of custom anti-patterns (name and regex per line), implies -antipatterns")
+	flag.BoolVar(&opts.WhereAlerts, "where-alerts", true,
+		"Immediately print updates/deletes without a where or limit clause")
+	flag.BoolVar(&opts.Locks, "locks", false,
+		"Report statements taking explicit locks (for update, lock tables, ...)")
+	flag.BoolVar(&opts.Warnings, "warnings", false,
+		"Show warnings per query and report the queries generating the most warnings")
+	flag.BoolVar(&opts.ReplSafety, "repl-safety", false,
+		"Report writes that aren't safe for statement based replication")
+	flag.DurationVar(&opts.ApdexTarget, "apdex", opts.ApdexTarget, "Apdex target latency T")
+	flag.DurationVar(&opts.ApdexRead, "apdex-read", 0, "Apdex target latency T for reads")
+	flag.DurationVar(&opts.ApdexWrite, "apdex-write", 0, "Apdex target latency T for writes")
+	flag.BoolVar(&opts.ListSizes, "list-sizes", false,
+		"Report the average and max sizes of IN lists and VALUES rows")
+	flag.IntVar(&opts.ListSizeWarn, "list-size-warn", 0,
+		"Highlight queries with IN lists or VALUES rows bigger than this, implies -list-sizes")
+	flag.BoolVar(&opts.Columns, "columns", false,
+		"Show the min, average and max columns of the result sets of each query")
+	flag.BoolVar(&opts.Bursts, "bursts", false,
+		"Score how bursty each query's arrivals are, from -1 (regular) to 1 (bursts)")
+	flag.BoolVar(&opts.ResponseSizes, "response-sizes", false,
+		"Show the p95 and max response size of each query")
+	flag.Float64Var(&opts.SizeOutlier, "size-outlier", opts.SizeOutlier,
+		"With -response-sizes, log responses over this many times their query's p99")
+	flag.BoolVar(&opts.Stalls, "stalls", false,
+		"Report responses stalled by clients that stopped reading (zero TCP window)")
+	flag.StringVar(&opts.Latency, "latency", "first",
+		"Latencies to the first packet of the response or the last: first, full")
+	flag.DurationVar(&opts.OneWayAfter, "one-way-after", opts.OneWayAfter,
+		"Warn when a server or stream has only had traffic one way this long, 0 to not check")
+	flag.BoolVar(&opts.RequireBidirectional, "require-bidirectional", false,
+		"Don't parse streams until we've seen traffic both ways, or while it's one way")
+	var dotimeline *bool = flag.Bool("timeline", false,
+		"Report qps over time, overall and for the busiest queries")
+	var bucket *time.Duration = flag.Duration("bucket", time.Hour,
+		"Size of the time buckets for -timeline")
+	flag.DurationVar(&opts.SlowConnect, "slow-connect", opts.SlowConnect,
+		"Highlight clients taking longer than this from connecting to their first query")
+	flag.DurationVar(&opts.SlowAuth, "slow-auth", opts.SlowAuth,
+		"Highlight clients and servers taking longer than this to log in")
+	flag.IntVar(&opts.Threads, "threads", 0,
+		"Show utilization against this many server threads (e.g. cores)")
+	flag.Var(&opts.MaxMemory, "max-memory",
+		"Shed idle streams and rare queries to stay under this much memory (e.g. 512MB)")
+	flag.IntVar(&opts.Detail, "detail", 0,
+		"Give rows only to this many queries with the most time lately, rolling up the rest")
+	opts.MaxPayload = sniffer.DEFAULT_MAX_PAYLOAD
+	flag.Var(&opts.MaxPayload, "max-payload",
+		"Keep at most this much of a command of 16MB or more (e.g. 64MB)")
+	flag.StringVar(&opts.Profile, "profile", "full",
+		"full, or lite for small hosts: sampled connections, capped fingerprints, CPU limit")
+	flag.Float64Var(&opts.SampleRate, "sample-rate", 0,
+		"Follow this share of connections (0-1), 0 for the profile's default")
+	flag.IntVar(&opts.MaxFingerprints, "max-fingerprints", 0,
+		"Count queries past this many fingerprints together, 0 for the profile's default")
+	flag.Float64Var(&opts.CPULimit, "cpu-limit", 0,
+		"Follow fewer connections while over this % of a core, 0 for the profile's default")
+	flag.DurationVar(&opts.MinLatency, "min-latency", 0,
+		"Only aggregate queries taking at least this long (e.g. 50ms)")
+	var forwardaddr *string = flag.String("forward", "",
+		"Send query events to the collector at this host:port")
+	var udpaddr *string = flag.String("udp-forward", "",
+		"Send query events as UDP datagrams to this host:port")
+	var udpdict *time.Duration = flag.Duration("udp-dict", time.Minute,
+		"How often -udp-forward sends the text of the fingerprints, 0 for never")
+	var chdsn *string = flag.String("clickhouse-dsn", "",
+		"Insert every query into ClickHouse over HTTP, e.g. http://localhost:8123/?database=mysql")
+	var chtable *string = flag.String("clickhouse-table", opts.ClickhouseTable,
+		"ClickHouse table for -clickhouse-dsn; fingerprints go in <table>_queries")
+	var chcreate *bool = flag.Bool("clickhouse-create", false,
+		"Create the ClickHouse tables if they don't exist")
+	var merge *bool = flag.Bool("merge", false,
+		"Merge the snapshot JSON files given as arguments into one report")
+	var mergejson *string = flag.String("merge-json", "",
+		"With -merge, write the merged snapshot as JSON to this file (- for stdout)")
+	var collectaddr *string = flag.String("collect", "",
+		"Collect query events from agents on this address instead of sniffing")
+	var recordfile *string = flag.String("record-replay", "",
+		"Record completed queries to this file for replaying")
+	var replayfile *string = flag.String("replay-file", "",
+		"Replay a file written by -record-replay against -replay-dsn instead of sniffing")
+	var replaydsn *string = flag.String("replay-dsn", "",
+		"DSN to replay against, e.g. user:pass@tcp(host:3306)/")
+	var replayfactor *float64 = flag.Float64("replay-factor", 1.0,
+		"Speed multiplier for replaying, 0 to replay as fast as possible")
+	var coveragedsn *string = flag.String("coverage-dsn", "",
+		"Compare what we capture with this server's performance_schema statement digests")
+	flag.StringVar(&opts.AdminDSN, "admin-dsn", "",
+		"Poll this server's Threads_running and Threads_connected to compare with our latencies")
+	var httpaddr *string = flag.String("http", "",
+		"Serve a dashboard and JSON API on this address (e.g. localhost:8080)")
+	flag.BoolVar(&opts.HTTPTargets, "http-targets", false,
+		"With -http, let POST /config/targets change the servers we sniff")
+	var targetsfile *string = flag.String("targets-file", "",
+		"Read the servers to sniff ([host:]port, comma separated) from this file, again on SIGHUP")
+	var dictfile *string = flag.String("dump-dictionary", "",
+		"Write the text behind the fingerprint hashes to this JSON file every interval")
+	var dictsamples *bool = flag.Bool("dict-samples", false,
+		"Include a raw query (with its values) for each fingerprint in the dictionary")
+	var migratefile *string = flag.String("migrate-dictionary", "",
+		"Rewrite this -dump-dictionary file for the current canonicalizer, to stdout")
+	flag.BoolVar(&opts.Redact, "redact", false,
+		"Replace table and column names, client IPs and users with pseudonyms in the output")
+	flag.StringVar(&opts.RedactMap, "redact-map", "",
+		"With -redact, write what the pseudonyms stand for to this file every interval")
+	var historyfile *string = flag.String("history", "",
+		"Append the busiest queries of every interval to this CSV file")
+	var historytop *int = flag.Int("history-top", 15,
+		"How many queries -history writes per interval, 0 for all")
+	var historymatch *string = flag.String("history-match", "",
+		"Only write queries matching this regexp to -history")
+	var generallog *string = flag.String("general-log", "",
+		"Read queries from this general log (- for stdin) instead of sniffing")
+	var slowlog *string = flag.String("slow-log", "",
+		"Read queries from this slow log (- for stdin) instead of sniffing")
+	var follow *bool = flag.Bool("follow", false,
+		"Keep reading logs as they grow, or -r files as new ones are finished")
+	var payloadfile *string = flag.String("payloads", "",
+		"Replay the TCP payloads in this file through the parser instead of sniffing")
+	var dumpfile *string = flag.String("dump-desyncs", "",
+		"Append the recent payloads of streams that desync to this file")
+	var selftest *bool = flag.Bool("selftest", false,
+		"Run a known workload while sniffing it and check the results")
+	var selftestdsn *string = flag.String("selftest-dsn", "",
+		"Server to run -selftest against, uses a fake server on lo when not given")
+	flag.BoolVar(&opts.Verify, "verify", false,
+		"Check the parser's bookkeeping as we go, logging and counting what doesn't add up")
+	var dotrace *bool = flag.Bool("vv", false,
+		"Trace every packet and parser decision on every connection (very spammy)")
+	var traceconn *string = flag.String("trace-conn", "",
+		"Trace every packet and parser decision on this client ip:port")
+	var tracehex *bool = flag.Bool("trace-hex", false,
+		"Include a hex dump of the first 64 bytes of each packet in the trace")
+	var tracefile *string = flag.String("trace-file", "",
+		"Write the trace to this file instead of stderr")
+	var listifaces *bool = flag.Bool("list-interfaces", false,
+		"List the interfaces, whether we can sniff them, and which see traffic on -P")
+	var diagfile *string = flag.String("diagnostics", "",
+		"On exit, write how healthy the capture was as JSON to this file (- for stderr)")
 	flag.Parse()
 
-	verbose = *doverbose
-	noclean = *nocleanquery
-	port = uint16(*lport)
-	dirty = *ldirty
-	parseFormat(*formatstr)
+	opts.Interface = *eth
+	opts.Offline, opts.Follow = *offline, *follow
+	if *dotimeline {
+		opts.TimelineBucket = *bucket
+	}
+	opts.Port = uint16(*lport)
+	opts.Format = *formatstr
+	opts.Group = *group
+	opts.Dirty = *ldirty
+	opts.NoClean = *nocleanquery
+	opts.Verbose = *doverbose
+	opts.OnlyVerbs, opts.SkipVerbs = *onlyverbs, *skipverbs
+	opts.OnlyUsers, opts.SkipUsers = *onlyusers, *skipusers
+	opts.AntipatternFile = *patternfile
+	opts.Forward, opts.Collect = *forwardaddr, *collectaddr
+	opts.UDPForward, opts.UDPDictionary = *udpaddr, *udpdict
+	opts.ClickhouseDSN, opts.ClickhouseTable, opts.ClickhouseCreate = *chdsn, *chtable, *chcreate
+	opts.RecordReplay = *recordfile
+	opts.CoverageDSN = *coveragedsn
+	opts.HTTP = *httpaddr
+	opts.DumpDictionary, opts.DictionarySamples = *dictfile, *dictsamples
+	opts.DumpDesyncs = *dumpfile
+	opts.TraceAll, opts.TraceConn, opts.TraceHex = *dotrace, *traceconn, *tracehex
+	opts.TraceFile = *tracefile
+	opts.Report = true
+	opts.Period = time.Duration(*period) * time.Second
+	opts.Display, opts.SortBy, opts.Cutoff, opts.Drill = *displaycount, *sortby, *cutoff, *drill
+	opts.Growth = *growthby
+	opts.Sections = *sections
+	opts.History, opts.HistoryTop, opts.HistoryMatch = *historyfile, *historytop, *historymatch
+
+	s, err := sniffer.New(opts)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
 	rand.Seed(time.Now().UnixNano())
 
 	log.SetPrefix("")
 	log.SetFlags(0)
 
-	log.Printf("Initializing MySQL sniffing on %s:%d...", *eth, port)
-	iface, err := pcap.Openlive(*eth, 1024, false, 0)
-	if iface == nil || err != nil {
-		msg := "unknown error"
-		if err != nil {
-			msg = err.Error()
+	if *listifaces {
+		if err := sniffer.ListInterfaces(opts.Port, 2*time.Second); err != nil {
+			log.Fatalf("%s", err.Error())
 		}
-		log.Fatalf("Failed to open device: %s", msg)
-	}
-
-	err = iface.Setfilter(fmt.Sprintf("tcp port %d", port))
-	if err != nil {
-		log.Fatalf("Failed to set port filter: %s", err.Error())
+		return
 	}
-
-	last := UnixNow()
-	var pkt *pcap.Packet = nil
-	var rv int32 = 0
-
-	for rv = 0; rv >= 0; {
-		for pkt, rv = iface.NextEx(); pkt != nil; pkt, rv = iface.NextEx() {
-			handlePacket(pkt)
-
-			// simple output printer... this should be super fast since we expect that a
-			// system like this will have relatively few unique queries once they're
-			// canonicalized.
-			if !verbose && querycount%1000 == 0 && last < UnixNow()-int64(*period) {
-				last = UnixNow()
-				handleStatusUpdate(*displaycount, *sortby, *cutoff)
-			}
+	if *selftest {
+		// The fake server is on loopback, so sniff there unless told otherwise.
+		ifset := false
+		flag.Visit(func(f *flag.Flag) { ifset = ifset || f.Name == "i" })
+		if *selftestdsn == "" && !ifset {
+			*eth = "lo"
 		}
-	}
-}
-
-func calculateTimes(timings *[TIME_BUCKETS]uint64) (fmin, favg, fmax float64) {
-	var counts, total, min, max, avg uint64 = 0, 0, 0, 0, 0
-	has_min := false
-	for _, val := range *timings {
-		if val == 0 {
-			// Queries should never take 0 nanoseconds. We are using 0 as a
-			// trigger to mean 'uninitialized reading'.
-			continue
+		if !sniffer.RunSelftest(*eth, *selftestdsn) {
+			os.Exit(1)
 		}
-		if val < min || !has_min {
-			has_min = true
-			min = val
+		return
+	}
+	if *migratefile != "" {
+		file, err := os.Open(*migratefile)
+		if err != nil {
+			log.Fatalf("%s", err.Error())
 		}
-		if val > max {
-			max = val
+		if err := sniffer.MigrateDictionary(file, os.Stdout); err != nil {
+			log.Fatalf("%s", err.Error())
 		}
-		counts++
-		total += val
+		return
 	}
-	if counts > 0 {
-		avg = total / counts // integer division
+	if *payloadfile != "" {
+		if err := sniffer.ReplayPayloads(*payloadfile); err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+		return
 	}
-	return float64(min) / 1000000, float64(avg) / 1000000,
-		float64(max) / 1000000
-}
-
-func handleStatusUpdate(displaycount int, sortby string, cutoff int) {
-	elapsed := float64(UnixNow() - start)
-
-	// print status bar
-	log.Printf("\n")
-	log.SetFlags(log.Ldate | log.Ltime)
-	log.Printf("%s%d total queries, %0.2f per second%s", COLOR_RED, querycount,
-		float64(querycount)/elapsed, COLOR_DEFAULT)
-	log.SetFlags(0)
-
-	log.Printf("%d packets (%0.2f%% on synchronized streams) / %d desyncs / %d streams",
-		stats.packets.rcvd, float64(stats.packets.rcvd_sync)/float64(stats.packets.rcvd)*100,
-		stats.desyncs, stats.streams)
-
-	// global timing values
-	gmin, gavg, gmax := calculateTimes(&times)
-	log.Printf("%0.2fms min / %0.2fms avg / %0.2fms max query times", gmin, gavg, gmax)
-	log.Printf("%d unique results in this filter", len(qbuf))
-	log.Printf(" ")
-	log.Printf("%s count     %sqps     %s  min    avg   max      %sbytes      per qry%s",
-		COLOR_YELLOW, COLOR_CYAN, COLOR_YELLOW, COLOR_GREEN, COLOR_DEFAULT)
-
-	// we cheat so badly here...
-	var tmp sortableSlice = make(sortableSlice, 0, len(qbuf))
-	for q, c := range qbuf {
-		qps := float64(c.count) / elapsed
-		if qps < float64(cutoff) {
-			continue
+	if *replayfile != "" {
+		if *replaydsn == "" {
+			log.Fatalf("-replay-file requires -replay-dsn")
 		}
-
-		qmin, qavg, qmax := calculateTimes(&c.times)
-		bavg := uint64(float64(c.bytes) / float64(c.count))
-
-		sorted := float64(c.count)
-		if sortby == "avg" {
-			sorted = qavg
-		} else if sortby == "max" {
-			sorted = qmax
-		} else if sortby == "maxbytes" {
-			sorted = float64(c.bytes)
-		} else if sortby == "avgbytes" {
-			sorted = float64(bavg)
+		if err := sniffer.RunReplay(*replayfile, *replaydsn, *replayfactor); err != nil {
+			log.Fatalf("%s", err.Error())
 		}
-
-		tmp = append(tmp, sortable{sorted, fmt.Sprintf(
-			"%s%6d  %s%7.2f/s  %s%6.2f %6.2f %6.2f  %s%9db %6db %s%s%s",
-			COLOR_YELLOW, c.count, COLOR_CYAN, qps, COLOR_YELLOW, qmin, qavg, qmax,
-			COLOR_GREEN, c.bytes, bavg, COLOR_WHITE, q, COLOR_DEFAULT)})
-	}
-	sort.Sort(tmp)
-
-	// now print top to bottom, since our sorted list is sorted backwards
-	// from what we want
-	if len(tmp) < displaycount {
-		displaycount = len(tmp)
-	}
-	for i := 1; i <= displaycount; i++ {
-		log.Printf(tmp[len(tmp)-i].line)
-	}
-}
-
-// Do something with a packet for a source.
-func processPacket(rs *source, request bool, data []byte) {
-	//		log.Printf("[%s] request=%t, got %d bytes", rs.src, request,
-	//			len(data))
-
-	stats.packets.rcvd++
-	if rs.synced {
-		stats.packets.rcvd_sync++
+		return
 	}
 
-	var ptype int = -1
-	var pdata []byte
-
-	if request {
-		// If we still have response buffer, we're in some weird state and
-		// didn't successfully process the response.
-		if rs.resbuffer != nil {
-			//				log.Printf("[%s] possibly pipelined request? %d bytes",
-			//					rs.src, len(rs.resbuffer))
-			stats.desyncs++
-			rs.resbuffer = nil
-			rs.synced = false
+	if *generallog != "" {
+		err := sniffer.RunLog(*generallog, sniffer.LOG_GENERAL, *follow, opts.Period, s.PrintStatus)
+		if err != nil {
+			log.Fatalf("%s", err.Error())
 		}
-		rs.reqbuffer = data
-		ptype, pdata = carvePacket(&rs.reqbuffer)
-	} else {
-		// FIXME: For now we're not doing anything with response data, just using the first packet
-		// after a query to determine latency.
-		rs.resbuffer = nil
-		ptype, pdata = 0, data
+		return
 	}
-
-	// The synchronization logic: if we're not presently, then we want to
-	// keep going until we are capable of carving off of a request/query.
-	if !rs.synced {
-		if !(request && ptype == COM_QUERY) {
-			rs.reqbuffer, rs.resbuffer = nil, nil
-			return
+	if *slowlog != "" {
+		err := sniffer.RunLog(*slowlog, sniffer.LOG_SLOW, *follow, opts.Period, s.PrintStatus)
+		if err != nil {
+			log.Fatalf("%s", err.Error())
 		}
-		rs.synced = true
-	}
-	//log.Printf("[%s] request=%b ptype=%d plen=%d", rs.src, request, ptype, len(pdata))
-
-	// No (full) packet detected yet. Continue on our way.
-	if ptype == -1 {
 		return
 	}
-	plen := uint64(len(pdata))
-
-	// If this is a response then we want to record the timing and
-	// store it with this channel so we can keep track of that.
-	var reqtime uint64
-	if !request {
-		// Keep adding the bytes we're getting, since this is probably still part of
-		// an earlier response
-		if rs.reqSent == nil {
-			if rs.qdata != nil {
-				rs.qdata.bytes += plen
-			}
-			return
-		}
-		reqtime = uint64(time.Since(*rs.reqSent).Nanoseconds())
-
-		// We keep track of per-source, global, and per-query timings.
-		randn := rand.Intn(TIME_BUCKETS)
-		rs.reqTimes[randn] = reqtime
-		times[randn] = reqtime
-		if rs.qdata != nil {
-			// This should never fail but it has. Probably because of a
-			// race condition I need to suss out, or sharing between
-			// two different goroutines. :(
-			rs.qdata.times[randn] = reqtime
-			rs.qdata.bytes += plen
+	if *merge {
+		if err := sniffer.RunMerge(flag.Args()); err != nil {
+			log.Fatalf("%s", err.Error())
 		}
-		rs.reqSent = nil
-
-		// If we're in verbose mode, just dump statistics from this one.
-		if verbose && len(rs.qtext) > 0 {
-			log.Printf("    %s%s %s## %sbytes: %d time: %0.2f%s\n", COLOR_GREEN, rs.qtext, COLOR_RED,
-				COLOR_YELLOW, rs.qbytes, float64(reqtime)/1000000, COLOR_DEFAULT)
+		if *mergejson == "" {
+			s.PrintStatus()
+		} else if err := writeSnapshot(s, *mergejson); err != nil {
+			log.Fatalf("Failed to write the merged snapshot: %s", err.Error())
 		}
-
 		return
 	}
 
-	// This is for sure a request, so let's count it as one.
-	if rs.reqSent != nil {
-		//			log.Printf("[%s] ...sending two requests without a response?",
-		//				rs.src)
-	}
-	tnow := time.Now()
-	rs.reqSent = &tnow
-
-	// Convert this request into whatever format the user wants.
-	querycount++
-	var text string
-
-	for _, item := range format {
-		switch item.(type) {
-		case int:
-			switch item.(int) {
-			case F_NONE:
-				log.Fatalf("F_NONE in format string")
-			case F_QUERY:
-				if dirty {
-					text += string(pdata)
-				} else {
-					text += cleanupQuery(pdata)
-				}
-			case F_ROUTE:
-				// Routes are in the query like:
-				//     SELECT /* hostname:route */ FROM ...
-				// We remove the hostname so routes can be condensed.
-				parts := strings.SplitN(string(pdata), " ", 5)
-				if len(parts) >= 4 && parts[1] == "/*" && parts[3] == "*/" {
-					if strings.Contains(parts[2], ":") {
-						text += strings.SplitN(parts[2], ":", 2)[1]
-					} else {
-						text += parts[2]
-					}
-				} else {
-					text += "(unknown) " + cleanupQuery(pdata)
-				}
-			case F_SOURCE:
-				text += rs.src
-			case F_SOURCEIP:
-				text += rs.srcip
-			default:
-				log.Fatalf("Unknown F_XXXXXX int in format string")
-			}
-		case string:
-			text += item.(string)
-		default:
-			log.Fatalf("Unknown type in format string")
-		}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	hups := make(chan os.Signal, 1)
+	if *targetsfile != "" {
+		signal.Notify(hups, syscall.SIGHUP)
 	}
-	qdata, ok := qbuf[text]
-	if !ok {
-		qdata = &queryData{}
-		qbuf[text] = qdata
-	}
-	qdata.count++
-	qdata.bytes += plen
-	rs.qtext, rs.qdata, rs.qbytes = text, qdata, plen
-}
-
-// carvePacket tries to pull a packet out of a slice of bytes. If so, it removes
-// those bytes from the slice.
-func carvePacket(buf *[]byte) (int, []byte) {
-	datalen := uint32(len(*buf))
-	if datalen < 5 {
-		return -1, nil
+	if err := s.Start(); err != nil {
+		writeDiagnostics(s, *diagfile, "error", err)
+		log.Fatalf("%s", err.Error())
 	}
-
-	size := uint32((*buf)[0]) + uint32((*buf)[1])<<8 + uint32((*buf)[2])<<16
-	if size == 0 || datalen < size+4 {
-		return -1, nil
+	if *targetsfile != "" {
+		loadTargets(s, *targetsfile, "-targets-file")
 	}
-
-	// Else, has some length, try to validate it.
-	end := size + 4
-	ptype := int((*buf)[4])
-	data := (*buf)[5 : size+4]
-	if end >= datalen {
-		*buf = nil
-	} else {
-		*buf = (*buf)[end:]
+	exit := "end"
+wait:
+	for {
+		select {
+		case <-hups:
+			loadTargets(s, *targetsfile, "SIGHUP")
+		case <-sigs:
+			// A second one kills us if stopping hangs.
+			signal.Stop(sigs)
+			s.Stop()
+			exit = "signal"
+			break wait
+		case <-s.Done():
+			break wait
+		}
 	}
-
-	//	log.Printf("datalen=%d size=%d end=%d ptype=%d data=%d buf=%d",
-	//		datalen, size, end, ptype, len(data), len(*buf))
-
-	return ptype, data
-}
-
-// extract the data... we have to figure out where it is, which means extracting data
-// from the various headers until we get the location we want.  this is crude, but
-// functional and it should be fast.
-func handlePacket(pkt *pcap.Packet) {
-	// Ethernet frame has 14 bytes of stuff to ignore, so we start our root position here
-	var pos byte = 14
-
-	// Grab the src IP address of this packet from the IP header.
-	srcIP := pkt.Data[pos+12 : pos+16]
-	dstIP := pkt.Data[pos+16 : pos+20]
-
-	// The IP frame has the header length in bits 4-7 of byte 0 (relative).
-	pos += pkt.Data[pos] & 0x0F * 4
-
-	// Grab the source port from the TCP header.
-	srcPort := uint16(pkt.Data[pos])<<8 + uint16(pkt.Data[pos+1])
-	dstPort := uint16(pkt.Data[pos+2])<<8 + uint16(pkt.Data[pos+3])
-
-	// The TCP frame has the data offset in bits 4-7 of byte 12 (relative).
-	pos += byte(pkt.Data[pos+12]) >> 4 * 4
-
-	// If this is a 0-length payload, do nothing. (Any way to change our filter
-	// to only dump packets with data?)
-	if len(pkt.Data[pos:]) <= 0 {
-		return
+	if s.Err() != nil {
+		exit = "error"
 	}
 
-	// This is either an inbound or outbound packet. Determine by seeing which
-	// end contains our port. Either way, we want to put this on the channel of
-	// the remote end.
-	var src string
-	var request bool = false
-	if srcPort == port {
-		src = fmt.Sprintf("%d.%d.%d.%d:%d", dstIP[0], dstIP[1], dstIP[2],
-			dstIP[3], dstPort)
-		//log.Printf("response to %s", src)
-	} else if dstPort == port {
-		src = fmt.Sprintf("%d.%d.%d.%d:%d", srcIP[0], srcIP[1], srcIP[2],
-			srcIP[3], srcPort)
-		request = true
-		//log.Printf("request from %s", src)
-	} else {
-		log.Fatalf("got packet src = %d, dst = %d", srcPort, dstPort)
+	// A capture file ends, so tell them what was in it.
+	if opts.Offline != "" && !opts.Verbose {
+		s.PrintStatus()
 	}
-
-	// Get the data structure for this source, then do something.
-	rs, ok := chmap[src]
-	if !ok {
-		srcip := src[0:strings.Index(src, ":")]
-		rs = &source{src: src, srcip: srcip, synced: false}
-		stats.streams++
-		chmap[src] = rs
+	writeDiagnostics(s, *diagfile, exit, s.Err())
+	if s.Err() != nil {
+		log.Fatalf("Capture failed: %s", s.Err().Error())
 	}
-
-	// Now with a source, process the packet.
-	processPacket(rs, request, pkt.Data[pos:])
 }
 
-// scans forward in the query given the current type and returns when we encounter
-// a new type and need to stop scanning.  returns the size of the last token and
-// the type of it.
-func scanToken(query []byte) (length int, thistype int) {
-	if len(query) < 1 {
-		log.Fatalf("scanToken called with empty query")
+// loadTargets sets the servers to sniff from a file, keeping the ones we have
+// if it can't.
+func loadTargets(s *sniffer.Sniffer, filename, origin string) {
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		err = s.SetTargets(string(data), origin)
 	}
-
-	//no clean queries
-	if verbose && noclean {
-		return len(query), TOKEN_OTHER
-	}
-	// peek at the first byte, then loop
-	b := query[0]
-	switch {
-	case b == 39 || b == 34: // '"
-		started_with := b
-		escaped := false
-		for i := 1; i < len(query); i++ {
-			switch query[i] {
-			case started_with:
-				if escaped {
-					escaped = false
-					continue
-				}
-				return i + 1, TOKEN_QUOTE
-			case 92:
-				escaped = true
-			default:
-				escaped = false
-			}
-		}
-		return len(query), TOKEN_QUOTE
-
-	case b >= 48 && b <= 57: // 0-9
-		for i := 1; i < len(query); i++ {
-			switch {
-			case query[i] >= 48 && query[i] <= 57: // 0-9
-				// do nothing
-			default:
-				return i, TOKEN_NUMBER
-			}
-		}
-		return len(query), TOKEN_NUMBER
-
-	case b == 32 || (b >= 9 && b <= 13): // whitespace
-		for i := 1; i < len(query); i++ {
-			switch {
-			case query[i] == 32 || (query[i] >= 9 && query[i] <= 13):
-				// Eat all whitespace
-			default:
-				return i, TOKEN_WHITESPACE
-			}
-		}
-		return len(query), TOKEN_WHITESPACE
-
-	case (b >= 65 && b <= 90) || (b >= 97 && b <= 122): // a-zA-Z
-		for i := 1; i < len(query); i++ {
-			switch {
-			case query[i] >= 48 && query[i] <= 57:
-				// Numbers, allow.
-			case (query[i] >= 65 && query[i] <= 90) || (query[i] >= 97 && query[i] <= 122):
-				// Letters, allow.
-			case query[i] == 36 || query[i] == 95:
-				// $ and _
-			default:
-				return i, TOKEN_WORD
-			}
-		}
-		return len(query), TOKEN_WORD
-
-	default: // everything else
-		return 1, TOKEN_OTHER
+	if err != nil {
+		log.Printf("Failed to load targets from %s: %s", filename, err.Error())
 	}
-
-	// shouldn't get here
-	log.Fatalf("scanToken failure: [%s]", query)
-	return
 }
 
-func cleanupQuery(query []byte) string {
-	// iterate until we hit the end of the query...
-	var qspace []string
-	for i := 0; i < len(query); {
-		length, toktype := scanToken(query[i:])
-
-		switch toktype {
-		case TOKEN_WORD, TOKEN_OTHER:
-			qspace = append(qspace, string(query[i:i+length]))
-
-		case TOKEN_NUMBER, TOKEN_QUOTE:
-			qspace = append(qspace, "?")
-
-		case TOKEN_WHITESPACE:
-			qspace = append(qspace, " ")
-
-		default:
-			log.Fatalf("scanToken returned invalid token type %d", toktype)
-		}
-
-		i += length
-	}
-
-	// Remove hostname from the route information if it's present
-	tmp := strings.Join(qspace, "")
-
-	parts := strings.SplitN(tmp, " ", 5)
-	if len(parts) >= 5 && parts[1] == "/*" && parts[3] == "*/" {
-		if strings.Contains(parts[2], ":") {
-			tmp = parts[0] + " /* " + strings.SplitN(parts[2], ":", 2)[1] + " */ " + parts[4]
+// writeSnapshot writes the current snapshot as JSON to a file, or to stdout if
+// the filename is "-".
+func writeSnapshot(s *sniffer.Sniffer, filename string) error {
+	file := os.Stdout
+	if filename != "-" {
+		var err error
+		if file, err = os.Create(filename); err != nil {
+			return err
 		}
+		defer file.Close()
 	}
-
-	return strings.Replace(tmp, "?, ", "", -1)
+	return json.NewEncoder(file).Encode(s.Snapshot())
 }
 
-// parseFormat takes a string and parses it out into the given format slice
-// that we later use to build up a string. This might actually be an overcomplicated
-// solution?
-func parseFormat(formatstr string) {
-	formatstr = strings.TrimSpace(formatstr)
-	if formatstr == "" {
-		formatstr = "#b:#k"
-	}
-
-	is_special := false
-	curstr := ""
-	do_append := F_NONE
-	for _, char := range formatstr {
-		if char == '#' {
-			if is_special {
-				curstr += string(char)
-				is_special = false
-			} else {
-				is_special = true
-			}
-			continue
-		}
-
-		if is_special {
-			switch strings.ToLower(string(char)) {
-			case "s":
-				do_append = F_SOURCE
-			case "i":
-				do_append = F_SOURCEIP
-			case "r":
-				do_append = F_ROUTE
-			case "q":
-				do_append = F_QUERY
-			default:
-				curstr += "#" + string(char)
-			}
-			is_special = false
-		} else {
-			curstr += string(char)
-		}
-
-		if do_append != F_NONE {
-			if curstr != "" {
-				format = append(format, curstr, do_append)
-				curstr = ""
-			} else {
-				format = append(format, do_append)
-			}
-			do_append = F_NONE
-		}
+// writeDiagnostics writes how the capture went, if we were asked to.
+func writeDiagnostics(s *sniffer.Sniffer, filename, exit string, err error) {
+	if filename == "" {
+		return
 	}
-	if curstr != "" {
-		format = append(format, curstr)
+	if err := sniffer.WriteDiagnostics(filename, s.Diagnostics(exit, err)); err != nil {
+		log.Printf("Failed to write diagnostics: %s", err.Error())
 	}
 }
-
-func (self sortableSlice) Len() int {
-	return len(self)
-}
-
-func (self sortableSlice) Less(i, j int) bool {
-	return self[i].value < self[j].value
-}
-
-func (self sortableSlice) Swap(i, j int) {
-	self[i], self[j] = self[j], self[i]
-}
@@ -0,0 +1,152 @@
+/*
+ * canonical.go
+ *
+ * Canonicalization of SQL queries: replacing the literals in a query so that
+ * queries which only differ in their values come out the same.
+ *
+ * FIXME: tokenizer doesn't handle negative numbers or floating points.
+ * FIXME: canonicalizer should collapse "IN (?,?,?,?)" and "VALUES (?,?,?,?)"
+ * FIXME: tokenizer breaks on '"' or similarly embedded quotes
+ * FIXME: tokenizer parses numbers in words wrong, i.e. s2compiled -> s?compiled
+ *
+ */
+
+package canonical
+
+import (
+	"log"
+	"strings"
+)
+
+// VERSION goes up whenever Fingerprint changes what it makes of a query, so
+// fingerprints (and their hashes) from different versions can be told apart.
+const VERSION = 1
+
+const (
+	TOKEN_WORD       = 0
+	TOKEN_QUOTE      = 1
+	TOKEN_NUMBER     = 2
+	TOKEN_WHITESPACE = 3
+	TOKEN_OTHER      = 4
+)
+
+// Fingerprint returns the canonical form of a query, with its literals replaced
+// by ? and its whitespace collapsed.
+func Fingerprint(sql string) string {
+	query := []byte(sql)
+
+	// iterate until we hit the end of the query...
+	var qspace []string
+	for i := 0; i < len(query); {
+		length, toktype := ScanToken(query[i:])
+
+		switch toktype {
+		case TOKEN_WORD, TOKEN_OTHER:
+			qspace = append(qspace, string(query[i:i+length]))
+
+		case TOKEN_NUMBER, TOKEN_QUOTE:
+			qspace = append(qspace, "?")
+
+		case TOKEN_WHITESPACE:
+			qspace = append(qspace, " ")
+
+		default:
+			log.Fatalf("ScanToken returned invalid token type %d", toktype)
+		}
+
+		i += length
+	}
+
+	return Tidy(strings.Join(qspace, ""))
+}
+
+// Tidy is the last step of Fingerprint: it removes the hostname from any route
+// comment and collapses lists of ?. It's useful on its own for queries that
+// shouldn't otherwise be touched.
+func Tidy(sql string) string {
+	// Remove hostname from the route information if it's present
+	parts := strings.SplitN(sql, " ", 5)
+	if len(parts) >= 5 && parts[1] == "/*" && parts[3] == "*/" {
+		if strings.Contains(parts[2], ":") {
+			sql = parts[0] + " /* " + strings.SplitN(parts[2], ":", 2)[1] + " */ " + parts[4]
+		}
+	}
+
+	return strings.Replace(sql, "?, ", "", -1)
+}
+
+// scans forward in the query given the current type and returns when we encounter
+// a new type and need to stop scanning.  returns the size of the last token and
+// the type of it.
+func ScanToken(query []byte) (length int, thistype int) {
+	if len(query) < 1 {
+		log.Fatalf("ScanToken called with empty query")
+	}
+
+	// peek at the first byte, then loop
+	b := query[0]
+	switch {
+	case b == 39 || b == 34: // '"
+		started_with := b
+		escaped := false
+		for i := 1; i < len(query); i++ {
+			switch query[i] {
+			case started_with:
+				if escaped {
+					escaped = false
+					continue
+				}
+				return i + 1, TOKEN_QUOTE
+			case 92:
+				escaped = true
+			default:
+				escaped = false
+			}
+		}
+		return len(query), TOKEN_QUOTE
+
+	case b >= 48 && b <= 57: // 0-9
+		for i := 1; i < len(query); i++ {
+			switch {
+			case query[i] >= 48 && query[i] <= 57: // 0-9
+				// do nothing
+			default:
+				return i, TOKEN_NUMBER
+			}
+		}
+		return len(query), TOKEN_NUMBER
+
+	case b == 32 || (b >= 9 && b <= 13): // whitespace
+		for i := 1; i < len(query); i++ {
+			switch {
+			case query[i] == 32 || (query[i] >= 9 && query[i] <= 13):
+				// Eat all whitespace
+			default:
+				return i, TOKEN_WHITESPACE
+			}
+		}
+		return len(query), TOKEN_WHITESPACE
+
+	case (b >= 65 && b <= 90) || (b >= 97 && b <= 122): // a-zA-Z
+		for i := 1; i < len(query); i++ {
+			switch {
+			case query[i] >= 48 && query[i] <= 57:
+				// Numbers, allow.
+			case (query[i] >= 65 && query[i] <= 90) || (query[i] >= 97 && query[i] <= 122):
+				// Letters, allow.
+			case query[i] == 36 || query[i] == 95:
+				// $ and _
+			default:
+				return i, TOKEN_WORD
+			}
+		}
+		return len(query), TOKEN_WORD
+
+	default: // everything else
+		return 1, TOKEN_OTHER
+	}
+
+	// shouldn't get here
+	log.Fatalf("ScanToken failure: [%s]", query)
+	return
+}
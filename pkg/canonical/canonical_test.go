@@ -1,12 +1,11 @@
-package main
+package canonical
 
 import (
 	"testing"
 )
 
 func cleanupHelper(t *testing.T, input, expected string) {
-	var iv []byte = []byte(input)
-	var out string = cleanupQuery(iv)
+	var out string = Fingerprint(input)
 	if out != expected {
 		t.Errorf("For query %s\n    Got %s\n    Expected %s", input, out, expected)
 	}
@@ -33,6 +32,11 @@ func TestWhitespace(t *testing.T) {
 	cleanupHelper(t, "select *\nfrom\n\n\n\r\ntable", "select * from table")
 }
 
+func TestEmpty(t *testing.T) {
+	cleanupHelper(t, "", "")
+	cleanupHelper(t, "\n\n\n", " ")
+}
+
 func TestFailing(t *testing.T) {
 	cleanupHelper(t, "select * from s2compiled", "select * from s2compiled")
 
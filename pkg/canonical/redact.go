@@ -0,0 +1,177 @@
+/*
+ * redact.go
+ *
+ * Redaction of canonical queries, for reports that leave the building: table
+ * and column names are replaced with whatever the caller picks (pseudonyms,
+ * usually), comments are dropped since they're where applications annotate
+ * queries, and any literals left are replaced by ?.
+ *
+ * Telling identifiers from SQL takes a list of keywords. A word we don't know
+ * is taken as an identifier, so the worst an unknown keyword costs is being
+ * redacted too; keywords often used as column names (status, level, text...)
+ * are left off the list for that reason. Words before a ( are taken as
+ * functions and kept. Tables are the words after FROM, JOIN, INTO, UPDATE and
+ * TABLE (along with their aliases) and the qualifiers in front of a dot;
+ * everything else is a column.
+ *
+ */
+
+package canonical
+
+import (
+	"strings"
+)
+
+const (
+	IDENT_TABLE  = 0
+	IDENT_COLUMN = 1
+)
+
+// The keywords that start a list of tables, and those that can sit in one.
+var tableStarts = wordSet("from join into update table straight_join")
+var tableWords = wordSet("as ignore low_priority delayed high_priority quick only lateral " +
+	"natural left right inner outer cross use force index key for")
+
+var keywords = wordSet(`
+	accessible add after against all alter analyze and any as asc ascii auto_increment avg
+	before begin between bigint binary blob boolean both by call cascade case change char
+	character charset check collate column commit committed constraint convert create cross
+	current current_date current_time current_timestamp current_user cursor database databases
+	date datetime day day_hour day_minute day_second deallocate decimal declare default
+	delayed delete desc describe distinct distinctrow div double drop dual duplicate else
+	elseif enclosed end engine enum escape escaped exists exit explain false fetch float for
+	force foreign from full fulltext function global grant group having high_priority hour if
+	ignore in index infile inner insert int integer interval into is isolation join key keys
+	kill lateral lead leading left like limit lines load local localtime localtimestamp lock
+	lock_mode long longblob longtext low_priority match mediumint mediumtext minute mod month
+	natural no not nowait null of offset on only optimize option optionally or order outer
+	outfile partition precision prepare primary procedure quarter quick range read real
+	references regexp rename repeatable replace restrict return revoke right rlike rollback
+	row rows savepoint schema second select separator serializable session set share show
+	signed skip smallint some spatial sql_big_result sql_buffer_result sql_cache
+	sql_calc_found_rows sql_no_cache sql_small_result start starting straight_join table
+	tables temporary terminated then time timestamp tinyint tinytext to trailing transaction
+	trigger true truncate uncommitted union unique unlock unsigned update usage use using
+	utc_date utc_time utc_timestamp values varbinary varchar varying view warnings week when
+	where while with write xor year year_month zerofill`)
+
+// wordSet makes a set of the words in a string.
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+// commentEnd returns where a comment starting at pos ends, or pos if there
+// isn't one.
+func commentEnd(query []byte, pos int) int {
+	switch {
+	case query[pos] == '#' || (query[pos] == '-' && pos+1 < len(query) &&
+		query[pos+1] == '-' && (pos+2 == len(query) || query[pos+2] <= ' ')):
+		for pos < len(query) && query[pos] != '\n' {
+			pos++
+		}
+	case query[pos] == '/' && pos+1 < len(query) && query[pos+1] == '*':
+		end := strings.Index(string(query[pos+2:]), "*/")
+		if end < 0 {
+			return len(query)
+		}
+		pos += end + 4
+	}
+	return pos
+}
+
+// Redact returns a query with its identifiers replaced by what name returns
+// for them, and its comments and literals gone.
+func Redact(sql string, name func(kind int, ident string) string) string {
+	query := []byte(sql)
+
+	// The tokens, with quoted identifiers as one word and comments as space.
+	type token struct {
+		toktype int
+		text    string
+		quoted  bool
+	}
+	var tokens []token
+	for i := 0; i < len(query); {
+		if end := commentEnd(query, i); end > i {
+			tokens = append(tokens, token{TOKEN_WHITESPACE, " ", false})
+			i = end
+			continue
+		}
+		if query[i] == '`' {
+			end := strings.IndexByte(string(query[i+1:]), '`')
+			if end < 0 {
+				end = len(query) - i - 1
+			}
+			tokens = append(tokens, token{TOKEN_WORD, string(query[i+1 : i+1+end]), true})
+			i += end + 2
+			continue
+		}
+		length, toktype := ScanToken(query[i:])
+		tokens = append(tokens, token{toktype, string(query[i : i+length]), false})
+		i += length
+	}
+
+	// The significant tokens either side of one.
+	near := func(pos, step int) string {
+		for pos += step; pos >= 0 && pos < len(tokens); pos += step {
+			if tokens[pos].toktype != TOKEN_WHITESPACE {
+				return tokens[pos].text
+			}
+		}
+		return ""
+	}
+
+	var out []string
+	tables, variable := false, false
+	for pos, tok := range tokens {
+		switch tok.toktype {
+		case TOKEN_WHITESPACE:
+			if len(out) > 0 && out[len(out)-1] != " " {
+				out = append(out, " ")
+			}
+			continue
+		case TOKEN_NUMBER, TOKEN_QUOTE:
+			out = append(out, "?")
+			continue
+		case TOKEN_OTHER:
+			if tok.text == "(" {
+				tables = false
+			}
+			if tok.text != "." && tok.text != "@" {
+				variable = false
+			}
+			out = append(out, tok.text)
+			continue
+		}
+
+		word := strings.ToLower(tok.text)
+		prev, next := near(pos, -1), near(pos, 1)
+		if prev == "@" || (prev == "." && variable) {
+			// @variables and @@system.variables
+			variable = true
+			out = append(out, tok.text)
+			continue
+		}
+		variable = false
+		switch {
+		case !tok.quoted && keywords[word]:
+			if tableStarts[word] && !(word == "update" && strings.ToLower(prev) == "key") {
+				tables = true
+			} else if !tableWords[word] {
+				tables = false
+			}
+			out = append(out, tok.text)
+		case !tok.quoted && next == "(" && !tables:
+			out = append(out, tok.text)
+		case tables || next == ".":
+			out = append(out, name(IDENT_TABLE, tok.text))
+		default:
+			out = append(out, name(IDENT_COLUMN, tok.text))
+		}
+	}
+	return strings.TrimSpace(strings.Join(out, ""))
+}
@@ -0,0 +1,39 @@
+package canonical
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	// Numbered per kind, in order of appearance, like the sniffer does it.
+	redactHelper := func(input, expected string) {
+		seen := map[string]string{}
+		counts := [2]int{}
+		out := Redact(input, func(kind int, ident string) string {
+			key := fmt.Sprintf("%d/%s", kind, ident)
+			if _, ok := seen[key]; !ok {
+				counts[kind]++
+				seen[key] = fmt.Sprintf("%s%d", []string{"table", "col"}[kind], counts[kind])
+			}
+			return seen[key]
+		})
+		if out != expected {
+			t.Errorf("For query %s\n    Got %s\n    Expected %s", input, out, expected)
+		}
+	}
+
+	redactHelper("select id, name from users where email = ?",
+		"select col1, col2 from table1 where col3 = ?")
+	redactHelper("/* app:controller */ SELECT count(*) FROM `order` o JOIN items i ON "+
+		"i.order_id = o.id WHERE o.id IN (?) -- trailing",
+		"SELECT count(*) FROM table1 table2 JOIN table3 table4 ON table4.col1 = table2.col2 "+
+			"WHERE table2.col2 IN (?)")
+	redactHelper("insert into shop.carts (user_id, total) values (?) on duplicate key update "+
+		"total = values(total)",
+		"insert into table1.table2 (col1, col2) values (?) on duplicate key update col2 = "+
+			"values(col2)")
+	redactHelper("update accounts set balance = balance - 5 where id = 'x'",
+		"update table1 set col1 = col1 - ? where col2 = ?")
+	redactHelper("select @@session.autocommit, @x from dual", "select @@session.autocommit, @x from dual")
+}
@@ -0,0 +1,428 @@
+/*
+ * analysis.go
+ *
+ * Optional analysis of the statements we see, looking for well known ways of
+ * hurting your database.
+ *
+ */
+
+package sniffer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+// sqlToken is a significant (non-whitespace, non-comment) token of a query.
+// Words are lowercased so they can be compared against keywords directly.
+type sqlToken struct {
+	toktype int
+	text    string
+}
+
+// customPattern is a user supplied anti-pattern, matched against the
+// canonicalized query.
+type customPattern struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+var analyze bool = false
+var customPatterns []customPattern
+var whereAlerts bool = true
+
+// unbounded maps the fingerprints of UPDATE and DELETE statements that had
+// neither a WHERE nor a LIMIT to how many times we've seen them.
+var unbounded map[string]uint64 = make(map[string]uint64)
+
+// antipatterns maps pattern name to fingerprint to the number of executions of
+// that fingerprint that matched the pattern.
+var antipatterns map[string]map[string]uint64 = make(map[string]map[string]uint64)
+
+// lexQuery splits a query up into its significant tokens, skipping whitespace
+// and comments so that keywords inside comments can't fool us.
+func lexQuery(query []byte) []sqlToken {
+	var tokens []sqlToken
+	for i := skipSpaceAndComments(query, 0); i < len(query); i = skipSpaceAndComments(query, i) {
+		length, toktype := canonical.ScanToken(query[i:])
+
+		text := string(query[i : i+length])
+		if toktype == canonical.TOKEN_WORD {
+			text = strings.ToLower(text)
+		}
+		tokens = append(tokens, sqlToken{toktype, text})
+
+		i += length
+	}
+	return tokens
+}
+
+// isWord tells us whether the token at the given position is the keyword.
+func isWord(tokens []sqlToken, pos int, word string) bool {
+	return pos >= 0 && pos < len(tokens) && tokens[pos].toktype == canonical.TOKEN_WORD &&
+		tokens[pos].text == word
+}
+
+// hasWord tells us whether the keyword appears anywhere in the query.
+func hasWord(tokens []sqlToken, word string) bool {
+	for i := range tokens {
+		if isWord(tokens, i, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectAntipatterns returns the names of all of the built-in anti-patterns the
+// query matches. inTxn says whether the connection is inside a transaction.
+func detectAntipatterns(tokens []sqlToken, inTxn bool) []string {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	var found []string
+	verb := tokens[0].text
+
+	switch verb {
+	case "update", "delete":
+		if !hasWord(tokens, "where") {
+			found = append(found, "update/delete without where")
+		}
+
+	case "select":
+		star := tokens[1:]
+		if isWord(star, 0, "distinct") || isWord(star, 0, "all") {
+			star = star[1:]
+		}
+		if len(star) > 0 && star[0].text == "*" && hasWord(tokens, "join") {
+			found = append(found, "select * with joins")
+		}
+
+		n := len(tokens)
+		if isWord(tokens, n-2, "for") && isWord(tokens, n-1, "update") && !inTxn {
+			found = append(found, "for update outside transaction")
+		}
+
+		if !hasWord(tokens, "where") && hasCommaJoin(tokens) {
+			found = append(found, "implicit cross join")
+		}
+	}
+
+	for i := range tokens {
+		if isWord(tokens, i, "order") && isWord(tokens, i+1, "by") &&
+			isWord(tokens, i+2, "rand") && i+3 < len(tokens) && tokens[i+3].text == "(" {
+			found = append(found, "order by rand()")
+		}
+		if isWord(tokens, i, "like") && i+1 < len(tokens) &&
+			tokens[i+1].toktype == canonical.TOKEN_QUOTE && len(tokens[i+1].text) > 1 &&
+			tokens[i+1].text[1] == '%' {
+			found = append(found, "like with leading wildcard")
+		}
+	}
+
+	return found
+}
+
+// isUnboundedWrite tells us whether the query is an UPDATE or DELETE that will
+// touch every row in its table(s).
+func isUnboundedWrite(tokens []sqlToken) bool {
+	if !isWord(tokens, 0, "update") && !isWord(tokens, 0, "delete") {
+		return false
+	}
+	return !hasWord(tokens, "where") && !hasWord(tokens, "limit")
+}
+
+// checkUnboundedWrite shouts about UPDATE and DELETE statements without a WHERE
+// clause the moment we see them, since by the next status update it might be
+// too late to do anything about it.
+func checkUnboundedWrite(rs *source, query []byte) {
+	if !isUnboundedWrite(lexQuery(query)) {
+		return
+	}
+
+	user := redactUser(rs.user)
+	if user == "" {
+		user = "(unknown)"
+	}
+	fingerprint := cleanupQuery(query)
+	stats.unbounded++
+	unbounded[fingerprint]++
+
+	// Redacted, there's no showing the values, so we show the fingerprint.
+	shown := string(query)
+	if redacting {
+		shown = redactQuery(fingerprint)
+	}
+	log.Printf("%s%s unbounded write from %s (user %s): %s%s",
+		COLOR_RED, clock().Format("2006/01/02 15:04:05"), redactClient(rs.src), user,
+		shown, COLOR_DEFAULT)
+}
+
+// tableModifiers are words that can sit between a keyword and the table name
+// it introduces, like "insert ignore into" or "update low_priority".
+var tableModifiers map[string]bool = map[string]bool{
+	"low_priority": true, "high_priority": true, "delayed": true, "ignore": true,
+	"quick": true, "only": true,
+}
+
+// clauseEnds are keywords that end the list of tables in a FROM clause.
+var clauseEnds map[string]bool = map[string]bool{
+	"where": true, "group": true, "order": true, "limit": true, "having": true,
+	"union": true, "on": true, "using": true, "set": true, "for": true, "lock": true,
+}
+
+// queryTables returns the sorted, de-duplicated list of tables a query refers
+// to, as found after FROM, JOIN, INTO, UPDATE and in comma separated lists.
+func queryTables(tokens []sqlToken) []string {
+	var tables []string
+	seen := make(map[string]bool)
+
+	depth, fromDepth := 0, -1
+	for i, tok := range tokens {
+		expect := false
+		switch {
+		case tok.text == "(":
+			depth++
+		case tok.text == ")":
+			if depth == fromDepth {
+				fromDepth = -1
+			}
+			depth--
+		case isWord(tokens, i, "from"):
+			fromDepth, expect = depth, true
+		case isWord(tokens, i, "join") || isWord(tokens, i, "into"):
+			expect = true
+		case i == 0 && isWord(tokens, i, "update"):
+			fromDepth, expect = depth, true
+		case tok.text == "," && depth == fromDepth:
+			expect = true
+		case tok.toktype == canonical.TOKEN_WORD && clauseEnds[tok.text] && depth == fromDepth:
+			fromDepth = -1
+		}
+
+		if expect {
+			if name := tableName(tokens, i+1); name != "" && name != "dual" && !seen[name] {
+				seen[name] = true
+				tables = append(tables, name)
+			}
+		}
+	}
+
+	sort.Strings(tables)
+	return tables
+}
+
+// tableName reads a (possibly schema qualified and quoted) table name starting
+// at the given position, returning an empty string if there isn't one.
+func tableName(tokens []sqlToken, pos int) string {
+	for pos < len(tokens) && tokens[pos].toktype == canonical.TOKEN_WORD &&
+		tableModifiers[tokens[pos].text] {
+		pos++
+	}
+
+	name := ""
+	for pos < len(tokens) {
+		switch {
+		case tokens[pos].text == "`":
+			// Quoting doesn't matter to us.
+		case tokens[pos].toktype == canonical.TOKEN_WORD && (name == "" || strings.HasSuffix(name, ".")):
+			name += tokens[pos].text
+		case tokens[pos].text == "." && name != "" && !strings.HasSuffix(name, "."):
+			name += "."
+		default:
+			return strings.TrimSuffix(name, ".")
+		}
+		pos++
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// queryShape returns the coarse grouping of a query used by -group shape: its
+// verb and the set of tables it touches.
+func queryShape(query []byte) string {
+	tables := queryTables(lexQuery(query))
+	if len(tables) == 0 {
+		return queryVerb(query)
+	}
+	return queryVerb(query) + " " + strings.Join(tables, ",")
+}
+
+// hasCommaJoin looks for a FROM clause listing several tables separated by
+// commas, ignoring anything in parentheses (subqueries, function calls).
+func hasCommaJoin(tokens []sqlToken) bool {
+	depth, inFrom := 0, false
+	for i, tok := range tokens {
+		switch {
+		case tok.text == "(":
+			depth++
+		case tok.text == ")":
+			depth--
+		case depth != 0:
+			// Nothing in a subquery counts.
+		case isWord(tokens, i, "from"):
+			inFrom = true
+		case isWord(tokens, i, "where") || isWord(tokens, i, "group") ||
+			isWord(tokens, i, "order") || isWord(tokens, i, "limit") ||
+			isWord(tokens, i, "having") || isWord(tokens, i, "union"):
+			inFrom = false
+		case inFrom && tok.text == ",":
+			return true
+		}
+	}
+	return false
+}
+
+// recordAntipatterns runs the analysis over a query and keeps track of what it
+// finds against the given fingerprint.
+func recordAntipatterns(fingerprint string, query []byte, inTxn bool) {
+	found := detectAntipatterns(lexQuery(query), inTxn)
+	if len(customPatterns) > 0 {
+		canonical := cleanupQuery(query)
+		for _, pattern := range customPatterns {
+			if pattern.regex.MatchString(canonical) {
+				found = append(found, pattern.name)
+			}
+		}
+	}
+
+	for _, name := range found {
+		fingerprints, ok := antipatterns[name]
+		if !ok {
+			fingerprints = make(map[string]uint64)
+			antipatterns[name] = fingerprints
+		}
+		fingerprints[fingerprint]++
+	}
+}
+
+// loadCustomPatterns reads a file of user supplied anti-patterns. Each line is a
+// name followed by whitespace and a regular expression that is matched against
+// the canonicalized query. Blank lines and lines starting with # are ignored.
+func loadCustomPatterns(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if tab := strings.SplitN(line, "\t", 2); len(tab[0]) < len(parts[0]) {
+			parts = tab
+		}
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return fmt.Errorf("%s:%d: expected a name and a regex", filename, lineno)
+		}
+
+		regex, err := regexp.Compile(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineno, err.Error())
+		}
+		customPatterns = append(customPatterns, customPattern{parts[0], regex})
+	}
+	return scanner.Err()
+}
+
+// printAntipatterns shows each pattern we've seen with its worst offenders.
+func printAntipatterns(w io.Writer, offenders int) {
+	if len(antipatterns) == 0 {
+		return
+	}
+
+	var patterns sortableSlice = make(sortableSlice, 0, len(antipatterns))
+	for name, fingerprints := range antipatterns {
+		var total uint64
+		for _, count := range fingerprints {
+			total += count
+		}
+		patterns = append(patterns, sortable{float64(total), name})
+	}
+	sort.Sort(sort.Reverse(patterns))
+
+	reportf(w, " ")
+	reportf(w, "%santi-patterns%s", COLOR_RED, COLOR_DEFAULT)
+	for _, pattern := range patterns {
+		reportf(w, "%s%8d  %s%s", COLOR_YELLOW, uint64(pattern.value),
+			redactPattern(pattern.line), COLOR_DEFAULT)
+
+		var worst sortableSlice = make(sortableSlice, 0, len(antipatterns[pattern.line]))
+		for fingerprint, count := range antipatterns[pattern.line] {
+			worst = append(worst, sortable{float64(count), fingerprint})
+		}
+		sort.Sort(sort.Reverse(worst))
+		for i := 0; i < len(worst) && i < offenders; i++ {
+			reportf(w, "    %s%8d  %s%s%s", COLOR_YELLOW, uint64(worst[i].value),
+				COLOR_WHITE, redactQuery(worst[i].line), COLOR_DEFAULT)
+		}
+	}
+}
+
+// redactPattern redacts the name of a custom pattern, which is as likely as not
+// to name a table. Our own names give nothing away.
+func redactPattern(name string) string {
+	if !redacting {
+		return name
+	}
+	for _, pattern := range customPatterns {
+		if pattern.name == name {
+			return pseudonym("pattern", name)
+		}
+	}
+	return name
+}
+
+// printUnbounded lists the unbounded writes we've seen since startup.
+func printUnbounded(w io.Writer) {
+	if len(unbounded) == 0 {
+		return
+	}
+
+	reportf(w, " ")
+	reportf(w, "%s%d updates/deletes without where or limit%s", COLOR_RED, stats.unbounded,
+		COLOR_DEFAULT)
+	var worst sortableSlice = make(sortableSlice, 0, len(unbounded))
+	for fingerprint, count := range unbounded {
+		worst = append(worst, sortable{float64(count), fingerprint})
+	}
+	sort.Sort(sort.Reverse(worst))
+	for _, item := range worst {
+		reportf(w, "    %s%8d  %s%s%s", COLOR_YELLOW, uint64(item.value), COLOR_WHITE,
+			redactQuery(item.line), COLOR_DEFAULT)
+	}
+}
+
+// printShape lists the fingerprints that make up one shape when -group shape is
+// being used, so you can drill down into it.
+func printShape(w io.Writer, shape string) {
+	qdata, ok := qbuf[shape]
+	if !ok {
+		return
+	}
+
+	reportf(w, " ")
+	reportf(w, "%s%d fingerprints in %s%s", COLOR_RED, len(qdata.fingerprints),
+		redactQuery(shape), COLOR_DEFAULT)
+	var tmp sortableSlice = make(sortableSlice, 0, len(qdata.fingerprints))
+	for fingerprint, count := range qdata.fingerprints {
+		tmp = append(tmp, sortable{float64(count), fingerprint})
+	}
+	sort.Sort(sort.Reverse(tmp))
+	for _, item := range tmp {
+		reportf(w, "    %s%8d  %s%s%s", COLOR_YELLOW, uint64(item.value), COLOR_WHITE,
+			redactQuery(item.line), COLOR_DEFAULT)
+	}
+}
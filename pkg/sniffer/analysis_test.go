@@ -0,0 +1,78 @@
+package sniffer
+
+import (
+	"strings"
+	"testing"
+)
+
+func antipatternHelper(t *testing.T, input string, inTxn bool, expected ...string) {
+	var out []string = detectAntipatterns(lexQuery([]byte(input)), inTxn)
+	if strings.Join(out, ",") != strings.Join(expected, ",") {
+		t.Errorf("For query %s\n    Got %v\n    Expected %v", input, out, expected)
+	}
+}
+
+func TestLexQuery(t *testing.T) {
+	tokens := lexQuery([]byte("SELECT /* where */ a, 'b' -- where\nFROM t"))
+	var words []string
+	for _, tok := range tokens {
+		words = append(words, tok.text)
+	}
+	if strings.Join(words, " ") != "select a , 'b' from t" {
+		t.Errorf("Got tokens %v", words)
+	}
+}
+
+func TestAntipatterns(t *testing.T) {
+	antipatternHelper(t, "select * from a where id=1", false)
+	antipatternHelper(t, "select * from a join b on a.id=b.id where a.x=1", false,
+		"select * with joins")
+	antipatternHelper(t, "select id from a order by rand() limit 1", false,
+		"order by rand()")
+	antipatternHelper(t, "select id from a where name like '%foo'", false,
+		"like with leading wildcard")
+	antipatternHelper(t, "select id from a where name like 'foo%'", false)
+	antipatternHelper(t, "delete from a", false, "update/delete without where")
+	antipatternHelper(t, "update a set x='where'", false, "update/delete without where")
+	antipatternHelper(t, "update a set x=1 /* where */ where id=2", false)
+	antipatternHelper(t, "select id from a where id=1 for update", false,
+		"for update outside transaction")
+	antipatternHelper(t, "select id from a where id=1 for update", true)
+	antipatternHelper(t, "select a.id from a, b", false, "implicit cross join")
+	antipatternHelper(t, "select a.id from a, b where a.id=b.id", false)
+	antipatternHelper(t, "select concat(a, b) from (select 1, 2) t", false)
+}
+
+func TestUnboundedWrite(t *testing.T) {
+	for query, expected := range map[string]bool{
+		"delete from a":                          true,
+		"update a set x='where'":                 true,
+		"update a set x=1 -- where id=1":         true,
+		"delete from a where id=1":               false,
+		"delete from a limit 100":                false,
+		"select * from a":                        false,
+		"UPDATE a SET x=1 /* LIMIT */ WHERE y=2": false,
+	} {
+		if isUnboundedWrite(lexQuery([]byte(query))) != expected {
+			t.Errorf("For query %s expected %t", query, expected)
+		}
+	}
+}
+
+func tablesHelper(t *testing.T, input, expected string) {
+	var out string = strings.Join(queryTables(lexQuery([]byte(input))), ",")
+	if out != expected {
+		t.Errorf("For query %s\n    Got %s\n    Expected %s", input, out, expected)
+	}
+}
+
+func TestQueryTables(t *testing.T) {
+	tablesHelper(t, "select * from orders o join customers c on o.cid=c.id", "customers,orders")
+	tablesHelper(t, "SELECT * FROM `shop`.`orders`, customers WHERE 1", "customers,shop.orders")
+	tablesHelper(t, "insert ignore into log (a, b) values (1, 2)", "log")
+	tablesHelper(t, "update low_priority users set name='from x' where id=1", "users")
+	tablesHelper(t, "delete from sessions where id in (select id from old)", "old,sessions")
+	tablesHelper(t, "select a, b from t where c in (1, 2)", "t")
+	tablesHelper(t, "select 1 from dual", "")
+	tablesHelper(t, "insert into a select * from b on duplicate key update x=1", "a,b")
+}
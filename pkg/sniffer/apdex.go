@@ -0,0 +1,61 @@
+/*
+ * apdex.go
+ *
+ * Apdex scoring of query latencies. Each execution is satisfied if it took at
+ * most T, tolerating if it took at most 4T, and frustrated otherwise.
+ *
+ */
+
+package sniffer
+
+import (
+	"time"
+)
+
+var apdexTarget time.Duration = 100 * time.Millisecond
+var apdexRead time.Duration
+var apdexWrite time.Duration
+
+// apdexScore keeps the counters needed to compute an Apdex value.
+type apdexScore struct {
+	satisfied  uint64
+	tolerating uint64
+	total      uint64
+}
+
+var apdex apdexScore
+
+// apdexThreshold returns the target T to use for a query with the given verb,
+// honoring the per-verb overrides.
+func apdexThreshold(verb string) uint64 {
+	target := apdexTarget
+	for _, v := range verbAliases["read"] {
+		if v == verb && apdexRead > 0 {
+			target = apdexRead
+		}
+	}
+	for _, v := range verbAliases["write"] {
+		if v == verb && apdexWrite > 0 {
+			target = apdexWrite
+		}
+	}
+	return uint64(target.Nanoseconds())
+}
+
+// record scores one execution that took reqtime nanoseconds against target T.
+func (self *apdexScore) record(reqtime, target uint64) {
+	self.total++
+	if reqtime <= target {
+		self.satisfied++
+	} else if reqtime <= 4*target {
+		self.tolerating++
+	}
+}
+
+// value returns the Apdex between 0 and 1, or 1 if nothing has been scored.
+func (self *apdexScore) value() float64 {
+	if self.total == 0 {
+		return 1
+	}
+	return (float64(self.satisfied) + float64(self.tolerating)/2) / float64(self.total)
+}
@@ -0,0 +1,34 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApdex(t *testing.T) {
+	var score apdexScore
+	if score.value() != 1 {
+		t.Errorf("Expected empty score to be 1, got %0.2f", score.value())
+	}
+
+	target := uint64(100 * time.Millisecond)
+	for _, ms := range []uint64{10, 100, 150, 400, 401, 1000} {
+		score.record(ms*uint64(time.Millisecond), target)
+	}
+	// 2 satisfied, 2 tolerating, 2 frustrated
+	if score.value() != 0.5 {
+		t.Errorf("Expected score of 0.50, got %0.2f", score.value())
+	}
+}
+
+func TestApdexThreshold(t *testing.T) {
+	apdexWrite = 500 * time.Millisecond
+	defer func() { apdexWrite = 0 }()
+
+	if apdexThreshold("select") != uint64(apdexTarget) {
+		t.Errorf("Expected select to use the default target")
+	}
+	if apdexThreshold("update") != uint64(apdexWrite) {
+		t.Errorf("Expected update to use the write target")
+	}
+}
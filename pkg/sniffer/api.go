@@ -0,0 +1,899 @@
+/*
+ * api.go
+ *
+ * The interface for embedding the sniffer in other programs. The parser keeps
+ * its state at the package level, so only one Sniffer can run at a time.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akrennmair/gopcap"
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+// VERSION is the version of the sniffer, as recorded in its dictionaries.
+const VERSION = "1.0"
+
+// QueryEvent is a query we saw complete, handed to Options.OnQuery.
+type QueryEvent struct {
+	Time      time.Time
+	Client    string // ip:port
+	Server    string // ip:port, or its -server-group label
+	Address   string // ip:port, if Server is a label
+	User      string // empty if we didn't see the login
+	Canonical string // the aggregation key, built according to Options.Format
+	Raw       string
+	Latency   time.Duration
+	Bytes     uint64
+	ErrorCode int // 0 unless the server returned an error
+}
+
+// Options configures the sniffer. The defaults from DefaultOptions match those
+// of the command line tool.
+type Options struct {
+	Interface   string
+	Offline     string // read packets from this pcap file, or the files in a directory or glob
+	From        string // with Offline, skip packets before this (RFC3339 or e.g. +20m)
+	To          string // with Offline, stop reading after this
+	Port        uint16
+	Proxy       string // sniff a proxy: its frontend and backend ports, e.g. "6033:3306"
+	Format      string // e.g. "#s:#q", see the -f flag
+	ClientPorts bool   // identify clients by ip:port rather than IP
+	SplitErrors bool   // aggregate each outcome (ok, rows, error code) separately
+	Group       string // "fingerprint" or "shape"
+	FoldColumns string // fold INSERT column lists: "", "sort" or "collapse"
+	Dirty       bool   // don't canonicalize queries
+	NoClean     bool   // with Verbose, don't even tokenize queries
+	Verbose     bool   // print every query as it completes
+
+	// With Offline, reproduce the capture's timing at this multiple of real
+	// time, 0 to read as fast as possible.
+	ReplaySpeed float64
+
+	// With Offline a set of files, keep reading new ones as they're finished.
+	Follow bool
+
+	// Statements of only whitespace and comments are counted but not timed,
+	// unless this is set.
+	IncludeEmpty bool
+
+	// Addresses reported as one server, e.g. after a failover, see ServerGroups.
+	ServerGroups ServerGroups
+
+	// Filters. The verb and user lists are comma separated, as on the command
+	// line.
+	OnlyVerbs    string
+	SkipVerbs    string
+	OnlyClients  CIDRList
+	SkipClients  CIDRList
+	OnlyUsers    string
+	SkipUsers    string
+	UnknownUsers bool
+	MinLatency   time.Duration
+
+	// Analysis.
+	Antipatterns    bool
+	AntipatternFile string
+	WhereAlerts     bool
+	Locks           bool
+	Warnings        bool // track the warnings queries return, implied by SortBy "warnings"
+	ReplSafety      bool // check writes for statement based replication safety
+	ApdexTarget     time.Duration
+	ApdexRead       time.Duration
+	ApdexWrite      time.Duration
+	ListSizes       bool // track IN list and VALUES sizes
+	ListSizeWarn    int  // highlight lists bigger than this, implies ListSizes
+	Columns         bool // show the column counts of the result sets
+	Bursts          bool // score how bursty arrivals are, implied by SortBy "burst"
+
+	// Keep each query's response sizes, implied by SortBy "respp95", and log
+	// responses over SizeOutlier times the p99 of their query.
+	ResponseSizes  bool
+	SizeOutlier    float64
+	Stalls         bool   // track clients stalling responses with a zero window
+	Latency        string // "first" or "full", what the table's latencies are to
+	TimelineBucket time.Duration
+	SlowConnect    time.Duration // highlight clients slower than this to first query
+	SlowAuth       time.Duration // highlight clients and servers slower than this to log in
+	Threads        int           // the server's capacity, to show utilization against
+
+	// Warn when a server or stream has only had traffic one way for this long
+	// (0 to not check), and with RequireBidirectional, don't parse streams
+	// until we've seen them both ways.
+	OneWayAfter          time.Duration
+	RequireBidirectional bool
+
+	// Shed idle streams and the least executed queries to keep what we hold
+	// under this many bytes, 0 for no limit.
+	MaxMemory ByteSize
+
+	// Keep at most this much of a command of 16MB or more, 0 for the default.
+	MaxPayload ByteSize
+
+	// Give only this many fingerprints, those with the most time lately, rows
+	// of their own and roll the rest up by verb and tables, 0 for all of them.
+	Detail int
+
+	// "full" or "lite", which follows a share of the connections, caps the
+	// fingerprints and throttles itself to CPULimit percent of a core. The
+	// rest override what the profile sets, 0 for its default.
+	Profile         string
+	SampleRate      float64
+	MaxFingerprints int
+	CPULimit        float64
+
+	// Where completed queries go besides the aggregate.
+	OnQuery      func(*QueryEvent) // called on the capture goroutine
+	Forward      string
+	Collect      string // aggregate the events agents forward here instead of sniffing
+	RecordReplay string
+
+	// Send events as UDP datagrams (see pkg/udpwire) to this address, with the
+	// text of the fingerprints every UDPDictionary.
+	UDPForward    string
+	UDPDictionary time.Duration
+
+	// Insert every event into this ClickHouse table, over HTTP at this DSN,
+	// e.g. "http://localhost:8123/?database=mysql".
+	ClickhouseDSN    string
+	ClickhouseTable  string
+	ClickhouseCreate bool // create the tables if they don't exist
+
+	// Compare what we capture with the performance_schema digests on this
+	// server, polling it every Period.
+	CoverageDSN string
+
+	// Poll this server's Threads_running and Threads_connected, to set beside
+	// the latencies we see.
+	AdminDSN string
+
+	// Serve the dashboard and JSON API on this address, e.g. "localhost:8080",
+	// with HTTPTargets letting POST /config/targets change what we sniff.
+	HTTP        string
+	HTTPTargets bool
+
+	// Write the text behind the fingerprint hashes to this file every Period,
+	// with a raw sample of each if DictionarySamples is set.
+	DumpDictionary    string
+	DictionarySamples bool
+
+	// Redact what we show and send for sharing, writing what the pseudonyms
+	// stand for to RedactMap if set.
+	Redact    bool
+	RedactMap string
+
+	// Debugging.
+	DumpDesyncs string
+	TraceAll    bool
+	TraceConn   string
+	TraceHex    bool
+	TraceFile   string
+	Verify      bool // check the parser's invariants, see verify.go
+
+	// Status reports, printed to the log every Period when Report is set.
+	Report   bool
+	Sections string // extra sections, comma separated: "users", "clients", "warnings", "mirror"
+	Period   time.Duration
+	Display  int
+	SortBy   string
+	Growth   string // "abs" or "rel", how the growth sort compares rates
+	Cutoff   int
+	Drill    string
+
+	// Append the busiest HistoryTop queries (0 for all), or those matching
+	// HistoryMatch, to this CSV every Period.
+	History      string
+	HistoryTop   int
+	HistoryMatch string
+}
+
+// QueryStats is the aggregate for one query (or whatever Options.Format makes
+// of it) in a Snapshot.
+type QueryStats struct {
+	Key   string
+	Hash  string // of the key, as in -history
+	Count uint64
+	QPS   float64
+	Bytes uint64
+	Min   time.Duration
+	Avg   time.Duration
+	Max   time.Duration
+	Apdex float64
+	Conc  int // most executions outstanding at once since the last status update
+
+	// Executions answered with an ERR packet, and cut off by their connection
+	// closing.
+	Errors  uint64
+	Aborted uint64
+
+	// The executions answered with an OK packet, and the rows they affected,
+	// and those answered with result sets, the result sets, and the rows in
+	// them.
+	OKs        uint64
+	Rows       uint64
+	Results    uint64
+	ResultSets uint64
+	Returned   uint64
+
+	// With Options.ListSizes, the sizes of the IN lists or VALUES rows.
+	ListAvg float64
+	ListMax int
+
+	// With Options.Columns, the column counts of the result sets.
+	ColumnsMin uint64  `json:",omitempty"`
+	ColumnsAvg float64 `json:",omitempty"`
+	ColumnsMax uint64  `json:",omitempty"`
+
+	// The fetches from cursors the executions opened, and their average time.
+	Fetches  uint64        `json:",omitempty"`
+	FetchAvg time.Duration `json:",omitempty"`
+
+	// The executions by latency, estimated from the samples: bucket i is
+	// from 2^(i-1) up to 2^i microseconds. For merging, see RunMerge.
+	Histogram []uint64 `json:",omitempty"`
+
+	// When collecting or merging, the executions by server.
+	Servers map[string]uint64 `json:",omitempty"`
+}
+
+// Snapshot is the state of the aggregate at a point in time.
+type Snapshot struct {
+	Host          string
+	Time          time.Time
+	Elapsed       time.Duration
+	Queries       int
+	Packets       uint64
+	SyncedPackets uint64
+	Desyncs       uint64
+	Streams       uint64 // opened since the start, not those still open
+	Apdex         float64
+	Stats         []QueryStats // busiest first
+
+	// The share of packets libpcap dropped, and how many queries there
+	// probably were given that. The latencies are unreliable if too many
+	// were dropped lately.
+	CaptureLoss       float64
+	EstimatedQueries  float64
+	LatenciesReliable bool
+
+	// The canonical.VERSION the keys were made with.
+	CanonicalVersion int
+}
+
+// Sniffer captures MySQL traffic from an interface and aggregates it.
+type Sniffer struct {
+	opts     Options
+	iface    *pcap.Pcap
+	listener net.Listener // what agents connect to, when collecting
+	stop     chan bool
+	stopOnce sync.Once
+	done     chan bool
+	report   chan bool // asks the reporter for a status report
+	reported chan bool // closed when the reporter has finished
+	retarget chan *retarget
+	err      error      // why the capture failed, if it did
+	stats    *pcap.Stat // libpcap's counters, once the interface is closed
+
+	// When reading a set of files, those still to read.
+	captures *captureSet
+}
+
+// parser serializes the capture goroutine with Snapshot.
+var parser sync.Mutex
+
+var onQuery func(*QueryEvent)
+
+// captureTime is the time of the packet being handled, when reading a file.
+var captureTime time.Time
+
+// DefaultOptions returns the options the command line tool defaults to.
+func DefaultOptions() Options {
+	return Options{
+		Interface:    "eth0",
+		Port:         3306,
+		Format:       "#s:#q",
+		Group:        "fingerprint",
+		UnknownUsers: true,
+		WhereAlerts:  true,
+		ApdexTarget:  100 * time.Millisecond,
+		SlowConnect:  100 * time.Millisecond,
+		SlowAuth:     100 * time.Millisecond,
+		Period:       10 * time.Second,
+		Display:      15,
+		SortBy:       "count",
+		OneWayAfter:  30 * time.Second,
+		SizeOutlier:  10,
+
+		ClickhouseTable: "mysql_queries",
+	}
+}
+
+// New configures the sniffer. It doesn't start capturing until Start.
+func New(opts Options) (*Sniffer, error) {
+	if err := applyProfile(&opts); err != nil {
+		return nil, err
+	}
+	if err := configure(opts); err != nil {
+		return nil, err
+	}
+	return &Sniffer{opts: opts, stop: make(chan bool), done: make(chan bool),
+		report: make(chan bool, 1), reported: make(chan bool),
+		retarget: make(chan *retarget)}, nil
+}
+
+// configure sets up the parser's package level state from the options.
+func configure(opts Options) error {
+	verbose = opts.Verbose
+	noclean = opts.NoClean
+	dirty = opts.Dirty
+	port = opts.Port
+	var err error
+	if proxyFrontend, proxyBackend, err = parseProxy(opts.Proxy); err != nil {
+		return err
+	}
+	clientPorts = opts.ClientPorts
+	serverGroups = opts.ServerGroups
+	splitErrors = opts.SplitErrors
+	includeEmpty = opts.IncludeEmpty
+	switch opts.Group {
+	case "", "fingerprint":
+		groupShape = false
+	case "shape":
+		groupShape = true
+	default:
+		return fmt.Errorf("Unknown grouping: %s", opts.Group)
+	}
+	if foldColumns, err = parseFold(opts.FoldColumns); err != nil {
+		return err
+	}
+
+	if onlyVerbs, err = parseVerbList(opts.OnlyVerbs); err != nil {
+		return err
+	}
+	if skipVerbs, err = parseVerbList(opts.SkipVerbs); err != nil {
+		return err
+	}
+	onlyClients, skipClients = opts.OnlyClients, opts.SkipClients
+	onlyUsers = parseUserList(opts.OnlyUsers)
+	skipUsers = parseUserList(opts.SkipUsers)
+	unknownUsers = opts.UnknownUsers
+	minLatency = opts.MinLatency
+
+	analyze = opts.Antipatterns
+	whereAlerts = opts.WhereAlerts
+	trackLocks = opts.Locks
+	trackWarnings = opts.Warnings || opts.SortBy == "warnings"
+	if err := parseSections(opts.Sections); err != nil {
+		return err
+	}
+	trackReplication = opts.ReplSafety
+	apdexTarget, apdexRead, apdexWrite = opts.ApdexTarget, opts.ApdexRead, opts.ApdexWrite
+	trackLists = opts.ListSizes || opts.ListSizeWarn > 0
+	listSizeWarn = opts.ListSizeWarn
+	trackBursts = opts.Bursts || opts.SortBy == "burst"
+	trackSizes = opts.ResponseSizes || opts.SortBy == "respp95"
+	sizeOutlier, logSizes = opts.SizeOutlier, opts.ResponseSizes || opts.Verbose
+	trackStalls = opts.Stalls
+	trackColumns = opts.Columns
+	switch opts.Latency {
+	case "", LATENCY_FIRST:
+		latencyMode = LATENCY_FIRST
+	case LATENCY_FULL:
+		latencyMode = LATENCY_FULL
+	default:
+		return fmt.Errorf("Unknown latency: %s", opts.Latency)
+	}
+	fullTimes = [TIME_BUCKETS]uint64{}
+	oneWayAfter, requireBidirectional = opts.OneWayAfter, opts.RequireBidirectional
+	if requireBidirectional && oneWayAfter <= 0 {
+		return fmt.Errorf("Requiring both directions needs -one-way-after")
+	}
+	trackDictionary = opts.DumpDictionary != "" || opts.HTTP != ""
+	redacting, redactMap = opts.Redact || opts.RedactMap != "", opts.RedactMap
+	dictionarySamples = trackDictionary && opts.DictionarySamples && !redacting
+	dictionaryFile = opts.DumpDictionary
+	switch opts.Growth {
+	case "", "abs":
+		growthRelative = false
+	case "rel":
+		growthRelative = true
+	default:
+		return fmt.Errorf("Unknown growth comparison: %s", opts.Growth)
+	}
+	timelineBucket = opts.TimelineBucket
+	if (opts.From != "" || opts.To != "") && opts.Offline == "" {
+		return fmt.Errorf("A time window needs a capture file to read")
+	}
+	if windowFrom, err = parseWindowBound(opts.From); err != nil {
+		return fmt.Errorf("Bad window start: %s", err.Error())
+	}
+	if windowTo, err = parseWindowBound(opts.To); err != nil {
+		return fmt.Errorf("Bad window end: %s", err.Error())
+	}
+	windowResolved = false
+	if opts.ReplaySpeed < 0 {
+		return fmt.Errorf("Replay speed can't be negative")
+	}
+	replaySpeed, paceWall = opts.ReplaySpeed, time.Time{}
+	checkCoverage = opts.CoverageDSN != ""
+	pollingLoad = opts.AdminDSN != ""
+	historyTop, historyMatch = opts.HistoryTop, nil
+	if opts.HistoryMatch != "" {
+		re, err := regexp.Compile(opts.HistoryMatch)
+		if err != nil {
+			return fmt.Errorf("Bad history match: %s", err.Error())
+		}
+		historyMatch = re
+	}
+	if opts.History != "" {
+		if err := startHistory(opts.History); err != nil {
+			return fmt.Errorf("Failed to open history: %s", err.Error())
+		}
+	}
+	slowConnect = opts.SlowConnect
+	slowAuth = opts.SlowAuth
+	busyThreads = opts.Threads
+	maxMemory = uint64(opts.MaxMemory)
+	detailLimit = opts.Detail
+	resetTiers()
+	if maxPayload = uint64(opts.MaxPayload); maxPayload == 0 {
+		maxPayload = DEFAULT_MAX_PAYLOAD
+	}
+	sampleRate, baseSampleRate = opts.SampleRate, opts.SampleRate
+	maxFingerprints, cpuLimit = opts.MaxFingerprints, opts.CPULimit
+	timeBuckets = TIME_BUCKETS
+	if opts.Profile == PROFILE_LITE {
+		timeBuckets = LITE_BUCKETS
+	}
+	if opts.AntipatternFile != "" {
+		if err := loadCustomPatterns(opts.AntipatternFile); err != nil {
+			return fmt.Errorf("Failed to load anti-patterns: %s", err.Error())
+		}
+		analyze = true
+	}
+
+	format = nil
+	parseFormat(opts.Format)
+	formatString = opts.Format
+	onQuery = opts.OnQuery
+	collecting = opts.Collect != ""
+
+	traceAll, traceConn, traceHex = opts.TraceAll, opts.TraceConn, opts.TraceHex
+	verifying = opts.Verify
+	if opts.TraceFile != "" {
+		if err := startTracing(opts.TraceFile); err != nil {
+			return fmt.Errorf("Failed to open trace file: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// parseSections turns the -report list into the sections to print.
+func parseSections(list string) error {
+	trackUsers, reportClients, reportMirror, reportBlind = false, false, false, false
+	reportThink = false
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "users":
+			trackUsers = true
+		case "clients":
+			reportClients = true
+		case "warnings":
+			trackWarnings = true
+		case "mirror":
+			reportMirror = true
+		case "blind":
+			reportBlind = true
+		case "think":
+			reportThink = true
+		default:
+			return fmt.Errorf("Unknown report section: %s", name)
+		}
+	}
+	return nil
+}
+
+// Start opens the interface, or with Collect listens for agents, and starts
+// capturing in the background.
+func (self *Sniffer) Start() error {
+	if self.opts.Collect != "" {
+		return self.startCollector()
+	}
+
+	// The capture first, so there's nothing else to undo if we can't have it.
+	var iface *pcap.Pcap
+	var err error
+	if self.opts.Offline != "" && isCaptureSet(self.opts.Offline) {
+		log.Printf("Reading MySQL packets on port %d from the files in %s...", port,
+			self.opts.Offline)
+		self.captures = &captureSet{spec: self.opts.Offline, follow: self.opts.Follow}
+		if iface, err = self.nextCapture(); iface == nil && err == nil {
+			return fmt.Errorf("No capture files in %s", self.opts.Offline)
+		}
+		clock = func() time.Time { return captureTime }
+	} else if self.opts.Offline != "" {
+		// Time comes from the capture, so latencies and rates are as recorded.
+		log.Printf("Reading MySQL packets on port %d from %s...", port, self.opts.Offline)
+		iface, err = pcap.Openoffline(self.opts.Offline)
+		clock = func() time.Time { return captureTime }
+	} else {
+		log.Printf("Initializing MySQL sniffing on %s:%d...", self.opts.Interface, port)
+		iface, err = pcap.Openlive(self.opts.Interface, 1024, false, 100)
+	}
+	if iface == nil || err != nil {
+		msg := "unknown error"
+		if err != nil {
+			msg = err.Error()
+		}
+		return fmt.Errorf("Failed to open device: %s", msg)
+	}
+
+	if err := iface.Setfilter(captureFilter()); err != nil {
+		iface.Close()
+		return fmt.Errorf("Failed to set port filter: %s", err.Error())
+	}
+	if self.opts.HTTP != "" && self.opts.HTTPTargets {
+		retargeter = self.SetTargets
+	}
+	if err := startOutputs(self.opts); err != nil {
+		iface.Close()
+		return err
+	}
+
+	self.iface = iface
+	go self.reporter()
+	go self.run()
+	return nil
+}
+
+// startOutputs starts everything that sends what we see somewhere else. If
+// one can't be started, the exporters already running are stopped again.
+func startOutputs(opts Options) error {
+	if opts.DumpDesyncs != "" {
+		file, err := os.OpenFile(opts.DumpDesyncs, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to open desync dump: %s", err.Error())
+		}
+		desyncDump = file
+	}
+	if opts.UDPForward != "" {
+		if err := startUDPForwarder(opts.UDPForward, opts.UDPDictionary); err != nil {
+			return fmt.Errorf("Failed to start UDP forwarding: %s", err.Error())
+		}
+	}
+	if opts.ClickhouseDSN != "" {
+		if err := startClickhouse(opts.ClickhouseDSN, opts.ClickhouseTable,
+			opts.ClickhouseCreate); err != nil {
+			stopOutputs()
+			return fmt.Errorf("Failed to start ClickHouse export: %s", err.Error())
+		}
+	}
+	if opts.RecordReplay != "" {
+		if err := startRecording(opts.RecordReplay); err != nil {
+			stopOutputs()
+			return fmt.Errorf("Failed to create replay file: %s", err.Error())
+		}
+	}
+	if opts.HTTP != "" {
+		if err := startHTTP(opts.HTTP); err != nil {
+			stopOutputs()
+			return fmt.Errorf("Failed to serve HTTP: %s", err.Error())
+		}
+	}
+	if opts.CoverageDSN != "" {
+		if err := startCoverage(opts.CoverageDSN, opts.Period); err != nil {
+			stopOutputs()
+			return fmt.Errorf("Failed to connect for coverage: %s", err.Error())
+		}
+	}
+	if opts.AdminDSN != "" {
+		if err := startServerLoad(opts.AdminDSN); err != nil {
+			stopOutputs()
+			return fmt.Errorf("Failed to connect for the server load: %s", err.Error())
+		}
+	}
+
+	// This one can't fail.
+	if opts.Forward != "" {
+		startForwarder(opts.Forward)
+	}
+	return nil
+}
+
+// stopOutputs flushes and stops the forwarders and exporters that are running.
+func stopOutputs() {
+	flushRecording()
+	if forwardQueue != nil {
+		stopForwarder()
+	}
+	if udpQueue != nil {
+		stopUDPForwarder()
+	}
+	if clickhouseExport != nil {
+		stopClickhouse()
+	}
+	if httpListener != nil {
+		stopHTTP()
+	}
+	if coverageStop != nil {
+		stopCoverage()
+	}
+	if loadStop != nil {
+		stopServerLoad()
+	}
+}
+
+// run is the capture loop, which runs until Stop or until the capture fails.
+func (self *Sniffer) run() {
+	defer close(self.done)
+
+	last := UnixNow()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case rt := <-self.retarget:
+			rt.done <- self.applyTargets(rt)
+		default:
+		}
+
+		pkt, rv := self.iface.NextEx()
+		if rv == -1 {
+			self.err = self.iface.Geterror()
+			return
+		} else if rv < 0 {
+			if self.captures == nil {
+				return
+			}
+			// On to the next file of the set, with the streams as they are.
+			next, err := self.nextCapture()
+			if next == nil {
+				self.err = err
+				return
+			}
+			self.iface.Close()
+			self.iface = next
+			continue
+		}
+		if pkt == nil {
+			continue
+		}
+
+		if self.opts.Offline != "" {
+			before, after := windowCheck(pkt.Time)
+			if after {
+				// Stopping at the end of the window makes it the elapsed time.
+				parser.Lock()
+				captureTime = windowEnd
+				parser.Unlock()
+				return
+			} else if before {
+				continue
+			}
+			if !self.pace(pkt.Time) {
+				return
+			}
+		}
+
+		parser.Lock()
+		if self.opts.Offline != "" {
+			if captureTime.IsZero() {
+				first := pkt.Time
+				if !windowStart.IsZero() {
+					first = windowStart
+				}
+				start, lastStatus, last = first.Unix(), first.Unix(), first.Unix()
+			}
+			captureTime = pkt.Time
+		}
+		handlePacket(pkt)
+		if !retireAt.IsZero() {
+			retireTargets(clock())
+		}
+		if cpuLimit > 0 && self.opts.Offline == "" {
+			if now := time.Now(); now.Sub(throttle.checked) >= CPU_CHECK {
+				checkCPU(now, cpuTime())
+			}
+		}
+
+		// simple output printer... this should be super fast since we expect that a
+		// system like this will have relatively few unique queries once they're
+		// canonicalized.
+		if querycount%1000 == 0 && last < UnixNow()-int64(self.opts.Period/time.Second) {
+			last = UnixNow()
+			flushRecording()
+			if self.opts.Report && !verbose && (self.opts.Offline == "" || replaySpeed > 0) {
+				recordLoss(self.pcapStats())
+				select {
+				case self.report <- true:
+				default:
+					// The last one is still being written out.
+				}
+			}
+		}
+		parser.Unlock()
+	}
+}
+
+// reporter writes out the status reports run asks for. The capture only waits
+// while the numbers are taken from the aggregate under the parser lock, and
+// gets it back every RANK_CHUNK queries of that; the queries are ranked and
+// the report formatted and written out after.
+func (self *Sniffer) reporter() {
+	defer close(self.reported)
+	report := &statusReport{yield: yieldParser}
+	for {
+		select {
+		case <-self.report:
+		case <-self.done:
+			return
+		}
+		parser.Lock()
+		report.take(self.opts.Display, self.opts.SortBy, self.opts.Cutoff, self.opts.Drill)
+		parser.Unlock()
+		top := topRows(report.ranked, self.opts.Display)
+		parser.Lock()
+		report.fill(top)
+		report.endInterval()
+		parser.Unlock()
+		report.print()
+	}
+}
+
+// Stop stops capturing and closes the interface. Calling it again does
+// nothing.
+func (self *Sniffer) Stop() {
+	self.stopOnce.Do(self.shutdown)
+}
+
+// shutdown does the work of Stop, once the capture and the reporter are done
+// with what it tears down.
+func (self *Sniffer) shutdown() {
+	close(self.stop)
+	<-self.done
+	<-self.reported
+
+	parser.Lock()
+	defer parser.Unlock()
+	self.stats = self.pcapStats()
+	if self.iface != nil {
+		self.iface.Close()
+		self.iface = nil
+	}
+	if self.listener != nil {
+		self.listener.Close()
+		self.listener = nil
+	}
+	stopOutputs()
+}
+
+// Wait blocks until the capture ends.
+func (self *Sniffer) Wait() {
+	<-self.done
+}
+
+// Done is closed when the capture ends.
+func (self *Sniffer) Done() <-chan bool {
+	return self.done
+}
+
+// Err returns why the capture failed, or nil if it ended normally.
+func (self *Sniffer) Err() error {
+	return self.err
+}
+
+// pcapStats returns libpcap's counters for a live capture, or nil if there
+// aren't any.
+func (self *Sniffer) pcapStats() *pcap.Stat {
+	if self.iface == nil || self.opts.Offline != "" {
+		return self.stats
+	}
+	pstats, err := self.iface.Getstats()
+	if err != nil {
+		return nil
+	}
+	return pstats
+}
+
+// PrintStatus prints a status report to the log, as the command line tool does
+// every period.
+func (self *Sniffer) PrintStatus() {
+	parser.Lock()
+	defer parser.Unlock()
+	recordLoss(self.pcapStats())
+	handleStatusUpdate(self.opts.Display, self.opts.SortBy, self.opts.Cutoff, self.opts.Drill)
+}
+
+// Snapshot returns the current state of the aggregate.
+func (self *Sniffer) Snapshot() *Snapshot {
+	parser.Lock()
+	defer parser.Unlock()
+	return snapshot()
+}
+
+func snapshot() *Snapshot {
+	now := clock()
+	elapsed := now.Sub(time.Unix(start, 0))
+	host, _ := os.Hostname()
+	snap := &Snapshot{
+		Host:          host,
+		Time:          now,
+		Elapsed:       elapsed,
+		Queries:       querycount,
+		Packets:       stats.packets.rcvd,
+		SyncedPackets: stats.packets.rcvd_sync,
+		Desyncs:       stats.desyncs,
+		Streams:       stats.streams,
+		Apdex:         apdex.value(),
+		Stats:         make([]QueryStats, 0, len(qbuf)),
+
+		CaptureLoss:       captureLoss(),
+		EstimatedQueries:  estimateQueries(),
+		LatenciesReliable: latenciesReliable(),
+
+		CanonicalVersion: canonical.VERSION,
+	}
+
+	ms := func(val float64) time.Duration {
+		return time.Duration(val * float64(time.Millisecond))
+	}
+	for key, qdata := range qbuf {
+		qmin, qavg, qmax := calculateTimes(qdata.latencies())
+		qs := QueryStats{Key: redactQuery(key), Hash: fmt.Sprintf("%016x", fingerprintHash(key)),
+			Count: qdata.count, Bytes: qdata.bytes, Min: ms(qmin), Avg: ms(qavg), Max: ms(qmax),
+			Apdex: qdata.apdex.value(), Conc: concPeak(key), Errors: qdata.errors,
+			Aborted: qdata.aborted, OKs: qdata.oks, Rows: qdata.rows, Results: qdata.results,
+			ResultSets: qdata.sets, Returned: qdata.returned,
+			ListAvg: qdata.lists.avg(), ListMax: qdata.lists.max,
+			Histogram: latencyHistogram(qdata.latencies(), qdata.count)}
+		if cs := qdata.columns; cs.count > 0 {
+			qs.ColumnsMin, qs.ColumnsAvg, qs.ColumnsMax = cs.min, cs.avg(), cs.max
+		}
+		if qdata.fetches > 0 {
+			qs.Fetches = qdata.fetches
+			qs.FetchAvg = time.Duration(qdata.fetchTime / qdata.fetches)
+		}
+		if len(qdata.servers) > 0 {
+			qs.Servers = make(map[string]uint64)
+			for server, count := range qdata.servers {
+				qs.Servers[server] = count
+			}
+		}
+		if elapsed > 0 {
+			qs.QPS = float64(qdata.count) / elapsed.Seconds()
+		}
+		snap.Stats = append(snap.Stats, qs)
+	}
+	sort.Sort(byCount(snap.Stats))
+	return snap
+}
+
+type byCount []QueryStats
+
+func (self byCount) Len() int {
+	return len(self)
+}
+
+func (self byCount) Less(i, j int) bool {
+	if self[i].Count != self[j].Count {
+		return self[i].Count > self[j].Count
+	}
+	return self[i].Key < self[j].Key
+}
+
+func (self byCount) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
@@ -0,0 +1,67 @@
+package sniffer
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEventsAndSnapshot(t *testing.T) {
+	var events []*QueryEvent
+	opts := DefaultOptions()
+	opts.Format = "#q"
+	opts.OnQuery = func(ev *QueryEvent) { events = append(events, ev) }
+	if _, err := New(opts); err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	defer func() { onQuery = nil }()
+
+	file, err := os.Open("testdata/streams/login.txt")
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %s", err)
+	}
+	defer file.Close()
+	streams, _, err := readPayloads(file)
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %s", err)
+	}
+
+	qbuf, querycount = make(map[string]*queryData), 0
+	rs := &source{src: streams[0].name, dst: "10.0.0.1:3306"}
+	for _, seg := range streams[0].segments {
+		processPacket(rs, seg.request, seg.data)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Got %d events, expected 1", len(events))
+	}
+	ev := events[0]
+	if ev.Canonical != "select * from orders where id = ?" ||
+		ev.Raw != "select * from orders where id = 7" || ev.User != "app_rw" ||
+		ev.Client != "10.0.0.3:50001" || ev.Server != "10.0.0.1:3306" {
+		t.Errorf("For event\n    Got %+v", ev)
+	}
+
+	snap := snapshot()
+	if snap.Queries != 1 || len(snap.Stats) != 1 || snap.Stats[0].Key != ev.Canonical ||
+		snap.Stats[0].Count != 1 {
+		t.Errorf("For snapshot\n    Got %+v", snap)
+	}
+}
+
+func TestBadOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Group = "tables"
+	if _, err := New(opts); err == nil {
+		t.Errorf("New accepted group %s", opts.Group)
+	}
+	opts = DefaultOptions()
+	opts.OnlyVerbs = "select,drop-table"
+	if _, err := New(opts); err == nil {
+		t.Errorf("New accepted verbs %s", opts.OnlyVerbs)
+	}
+	opts = DefaultOptions()
+	opts.TraceFile = "testdata/no-such-dir/trace.log"
+	if _, err := New(opts); err == nil {
+		t.Errorf("New accepted trace file %s", opts.TraceFile)
+	}
+}
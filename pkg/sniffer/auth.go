@@ -0,0 +1,190 @@
+/*
+ * auth.go
+ *
+ * How long logins take: from the server's greeting to the OK (or error) that
+ * ends authentication, for connections we see from the start. Slow reverse DNS
+ * on the server, expensive auth plugins and round trips for auth switches all
+ * show up here, and none of it shows up in the query latencies.
+ *
+ * Connections that switch to TLS can't be timed, since the end of the login is
+ * encrypted; we count them instead.
+ *
+ * A stream we see log in goes from the greeting to the handshake response to
+ * the auth exchange (auth switches, and more data for the plugin, as many
+ * round trips as it takes) to the OK or ERR that ends it. Nothing before that
+ * is a command, and only a handshake response while we're waiting for one
+ * tells us who the client is.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	CLIENT_SSL = 0x00000800
+)
+
+const (
+	LOGIN_NONE     = iota // we didn't see the login start
+	LOGIN_GREETING        // the server greeted, the handshake response is next
+	LOGIN_AUTH            // the client answered, authenticating until the OK or ERR
+	LOGIN_DONE            // established
+)
+
+var slowAuth time.Duration = 100 * time.Millisecond
+
+var authCount, authFailed, authTLS, authSwitches uint64
+var authTimes [TIME_BUCKETS]uint64
+var authClients map[string]*connectStats = make(map[string]*connectStats)
+var authServers map[string]*connectStats = make(map[string]*connectStats)
+
+// authStarted notes the server's greeting on a stream.
+func authStarted(rs *source) {
+	rs.authStart, rs.login = clock(), LOGIN_GREETING
+	trace(rs, "greeting, login starting")
+}
+
+// loggingIn says whether a stream is in a login we saw start.
+func loggingIn(rs *source) bool {
+	return rs.login == LOGIN_GREETING || rs.login == LOGIN_AUTH
+}
+
+// loginResponse follows what the server sends during the login, returning
+// whether it's over, and if so whether the client got in.
+func loginResponse(rs *source, data []byte) (over, ok bool) {
+	for rest := data; len(rest) > 4; {
+		size := int(rest[0]) | int(rest[1])<<8 | int(rest[2])<<16
+		if len(rest) < size+4 || size == 0 {
+			break
+		}
+		switch payload := rest[4 : size+4]; {
+		case payload[0] == 0xfe && size > 1:
+			plugin, _, _ := nulString(payload, 1)
+			trace(rs, "auth switch to %s", plugin)
+			authSwitches++
+		case payload[0] == 0x01 && rs.login == LOGIN_AUTH:
+			trace(rs, "more auth data, %d bytes", size-1)
+		}
+		rest = rest[size+4:]
+	}
+	return loginOver(data)
+}
+
+// checkAuthRequest looks at what the client sends during the login, to see
+// if it's switching to TLS.
+func checkAuthRequest(rs *source, data []byte) {
+	if sslRequest(data) {
+		trace(rs, "switching to TLS, login can't be timed")
+		rs.authStart = time.Time{}
+		authTLS++
+	}
+}
+
+// checkAuthResponse looks for the end of the login in what the server sends:
+// an OK or an error after the greeting. Auth switches and more data for the
+// auth plugin come before it.
+func checkAuthResponse(rs *source, data []byte) {
+	if over, ok := loginOver(data); over {
+		recordAuth(rs, ok)
+	}
+}
+
+// loginOver tells us whether a response is the end of the login, and whether
+// the login went through.
+func loginOver(data []byte) (over, ok bool) {
+	for len(data) > 4 {
+		size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		if data[3] >= 2 && (data[4] == 0x00 || data[4] == 0xff) {
+			return true, data[4] == 0x00
+		}
+		if len(data) < size+4 {
+			break
+		}
+		data = data[size+4:]
+	}
+	return false, false
+}
+
+// recordAuth records the time since a stream's greeting, now that the login
+// is over.
+func recordAuth(rs *source, ok bool) {
+	elapsed := uint64(clock().Sub(rs.authStart).Nanoseconds())
+	rs.authStart = time.Time{}
+	if elapsed == 0 {
+		// We use 0 to mean no reading.
+		elapsed = 1
+	}
+	trace(rs, "login over after %0.2fms, ok %t", float64(elapsed)/1000000, ok)
+
+	authCount++
+	if !ok {
+		authFailed++
+	}
+	authTimes[rand.Intn(TIME_BUCKETS)] = elapsed
+	for _, by := range []struct {
+		stats map[string]*connectStats
+		key   string
+	}{{authClients, clientOf(rs).id}, {authServers, serverOf(rs)}} {
+		as, ok := by.stats[by.key]
+		if !ok {
+			as = &connectStats{}
+			by.stats[by.key] = as
+		}
+		as.count++
+		as.total += elapsed
+		if elapsed > as.max {
+			as.max = elapsed
+		}
+	}
+}
+
+// printAuths prints the login times overall, and for the slowest clients and
+// servers.
+func printAuths(w io.Writer, displaycount int) {
+	if authCount == 0 && authTLS == 0 {
+		return
+	}
+
+	amin, aavg, amax := calculateTimes(authTimes[:])
+	reportf(w, " ")
+	reportf(w, "%s%d logins (%d failed, %d auth switches, %d over TLS not timed), %0.2fms min / "+
+		"%0.2fms avg / %0.2fms max to authenticate%s", COLOR_RED, authCount, authFailed,
+		authSwitches, authTLS, amin, aavg, amax, COLOR_DEFAULT)
+	if authCount == 0 {
+		return
+	}
+
+	for _, by := range []struct {
+		name  string
+		stats map[string]*connectStats
+	}{{"client", authClients}, {"server", authServers}} {
+		var tmp sortableSlice
+		for key, as := range by.stats {
+			if by.name == "client" {
+				key = redactClient(key)
+			}
+			avg := float64(as.total) / float64(as.count) / 1000000
+			color := COLOR_YELLOW
+			if avg > float64(slowAuth)/float64(time.Millisecond) {
+				color = COLOR_RED
+			}
+			tmp = append(tmp, sortable{avg, fmt.Sprintf("%s%6d  %s%8.2f %8.2f  %s%s%s",
+				COLOR_YELLOW, as.count, color, avg, float64(as.max)/1000000, COLOR_WHITE,
+				key, COLOR_DEFAULT)})
+		}
+		sort.Sort(sort.Reverse(tmp))
+
+		reportf(w, "%slogins       avg      max  %s%s%s", COLOR_YELLOW, COLOR_WHITE, by.name,
+			COLOR_DEFAULT)
+		for i := 0; i < len(tmp) && i < displaycount; i++ {
+			fmt.Fprintln(w, tmp[i].line)
+		}
+	}
+}
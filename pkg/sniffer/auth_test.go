@@ -0,0 +1,145 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthTime(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	authCount, authFailed, authTLS = 0, 0, 0
+	authClients, authServers = make(map[string]*connectStats), make(map[string]*connectStats)
+	parseFormat("#q")
+	client := [4]byte{10, 0, 0, 4}
+	greeting := mysqlPacket(0, append([]byte{10}, "5.6.24\x00"...)...)
+
+	// A login with an auth switch, taking 40ms.
+	handlePacket(tcpPacket(client, 50000, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, greeting))
+	now = now.Add(10 * time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, makeHandshakeResponse("app")))
+	now = now.Add(10 * time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK,
+		mysqlPacket(2, append([]byte{0xfe}, "mysql_native_password\x00"...)...)))
+	now = now.Add(10 * time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, mysqlPacket(3, make([]byte, 20)...)))
+	now = now.Add(10 * time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, mysqlPacket(4, 0, 0, 0, 2, 0, 0, 0)))
+
+	// One refused, and one switching to TLS.
+	handlePacket(tcpPacket(client, 50001, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50001, false, TCP_ACK, greeting))
+	handlePacket(tcpPacket(client, 50001, true, TCP_ACK, makeHandshakeResponse("app")))
+	now = now.Add(time.Millisecond)
+	handlePacket(tcpPacket(client, 50001, false, TCP_ACK, mysqlPacket(2, 0xff, 0x15, 0x04)))
+	handlePacket(tcpPacket(client, 50002, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50002, false, TCP_ACK, greeting))
+	handlePacket(tcpPacket(client, 50002, true, TCP_ACK,
+		mysqlPacket(1, append([]byte{0x0d, 0xaa, 0, 0, 0, 0, 0, 1, 33}, make([]byte, 23)...)...)))
+	handlePacket(tcpPacket(client, 50002, false, TCP_ACK, []byte{0x16, 3, 1, 0, 0x55}))
+
+	as := authClients["10.0.0.4"]
+	if authCount != 2 || authFailed != 1 || authTLS != 1 || as == nil ||
+		as.max != uint64(40*time.Millisecond) || authServers["10.0.0.1:3306"] == nil {
+		t.Errorf("For logins\n    Got %d (%d failed, %d TLS), %+v, %v\n"+
+			"    Expected 2 (1 failed, 1 TLS), the slowest taking 40ms", authCount, authFailed,
+			authTLS, as, authServers)
+	}
+}
+
+func TestCachingSha2Login(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	querycount, stats.desyncs, authCount, authFailed = 0, 0, 0, 0
+	parseFormat("#q")
+	client := [4]byte{10, 0, 0, 5}
+	greeting := mysqlPacket(0, append([]byte{10}, "8.0.21\x00"...)...)
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...)
+	ok := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+
+	type packet struct {
+		request bool
+		data    []byte
+	}
+	// The fast path: the server has the password cached.
+	fast := []packet{{false, mysqlPacket(2, 0x01, 0x03)},
+		{false, mysqlPacket(3, 0, 0, 0, 2, 0, 0, 0)}}
+	// Full authentication over a plain connection: the client asks for the
+	// server's public key and sends the password encrypted with it.
+	full := []packet{{false, mysqlPacket(2, 0x01, 0x04)}, {true, mysqlPacket(3, 0x02)},
+		{false, mysqlPacket(4, append([]byte{0x01}, "-----BEGIN PUBLIC KEY-----\n"...)...)},
+		{true, mysqlPacket(5, make([]byte, 256)...)},
+		{false, mysqlPacket(6, 0, 0, 0, 2, 0, 0, 0)}}
+	for i, exchange := range [][]packet{fast, full} {
+		clientPort := uint16(50000 + i)
+		handlePacket(tcpPacket(client, clientPort, true, TCP_SYN, nil))
+		handlePacket(tcpPacket(client, clientPort, false, TCP_ACK, greeting))
+		handlePacket(tcpPacket(client, clientPort, true, TCP_ACK,
+			makeHandshakeResponse("app")))
+		for _, p := range exchange {
+			now = now.Add(5 * time.Millisecond)
+			handlePacket(tcpPacket(client, clientPort, p.request, TCP_ACK, p.data))
+		}
+		handlePacket(tcpPacket(client, clientPort, true, TCP_ACK, query))
+		now = now.Add(2 * time.Millisecond)
+		handlePacket(tcpPacket(client, clientPort, false, TCP_ACK, ok))
+	}
+
+	qdata := qbuf["select ?"]
+	if qdata == nil || qdata.count != 2 || qdata.timeMax != uint64(2*time.Millisecond) {
+		t.Errorf("For the first queries after the logins\n    Got %+v\n    Expected 2 of 2ms",
+			qdata)
+	}
+	if authCount != 2 || authFailed != 0 || stats.desyncs != 0 {
+		t.Errorf("For caching_sha2_password logins\n    Got %d (%d failed), %d desyncs\n"+
+			"    Expected 2, no desyncs", authCount, authFailed, stats.desyncs)
+	}
+}
+
+func TestLoginStates(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	qbuf, format, querycount, authSwitches = make(map[string]*queryData), nil, 0, 0
+	parseFormat("#q")
+	rs := &source{}
+	greeting := mysqlPacket(0, append([]byte{10}, "5.7.30\x00"...)...)
+
+	processPacket(rs, false, greeting)
+	if rs.login != LOGIN_GREETING {
+		t.Errorf("For the greeting\n    Got %d\n    Expected LOGIN_GREETING", rs.login)
+	}
+	processPacket(rs, true, makeHandshakeResponse("app"))
+	if rs.login != LOGIN_AUTH || rs.user != "app" {
+		t.Errorf("For the handshake response\n    Got %d, %s\n    Expected LOGIN_AUTH, app",
+			rs.login, rs.user)
+	}
+
+	// An auth switch, answered with auth data that looks like a query, then
+	// the OK, and a late packet that looks like another handshake response.
+	processPacket(rs, false, mysqlPacket(2, append([]byte{0xfe},
+		"sha256_password\x00"...)...))
+	processPacket(rs, true, mysqlPacket(3, append([]byte{COM_QUERY}, "select 1"...)...))
+	processPacket(rs, false, mysqlPacket(4, 0, 0, 0, 2, 0, 0, 0))
+	processPacket(rs, true, makeHandshakeResponse("other"))
+	if rs.login != LOGIN_DONE || rs.user != "app" || authSwitches != 1 || querycount != 0 {
+		t.Errorf("For the auth exchange\n    Got %d, %s, %d switches, %d queries\n"+
+			"    Expected LOGIN_DONE, app, 1 switch, no queries", rs.login, rs.user,
+			authSwitches, querycount)
+	}
+
+	// The first query is timed from when it's sent.
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...))
+	now = now.Add(3 * time.Millisecond)
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+	if qdata := qbuf["select ?"]; qdata == nil || qdata.timeTotal != uint64(3*time.Millisecond) {
+		t.Errorf("For the first query\n    Got %+v\n    Expected 3ms", qdata)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * binlog.go
+ *
+ * Replicas reading the binlog. A replica registers with COM_REGISTER_SLAVE and
+ * asks for the binlog with COM_BINLOG_DUMP (or COM_BINLOG_DUMP_GTID), and from
+ * then on the server sends events, one packet each, for as long as the
+ * connection lasts. None of it is queries, and a stream picked up in the middle
+ * of it is a one-way flood that would otherwise sit unsynced, occasionally
+ * showing something that looks like a command. We mark these streams as
+ * replication and only count their packets and bytes.
+ *
+ * Streams we pick up mid-dump are recognized from the server's side: each event
+ * packet is an OK byte and the event, whose header gives its size.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+)
+
+const (
+	// The size of a binlog event header: timestamp, type, server id, event
+	// size, next position and flags.
+	BINLOG_EVENT_HEADER = 19
+)
+
+// replicationCommand says whether a command makes a stream a replica's: a
+// registration or a dump, with their fixed fields there.
+func replicationCommand(ptype int, pdata []byte) bool {
+	switch ptype {
+	case COM_REGISTER_SLAVE:
+		// Server id, three length prefixed strings, port, rank and master id.
+		return len(pdata) >= 17
+	case COM_BINLOG_DUMP:
+		// Position, flags and server id, then the file name.
+		return len(pdata) >= 10
+	case COM_BINLOG_DUMP_GTID:
+		// Flags, server id, then the file name's length.
+		return len(pdata) >= 10
+	}
+	return false
+}
+
+// binlogEvent says whether a segment from the server starts with a binlog event
+// packet, whose event header gives the size of the rest of the packet.
+func binlogEvent(data []byte) bool {
+	if len(data) < 4+1+BINLOG_EVENT_HEADER || data[4] != 0x00 {
+		return false
+	}
+	size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+	event := data[5:]
+	eventSize := int(event[9]) | int(event[10])<<8 | int(event[11])<<16 | int(event[12])<<24
+	return eventSize == size-1
+}
+
+// startReplication marks a stream as a replica's, leaving what's outstanding
+// on it.
+func startReplication(rs *source, why string) {
+	trace(rs, "replication stream, %s", why)
+	rs.replica = true
+	rs.queue, rs.resp, rs.reqbuffer, rs.resbuffer = nil, response{}, nil, nil
+	rs.respBytes, rs.large = 0, nil
+	concEnd(rs)
+	stats.binlog.streams++
+}
+
+// countReplication counts a packet of a replica's stream.
+func countReplication(data []byte) {
+	stats.binlog.packets++
+	stats.binlog.bytes += uint64(len(data))
+}
+
+// printReplication prints the replication streams, for the status bar.
+func printReplication(w io.Writer) {
+	if stats.binlog.streams == 0 {
+		return
+	}
+	reportf(w, "%d replication streams, %d packets / %s not parsed", stats.binlog.streams,
+		stats.binlog.packets, formatBytes(stats.binlog.bytes))
+}
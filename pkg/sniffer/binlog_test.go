@@ -0,0 +1,64 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+// binlogEventPacket builds the packet of a binlog event of the given type,
+// with a body of size bytes.
+func binlogEventPacket(seq byte, etype byte, size int) []byte {
+	total := BINLOG_EVENT_HEADER + size
+	event := []byte{0, 0, 0, 0, etype, 1, 0, 0, 0, byte(total), byte(total >> 8), 0, 0,
+		0, 0, 0, 0, 0, 0}
+	return mysqlPacket(seq, append(append([]byte{0x00}, event...), make([]byte, size)...)...)
+}
+
+func TestReplicationStreams(t *testing.T) {
+	qbuf, format, querycount = make(map[string]*queryData), nil, 0
+	stats.binlog.streams, stats.binlog.packets, stats.binlog.bytes = 0, 0, 0
+	parseFormat("#q")
+	ok := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+
+	// A replica connecting: a query, its registration, then the dump.
+	rs := &source{synced: true}
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY},
+		"select unix_timestamp()"...)...))
+	processPacket(rs, false, ok)
+	register := append([]byte{COM_REGISTER_SLAVE, 2, 0, 0, 0, 0, 0, 0, 0xea, 0x0c},
+		make([]byte, 8)...)
+	processPacket(rs, true, mysqlPacket(0, register...))
+	processPacket(rs, false, ok)
+	if !rs.replica || querycount != 1 {
+		t.Errorf("For COM_REGISTER_SLAVE\n    Got replica %t, %d queries\n    Expected a replica",
+			rs.replica, querycount)
+	}
+	rcvd := stats.packets.rcvd
+	dump := append([]byte{COM_BINLOG_DUMP, 4, 0, 0, 0, 0, 0, 2, 0, 0, 0}, "bin.000001"...)
+	processPacket(rs, true, mysqlPacket(0, dump...))
+	// An event that looks like a query, which it isn't.
+	processPacket(rs, false, mysqlPacket(1, append([]byte{0x00, COM_QUERY}, "drop"...)...))
+	if querycount != 1 || stats.packets.rcvd != rcvd || stats.binlog.packets != 3 {
+		t.Errorf("For the dump\n    Got %d queries, %d packets, %d replication packets\n"+
+			"    Expected 1, none, 3", querycount, stats.packets.rcvd-rcvd, stats.binlog.packets)
+	}
+
+	// Picked up in the middle of the events.
+	rs = &source{}
+	processPacket(rs, false, binlogEventPacket(57, 2, 40))
+	if !rs.replica || stats.binlog.streams != 2 {
+		t.Errorf("For the events of a dump\n    Got replica %t, %d streams\n    Expected 2",
+			rs.replica, stats.binlog.streams)
+	}
+
+	// A row starting with an empty string isn't an event.
+	row := mysqlPacket(3, append([]byte{0x00, 5}, "hello world, and more to it"...)...)
+	if binlogEvent(row) {
+		t.Errorf("For a row\n    Got a binlog event\n    Expected none")
+	}
+	// Nor, out of sync, is something like a dump followed by more.
+	rs = &source{}
+	processPacket(rs, true, append(mysqlPacket(0, dump...), mysqlPacket(0, COM_PING)...))
+	if rs.replica {
+		t.Errorf("For a dump followed by a ping out of sync\n    Got a replica\n    Expected none")
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * blind.go
+ *
+ * The traffic we can't decode, so it's clear how much of the workload the
+ * query table covers. Streams are blind to us when they're:
+ *
+ *   - encrypted, after the client asks for TLS, or when what a stream we
+ *     picked up mid-stream sends is TLS records
+ *   - compressed, when what should be compressed frames doesn't uncompress
+ *   - never synced, picked up mid-stream and never sending a query we could
+ *     start from (bytes on a stream count here until it syncs)
+ *   - truncated, where the capture length cut packets short
+ *   - X Protocol, which we don't speak, see xprotocol.go
+ *
+ * and we count their connections and bytes per server and per client subnet
+ * for -report blind.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	CLIENT_COMPRESS = 0x00000020
+)
+
+const (
+	BLIND_NONE = iota
+	BLIND_ENCRYPTED
+	BLIND_COMPRESSED
+	BLIND_UNSYNCED
+	BLIND_TRUNCATED
+	BLIND_XPROTOCOL
+	BLIND_CATEGORIES
+)
+
+var blindNames = [BLIND_CATEGORIES]string{"", "encrypted", "compressed", "never synced",
+	"truncated", "x protocol"}
+
+var reportBlind bool = false
+
+// blindData is the undecodable traffic of a server or subnet.
+type blindData struct {
+	conns [BLIND_CATEGORIES]uint64
+	bytes [BLIND_CATEGORIES]uint64
+}
+
+func (self *blindData) total() (total uint64) {
+	for _, bytes := range self.bytes {
+		total += bytes
+	}
+	return total
+}
+
+var blind struct {
+	total   uint64 // all the bytes we saw, decoded or not
+	bytes   [BLIND_CATEGORIES]uint64
+	servers map[string]*blindData
+	subnets map[string]*blindData
+}
+
+// clientSubnet is the /24 of a client IP.
+func clientSubnet(ip string) string {
+	if i := strings.LastIndex(ip, "."); i >= 0 {
+		return ip[:i] + ".0/24"
+	}
+	return ip
+}
+
+// recordBlind counts bytes of a stream we can't decode, and the stream, the
+// first time it has some in the category.
+func recordBlind(rs *source, category int, bytes int) {
+	if blind.servers == nil {
+		blind.servers, blind.subnets = make(map[string]*blindData), make(map[string]*blindData)
+	}
+	first := rs.blindSeen&(1<<uint(category)) == 0
+	rs.blindSeen |= 1 << uint(category)
+	if category == BLIND_UNSYNCED {
+		rs.unsynced += uint64(bytes)
+	}
+	blind.bytes[category] += uint64(bytes)
+	for _, by := range []struct {
+		data map[string]*blindData
+		key  string
+	}{{blind.servers, serverOf(rs)}, {blind.subnets, clientSubnet(rs.srcip)}} {
+		bd, ok := by.data[by.key]
+		if !ok {
+			bd = &blindData{}
+			by.data[by.key] = bd
+		}
+		bd.bytes[category] += uint64(bytes)
+		if first {
+			bd.conns[category]++
+		}
+	}
+}
+
+// unblind takes back what a stream counted as never synced, now that it has,
+// or moves it into the category the stream turned out to be.
+func unblind(rs *source, into int) {
+	if rs.blindSeen&(1<<BLIND_UNSYNCED) == 0 {
+		return
+	}
+	rs.blindSeen &^= 1 << BLIND_UNSYNCED
+	bytes := rs.unsynced
+	rs.unsynced = 0
+	blind.bytes[BLIND_UNSYNCED] -= bytes
+	subnet := clientSubnet(rs.srcip)
+	for _, bd := range []*blindData{blind.servers[serverOf(rs)], blind.subnets[subnet]} {
+		bd.bytes[BLIND_UNSYNCED] -= bytes
+		bd.conns[BLIND_UNSYNCED]--
+	}
+	if into != BLIND_NONE {
+		recordBlind(rs, into, int(bytes))
+	}
+}
+
+// goBlind marks a stream as one we can't decode from here on.
+func goBlind(rs *source, category int) {
+	trace(rs, "can't decode the rest of the stream, it's %s", blindNames[category])
+	rs.blind = category
+	desync(rs, DESYNC_UNDECODABLE, blindNames[category])
+	unblind(rs, category)
+	if rs.blindSeen&(1<<uint(category)) == 0 {
+		recordBlind(rs, category, 0)
+	}
+}
+
+// sslRequest tells us whether a packet is a client asking to switch to TLS,
+// which is the first 32 bytes of a handshake response.
+func sslRequest(data []byte) bool {
+	if len(data) != 36 || data[3] != 1 {
+		return false
+	}
+	caps := uint32(data[4]) | uint32(data[5])<<8 | uint32(data[6])<<16 | uint32(data[7])<<24
+	return caps&CLIENT_PROTOCOL_41 != 0 && caps&CLIENT_SSL != 0
+}
+
+// tlsRecord tells us whether a packet starts with a TLS record header rather
+// than a MySQL one: a content type from change_cipher_spec (20) to application
+// data (23), TLS 1.0 to 1.3 on the wire, and a length TLS allows. As a MySQL
+// packet that'd be a command of 197KB, give or take, with a sequence number
+// that's the high byte of the length.
+func tlsRecord(data []byte) bool {
+	return len(data) >= 5 && data[0] >= 20 && data[0] <= 23 && data[1] == 3 &&
+		data[2] >= 1 && data[2] <= 4 && int(data[3])<<8|int(data[4]) <= 1<<14+2048
+}
+
+// handshakeCaps returns the capability flags of a handshake response.
+func handshakeCaps(data []byte) uint32 {
+	if len(data) < 8 {
+		return 0
+	}
+	return uint32(data[4]) | uint32(data[5])<<8 | uint32(data[6])<<16 | uint32(data[7])<<24
+}
+
+// printEncrypted prints how many streams are encrypted, for the status bar.
+func printEncrypted(w io.Writer) {
+	var conns uint64
+	for _, bd := range blind.servers {
+		conns += bd.conns[BLIND_ENCRYPTED]
+	}
+	if conns == 0 {
+		return
+	}
+	open := 0
+	for _, rs := range chmap {
+		if rs.blind == BLIND_ENCRYPTED {
+			open++
+		}
+	}
+	pct := 0.0
+	if blind.total > 0 {
+		pct = float64(blind.bytes[BLIND_ENCRYPTED]) / float64(blind.total) * 100
+	}
+	reportf(w, "%d streams encrypted (%d open), %s (%0.1f%%) of traffic we can't see into",
+		conns, open, formatBytes(blind.bytes[BLIND_ENCRYPTED]), pct)
+}
+
+// printBlind prints how much traffic we couldn't decode, for the servers and
+// subnets with the most.
+func printBlind(w io.Writer, displaycount int) {
+	var total uint64
+	for _, bytes := range blind.bytes {
+		total += bytes
+	}
+	reportf(w, " ")
+	pct := 0.0
+	if blind.total > 0 {
+		pct = float64(total) / float64(blind.total) * 100
+	}
+	reportf(w, "%sBlind traffic: %s of %s (%0.1f%%) couldn't be decoded%s", COLOR_RED,
+		formatBytes(total), formatBytes(blind.total), pct, COLOR_DEFAULT)
+	if total == 0 {
+		return
+	}
+
+	header := ""
+	for _, name := range blindNames[1:] {
+		header += fmt.Sprintf("%-19s", name)
+	}
+	for _, by := range []struct {
+		name string
+		data map[string]*blindData
+	}{{"server", blind.servers}, {"client subnet", blind.subnets}} {
+		var tmp sortableSlice
+		for key, bd := range by.data {
+			if bd.total() == 0 {
+				continue
+			}
+			line := ""
+			for category := 1; category < BLIND_CATEGORIES; category++ {
+				line += fmt.Sprintf("%6d %10s  ", bd.conns[category],
+					formatBytes(bd.bytes[category]))
+			}
+			if by.name == "client subnet" {
+				key = redactClient(key)
+			}
+			tmp = append(tmp, sortable{float64(bd.total()), fmt.Sprintf("%s%s%s%s",
+				line, COLOR_WHITE, key, COLOR_DEFAULT)})
+		}
+		sort.Sort(sort.Reverse(tmp))
+
+		reportf(w, "%s%s%s", COLOR_YELLOW, header, COLOR_DEFAULT)
+		reportf(w, "%s%s%s%s%s", COLOR_YELLOW,
+			strings.Repeat(" conns      bytes  ", BLIND_CATEGORIES-1), COLOR_WHITE, by.name,
+			COLOR_DEFAULT)
+		for i := 0; i < len(tmp) && i < displaycount; i++ {
+			fmt.Fprintln(w, tmp[i].line)
+		}
+	}
+}
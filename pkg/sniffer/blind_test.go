@@ -0,0 +1,79 @@
+package sniffer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBlindTraffic(t *testing.T) {
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	blind.total, blind.bytes, blind.servers, blind.subnets = 0, [BLIND_CATEGORIES]uint64{}, nil, nil
+	parseFormat("#q")
+	client := [4]byte{10, 0, 1, 7}
+	greeting := mysqlPacket(0, append([]byte{10}, "5.6.24\x00"...)...)
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	ok := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+
+	// A connection that logs in and syncs, so none of it is blind.
+	handlePacket(tcpPacket(client, 50000, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, greeting))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, makeHandshakeResponse("app")))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+
+	// One that switches to TLS.
+	handlePacket(tcpPacket(client, 50001, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50001, false, TCP_ACK, greeting))
+	handlePacket(tcpPacket(client, 50001, true, TCP_ACK,
+		mysqlPacket(1, append([]byte{0x0d, 0xaa, 0, 0, 0, 0, 0, 1, 33}, make([]byte, 23)...)...)))
+	handlePacket(tcpPacket(client, 50001, true, TCP_ACK, make([]byte, 100)))
+
+	// One that compresses, but sends frames that don't uncompress.
+	compressed := makeHandshakeResponse("app")
+	compressed[4] |= CLIENT_COMPRESS
+	loggedIn := mysqlPacket(2, 0, 0, 0, 2, 0, 0, 0)
+	bad := append([]byte{43, 0, 0, 0, 50, 0, 0}, make([]byte, 43)...)
+	handlePacket(tcpPacket(client, 50002, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50002, true, TCP_ACK, compressed))
+	handlePacket(tcpPacket(client, 50002, false, TCP_ACK, loggedIn))
+	handlePacket(tcpPacket(client, 50002, true, TCP_ACK, bad))
+
+	// One picked up mid-stream after it switched.
+	record := append([]byte{0x17, 3, 3, 0, 40}, make([]byte, 40)...)
+	handlePacket(tcpPacket(client, 50004, true, TCP_ACK, record))
+	handlePacket(tcpPacket(client, 50004, true, TCP_ACK, record))
+
+	// And one we never sync on, with a truncated packet.
+	handlePacket(tcpPacket(client, 50003, false, TCP_ACK, ok))
+	truncated := tcpPacket(client, 50003, false, TCP_ACK, ok)
+	truncated.Len += 20
+	handlePacket(truncated)
+
+	bd := blind.subnets["10.0.1.0/24"]
+	if bd == nil {
+		t.Fatalf("For the subnet\n    Got nothing\n    Expected blind traffic")
+	}
+	tlsBytes := uint64(len(greeting) + 36 + 100 + 2*len(record))
+	for category, expected := range map[int]struct{ conns, bytes uint64 }{
+		BLIND_ENCRYPTED:  {2, tlsBytes},
+		BLIND_COMPRESSED: {1, uint64(len(compressed) + len(loggedIn) + len(bad))},
+		BLIND_UNSYNCED:   {1, uint64(2 * len(ok))},
+		BLIND_TRUNCATED:  {1, 20},
+	} {
+		if bd.conns[category] != expected.conns || bd.bytes[category] != expected.bytes {
+			t.Errorf("For %s\n    Got %d conns, %d bytes\n    Expected %d conns, %d bytes",
+				blindNames[category], bd.conns[category], bd.bytes[category], expected.conns,
+				expected.bytes)
+		}
+	}
+	if server := blind.servers["10.0.0.1:3306"]; server == nil || server.total() != bd.total() {
+		t.Errorf("For the server\n    Got %+v\n    Expected the same as the subnet", server)
+	}
+
+	var out bytes.Buffer
+	printEncrypted(&out)
+	if !strings.HasPrefix(out.String(), "2 streams encrypted (2 open)") {
+		t.Errorf("For the status bar\n    Got %q\n    Expected 2 streams encrypted", out.String())
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * burst.go
+ *
+ * How bursty the arrivals of each query are within the status interval. Two
+ * queries averaging 100 qps look the same in the rates, but one arriving
+ * smoothly is nothing like one arriving as 2000 queries every 20 seconds.
+ *
+ * We score the gaps between arrivals as (stddev - mean) / (stddev + mean),
+ * which runs from -1 for perfectly regular arrivals through 0 for random
+ * (Poisson) ones to nearly 1 for arrivals in bursts.
+ *
+ */
+
+package sniffer
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Queries need this many gaps between arrivals in the interval to be
+	// scored, since a few gaps say little about the pattern.
+	BURST_MIN_SAMPLES = 10
+)
+
+var trackBursts bool = false
+
+// arrivalStats keeps the running mean and variance of the gaps between
+// arrivals of a query.
+type arrivalStats struct {
+	last time.Time
+	gaps uint64
+	mean float64 // seconds
+	m2   float64
+}
+
+// record notes a query arriving at when. Arrivals are recorded as queries
+// complete, so they can come in slightly out of order; those count as no gap.
+func (self *arrivalStats) record(when time.Time) {
+	if self.last.IsZero() {
+		self.last = when
+		return
+	}
+	gap := 0.0
+	if when.After(self.last) {
+		gap = when.Sub(self.last).Seconds()
+		self.last = when
+	}
+
+	self.gaps++
+	delta := gap - self.mean
+	self.mean += delta / float64(self.gaps)
+	self.m2 += delta * (gap - self.mean)
+}
+
+// burstiness returns the score of the gaps so far, and false if there aren't
+// enough of them.
+func (self *arrivalStats) burstiness() (float64, bool) {
+	if self.gaps < BURST_MIN_SAMPLES {
+		return 0, false
+	}
+	stddev := math.Sqrt(self.m2 / float64(self.gaps))
+	if stddev+self.mean == 0 {
+		// Everything arrived at once.
+		return 1, true
+	}
+	return (stddev - self.mean) / (stddev + self.mean), true
+}
+
+// reset starts over for a new interval, keeping the last arrival so the first
+// gap of the interval is measured from it.
+func (self *arrivalStats) reset() {
+	*self = arrivalStats{last: self.last}
+}
@@ -0,0 +1,68 @@
+package sniffer
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBurstiness(t *testing.T) {
+	base := time.Unix(1434510000, 0)
+	random := rand.New(rand.NewSource(1))
+
+	// Each pattern averages 100 qps over a minute.
+	patterns := map[string]func(i int) time.Duration{
+		"regular": func(i int) time.Duration {
+			return time.Duration(i) * 10 * time.Millisecond
+		},
+		"bursts": func(i int) time.Duration {
+			// 2000 queries within 100ms, every 20 seconds.
+			return time.Duration(i/2000)*20*time.Second + time.Duration(i%2000)*50*time.Microsecond
+		},
+	}
+	var offset time.Duration
+	patterns["random"] = func(i int) time.Duration {
+		offset += time.Duration(random.ExpFloat64() * float64(10*time.Millisecond))
+		return offset
+	}
+
+	for name, expected := range map[string][2]float64{
+		"regular": {-1, -0.99},
+		"random":  {-0.05, 0.05},
+		"bursts":  {0.9, 1},
+	} {
+		var arrivals arrivalStats
+		for i := 0; i < 6000; i++ {
+			arrivals.record(base.Add(patterns[name](i)))
+		}
+		if score, ok := arrivals.burstiness(); !ok || score < expected[0] || score > expected[1] {
+			t.Errorf("For %s arrivals\n    Got %0.3f (%t)\n    Expected %0.2f to %0.2f", name,
+				score, ok, expected[0], expected[1])
+		}
+	}
+}
+
+func TestBurstinessInterval(t *testing.T) {
+	var arrivals arrivalStats
+	base := time.Unix(1434510000, 0)
+	for i := 0; i < BURST_MIN_SAMPLES; i++ {
+		arrivals.record(base.Add(time.Duration(i) * time.Second))
+	}
+	if _, ok := arrivals.burstiness(); ok {
+		t.Errorf("For %d arrivals\n    Got a score\n    Expected too few gaps", BURST_MIN_SAMPLES)
+	}
+
+	// Out of order arrivals count as no gap, and don't move us back.
+	arrivals.record(base)
+	if score, ok := arrivals.burstiness(); !ok || score <= -1 {
+		t.Errorf("For out of order arrival\n    Got %0.3f (%t)\n    Expected a score over -1",
+			score, ok)
+	}
+
+	arrivals.reset()
+	arrivals.record(base.Add(20 * time.Second))
+	if arrivals.gaps != 1 || arrivals.mean != 11 {
+		t.Errorf("For first arrival after reset\n    Got %d gaps of %0.1fs\n    Expected 1 of 11s",
+			arrivals.gaps, arrivals.mean)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * busy.go
+ *
+ * How busy the server is: the time each connection spends waiting on a query,
+ * added up across connections. Over an interval that's the average number of
+ * queries in flight, and against the number of threads the server can run at
+ * once, roughly how loaded it is.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+	"time"
+)
+
+// How many queries the server can usefully run at once, 0 if we don't know.
+var busyThreads int
+
+// busyStreams maps streams with a query outstanding to when they sent it, and
+// busyTime is the time spent on queries since busyWindow.
+var busyStreams map[*source]time.Time = make(map[*source]time.Time)
+var busyTime time.Duration
+var busyWindow time.Time
+
+func busyStart(rs *source) {
+	busyStreams[rs] = clock()
+}
+
+func busyEnd(rs *source) {
+	if since, ok := busyStreams[rs]; ok {
+		delete(busyStreams, rs)
+		busyTime += clock().Sub(laterTime(since, busyWindow))
+	}
+}
+
+func laterTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// busyInterval returns the average number of queries in flight since the last
+// reset, counting the ones still running up to now.
+func busyInterval(now time.Time) float64 {
+	window := busyWindow
+	if window.IsZero() {
+		window = time.Unix(start, 0)
+	}
+	if !now.After(window) {
+		return 0
+	}
+
+	busy := busyTime
+	for _, since := range busyStreams {
+		busy += now.Sub(laterTime(since, window))
+	}
+	return float64(busy) / float64(now.Sub(window))
+}
+
+// printBusy prints the average queries in flight over the interval.
+func printBusy(w io.Writer, now time.Time) {
+	inflight := busyInterval(now)
+	if busyThreads > 0 {
+		reportf(w, "%0.2f queries in flight on average, %0.1f%% of %d threads", inflight,
+			inflight/float64(busyThreads)*100, busyThreads)
+	} else {
+		reportf(w, "%0.2f queries in flight on average", inflight)
+	}
+}
+
+// resetBusy starts a new interval.
+func resetBusy(now time.Time) {
+	busyTime, busyWindow = 0, now
+}
@@ -0,0 +1,43 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBusy(t *testing.T) {
+	defer func() { clock = time.Now }()
+	base := time.Date(2015, 6, 17, 3, 0, 0, 0, time.UTC)
+	at := func(secs int) {
+		now := base.Add(time.Duration(secs) * time.Second)
+		clock = func() time.Time { return now }
+	}
+	busyStreams, inflight = make(map[*source]time.Time), make(map[string]*concurrency)
+	resetBusy(base)
+
+	// Two connections overlapping for 2s, one still running at the end.
+	a, b := &source{}, &source{}
+	at(0)
+	concStart(a, "select ?")
+	at(2)
+	concStart(b, "select ?")
+	at(4)
+	concEnd(a)
+	at(6)
+	concStart(a, "select ?")
+	concEnd(a)
+
+	at(10)
+	if got := busyInterval(clock()); got != 1.2 {
+		t.Errorf("For the first interval\n    Got %f\n    Expected 1.2", got)
+	}
+
+	// The running query only counts for its time in the next interval.
+	resetBusy(clock())
+	at(15)
+	concEnd(b)
+	at(20)
+	if got := busyInterval(clock()); got != 0.5 {
+		t.Errorf("For the second interval\n    Got %f\n    Expected 0.5", got)
+	}
+}
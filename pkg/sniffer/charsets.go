@@ -0,0 +1,83 @@
+/*
+ * charsets.go
+ *
+ * Character sets of connections. Query text is kept as the bytes the client
+ * sent, which is what the aggregation keys are made of, but a client logged in
+ * with latin1 or sjis sends literals that print as mojibake. For -v, the text
+ * is decoded from the character set the client chose in its login, with what
+ * doesn't decode escaped.
+ *
+ * requires golang.org/x/text:
+ *   https://pkg.go.dev/golang.org/x/text
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// charsets are the encodings of the collations clients can log in with that
+// aren't UTF-8 or ASCII, by collation id. MySQL's latin1 is really cp1252.
+var charsets map[byte]encoding.Encoding = map[byte]encoding.Encoding{
+	5: charmap.Windows1252, 8: charmap.Windows1252, 15: charmap.Windows1252,
+	31: charmap.Windows1252, 47: charmap.Windows1252, 48: charmap.Windows1252,
+	49: charmap.Windows1252, 94: charmap.Windows1252,
+	13: japanese.ShiftJIS, 88: japanese.ShiftJIS, 95: japanese.ShiftJIS, 96: japanese.ShiftJIS,
+	28: simplifiedchinese.GBK, 87: simplifiedchinese.GBK,
+	248: simplifiedchinese.GB18030, 249: simplifiedchinese.GB18030,
+	250: simplifiedchinese.GB18030,
+}
+
+// handshakeCharset returns the collation id a 4.1 handshake response logs in
+// with, or 0 if it doesn't say.
+func handshakeCharset(data []byte) byte {
+	if len(data) < 13 || handshakeCaps(data)&CLIENT_PROTOCOL_41 == 0 {
+		return 0
+	}
+	return data[12]
+}
+
+// decodeText returns query text sent in a connection's character set as UTF-8.
+// Bytes that aren't part of a character are escaped as \xNN.
+func decodeText(charset byte, text string) string {
+	enc, ok := charsets[charset]
+	if !ok {
+		return text
+	}
+	decoder := enc.NewDecoder()
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		if text[i] < 0x80 {
+			out.WriteByte(text[i])
+			i++
+			continue
+		}
+
+		// The shortest run of bytes that makes one character, which is at
+		// most four (in GB18030).
+		size := 0
+		for n := 1; n <= 4 && i+n <= len(text) && size == 0; n++ {
+			char, err := decoder.String(text[i : i+n])
+			if r, width := utf8.DecodeRuneInString(char); err == nil &&
+				r != utf8.RuneError && width == len(char) {
+				out.WriteString(char)
+				size = n
+			}
+		}
+		if size == 0 {
+			fmt.Fprintf(&out, "\\x%02x", text[i])
+			size = 1
+		}
+		i += size
+	}
+	return out.String()
+}
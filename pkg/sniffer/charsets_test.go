@@ -0,0 +1,68 @@
+package sniffer
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name     string
+		charset  byte
+		text     string
+		expected string
+	}{
+		{"latin1", 8, "select 'caf\xe9 \x80'", "select 'café €'"},
+		{"sjis", 13, "select '\x93\xfa\x96\x7b \xb1'", "select '日本 ｱ'"},
+		{"sjis cut off", 13, "select '\x93\xfa\x96'", "select '日\\x96'"},
+		{"gbk", 28, "select '\xd6\xd0\xce\xc4'", "select '中文'"},
+		{"gbk bad bytes", 28, "select '\xff\xd6'", "select '\\xff\\xd6'"},
+		{"utf8mb4", 45, "select 'café'", "select 'café'"},
+		{"not known", 0, "select 'caf\xe9'", "select 'caf\xe9'"},
+	}
+	for _, test := range tests {
+		if text := decodeText(test.charset, test.text); text != test.expected {
+			t.Errorf("For %s\n    Got %q\n    Expected %q", test.name, text, test.expected)
+		}
+	}
+}
+
+func TestVerboseCharset(t *testing.T) {
+	defer func() { clock, verbose, noclean = time.Now, false, false }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	verbose, noclean = true, true
+	parseFormat("#q")
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	// A client logging in with latin1_swedish_ci.
+	login := makeHandshakeResponse("legacy")
+	login[12] = 8
+	if charset := handshakeCharset(login); charset != 8 {
+		t.Errorf("For a latin1 login\n    Got charset %d\n    Expected 8", charset)
+	}
+	client := [4]byte{10, 0, 0, 7}
+	handlePacket(tcpPacket(client, 50000, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK,
+		mysqlPacket(0, append([]byte{10}, "5.7.30\x00"...)...)))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, login))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, mysqlPacket(2, 0, 0, 0, 2, 0, 0, 0)))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK,
+		mysqlPacket(0, append([]byte{COM_QUERY}, "select 'Andr\xe9'"...)...)))
+	now = now.Add(time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)))
+
+	if !strings.Contains(out.String(), "select 'André'") {
+		t.Errorf("For a latin1 query\n    Got %q\n    Expected it printed as UTF-8", out.String())
+	}
+	if _, ok := qbuf["select 'Andr\xe9'"]; !ok {
+		t.Errorf("For the aggregation\n    Got %v\n    Expected the key as sent", qbuf)
+	}
+}
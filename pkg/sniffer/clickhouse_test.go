@@ -0,0 +1,105 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClickhouseExport(t *testing.T) {
+	defer func(flush time.Duration) { clickhouseFlush = flush }(clickhouseFlush)
+	clickhouseFlush = 20 * time.Millisecond
+
+	var mu sync.Mutex
+	var statements []string
+	inserted := make(map[string][]string)
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		statement := r.URL.Query().Get("query")
+		if user, pass, _ := r.BasicAuth(); user != "sniffer" || pass != "secret" {
+			http.Error(w, "bad credentials", http.StatusForbidden)
+			return
+		}
+		if strings.HasPrefix(statement, "INSERT") && failures > 0 {
+			failures--
+			http.Error(w, "too many parts", http.StatusInternalServerError)
+			return
+		}
+		statements = append(statements, statement)
+		body, _ := io.ReadAll(r.Body)
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if line != "" {
+				inserted[statement] = append(inserted[statement], line)
+			}
+		}
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "http://", "http://sniffer:secret@", 1) + "/?database=mysql"
+	if err := startClickhouse(dsn, "events", true); err != nil {
+		t.Fatalf("Failed to start: %s", err.Error())
+	}
+	defer stopClickhouse()
+	for i := 0; i < 3; i++ {
+		forwardClickhouse(&queryEvent{time: time.Unix(1434510000, 0), server: "10.0.0.1:3306",
+			client: "10.0.0.2:50000", user: "app", db: "shop", hash: fingerprintHash("delete ?"),
+			text: "delete ?", latency: 2500000, bytes: 30, rows: 4})
+	}
+
+	// The first insert fails, so this also covers the retry.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := len(inserted["INSERT INTO events FORMAT JSONEachRow"]) == 3
+		mu.Unlock()
+		if done {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Rows never arrived, got %v", statements)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(statements) < 2 || !strings.HasPrefix(statements[0], "CREATE TABLE IF NOT EXISTS events (") ||
+		!strings.HasPrefix(statements[1], "CREATE TABLE IF NOT EXISTS events_queries (") {
+		t.Errorf("For create\n    Got %v\n    Expected both tables created", statements)
+	}
+
+	var row clickhouseRow
+	json.Unmarshal([]byte(inserted["INSERT INTO events FORMAT JSONEachRow"][0]), &row)
+	expected := clickhouseRow{Time: "2015-06-17 03:00:00.000000", Server: "10.0.0.1:3306",
+		Client: "10.0.0.2:50000", User: "app", DB: "shop", Hash: fingerprintHash("delete ?"),
+		LatencyUs: 2500, Bytes: 30, Rows: 4}
+	if row != expected {
+		t.Errorf("For row\n    Got %+v\n    Expected %+v", row, expected)
+	}
+	if queries := inserted["INSERT INTO events_queries FORMAT JSONEachRow"]; len(queries) != 1 ||
+		!strings.Contains(queries[0], `"text":"delete ?"`) {
+		t.Errorf("For dictionary\n    Got %v\n    Expected delete ? once", queries)
+	}
+}
+
+func TestParseAffectedRows(t *testing.T) {
+	for _, test := range []struct {
+		data     []byte
+		expected uint64
+	}{
+		{[]byte{7, 0, 0, 1, 0x00, 3, 0, 2, 0, 0, 0}, 3},
+		{[]byte{9, 0, 0, 1, 0x00, 0xfc, 0x10, 0x27, 0, 2, 0, 0, 0}, 10000},
+		{[]byte{1, 0, 0, 1, 2}, 0},
+		{[]byte{9, 0, 0, 1, 0xff, 0x15, 0x04, '#'}, 0},
+	} {
+		if got := parseAffectedRows(test.data); got != test.expected {
+			t.Errorf("For %v\n    Got %d\n    Expected %d", test.data, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * clients.go
+ *
+ * Who's on the other end of a stream. Streams are tracked by ip:port, but the
+ * port is just whatever the client's kernel picked for the connection, so for
+ * anything we report per client we go by the IP instead. Otherwise one busy
+ * application server shows up as hundreds of clients.
+ *
+ * Each client keeps a sample of its latencies like each query does, so we can
+ * tell a slow server from one slow caller.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+	"sort"
+)
+
+// Keep the port in client identities, for when clients share an IP and are
+// told apart by port range (e.g. containers behind SNAT).
+var clientPorts bool = false
+var reportClients bool = false
+
+type clientData struct {
+	id       string
+	streams  uint64
+	count    uint64
+	errors   uint64
+	reqTimes [TIME_BUCKETS]uint64
+	think    *thinkData
+}
+
+var clients map[string]*clientData = make(map[string]*clientData)
+
+// clientOf returns the client a stream belongs to.
+func clientOf(rs *source) *clientData {
+	if rs.client != nil {
+		return rs.client
+	}
+
+	id := rs.srcip
+	if clientPorts || id == "" {
+		id = rs.src
+	}
+	client, ok := clients[id]
+	if !ok {
+		client = &clientData{id: id}
+		clients[id] = client
+	}
+	client.streams++
+	rs.client = client
+	return client
+}
+
+// recordClient adds a response to the stream's client.
+func recordClient(rs *source, randn int, reqtime uint64, errcode int) {
+	client := clientOf(rs)
+	client.count++
+	client.reqTimes[randn] = reqtime
+	if errcode != 0 {
+		client.errors++
+	}
+}
+
+// printClients shows the latencies of the busiest clients.
+func printClients(w io.Writer, displaycount int, elapsed float64) {
+	var tmp sortableSlice = make(sortableSlice, 0, len(clients))
+	for id, client := range clients {
+		if client.count > 0 {
+			tmp = append(tmp, sortable{float64(client.count), id})
+		}
+	}
+	if len(tmp) == 0 {
+		return
+	}
+	sort.Sort(sort.Reverse(tmp))
+
+	reportf(w, " ")
+	reportf(w, "%s queries       %sqps  %s   p50    p95    p99  %serr%%  %sclient%s", COLOR_YELLOW,
+		COLOR_CYAN, COLOR_YELLOW, COLOR_RED, COLOR_WHITE, COLOR_DEFAULT)
+	for i := 0; i < len(tmp) && i < displaycount; i++ {
+		client := clients[tmp[i].line]
+		pcts := percentiles(client.reqTimes[:], 50, 95, 99)
+		reportf(w, "%s%8d %s%8.2f/s  %s%6.2f %6.2f %6.2f  %s%5.2f  %s%s%s", COLOR_YELLOW,
+			client.count, COLOR_CYAN, float64(client.count)/elapsed, COLOR_YELLOW, pcts[0],
+			pcts[1], pcts[2], COLOR_RED, float64(client.errors)/float64(client.count)*100,
+			COLOR_WHITE, redactClient(client.id), COLOR_DEFAULT)
+	}
+}
@@ -0,0 +1,50 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func TestClientIdentity(t *testing.T) {
+	defer func() { clientPorts = false }()
+	for _, ports := range []bool{false, true} {
+		clientPorts, clients = ports, make(map[string]*clientData)
+		format = nil
+		parseFormat("#s:#q")
+		for _, src := range []string{"10.0.0.1:40001", "10.0.0.1:40002", "10.0.0.2:40001"} {
+			rs := &source{src: src, srcip: src[:8]}
+			got := formatQuery(rs, []byte("select 1"))
+			expected := rs.srcip + ":select ?"
+			if ports {
+				expected = src + ":select ?"
+			}
+			if got != expected {
+				t.Errorf("For %s (ports=%t)\n    Got %s\n    Expected %s", src, ports, got,
+					expected)
+			}
+		}
+		if expected := map[bool]int{false: 2, true: 3}[ports]; len(clients) != expected {
+			t.Errorf("For clients (ports=%t)\n    Got %d\n    Expected %d", ports, len(clients),
+				expected)
+		}
+	}
+}
+
+func TestClientLatencies(t *testing.T) {
+	clients = make(map[string]*clientData)
+	rs := &source{src: "10.0.0.1:40001", srcip: "10.0.0.1"}
+	for i := 0; i < 100; i++ {
+		errcode := 0
+		if i%10 == 0 {
+			errcode = 1205
+		}
+		recordClient(rs, i, uint64(i+1)*1000000, errcode)
+	}
+
+	client := clients["10.0.0.1"]
+	pcts := percentiles(client.reqTimes[:], 50, 99)
+	if client.count != 100 || client.errors != 10 || pcts[0] != 51 || pcts[1] != 100 {
+		t.Errorf("For client 10.0.0.1\n    Got %d queries, %d errors, p50 %0.2f, p99 %0.2f\n"+
+			"    Expected 100 queries, 10 errors, p50 51.00, p99 100.00", client.count,
+			client.errors, pcts[0], pcts[1])
+	}
+}
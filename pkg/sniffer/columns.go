@@ -0,0 +1,68 @@
+/*
+ * columns.go
+ *
+ * The columns of the result sets a query returns, from the column count that
+ * starts each one. A SELECT * dragging back 80 columns where the application
+ * uses three looks like any other select in the table, but next to its bytes
+ * per query the column count gives it away.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+)
+
+var trackColumns bool = false
+
+// columnStats keeps the column counts of a query's result sets, the widest of
+// each execution's.
+type columnStats struct {
+	count uint64
+	total uint64
+	min   uint64
+	max   uint64
+}
+
+func (self *columnStats) record(columns uint64) {
+	if self.count == 0 || columns < self.min {
+		self.min = columns
+	}
+	if columns > self.max {
+		self.max = columns
+	}
+	self.count++
+	self.total += columns
+}
+
+// avg returns the average column count, or 0 if we haven't seen any.
+func (self *columnStats) avg() float64 {
+	if self.count == 0 {
+		return 0
+	}
+	return float64(self.total) / float64(self.count)
+}
+
+// fold adds the column counts of another query.
+func (self *columnStats) fold(other columnStats) {
+	if other.count == 0 {
+		return
+	}
+	if self.count == 0 || other.min < self.min {
+		self.min = other.min
+	}
+	if other.max > self.max {
+		self.max = other.max
+	}
+	self.count += other.count
+	self.total += other.total
+}
+
+// formatColumns formats a query's column counts for the table.
+func formatColumns(cs *columnStats) string {
+	if cs.count == 0 {
+		return fmt.Sprintf("%s%8s %5s %5s  ", COLOR_CYAN, "-", "-", "-")
+	}
+	return fmt.Sprintf("%s%8d %5.1f %5d  ", COLOR_CYAN, cs.min, cs.avg(), cs.max)
+}
@@ -0,0 +1,49 @@
+package sniffer
+
+import (
+	"strings"
+	"testing"
+)
+
+// resultSet builds the response of a query returning a row of a result set of
+// the given columns.
+func resultSet(columns int) []byte {
+	payloads := [][]byte{{byte(columns)}}
+	for i := 0; i < columns; i++ {
+		payloads = append(payloads, []byte("def"))
+	}
+	eof := []byte{0xfe, 0, 0, 2, 0}
+	return mysqlPackets(append(payloads, eof, []byte{1, 'x'}, eof)...)
+}
+
+func TestColumns(t *testing.T) {
+	defer func() { trackColumns = false }()
+	qbuf, format, trackColumns = make(map[string]*queryData), nil, true
+	parseFormat("#q")
+	rs := &source{synced: true}
+	for _, columns := range []int{3, 80, 1} {
+		processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select * from t"...)...))
+		processPacket(rs, false, resultSet(columns))
+	}
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select * from t"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+
+	qdata := qbuf["select * from t"]
+	if qdata == nil || qdata.columns.count != 3 || qdata.columns.min != 1 ||
+		qdata.columns.max != 80 || qdata.columns.avg() != 28 {
+		t.Errorf("For three result sets\n    Got %+v\n    Expected 1, 28 avg, 80", qdata)
+		return
+	}
+	row := formatRow(copyRow("select * from t", qdata), 1)
+	if !strings.Contains(row, "1  28.0    80") {
+		t.Errorf("For the table\n    Got %q\n    Expected the column counts", row)
+	}
+
+	// Folded into another query.
+	other := &queryData{}
+	other.columns.record(100)
+	foldQuery(other, qdata)
+	if other.columns.count != 4 || other.columns.min != 1 || other.columns.max != 100 {
+		t.Errorf("For a fold\n    Got %+v\n    Expected 4, from 1 to 100", other.columns)
+	}
+}
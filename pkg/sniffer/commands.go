@@ -0,0 +1,476 @@
+/*
+ * commands.go
+ *
+ * Matching responses to the commands they answer. Connection pools and ORMs
+ * reuse a connection for prepared statements and plain queries alike, and
+ * some clients send a command before the response to the last one is over. So
+ * each stream keeps a queue of the commands it's waiting on, and we follow the
+ * responses packet by packet to know where each one ends and the next begins.
+ *
+ * Only a response nothing asked for, a response packet out of sequence, or more
+ * commands outstanding than any client would pipeline, is a desync. A response
+ * starting over at sequence number 1 before the last one ended means we missed
+ * the end of the last one, so we take that one as over and carry on.
+ *
+ * Commands whose responses we can't follow (COM_CHANGE_USER and the like) fall
+ * back to treating everything until the next command as theirs.
+ *
+ * A pipelined command is timed from the end of the response before it, since
+ * that's when the server gets to it.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// More commands outstanding on one stream than this means we've lost
+	// track of the responses.
+	COMMAND_QUEUE = 64
+
+	// How much of each response packet we keep to look at.
+	RESPONSE_PREFIX = 32
+
+	// Status flags in OK and EOF packets.
+	SERVER_MORE_RESULTS_EXISTS  = 0x0008
+	SERVER_STATUS_CURSOR_EXISTS = 0x0040
+)
+
+// Whether a response has had more than one result set, which the report then
+// has a column for.
+var multiResults bool = false
+
+// Where we are in following a response.
+const (
+	RES_NONE        = iota // not following, everything is part of the last response
+	RES_FIRST              // waiting for the first packet
+	RES_COLUMNS            // column definitions of a result set
+	RES_COLUMNS_EOF        // after the definitions, where there may be an EOF
+	RES_ROWS               // rows, until an EOF, OK or ERR
+	RES_PREPARE            // parameter and column definitions of a prepare
+	RES_PREPARE_EOF        // after a set of those, where there may be an EOF
+	RES_INFILE             // the client sending a file for LOCAL INFILE, see infile.go
+	RES_DONE               // the response is over
+)
+
+// command is a command a stream is waiting on the response to.
+type command struct {
+	ptype  int
+	sent   time.Time // zero if it isn't measured
+	text   string
+	fprint string
+	canon  string // the statement, without what the format adds, see queryStatement
+	raw    string
+	bytes  uint64
+	target uint64
+	list   int
+	lock   *lockData
+	stmt   string // for prepares, the statement being prepared
+	bound  string // with -v, an execute with its values
+	empty  bool   // only whitespace and comments, see EMPTY_STATEMENT
+
+	// Of a multi-statement, the statements before the last, see multi.go.
+	batch []batchQuery
+
+	// The statement an execute opens a cursor on, and the query a fetch from
+	// one counts toward, see cursors.go.
+	cursor *statement
+	fetch  *queryData
+}
+
+// response follows the packets of a response across segments.
+type response struct {
+	ptype   int
+	phase   int
+	defs    uint64 // definitions left in this phase
+	columns uint64 // for prepares, the column definitions after the parameters
+	large   bool   // the last packet was full size, so the next continues it
+
+	header []byte // a header split across segments
+	seq    byte   // the sequence number the next packet should have
+	body   bool   // whether we're in a packet's payload
+	left   int    // bytes of the payload still to come
+	plen   int
+	prefix []byte
+
+	// A header split across segments that turned out to be the start of the
+	// next response.
+	carry []byte
+
+	// The result sets and the rows in them, so far, and the columns of the
+	// widest set.
+	results  uint64
+	returned uint64
+	width    uint64
+
+	// The schema the server said the session switched to, if it did, see
+	// session.go.
+	schema   string
+	switched bool
+
+	// Whether a packet came out of sequence, and with -verify, how a packet
+	// took the response where it can't go.
+	gap     bool
+	illegal string
+}
+
+// responds says which commands we know the responses of, and so whether we
+// follow them.
+func responds(ptype int) bool {
+	switch ptype {
+	case COM_QUERY, COM_STMT_EXECUTE, COM_STMT_PREPARE, COM_STMT_FETCH, COM_FIELD_LIST,
+		COM_INIT_DB, COM_PING, COM_REFRESH, COM_STATISTICS, COM_PROCESS_INFO, COM_PROCESS_KILL,
+		COM_DEBUG, COM_SET_OPTION, COM_STMT_RESET, COM_RESET_CONNECTION:
+		return true
+	}
+	return false
+}
+
+// outstanding says whether the stream's current response isn't over yet, so a
+// command sent now is pipelined behind it.
+func outstanding(rs *source) bool {
+	switch rs.resp.phase {
+	case RES_NONE, RES_DONE:
+		return false
+	case RES_COLUMNS_EOF:
+		// Without EOFs, nothing more comes after the definitions of a cursor.
+		return rs.resp.ptype != COM_STMT_EXECUTE
+	case RES_PREPARE_EOF:
+		// Likewise after the last definitions of a prepare.
+		return rs.resp.columns > 0
+	}
+	return true
+}
+
+// sendCommand makes a command the stream's current one, or queues it if the
+// response to the current one isn't over.
+func sendCommand(rs *source, cmd *command) {
+	thinkSent(rs)
+	if !cmd.sent.IsZero() {
+		rs.cmds.sent++
+	}
+	if !outstanding(rs) {
+		startCommand(rs, cmd)
+		return
+	}
+	if len(rs.queue) >= COMMAND_QUEUE {
+		if !cmd.sent.IsZero() {
+			rs.cmds.dropped++
+		}
+		desync(rs, DESYNC_OVERFLOW, "too many commands outstanding")
+		return
+	}
+	trace(rs, "pipelined behind %d commands", len(rs.queue)+1)
+	stats.pipelined++
+	rs.queue = append(rs.queue, cmd)
+}
+
+// startCommand makes a command the one the stream's responses are for.
+func startCommand(rs *source, cmd *command) {
+	// The response to a command we don't follow ends here.
+	if rs.respBytes > 0 {
+		responseDone(rs)
+	}
+	if rs.reqSent != nil {
+		// Never answered, as far as we could tell.
+		rs.cmds.dropped++
+	}
+	rs.qtext, rs.qfprint, rs.qcanon = cmd.text, cmd.fprint, cmd.canon
+	rs.qraw, rs.qdata = cmd.raw, nil
+	rs.respTo = RESP_NONE
+	rs.qbytes, rs.qtarget, rs.qlist, rs.lock = cmd.bytes, cmd.target, cmd.list, cmd.lock
+	rs.qstmt, rs.qempty, rs.qbound, rs.qbatch = cmd.stmt, cmd.empty, cmd.bound, cmd.batch
+	rs.qcursor, rs.qfetch = cmd.cursor, cmd.fetch
+	if cmd.fetch != nil {
+		// Timed for the query that opened the cursor, not as one of its own.
+		rs.fetchSent, cmd.sent = cmd.sent, time.Time{}
+	}
+	rs.reqSent = nil
+	if cmd.sent.IsZero() {
+		concEnd(rs)
+	} else {
+		sent := cmd.sent
+		rs.reqSent = &sent
+		concStart(rs, cmd.text)
+		if rs.side == SIDE_FRONTEND && cmd.text != "" {
+			proxySent(rs)
+		}
+	}
+
+	rs.resp = response{ptype: cmd.ptype, phase: RES_NONE, seq: 1}
+	if responds(cmd.ptype) {
+		rs.resp.phase = RES_FIRST
+	}
+}
+
+// handleResponse splits a response segment between the commands it answers.
+func handleResponse(rs *source, data []byte) {
+	for len(data) > 0 {
+		if rs.resp.phase == RES_DONE {
+			desync(rs, DESYNC_SEQUENCE, "response with no command outstanding")
+			return
+		}
+		if rs.resp.phase == RES_INFILE {
+			infileAnswered(rs, data)
+		}
+		used, done := rs.resp.walk(data)
+		if used > 0 {
+			respond(rs, data[:used])
+		}
+		data = data[used:]
+		if rs.resp.gap {
+			desync(rs, DESYNC_SEQUENCE, "sequence gap")
+			return
+		}
+		if done {
+			responseDone(rs)
+			txnStatus(rs, rs.resp.prefix)
+			if rs.resp.switched && rs.resp.schema != rs.db {
+				trace(rs, "session schema now %q", rs.resp.schema)
+				rs.db = rs.resp.schema
+			}
+			if rs.resp.results > 0 && rs.qdata != nil {
+				rs.qdata.results++
+				rs.qdata.sets += rs.resp.results
+				rs.qdata.returned += rs.resp.returned
+				if trackColumns {
+					rs.qdata.columns.record(rs.resp.width)
+				}
+				multiResults = multiResults || rs.resp.results > 1
+			}
+			if rs.qfetch != nil {
+				rs.qfetch.returned += rs.resp.returned
+			}
+		}
+
+		// The next command starts as soon as this response is over.
+		if done && len(rs.queue) > 0 {
+			cmd, carry := rs.queue[0], rs.resp.carry
+			rs.queue = rs.queue[1:]
+			cmd.sent = clock()
+			startCommand(rs, cmd)
+			rs.resp.header = carry
+		} else if done {
+			thinkIdle(rs)
+		}
+	}
+}
+
+// walk follows the packets in a segment of the response, returning how many of
+// its bytes belong to it and whether it's over.
+func (self *response) walk(data []byte) (int, bool) {
+	if self.phase == RES_NONE {
+		return len(data), false
+	}
+	pos := 0
+	for pos < len(data) {
+		if !self.body {
+			start := pos - len(self.header)
+			need := 4 - len(self.header)
+			if len(data)-pos < need {
+				self.header = append(self.header, data[pos:]...)
+				return len(data), false
+			}
+			header := append(self.header, data[pos:pos+need]...)
+			self.header = nil
+			pos += need
+
+			// Either there's no EOF after a prepare, or we've missed the end of
+			// the response; both ways this packet is the start of the next one.
+			plen := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+			if (self.phase == RES_PREPARE_EOF && self.columns == 0 && plen != 5) ||
+				(header[3] == 1 && self.seq != 1) {
+				self.phase = RES_DONE
+				if start < 0 {
+					self.carry = header[:-start]
+					return 0, true
+				}
+				return start, true
+			}
+			if header[3] != self.seq {
+				// We've missed packets of the response.
+				self.gap = true
+				if start < 0 {
+					return 0, false
+				}
+				return start, false
+			}
+			self.seq = header[3] + 1
+			self.body, self.left, self.plen, self.prefix = true, plen, plen, nil
+		}
+
+		n := self.left
+		if n > len(data)-pos {
+			n = len(data) - pos
+		}
+		limit := RESPONSE_PREFIX
+		if len(self.prefix) > 0 {
+			limit = self.prefixSize(self.prefix[0])
+		} else if n > 0 {
+			limit = self.prefixSize(data[pos])
+		}
+		if keep := limit - len(self.prefix); keep > 0 {
+			if keep > n {
+				keep = n
+			}
+			self.prefix = append(self.prefix, data[pos:pos+keep]...)
+		}
+		pos += n
+		self.left -= n
+		if self.left == 0 {
+			self.body = false
+			from := self.phase
+			last := self.packet()
+			if verifying && !phaseAllowed(from, self.phase) && self.illegal == "" {
+				self.illegal = fmt.Sprintf("a packet took the response from %s to %s",
+					phaseNames[from], phaseNames[self.phase])
+			}
+			if last {
+				self.phase = RES_DONE
+				return pos, true
+			}
+		}
+	}
+	return pos, false
+}
+
+// packet looks at a packet of the response once we have all of it, returning
+// true if it's the last.
+func (self *response) packet() bool {
+	continued := self.large
+	self.large = self.plen == 0xffffff
+	if continued {
+		return false
+	}
+	return self.interpret()
+}
+
+// interpret works out what a packet means for the response.
+func (self *response) interpret() bool {
+	p, plen := self.prefix, self.plen
+	eof := plen == 5 && p[0] == 0xfe
+
+	switch self.phase {
+	case RES_FIRST:
+		if self.ptype != COM_STMT_PREPARE {
+			if name, ok := sessionSchema(p); ok {
+				self.schema, self.switched = name, true
+			}
+		}
+		switch {
+		case len(p) == 0:
+			self.phase = RES_NONE
+		case p[0] == 0xff:
+			return true
+		case p[0] == 0x00 && self.ptype == COM_STMT_PREPARE:
+			if len(p) < 9 {
+				return true
+			}
+			self.columns = uint64(p[5]) | uint64(p[6])<<8
+			self.defs = uint64(p[7]) | uint64(p[8])<<8
+			if self.defs == 0 {
+				self.defs, self.columns = self.columns, 0
+			}
+			if self.defs == 0 {
+				return true
+			}
+			self.phase = RES_PREPARE
+		case p[0] == 0x00 && (self.ptype == COM_QUERY || self.ptype == COM_STMT_EXECUTE):
+			return !moreResults(p)
+		case self.ptype == COM_STMT_FETCH || self.ptype == COM_FIELD_LIST:
+			self.phase = RES_ROWS
+			return self.interpret()
+		case self.ptype != COM_QUERY && self.ptype != COM_STMT_EXECUTE &&
+			self.ptype != COM_PROCESS_INFO:
+			// Everything else answers with one packet. (COM_PROCESS_INFO is
+			// answered like SHOW PROCESSLIST.)
+			return true
+		case p[0] == 0xfb:
+			// LOCAL INFILE, which has the client send the file first.
+			self.phase = RES_INFILE
+		default:
+			// A result set, starting with the number of columns.
+			self.defs = lenencInt(p)
+			self.phase = RES_COLUMNS
+			self.results++
+			if self.defs > self.width {
+				self.width = self.defs
+			}
+			if self.defs == 0 {
+				self.phase = RES_NONE
+			}
+		}
+	case RES_COLUMNS:
+		self.defs--
+		if self.defs == 0 {
+			self.phase = RES_COLUMNS_EOF
+		}
+	case RES_COLUMNS_EOF:
+		self.phase = RES_ROWS
+		if eof {
+			// With a cursor open, the rows come from COM_STMT_FETCH.
+			status, _ := parseStatus(p)
+			return status&SERVER_STATUS_CURSOR_EXISTS != 0
+		}
+		return self.interpret()
+	case RES_ROWS:
+		switch {
+		case len(p) > 0 && p[0] == 0xff:
+			return true
+		case len(p) > 0 && p[0] == 0xfe && plen < 0xffffff:
+			if moreResults(p) {
+				self.phase = RES_FIRST
+				return false
+			}
+			return true
+		default:
+			// A row, text or binary, however many packets it took.
+			self.returned++
+		}
+	case RES_PREPARE:
+		self.defs--
+		if self.defs == 0 {
+			self.phase = RES_PREPARE_EOF
+		}
+	case RES_PREPARE_EOF:
+		if self.columns == 0 {
+			return true
+		}
+		self.defs, self.columns, self.phase = self.columns, 0, RES_PREPARE
+		if !eof {
+			return self.interpret()
+		}
+	}
+	return false
+}
+
+// moreResults says whether an OK or EOF packet says more result sets follow.
+func moreResults(payload []byte) bool {
+	status, ok := parseStatus(payload)
+	return ok && status&SERVER_MORE_RESULTS_EXISTS != 0
+}
+
+// recordPrepare remembers the statement a prepare's response gives an id to,
+// and how many parameters it has, from the first packet of the response.
+func recordPrepare(rs *source, data []byte) {
+	if len(data) < 9 || data[4] != 0x00 {
+		return
+	}
+	if rs.stmts == nil {
+		rs.stmts = make(map[uint32]*statement)
+	}
+	stmt := &statement{text: rs.qstmt}
+	if len(data) >= 13 {
+		stmt.params = int(data[11]) | int(data[12])<<8
+	}
+	rs.stmts[stmtID(data[5:])] = stmt
+}
+
+// stmtID returns the statement id at the start of data.
+func stmtID(data []byte) uint32 {
+	return uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+}
@@ -0,0 +1,225 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+// mysqlPacket frames a payload with its header.
+func mysqlPacket(seq byte, payload ...byte) []byte {
+	return append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16),
+		seq}, payload...)
+}
+
+func TestResponseWalk(t *testing.T) {
+	coldef := []byte{3, 'd', 'e', 'f', 0, 0, 0, 1, 'a', 0, 0x0c, 0x3f, 0, 1, 0, 0, 0, 8, 0x81, 0,
+		0, 0, 0}
+	join := func(packets ...[]byte) []byte {
+		var data []byte
+		for _, packet := range packets {
+			data = append(data, packet...)
+		}
+		return data
+	}
+	eof := func(seq byte, status byte) []byte { return mysqlPacket(seq, 0xfe, 0, 0, status, 0) }
+	ok := func(seq byte, status byte) []byte { return mysqlPacket(seq, 0, 0, 0, status, 0, 0, 0) }
+	next := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+
+	tests := []struct {
+		name     string
+		ptype    int
+		response []byte
+	}{
+		{"ok", COM_QUERY, ok(1, 2)},
+		{"result set", COM_QUERY, join(mysqlPacket(1, 1), mysqlPacket(2, coldef...), eof(3, 2),
+			mysqlPacket(4, 1, '1'), eof(5, 2))},
+		{"result set without EOFs", COM_QUERY, join(mysqlPacket(1, 1),
+			mysqlPacket(2, coldef...), mysqlPacket(3, 1, '1'), mysqlPacket(4, 0xfe, 0, 0, 2, 0, 0, 0))},
+		{"multiple results", COM_QUERY, join(ok(1, 2|SERVER_MORE_RESULTS_EXISTS),
+			mysqlPacket(2, 1), mysqlPacket(3, coldef...), eof(4, 2|SERVER_MORE_RESULTS_EXISTS),
+			eof(5, 2|SERVER_MORE_RESULTS_EXISTS), ok(6, 2))},
+		{"error in the rows", COM_QUERY, join(mysqlPacket(1, 1), mysqlPacket(2, coldef...),
+			eof(3, 2), mysqlPacket(4, 0xff, 0x24, 0x04))},
+		{"cursor", COM_STMT_EXECUTE, join(mysqlPacket(1, 1), mysqlPacket(2, coldef...),
+			eof(3, 2|SERVER_STATUS_CURSOR_EXISTS))},
+		{"fetch", COM_STMT_FETCH, join(mysqlPacket(1, 0, 0, 1, 0, 0, 0), eof(2, 2))},
+		{"prepare", COM_STMT_PREPARE, join(mysqlPacket(1, 0, 1, 0, 0, 0, 1, 0, 2, 0, 0, 0, 0),
+			mysqlPacket(2, coldef...), mysqlPacket(3, coldef...), eof(4, 2),
+			mysqlPacket(5, coldef...), eof(6, 2))},
+		{"prepare without EOFs", COM_STMT_PREPARE, join(mysqlPacket(1, 0, 1, 0, 0, 0, 1, 0, 1, 0,
+			0, 0, 0), mysqlPacket(2, coldef...), mysqlPacket(3, coldef...))},
+		{"ping", COM_PING, ok(1, 2)},
+	}
+
+	for _, test := range tests {
+		// Whole, then a byte at a time, each time followed by the next response.
+		for _, step := range []int{len(test.response) + len(next), 1} {
+			resp := &response{ptype: test.ptype, phase: RES_FIRST, seq: 1}
+			data, total, done := append(append([]byte(nil), test.response...), next...), 0, false
+			for len(data) > 0 && !done {
+				n := step
+				if n > len(data) {
+					n = len(data)
+				}
+				var used int
+				used, done = resp.walk(data[:n])
+				total += used
+				data = data[n:]
+			}
+			total -= len(resp.carry)
+			if !done || total != len(test.response) {
+				t.Errorf("For %s in steps of %d\n    Got done %t after %d bytes\n"+
+					"    Expected done after %d bytes", test.name, step, done, total,
+					len(test.response))
+			}
+		}
+	}
+}
+
+func TestPreparedStatements(t *testing.T) {
+	qbuf, format, querycount = make(map[string]*queryData), nil, 0
+	parseFormat("#q")
+	rs := &source{synced: true}
+	execute := mysqlPacket(0, COM_STMT_EXECUTE, 7, 0, 0, 0, 0, 1, 0, 0, 0)
+
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_STMT_PREPARE},
+		"select * from orders where id = 5 and state = ?"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0))
+	processPacket(rs, true, execute)
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+
+	// Once closed, the statement is unknown.
+	processPacket(rs, true, mysqlPacket(0, COM_STMT_CLOSE, 7, 0, 0, 0))
+	processPacket(rs, true, execute)
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+
+	if qdata := qbuf["select * from orders where id = ? and state = ?"]; querycount != 2 ||
+		qdata == nil || qdata.count != 1 {
+		t.Errorf("For a prepared statement executed\n    Got %d queries, %+v\n"+
+			"    Expected the execution under the statement's text", querycount, qbuf)
+	}
+	if qdata := qbuf[UNKNOWN_STATEMENT]; qdata == nil || qdata.count != 1 || !rs.synced {
+		t.Errorf("For an unknown statement executed\n    Got %+v, synced %v\n"+
+			"    Expected it counted and the stream in sync", qdata, rs.synced)
+	}
+}
+
+func TestLongData(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+	qbuf, format, querycount, stats.desyncs = make(map[string]*queryData), nil, 0, 0
+	parseFormat("#q")
+	rs := &source{synced: true}
+
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_STMT_PREPARE},
+		"insert into blobs values (?)"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0))
+	now = now.Add(time.Second)
+	long := append([]byte{COM_STMT_SEND_LONG_DATA, 7, 0, 0, 0, 0, 0}, make([]byte, 1000)...)
+	processPacket(rs, true, mysqlPacket(0, long...))
+	now = now.Add(time.Second)
+	processPacket(rs, true, mysqlPacket(0, COM_STMT_EXECUTE, 7, 0, 0, 0, 0, 1, 0, 0, 0))
+	now = now.Add(5 * time.Millisecond)
+	processPacket(rs, false, mysqlPacket(1, 0, 1, 0, 2, 0, 0, 0))
+	processPacket(rs, true, mysqlPacket(0, COM_STMT_CLOSE, 7, 0, 0, 0))
+
+	qdata := qbuf["insert into blobs values (?)"]
+	if qdata == nil || querycount != 1 || qdata.timeTotal != uint64(5*time.Millisecond) ||
+		qdata.bytes < uint64(len(long)) {
+		t.Fatalf("For an execute after long data\n    Got %d queries, %+v\n    Expected one of "+
+			"5ms with the long data's bytes", querycount, qdata)
+	}
+	if !rs.synced || stats.desyncs != 0 || rs.longData != 0 {
+		t.Errorf("For long data and a close\n    Got synced %v, %d desyncs, %d bytes kept\n"+
+			"    Expected the stream in sync and nothing kept", rs.synced, stats.desyncs, rs.longData)
+	}
+}
+
+func TestEmptyStatements(t *testing.T) {
+	defer func() { clock, includeEmpty = time.Now, false }()
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+
+	for _, include := range []bool{false, true} {
+		qbuf, format, querycount, includeEmpty = make(map[string]*queryData), nil, 0, include
+		times = [TIME_BUCKETS]uint64{}
+		parseFormat("#q")
+		rs := &source{synced: true}
+		for _, query := range []string{"-- ping", "/* */", "\n\n\r\n", "select 1",
+			"/*!40101 SET NAMES utf8 */"} {
+			processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, query...)...))
+			now = now.Add(time.Millisecond)
+			processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+		}
+
+		qdata := qbuf[EMPTY_STATEMENT]
+		if querycount != 5 || qdata == nil || qdata.count != 3 || qbuf[""] != nil ||
+			qbuf["select ?"] == nil || len(qbuf) != 3 {
+			t.Fatalf("For empty statements\n    Got %d queries, %+v\n"+
+				"    Expected three under %s", querycount, qbuf, EMPTY_STATEMENT)
+		}
+		// Samples land in random buckets and two can share one, so only
+		// check that the empty ones were added to the real ones.
+		var sampled int
+		for _, val := range times {
+			if val > 0 {
+				sampled++
+			}
+		}
+		if expected := map[bool]uint64{false: 0, true: 3}[include]; qdata.timed != expected ||
+			(sampled > 2) != include {
+			t.Errorf("For empty statements with -include-empty %t\n    Got %d timed, %d "+
+				"samples overall\n    Expected %d timed", include, qdata.timed, sampled, expected)
+		}
+	}
+}
+
+func TestResponseBytes(t *testing.T) {
+	defer func() { clock, minLatency = time.Now, 0 }()
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+	coldef := []byte{3, 'd', 'e', 'f', 0, 0, 0, 1, 'a', 0, 0x0c, 0x3f, 0, 1, 0, 0, 0, 8, 0x81, 0,
+		0, 0, 0}
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select a from t"...)...)
+	var response []byte
+	response = append(response, mysqlPacket(1, 1)...)
+	response = append(response, mysqlPacket(2, coldef...)...)
+	response = append(response, mysqlPacket(3, 0xfe, 0, 0, 2, 0)...)
+	for seq := byte(4); seq < 24; seq++ {
+		response = append(response, mysqlPacket(seq, 5, 'a', 'b', 'c', 'd', 'e')...)
+	}
+	response = append(response, mysqlPacket(24, 0xfe, 0, 0, 2, 0)...)
+
+	for _, fast := range []bool{false, true} {
+		qbuf, format, querycount, minLatency = make(map[string]*queryData), nil, 0, 0
+		stats.fast.queries, stats.fast.bytes = 0, 0
+		if fast {
+			minLatency = time.Second
+		}
+		parseFormat("#q")
+		rs := &source{synced: true}
+
+		// Five segments, split wherever, headers and all.
+		processPacket(rs, true, query)
+		now = now.Add(time.Millisecond)
+		for i, cut := 0, len(response)/5; i < 5; i++ {
+			segment := response[i*cut:]
+			if i < 4 {
+				segment = segment[:cut]
+			}
+			processPacket(rs, false, segment)
+		}
+		// The query's text, and all of the response.
+		expected := uint64(len(query) - 5 + len(response))
+
+		got := stats.fast.bytes
+		if qdata := qbuf["select a from t"]; !fast && qdata != nil {
+			got = qdata.bytes
+		}
+		if got != expected || !rs.synced {
+			t.Errorf("For a response in five segments (fast %t)\n    Got %d bytes, synced %t\n"+
+				"    Expected %d bytes", fast, got, rs.synced, expected)
+		}
+	}
+}
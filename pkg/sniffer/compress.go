@@ -0,0 +1,129 @@
+/*
+ * compress.go
+ *
+ * The compressed protocol, which clients ask for with CLIENT_COMPRESS in the
+ * login. From the end of the login on, both ways, packets go in frames with a
+ * header of their own:
+ *
+ *     3 bytes   length of the frame's payload
+ *     1 byte    sequence of the frame
+ *     3 bytes   length of the payload uncompressed, 0 if it was sent as is
+ *
+ * the payload being zlib compressed unless it was too small to be worth it. We
+ * take the frames off and hand what was in them to the rest of the parser as if
+ * that's what came over the wire. Streams picked up mid-stream we recognize by
+ * their requests being frames end to end where they aren't packets end to end.
+ *
+ */
+
+package sniffer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+const (
+	FRAME_HEADER = 7
+)
+
+// frameHeader returns the payload length and uncompressed length of the frame
+// at the start of data.
+func frameHeader(data []byte) (int, int) {
+	return int(data[0]) | int(data[1])<<8 | int(data[2])<<16,
+		int(data[4]) | int(data[5])<<8 | int(data[6])<<16
+}
+
+// packetsEndToEnd tells us whether data is whole packets and nothing else.
+func packetsEndToEnd(data []byte) bool {
+	for len(data) >= 4 {
+		size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		if len(data) < size+4 {
+			return false
+		}
+		data = data[size+4:]
+	}
+	return len(data) == 0
+}
+
+// compressedFrames tells us whether a request picked up mid-stream looks like
+// compressed frames rather than packets: frames end to end, compressed ones
+// starting with a zlib header and the rest holding packets.
+func compressedFrames(data []byte) bool {
+	if len(data) < FRAME_HEADER || packetsEndToEnd(data) {
+		return false
+	}
+	for len(data) > 0 {
+		if len(data) < FRAME_HEADER {
+			return false
+		}
+		clen, ulen := frameHeader(data)
+		if clen == 0 || len(data) < FRAME_HEADER+clen {
+			return false
+		}
+		payload := data[FRAME_HEADER : FRAME_HEADER+clen]
+		if ulen == 0 && !packetsEndToEnd(payload) {
+			return false
+		}
+		if ulen > 0 && (clen < 2 || payload[0]&0x0f != 8 ||
+			(int(payload[0])<<8|int(payload[1]))%31 != 0) {
+			return false
+		}
+		data = data[FRAME_HEADER+clen:]
+	}
+	return true
+}
+
+// startCompression takes the frames off what the stream sends from here on.
+func startCompression(rs *source, why string) {
+	trace(rs, "compressed, %s", why)
+	rs.compressed, rs.compressLogin = true, false
+	stats.compressed++
+}
+
+// uncompress takes the frames off a segment of a compressed stream, returning
+// what was in them, or false if they don't uncompress. A frame cut off at the
+// end of the segment is kept for the next.
+func uncompress(rs *source, request bool, data []byte) ([]byte, bool) {
+	partial := &rs.zres
+	if request {
+		partial = &rs.zreq
+	}
+	if *partial != nil {
+		data = append(*partial, data...)
+		*partial = nil
+	}
+
+	var plain []byte
+	for len(data) > 0 {
+		if len(data) < FRAME_HEADER {
+			*partial = append([]byte(nil), data...)
+			break
+		}
+		clen, ulen := frameHeader(data)
+		if len(data) < FRAME_HEADER+clen {
+			*partial = append([]byte(nil), data...)
+			break
+		}
+		payload := data[FRAME_HEADER : FRAME_HEADER+clen]
+		data = data[FRAME_HEADER+clen:]
+		if ulen == 0 {
+			plain = append(plain, payload...)
+			continue
+		}
+
+		reader, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, false
+		}
+		start := len(plain)
+		plain = append(plain, make([]byte, ulen)...)
+		_, err = io.ReadFull(reader, plain[start:])
+		reader.Close()
+		if err != nil {
+			return nil, false
+		}
+	}
+	return plain, true
+}
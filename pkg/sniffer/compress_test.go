@@ -0,0 +1,65 @@
+package sniffer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+)
+
+// compressedFrame wraps data in a frame of the compressed protocol, compressing
+// it or not.
+func compressedFrame(seq byte, data []byte, compress bool) []byte {
+	payload, ulen := data, 0
+	if compress {
+		var buf bytes.Buffer
+		writer := zlib.NewWriter(&buf)
+		writer.Write(data)
+		writer.Close()
+		payload, ulen = buf.Bytes(), len(data)
+	}
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq,
+		byte(ulen), byte(ulen >> 8), byte(ulen >> 16)}
+	return append(header, payload...)
+}
+
+func TestCompressedFrames(t *testing.T) {
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select * from orders"...)...)
+	for _, test := range []struct {
+		name     string
+		data     []byte
+		expected bool
+	}{
+		{"a query", query, false},
+		{"a compressed query", compressedFrame(0, query, true), true},
+		{"a query in a frame as is", compressedFrame(0, query, false), true},
+		{"two frames", append(compressedFrame(0, query, false), compressedFrame(1, query, true)...),
+			true},
+		{"a frame cut short", compressedFrame(0, query, true)[:12], false},
+	} {
+		if got := compressedFrames(test.data); got != test.expected {
+			t.Errorf("For %s\n    Got %t\n    Expected %t", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestUncompress(t *testing.T) {
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select * from orders"...)...)
+	rs := &source{compressed: true}
+
+	// A frame over two segments comes out with the second.
+	frame := compressedFrame(0, query, true)
+	if plain, ok := uncompress(rs, true, frame[:10]); !ok || len(plain) != 0 {
+		t.Errorf("For the start of a frame\n    Got %q (ok=%t)\n    Expected nothing yet", plain, ok)
+	}
+	if plain, ok := uncompress(rs, true, frame[10:]); !ok || !bytes.Equal(plain, query) {
+		t.Errorf("For the rest of a frame\n    Got %q (ok=%t)\n    Expected %q", plain, ok, query)
+	}
+	if rs.zreq != nil {
+		t.Errorf("For a whole frame\n    Got %d bytes kept\n    Expected none", len(rs.zreq))
+	}
+
+	// Garbage where the zlib stream should be gives up.
+	if _, ok := uncompress(rs, false, []byte{4, 0, 0, 0, 20, 0, 0, 1, 2, 3, 4}); ok {
+		t.Errorf("For a frame that doesn't uncompress\n    Got ok\n    Expected it to fail")
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * concurrency.go
+ *
+ * How many executions of each query are outstanding at once. Fifty copies of a
+ * query running in parallel hurt a lot more than fifty running one after the
+ * other, even though the rate is the same.
+ *
+ */
+
+package sniffer
+
+// concurrency is the in-flight gauge for one query, and its high-water mark
+// since the last status update.
+type concurrency struct {
+	cur  int
+	peak int
+}
+
+var inflight map[string]*concurrency = make(map[string]*concurrency)
+
+// concStart marks a query as outstanding on a stream, ending whatever the
+// stream had outstanding before, since it isn't going to get a response now.
+func concStart(rs *source, text string) {
+	concEnd(rs)
+	conc, ok := inflight[text]
+	if !ok {
+		conc = &concurrency{}
+		inflight[text] = conc
+	}
+	conc.cur++
+	if conc.cur > conc.peak {
+		conc.peak = conc.cur
+	}
+	rs.qconc = conc
+	busyStart(rs)
+}
+
+// concEnd marks the stream's outstanding query, if any, as done.
+func concEnd(rs *source) {
+	if rs.qconc != nil {
+		rs.qconc.cur--
+		rs.qconc = nil
+	}
+	busyEnd(rs)
+}
+
+// concPeak returns the high-water mark for a query since the last reset.
+func concPeak(text string) int {
+	if conc, ok := inflight[text]; ok {
+		return conc.peak
+	}
+	return 0
+}
+
+// resetConcurrency starts a new interval. Queries with nothing outstanding are
+// forgotten; streams only hold on to ones that are.
+func resetConcurrency() {
+	for text, conc := range inflight {
+		if conc.cur <= 0 {
+			delete(inflight, text)
+		} else {
+			conc.peak = conc.cur
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func TestConcurrency(t *testing.T) {
+	inflight = make(map[string]*concurrency)
+	a, b, c := &source{src: "a"}, &source{src: "b"}, &source{src: "c"}
+
+	concStart(a, "select ?")
+	concStart(b, "select ?")
+	concStart(c, "update ?")
+	concEnd(a)
+	concStart(a, "select ?")
+	concStart(a, "select ?") // no response to the last one
+	if peak := concPeak("select ?"); peak != 2 {
+		t.Errorf("For peak of %s\n    Got %d\n    Expected %d", "select ?", peak, 2)
+	}
+
+	concEnd(a)
+	concEnd(b)
+	concEnd(b)
+	resetConcurrency()
+	if peak := concPeak("select ?"); peak != 0 {
+		t.Errorf("For peak after reset of %s\n    Got %d\n    Expected %d", "select ?", peak, 0)
+	}
+	if peak := concPeak("update ?"); peak != 1 {
+		t.Errorf("For peak after reset of %s\n    Got %d\n    Expected %d", "update ?", peak, 1)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * connect.go
+ *
+ * How long connections take to get going: from the SYN (or the server's
+ * greeting, if we missed that) to the first command the client sends. For
+ * short lived connections this can be a good part of the time they spend on
+ * the database.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+var slowConnect time.Duration = 100 * time.Millisecond
+
+// connectStats is the connect-to-first-query time of one client IP.
+type connectStats struct {
+	count uint64
+	total uint64
+	max   uint64
+}
+
+var connectCount uint64
+var connectTimes [TIME_BUCKETS]uint64
+var connectClients map[string]*connectStats = make(map[string]*connectStats)
+
+// connectStarted notes when a stream's connection began.
+func connectStarted(rs *source, why string) {
+	rs.connStart = clock()
+	trace(rs, "connection starting (%s)", why)
+}
+
+// recordConnect records the time since a stream's connection began, now that
+// it has sent its first command.
+func recordConnect(rs *source) {
+	elapsed := uint64(clock().Sub(rs.connStart).Nanoseconds())
+	rs.connStart = time.Time{}
+	if elapsed == 0 {
+		// We use 0 to mean no reading.
+		elapsed = 1
+	}
+	trace(rs, "first command %0.2fms after connecting", float64(elapsed)/1000000)
+
+	connectCount++
+	connectTimes[rand.Intn(TIME_BUCKETS)] = elapsed
+	client, ok := connectClients[clientOf(rs).id]
+	if !ok {
+		client = &connectStats{}
+		connectClients[clientOf(rs).id] = client
+	}
+	client.count++
+	client.total += elapsed
+	if elapsed > client.max {
+		client.max = elapsed
+	}
+}
+
+// printConnects prints the connect times overall and for the slowest clients.
+func printConnects(w io.Writer, displaycount int) {
+	if connectCount == 0 {
+		return
+	}
+
+	cmin, cavg, cmax := calculateTimes(connectTimes[:])
+	reportf(w, " ")
+	reportf(w, "%s%d connections, %0.2fms min / %0.2fms avg / %0.2fms max to first query%s",
+		COLOR_RED, connectCount, cmin, cavg, cmax, COLOR_DEFAULT)
+
+	var tmp sortableSlice
+	for ip, client := range connectClients {
+		avg := float64(client.total) / float64(client.count) / 1000000
+		color := COLOR_YELLOW
+		if avg > float64(slowConnect)/float64(time.Millisecond) {
+			color = COLOR_RED
+		}
+		tmp = append(tmp, sortable{avg, fmt.Sprintf("%s%6d  %s%8.2f %8.2f  %s%s%s",
+			COLOR_YELLOW, client.count, color, avg, float64(client.max)/1000000, COLOR_WHITE,
+			redactClient(ip), COLOR_DEFAULT)})
+	}
+	sort.Sort(sort.Reverse(tmp))
+
+	reportf(w, "%s conns       avg      max  %sclient%s", COLOR_YELLOW, COLOR_WHITE,
+		COLOR_DEFAULT)
+	for i := 0; i < len(tmp) && i < displaycount; i++ {
+		fmt.Fprintln(w, tmp[i].line)
+	}
+}
@@ -0,0 +1,35 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectTime(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	connectCount, connectClients = 0, make(map[string]*connectStats)
+	parseFormat("#q")
+	client := [4]byte{10, 0, 0, 3}
+
+	handlePacket(tcpPacket(client, 50000, true, TCP_SYN, nil))
+	now = now.Add(10 * time.Millisecond)
+	login := makeHandshakeResponse("app")
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, login))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, []byte{7, 0, 0, 2, 0, 0, 0, 2, 0, 0, 0}))
+	now = now.Add(20 * time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK,
+		append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)))
+	now = now.Add(5 * time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK,
+		append([]byte{9, 0, 0, 0, COM_QUERY}, "select 2"...)))
+
+	cs, ok := connectClients["10.0.0.3"]
+	if !ok || connectCount != 1 || cs.count != 1 || cs.max != uint64(30*time.Millisecond) {
+		t.Errorf("For connect time\n    Got %d connections, %+v\n    Expected 1 taking 30ms",
+			connectCount, cs)
+	}
+}
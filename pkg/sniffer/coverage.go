@@ -0,0 +1,228 @@
+/*
+ * coverage.go
+ *
+ * Checking how much of a server's traffic we're actually seeing, by comparing
+ * what we capture against performance_schema's statement digests. Encrypted
+ * sessions, unix socket connections, and dropped packets all show up here as
+ * executions the server did that we never saw.
+ *
+ * requires the MySQL driver:
+ *   https://github.com/go-sql-driver/mysql
+ *
+ */
+
+package sniffer
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+// How many digests we saw too little of to list in the status.
+const COVERAGE_MISSING = 5
+
+var checkCoverage bool = false
+
+// wireDigests counts the executions we've captured since the last poll, by
+// digestKey.
+var wireDigests map[string]uint64 = make(map[string]uint64)
+
+// coverageReport is the result of the latest poll, shown in the status.
+var coverageReport struct {
+	valid   bool
+	server  uint64
+	seen    uint64
+	missing sortableSlice
+}
+
+// digestKey normalizes a query or a performance_schema DIGEST_TEXT so that the
+// two compare equal: identifiers unquoted, literals and lists collapsed, and one
+// space between tokens.
+func digestKey(query []byte) string {
+	var words []string
+	for _, tok := range lexQuery(query) {
+		switch {
+		case tok.text == "`":
+		case tok.toktype == canonical.TOKEN_NUMBER || tok.toktype == canonical.TOKEN_QUOTE:
+			words = append(words, "?")
+		default:
+			words = append(words, tok.text)
+		}
+	}
+
+	// Collapse anything in parentheses that's only placeholders, which covers
+	// both our "(?, ?)" and the server's "(...)", then repeated rows of them.
+	var out []string
+	for i := 0; i < len(words); i++ {
+		if words[i] == "(" {
+			j := i + 1
+			for j < len(words) && (words[j] == "?" || words[j] == "," || words[j] == ".") {
+				j++
+			}
+			if j < len(words) && words[j] == ")" && j > i+1 {
+				if n := len(out); n >= 4 && out[n-1] == "," && out[n-2] == ")" &&
+					out[n-3] == "?" && out[n-4] == "(" {
+					out = out[:n-1]
+				} else {
+					out = append(out, "(", "?", ")")
+				}
+				i = j
+				continue
+			}
+		}
+		out = append(out, words[i])
+	}
+	return strings.Join(out, " ")
+}
+
+// countWireDigest records that we saw an execution of the query.
+func countWireDigest(query []byte) {
+	wireDigests[digestKey(query)]++
+}
+
+// coverageStop is closed to stop the poller.
+var coverageStop chan bool
+
+// openServer opens the server at dsn and checks that we can reach it, so that
+// a bad DSN fails when we start rather than at the first poll.
+func openServer(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// startCoverage connects to the server and starts polling it in the
+// background.
+func startCoverage(dsn string, period time.Duration) error {
+	db, err := openServer(dsn)
+	if err != nil {
+		return err
+	}
+	coverageStop = make(chan bool)
+	go runCoverage(db, period, coverageStop)
+	return nil
+}
+
+// stopCoverage stops the poller. It doesn't wait for it, since a poll may be
+// waiting for the parser lock our caller holds.
+func stopCoverage() {
+	close(coverageStop)
+	coverageStop = nil
+}
+
+// runCoverage polls the server's digest summary every period, comparing what
+// it executed with what we captured over the same time, until stop is closed.
+// A poll that fails is logged and tried again the next period.
+func runCoverage(db *sql.DB, period time.Duration, stop chan bool) {
+	defer db.Close()
+
+	var last map[string]uint64
+	for {
+		counts, texts, err := readDigests(db)
+		if err != nil {
+			log.Printf("%sFailed to read performance_schema digests: %s%s", COLOR_RED,
+				err.Error(), COLOR_DEFAULT)
+		} else {
+			parser.Lock()
+			if last != nil {
+				compareDigests(last, counts, texts)
+			}
+			wireDigests = make(map[string]uint64)
+			parser.Unlock()
+			last = counts
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(period):
+		}
+	}
+}
+
+// readDigests returns the execution count and digestKey of every digest the
+// server has, keyed by the digest.
+func readDigests(db *sql.DB) (map[string]uint64, map[string]string, error) {
+	rows, err := db.Query("SELECT IFNULL(DIGEST, ''), IFNULL(DIGEST_TEXT, ''), COUNT_STAR " +
+		"FROM performance_schema.events_statements_summary_by_digest")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	counts, texts := make(map[string]uint64), make(map[string]string)
+	for rows.Next() {
+		var digest, text string
+		var count uint64
+		if err := rows.Scan(&digest, &text, &count); err != nil {
+			return nil, nil, err
+		}
+		// Our own polling isn't on the wire we're watching.
+		if strings.Contains(text, "events_statements_summary_by_digest") {
+			continue
+		}
+		counts[digest], texts[digest] = counts[digest]+count, digestKey([]byte(text))
+	}
+	return counts, texts, rows.Err()
+}
+
+// compareDigests works out the coverage over the last interval from the server's
+// counts at its start and end, and what we captured in between.
+func compareDigests(last, counts map[string]uint64, texts map[string]string) {
+	server := make(map[string]uint64)
+	for digest, count := range counts {
+		// A count going backwards means the table was truncated.
+		if count >= last[digest] {
+			count -= last[digest]
+		}
+		if count > 0 {
+			server[texts[digest]] += count
+		}
+	}
+
+	coverageReport.valid, coverageReport.server, coverageReport.seen = true, 0, 0
+	coverageReport.missing = nil
+	for key, count := range server {
+		seen := wireDigests[key]
+		if seen > count {
+			seen = count
+		}
+		coverageReport.server += count
+		coverageReport.seen += seen
+		if seen < count {
+			coverageReport.missing = append(coverageReport.missing,
+				sortable{float64(count - seen), key})
+		}
+	}
+	sort.Sort(sort.Reverse(coverageReport.missing))
+}
+
+// printCoverage prints the result of the latest comparison.
+func printCoverage(w io.Writer) {
+	if !coverageReport.valid {
+		return
+	}
+
+	pct := 100.0
+	if coverageReport.server > 0 {
+		pct = float64(coverageReport.seen) / float64(coverageReport.server) * 100
+	}
+	reportf(w, " ")
+	reportf(w, "%s%0.2f%% coverage%s: saw %d of the %d executions performance_schema counted",
+		COLOR_RED, pct, COLOR_DEFAULT, coverageReport.seen, coverageReport.server)
+	for i := 0; i < len(coverageReport.missing) && i < COVERAGE_MISSING; i++ {
+		reportf(w, "%s%6d missed  %s%s%s", COLOR_YELLOW, int(coverageReport.missing[i].value),
+			COLOR_WHITE, redactQuery(coverageReport.missing[i].line), COLOR_DEFAULT)
+	}
+}
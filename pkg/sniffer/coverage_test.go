@@ -0,0 +1,47 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func digestHelper(t *testing.T, query, digest string) {
+	if ours, theirs := digestKey([]byte(query)), digestKey([]byte(digest)); ours != theirs {
+		t.Errorf("For query %s\n    Got %s\n    Expected %s", query, ours, theirs)
+	}
+}
+
+func TestDigestKey(t *testing.T) {
+	digestHelper(t, "select * from orders where id = 7",
+		"SELECT * FROM `orders` WHERE `id` = ?")
+	digestHelper(t, "SELECT a.b FROM t a WHERE x IN (1, 2, 'three') /* app */",
+		"SELECT `a` . `b` FROM `t` `a` WHERE `x` IN (...)")
+	digestHelper(t, "insert into t (a, b) values (1, 'x'), (2, 'y'), (3, 'z')",
+		"INSERT INTO `t` ( `a` , `b` ) VALUES (...) /* , ... */")
+	digestHelper(t, "insert into t (a, b) values (1, 'x'), (2, 'y')",
+		"INSERT INTO `t` ( `a` , `b` ) VALUES (...) , (...)")
+}
+
+func TestCompareDigests(t *testing.T) {
+	wireDigests = map[string]uint64{digestKey([]byte("select 1")): 8}
+	compareDigests(map[string]uint64{"a": 10, "b": 5},
+		map[string]uint64{"a": 20, "b": 10, "c": 3},
+		map[string]string{"a": digestKey([]byte("SELECT ?")), "b": "update", "c": "delete"})
+
+	if coverageReport.server != 18 || coverageReport.seen != 8 ||
+		len(coverageReport.missing) != 3 || coverageReport.missing[0].line != "update" {
+		t.Errorf("For coverage\n    Got %+v\n    Expected 8 of 18, update missed most",
+			coverageReport)
+	}
+}
+
+func TestCoverageBadDSN(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CoverageDSN = "not a dsn"
+	if err := startOutputs(opts); err == nil {
+		stopOutputs()
+		t.Errorf("For DSN %s\n    Got no error\n    Expected one", opts.CoverageDSN)
+	}
+	if coverageStop != nil {
+		t.Errorf("For the poller\n    Got it running\n    Expected it not started")
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * cursors.go
+ *
+ * Server side cursors. A COM_STMT_EXECUTE with a cursor flag is answered with
+ * only the column definitions, and the rows come after in answer to as many
+ * COM_STMT_FETCHes as the client cares to send. On their own the executes look
+ * instant, so the fetches, their bytes and their time count toward the query
+ * that opened the cursor.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// The execute flag asking for a cursor; the others are never implemented.
+	CURSOR_TYPE_READ_ONLY = 0x01
+)
+
+// Whether any fetches have been counted, which the report then has a column
+// for.
+var cursorFetches bool = false
+
+// cursorOpened says whether a COM_STMT_EXECUTE payload asks for a cursor.
+func cursorOpened(pdata []byte) bool {
+	return len(pdata) >= 5 && pdata[4]&CURSOR_TYPE_READ_ONLY != 0
+}
+
+// fetchCommand makes the command for a COM_STMT_FETCH, counting toward the
+// query that opened the cursor if we know it.
+func fetchCommand(rs *source, pdata []byte) *command {
+	cmd := &command{ptype: COM_STMT_FETCH}
+	if len(pdata) < 4 {
+		return cmd
+	}
+	if stmt := rs.stmts[stmtID(pdata)]; stmt != nil && stmt.cursor != nil {
+		cmd.fetch, cmd.sent = stmt.cursor, clock()
+	} else {
+		trace(rs, "fetching from an unknown cursor")
+	}
+	return cmd
+}
+
+// recordFetch counts a segment of the response to a fetch toward the query
+// that opened the cursor.
+func recordFetch(rs *source, bytes uint64) {
+	qdata := rs.qfetch
+	qdata.roll()
+	qdata.bytes += bytes
+	if rs.fetchSent.IsZero() {
+		return
+	}
+	fetchtime := uint64(clock().Sub(rs.fetchSent).Nanoseconds())
+	trace(rs, "fetch after %0.2fms", float64(fetchtime)/1000000)
+	rs.cmds.matched++
+	rs.fetchSent = time.Time{}
+	qdata.fetches++
+	qdata.fetchTime += fetchtime
+	cursorFetches = true
+}
+
+// formatFetches is the fetches column of a query's row: the fetches, and
+// their average time.
+func formatFetches(c *queryData) string {
+	avg := "-"
+	if c.fetches > 0 {
+		avg = fmt.Sprintf("%.2f", float64(c.fetchTime)/float64(c.fetches)/1000000)
+	}
+	return fmt.Sprintf("%s%7d %8s  ", COLOR_CYAN, c.fetches, avg)
+}
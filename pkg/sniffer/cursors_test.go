@@ -0,0 +1,68 @@
+package sniffer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorFetches(t *testing.T) {
+	defer func() { clock, cursorFetches = time.Now, false }()
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+	qbuf, format, querycount, cursorFetches = make(map[string]*queryData), nil, 0, false
+	parseFormat("#q")
+	rs := &source{synced: true}
+	coldef := []byte{3, 'd', 'e', 'f', 0, 0, 0, 1, 'a', 0, 0x0c, 0x3f, 0, 1, 0, 0, 0, 8, 0x81, 0,
+		0, 0, 0}
+	eof := func(seq byte, status byte) []byte { return mysqlPacket(seq, 0xfe, 0, 0, status, 0) }
+	row := mysqlPacket(0, 0, 0, 1, 0, 0, 0)[4:]
+
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_STMT_PREPARE},
+		"select id from orders where state = ?"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0, 7, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0))
+	processPacket(rs, false, mysqlPacket(2, coldef...))
+	processPacket(rs, false, eof(3, 2))
+
+	// An execute opening a cursor, answered with only the column definitions.
+	processPacket(rs, true, mysqlPacket(0, COM_STMT_EXECUTE, 7, 0, 0, 0, CURSOR_TYPE_READ_ONLY,
+		1, 0, 0, 0))
+	now = now.Add(time.Millisecond)
+	processPacket(rs, false, append(append(mysqlPacket(1, 1), mysqlPacket(2, coldef...)...),
+		eof(3, 2|SERVER_STATUS_CURSOR_EXISTS)...))
+	qdata := qbuf["select id from orders where state = ?"]
+	if qdata == nil {
+		t.Fatalf("For an execute opening a cursor\n    Got %v\n    Expected it counted", qbuf)
+	}
+	bytes := qdata.bytes
+
+	// Two fetches of two rows, the second reaching the end.
+	for i, status := range []byte{2 | SERVER_STATUS_CURSOR_EXISTS, 2 | 0x80} {
+		processPacket(rs, true, mysqlPacket(0, COM_STMT_FETCH, 7, 0, 0, 0, 2, 0, 0, 0))
+		now = now.Add(time.Duration(10*(i+1)) * time.Millisecond)
+		processPacket(rs, false, append(append(mysqlPacket(1, row...), mysqlPacket(2, row...)...),
+			eof(3, status)...))
+	}
+	processPacket(rs, true, mysqlPacket(0, COM_STMT_CLOSE, 7, 0, 0, 0))
+
+	// A fetch from a statement we never saw execute counts toward nothing.
+	processPacket(rs, true, mysqlPacket(0, COM_STMT_FETCH, 8, 0, 0, 0, 2, 0, 0, 0))
+	processPacket(rs, false, eof(1, 2))
+
+	if querycount != 1 || qdata.count != 1 || qdata.fetches != 2 ||
+		qdata.fetchTime != uint64(30*time.Millisecond) || qdata.returned != 4 {
+		t.Errorf("For two fetches from a cursor\n    Got %d queries, %d executions, %d fetches "+
+			"taking %v, %d rows\n    Expected 1, 1, 2 taking 30ms, 4 rows", querycount,
+			qdata.count, qdata.fetches, time.Duration(qdata.fetchTime), qdata.returned)
+	}
+	if fetched := qdata.bytes - bytes; fetched != 2*uint64(2*10+9) {
+		t.Errorf("For the bytes of the fetches\n    Got %d\n    Expected %d", fetched, 2*(2*10+9))
+	}
+	if !rs.synced || !cursorFetches {
+		t.Errorf("For fetches\n    Got synced %v, column %v\n    Expected both", rs.synced,
+			cursorFetches)
+	}
+	if row := formatFetches(qdata); !strings.Contains(row, "      2    15.00") {
+		t.Errorf("For the fetches column\n    Got %q\n    Expected 2 fetches of 15ms", row)
+	}
+}
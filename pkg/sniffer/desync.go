@@ -0,0 +1,147 @@
+/*
+ * desync.go
+ *
+ * Why streams lose sync, and what it costs us. Each desync is put down to a
+ * cause:
+ *
+ *   - pipelined request, a command while we still had a response buffered
+ *   - bad packet length, where a packet's length left us in the middle of
+ *     something that isn't a command
+ *   - sequence gap, a response packet out of sequence, a command packet not
+ *     at sequence 0 where the client has nothing more to send, or a response
+ *     to nothing, so we missed packets
+ *   - truncated capture, a packet cut short by the capture length
+ *   - buffer overflow, more commands outstanding than we keep
+ *   - undecodable, a stream switching to TLS, or compression we can't undo
+ *
+ * and for each we keep how long streams took to sync again, and the bytes that
+ * went by meanwhile, which at the bytes per query of the synced streams is
+ * roughly how many queries we missed.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	DESYNC_PIPELINED = iota
+	DESYNC_LENGTH
+	DESYNC_SEQUENCE
+	DESYNC_TRUNCATED
+	DESYNC_OVERFLOW
+	DESYNC_UNDECODABLE
+	DESYNC_CAUSES
+)
+
+var desyncNames = [DESYNC_CAUSES]string{"pipelined request", "bad packet length",
+	"sequence gap", "truncated capture", "buffer overflow", "undecodable"}
+
+// desyncData is the desyncs of a cause.
+type desyncData struct {
+	count    uint64
+	resynced connectStats // how long the streams took to sync again
+	bytes    uint64       // that went by while they were out of sync
+}
+
+var desyncCauses [DESYNC_CAUSES]desyncData
+
+// The bytes on synced streams, to tell the bytes of a query.
+var syncedBytes uint64
+
+// desync marks a stream as having lost track of where it is in the protocol.
+func desync(rs *source, cause int, reason string) {
+	stats.desyncs++
+	desyncCauses[cause].count++
+	if stats.desyncReasons == nil {
+		stats.desyncReasons = make(map[string]uint64)
+	}
+	stats.desyncReasons[reason]++
+	rs.synced = false
+	for _, cmd := range rs.queue {
+		if !cmd.sent.IsZero() {
+			rs.cmds.dropped++
+		}
+	}
+	rs.queue, rs.resp = nil, response{}
+	rs.idleSince = time.Time{}
+	rs.desyncedAt, rs.desyncCause = clock(), cause
+	rs.respBytes, rs.large = 0, nil
+	concEnd(rs)
+	trace(rs, "desync: %s", reason)
+
+	if desyncDump != nil && len(rs.history) > 0 {
+		fmt.Fprintf(desyncDump, "# desync: %s\n", reason)
+		writePayloads(desyncDump, rs.src, rs.history)
+		rs.history = nil
+	}
+}
+
+// countDesynced counts the bytes of a packet on a stream, against its
+// desync if it's out of sync after one.
+func countDesynced(rs *source, bytes int) {
+	if rs.synced {
+		syncedBytes += uint64(bytes)
+	} else if !rs.desyncedAt.IsZero() {
+		desyncCauses[rs.desyncCause].bytes += uint64(bytes)
+	}
+}
+
+// resynced records how long a stream was out of sync, now that it isn't.
+func resynced(rs *source) {
+	if rs.desyncedAt.IsZero() {
+		return
+	}
+	elapsed := uint64(clock().Sub(rs.desyncedAt).Nanoseconds())
+	rs.desyncedAt = time.Time{}
+	trace(rs, "back in sync after %0.2fms", float64(elapsed)/1000000)
+
+	rc := &desyncCauses[rs.desyncCause].resynced
+	rc.count++
+	rc.total += elapsed
+	if elapsed > rc.max {
+		rc.max = elapsed
+	}
+}
+
+// missedQueries estimates the queries in the bytes that went by out of sync.
+func missedQueries(bytes uint64) float64 {
+	if syncedBytes == 0 {
+		return 0
+	}
+	return float64(bytes) * float64(querycount) / float64(syncedBytes)
+}
+
+// printDesyncs prints the desyncs by cause, and how the streams recovered.
+func printDesyncs(w io.Writer) {
+	if stats.desyncs == 0 {
+		return
+	}
+	var causes []string
+	var resynced connectStats
+	var bytes uint64
+	for cause, dd := range desyncCauses {
+		if dd.count > 0 {
+			causes = append(causes, fmt.Sprintf("%d %s", dd.count, desyncNames[cause]))
+		}
+		resynced.count += dd.resynced.count
+		resynced.total += dd.resynced.total
+		if dd.resynced.max > resynced.max {
+			resynced.max = dd.resynced.max
+		}
+		bytes += dd.bytes
+	}
+	reportf(w, "%sdesyncs: %s%s", COLOR_RED, strings.Join(causes, ", "), COLOR_DEFAULT)
+	avg := 0.0
+	if resynced.count > 0 {
+		avg = float64(resynced.total) / float64(resynced.count) / 1000000
+	}
+	reportf(w, "%d resynced after %0.2fms avg / %0.2fms max, %s out of sync (~%0.0f queries "+
+		"missed)", resynced.count, avg, float64(resynced.max)/1000000, formatBytes(bytes),
+		missedQueries(bytes))
+}
@@ -0,0 +1,126 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDesyncCauses(t *testing.T) {
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	querycount, syncedBytes, desyncCauses = 0, 0, [DESYNC_CAUSES]desyncData{}
+	defer func() { clock = time.Now }()
+	now := time.Unix(1000, 0)
+	clock = func() time.Time { return now }
+	parseFormat("#q")
+
+	client := [4]byte{10, 0, 1, 9}
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	ok := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+	// A result set missing its column definition.
+	gap := []byte{1, 0, 0, 1, 1, 5, 0, 0, 3, 0xfe, 0, 0, 2, 0}
+
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, gap))
+
+	// Out of sync for 10ms, over a command we don't sync on.
+	now = now.Add(10 * time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, []byte{1, 0, 0, 0, COM_STATISTICS}))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+
+	// Then a command byte no client sends.
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, []byte{1, 0, 0, 0, 0x7f}))
+
+	dd := desyncCauses[DESYNC_SEQUENCE]
+	if dd.count != 1 || dd.resynced.count != 1 || dd.resynced.max != uint64(10*time.Millisecond) {
+		t.Errorf("For the sequence gap\n    Got %d desyncs, %d resynced after %d\n"+
+			"    Expected 1, 1 after 10ms", dd.count, dd.resynced.count, dd.resynced.max)
+	}
+	// The command and the query we synced on.
+	if dd.bytes != uint64(5+len(query)) {
+		t.Errorf("For the bytes out of sync\n    Got %d\n    Expected %d", dd.bytes, 5+len(query))
+	}
+	// What came while synced: from the answer to the first query through the
+	// gap, then the bad command.
+	synced := len(ok) + len(query) + len(gap) + 5
+	if expected := float64(5+len(query)) * 3 / float64(synced); missedQueries(dd.bytes) != expected {
+		t.Errorf("For the queries missed\n    Got %0.3f\n    Expected %0.3f",
+			missedQueries(dd.bytes), expected)
+	}
+	if desyncCauses[DESYNC_LENGTH].count != 1 || desyncCauses[DESYNC_LENGTH].resynced.count != 0 {
+		t.Errorf("For the bad packet length\n    Got %d desyncs\n    Expected 1",
+			desyncCauses[DESYNC_LENGTH].count)
+	}
+}
+
+func TestSyncCommands(t *testing.T) {
+	qbuf, format, querycount = make(map[string]*queryData), nil, 0
+	stats.synced.queries, stats.synced.others = 0, 0
+	parseFormat("#q")
+
+	// Nothing but prepared statements, picked up mid-stream.
+	rs := &source{}
+	processPacket(rs, true, mysqlPacket(0, COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0))
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_STMT_PREPARE},
+		"select * from orders where id = ?"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0))
+	processPacket(rs, true, mysqlPacket(0, COM_STMT_EXECUTE, 7, 0, 0, 0, 0, 1, 0, 0, 0))
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+	if !rs.synced || querycount != 2 || qbuf["select * from orders where id = ?"] == nil ||
+		stats.synced.others != 1 {
+		t.Errorf("For prepared statements only\n    Got synced %t, %d queries, %d synced on "+
+			"others\n    Expected in sync from the first execute", rs.synced, querycount,
+			stats.synced.others)
+	}
+
+	// Only well formed commands count, and some never do.
+	for _, test := range []struct {
+		name     string
+		ptype    int
+		pdata    []byte
+		expected bool
+	}{
+		{"a ping", COM_PING, nil, true},
+		{"a ping with a payload", COM_PING, []byte{1}, false},
+		{"an init db", COM_INIT_DB, []byte("shop"), true},
+		{"a close", COM_STMT_CLOSE, []byte{7, 0, 0, 0}, true},
+		{"a short execute", COM_STMT_EXECUTE, []byte{7, 0, 0, 0}, false},
+		{"a fetch", COM_STMT_FETCH, []byte{7, 0, 0, 0, 1, 0, 0, 0}, false},
+	} {
+		if got := syncCommand(test.ptype, test.pdata); got != test.expected {
+			t.Errorf("For %s\n    Got %t\n    Expected %t", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestCommandSequence(t *testing.T) {
+	qbuf, format, querycount, desyncCauses = make(map[string]*queryData), nil, 0,
+		[DESYNC_CAUSES]desyncData{}
+	parseFormat("#q")
+	rs := &source{synced: true}
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...)
+	ok := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+
+	// A command packet that isn't the start of a command.
+	processPacket(rs, true, query)
+	processPacket(rs, false, ok)
+	processPacket(rs, true, mysqlPacket(3, append([]byte{COM_QUERY}, "select 2"...)...))
+	if rs.synced || desyncCauses[DESYNC_SEQUENCE].count != 1 {
+		t.Errorf("For a command at sequence 3\n    Got synced %t, %d sequence desyncs\n"+
+			"    Expected a desync", rs.synced, desyncCauses[DESYNC_SEQUENCE].count)
+	}
+
+	// Something that looks like a query, followed by a packet out of sequence,
+	// isn't on a packet boundary.
+	processPacket(rs, true, append(append([]byte{}, query...), 1, 0, 0, 2, 'x'))
+	if rs.synced {
+		t.Errorf("For a query followed by packet 2\n    Got synced\n    Expected not")
+	}
+	processPacket(rs, true, query)
+	if !rs.synced || querycount != 2 {
+		t.Errorf("For a query on its own\n    Got synced %t, %d queries\n    Expected 2",
+			rs.synced, querycount)
+	}
+}
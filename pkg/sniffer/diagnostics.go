@@ -0,0 +1,243 @@
+/*
+ * diagnostics.go
+ *
+ * How healthy a capture was, written as JSON when the sniffer exits so that
+ * scripts running captures can decide whether to trust the results without
+ * scraping the status output:
+ *
+ *     {"exit": "end", "duration_seconds": 600.2,
+ *      "packets": {"received": 1203311, "pcap_dropped": 0, ...},
+ *      "desyncs": {"total": 3, "reasons": {"response with no command outstanding": 3},
+ *                  "causes": {"sequence gap": {"count": 3, "resynced": 2, ...}, ...}},
+ *      "streams": {"opened": 412, "closed": 398, "evicted": 2, "open": 12}, ...}
+ *
+ */
+
+package sniffer
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Diagnostics is how a capture went.
+type Diagnostics struct {
+	Version  string    `json:"version"`
+	Exit     string    `json:"exit"` // "end", "signal" or "error"
+	Error    string    `json:"error,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration_seconds"`
+
+	Packets struct {
+		Received  uint64 `json:"received"`
+		Synced    uint64 `json:"synced"`    // on streams we were following
+		Truncated uint64 `json:"truncated"` // cut short by the capture length
+		Filtered  uint64 `json:"filtered"`
+		OneWay    uint64 `json:"skipped_one_way"`
+
+		// Commands of 16MB or more, and those over -max-payload.
+		Large       uint64 `json:"large_payloads"`
+		LargeCapped uint64 `json:"large_payloads_capped"`
+
+		// What libpcap says, for live captures.
+		PcapReceived  uint64 `json:"pcap_received"`
+		PcapDropped   uint64 `json:"pcap_dropped"`
+		PcapIfDropped uint64 `json:"pcap_interface_dropped"`
+
+		// The share dropped over the status intervals, and the queries we
+		// estimate there were given that.
+		CaptureLoss      float64 `json:"capture_loss"`
+		EstimatedQueries float64 `json:"estimated_queries"`
+
+		// The payload bytes we saw, and those we couldn't decode by why.
+		Bytes uint64            `json:"bytes"`
+		Blind map[string]uint64 `json:"blind_bytes"`
+	} `json:"packets"`
+
+	Desyncs struct {
+		Total   uint64                 `json:"total"`
+		Reasons map[string]uint64      `json:"reasons"`
+		Causes  map[string]DesyncCause `json:"causes"`
+	} `json:"desyncs"`
+
+	Streams struct {
+		Opened  uint64 `json:"opened"`
+		Closed  uint64 `json:"closed"`
+		Quit    uint64 `json:"quit"`    // of those closed, with COM_QUIT
+		Evicted uint64 `json:"evicted"` // replaced by a new connection before closing
+		Open    int    `json:"open"`
+		Retired uint64 `json:"retired"` // dropped with their target
+
+		// Those on the compressed protocol we followed.
+		Compressed uint64 `json:"compressed"`
+
+		// Those we started following on a query, and on another command.
+		SyncedQuery uint64 `json:"synced_query"`
+		SyncedOther uint64 `json:"synced_other"`
+	} `json:"streams"`
+
+	// Changes of targets while we ran, see SetTargets, and server groups
+	// failing over, see ServerGroups.
+	Targets   []TargetChange `json:"target_changes,omitempty"`
+	Failovers []Failover     `json:"failovers,omitempty"`
+
+	// Events we couldn't keep up with sending.
+	Dropped struct {
+		Events     uint64 `json:"events"`
+		Forward    uint64 `json:"forward"`
+		UDP        uint64 `json:"udp"`
+		Clickhouse uint64 `json:"clickhouse"`
+	} `json:"events_dropped"`
+
+	// With -max-memory, what we held at the end and what we shed to stay
+	// under it.
+	Memory struct {
+		Accounted uint64 `json:"accounted"`
+		Budget    uint64 `json:"budget"`
+		Streams   uint64 `json:"shed_streams"`
+		Queries   uint64 `json:"shed_queries"`
+	} `json:"memory"`
+
+	// With -detail, the queries given rows and rolled up, and about how many
+	// distinct ones the rolled up were.
+	Tiers struct {
+		Promoted     uint64 `json:"promoted"`
+		Demoted      uint64 `json:"demoted"`
+		Buckets      int    `json:"buckets"`
+		Fingerprints uint64 `json:"tail_fingerprints"`
+	} `json:"tiers"`
+
+	// The commands sent, by name, see mix.go.
+	Commands map[string]uint64 `json:"commands"`
+
+	// With -verify, the times each invariant broke, see verify.go.
+	Violations map[string]uint64 `json:"invariant_violations,omitempty"`
+
+	Queries      int `json:"queries"`
+	Fingerprints int `json:"fingerprints"`
+}
+
+// DesyncCause is the desyncs of a cause, and how the streams recovered.
+type DesyncCause struct {
+	Count     uint64  `json:"count"`
+	Resynced  uint64  `json:"resynced"`
+	ResyncAvg float64 `json:"resync_avg_ms"`
+	ResyncMax float64 `json:"resync_max_ms"`
+	Bytes     uint64  `json:"bytes_missed"`
+	Queries   float64 `json:"queries_missed"` // estimated from the bytes
+}
+
+// Diagnostics returns how the capture went, given why it ended and the error
+// if it failed.
+func (self *Sniffer) Diagnostics(exit string, err error) *Diagnostics {
+	parser.Lock()
+	defer parser.Unlock()
+
+	diag := &Diagnostics{Version: VERSION, Exit: exit, Start: time.Unix(start, 0), End: clock()}
+	if err != nil {
+		diag.Error = err.Error()
+	}
+	diag.Duration = diag.End.Sub(diag.Start).Seconds()
+
+	diag.Packets.Received = stats.packets.rcvd
+	diag.Packets.Synced = stats.packets.rcvd_sync
+	diag.Packets.Truncated = stats.packets.truncated
+	diag.Packets.Filtered = stats.filtered.packets
+	diag.Packets.OneWay = stats.mirror.skipped
+	diag.Packets.Large, diag.Packets.LargeCapped = largeStats.count, largeStats.capped
+	if pstats := self.pcapStats(); pstats != nil {
+		diag.Packets.PcapReceived = uint64(pstats.PacketsReceived)
+		diag.Packets.PcapDropped = uint64(pstats.PacketsDropped)
+		diag.Packets.PcapIfDropped = uint64(pstats.PacketsIfDropped)
+	}
+	diag.Packets.CaptureLoss, diag.Packets.EstimatedQueries = captureLoss(), estimateQueries()
+	diag.Packets.Bytes, diag.Packets.Blind = blind.total, make(map[string]uint64)
+	for category := 1; category < BLIND_CATEGORIES; category++ {
+		diag.Packets.Blind[blindNames[category]] = blind.bytes[category]
+	}
+
+	diag.Desyncs.Total = stats.desyncs
+	diag.Desyncs.Reasons = make(map[string]uint64)
+	for reason, count := range stats.desyncReasons {
+		diag.Desyncs.Reasons[reason] = count
+	}
+	diag.Desyncs.Causes = make(map[string]DesyncCause)
+	for cause, dd := range desyncCauses {
+		dc := DesyncCause{Count: dd.count, Resynced: dd.resynced.count, Bytes: dd.bytes,
+			ResyncMax: float64(dd.resynced.max) / 1000000, Queries: missedQueries(dd.bytes)}
+		if dd.resynced.count > 0 {
+			dc.ResyncAvg = float64(dd.resynced.total) / float64(dd.resynced.count) / 1000000
+		}
+		diag.Desyncs.Causes[desyncNames[cause]] = dc
+	}
+
+	td := stats.teardowns
+	diag.Streams.Opened = stats.streams
+	diag.Streams.Closed = td.clientFin + td.clientRst + td.serverFin + td.serverRst + td.quit
+	diag.Streams.Quit = td.quit
+	diag.Streams.Evicted = stats.evicted
+	diag.Streams.Open = len(chmap)
+	diag.Streams.Retired = targetStats.retired
+	diag.Streams.Compressed = stats.compressed
+	diag.Streams.SyncedQuery, diag.Streams.SyncedOther = stats.synced.queries, stats.synced.others
+	diag.Targets, diag.Failovers = targetChanges, failovers
+
+	diag.Dropped.Events = atomic.LoadUint64(&stats.events.dropped)
+	diag.Dropped.Forward = atomic.LoadUint64(&stats.forward.dropped)
+	diag.Dropped.UDP = atomic.LoadUint64(&stats.udp.dropped)
+	diag.Dropped.Clickhouse = atomic.LoadUint64(&stats.clickhouse.dropped)
+
+	if maxMemory > 0 {
+		diag.Memory.Accounted, diag.Memory.Budget = accountedMemory(), maxMemory
+		diag.Memory.Streams, diag.Memory.Queries = stats.memory.streams, stats.memory.queries
+	}
+
+	diag.Commands = make(map[string]uint64)
+	for ptype, count := range commandCounts {
+		if count > 0 {
+			diag.Commands[commandName(ptype)] = count
+		}
+	}
+
+	if detailLimit > 0 {
+		diag.Tiers.Promoted, diag.Tiers.Demoted = tiers.promoted, tiers.demoted
+		diag.Tiers.Buckets, diag.Tiers.Fingerprints = len(tiers.buckets), tiers.distinct.estimate()
+	}
+
+	if verifying {
+		verifyTotals()
+		diag.Violations = make(map[string]uint64)
+		for invariant, count := range violations {
+			diag.Violations[invariant] = count
+		}
+	}
+
+	diag.Queries = querycount
+	diag.Fingerprints = len(qbuf)
+	return diag
+}
+
+// WriteDiagnostics writes diagnostics as JSON to a file, or to stderr if the
+// filename is "-".
+func WriteDiagnostics(filename string, diag *Diagnostics) error {
+	file := os.Stderr
+	if filename != "-" {
+		var err error
+		file, err = os.Create(filename)
+		if err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(file)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(diag)
+	if file != os.Stderr {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	querycount, stats.streams, stats.evicted, stats.desyncs = 0, 0, 0, 0
+	stats.desyncReasons, stats.packets.truncated = nil, 0
+	parseFormat("#q")
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	ok := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+	client := [4]byte{10, 0, 0, 2}
+
+	// A query answered twice, then a new connection from the same port.
+	handlePacket(tcpPacket(client, 50000, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+	truncated := tcpPacket(client, 50000, true, TCP_SYN, nil)
+	truncated.Len += 100
+	handlePacket(truncated)
+
+	filename := filepath.Join(t.TempDir(), "diagnostics.json")
+	if err := WriteDiagnostics(filename, (&Sniffer{}).Diagnostics("end", nil)); err != nil {
+		t.Fatalf("Failed to write diagnostics: %s", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read diagnostics: %s", err)
+	}
+	var diag Diagnostics
+	if err := json.Unmarshal(data, &diag); err != nil {
+		t.Fatalf("Failed to decode diagnostics: %s\n%s", err, data)
+	}
+
+	if diag.Exit != "end" {
+		t.Errorf("For the exit\n    Got %q\n    Expected \"end\"", diag.Exit)
+	}
+	for name, test := range map[string]struct{ got, expected uint64 }{
+		"queries":   {uint64(diag.Queries), 1},
+		"opened":    {diag.Streams.Opened, 2},
+		"evicted":   {diag.Streams.Evicted, 1},
+		"open":      {uint64(diag.Streams.Open), 1},
+		"truncated": {diag.Packets.Truncated, 1},
+		"desyncs":   {diag.Desyncs.Total, 1},
+		"reason":    {diag.Desyncs.Reasons["response with no command outstanding"], 1},
+	} {
+		if test.got != test.expected {
+			t.Errorf("For %s\n    Got %d\n    Expected %d\n%s", name, test.got, test.expected, data)
+		}
+	}
+}
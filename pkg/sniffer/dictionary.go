@@ -0,0 +1,206 @@
+/*
+ * dictionary.go
+ *
+ * The text behind the fingerprint hashes in the events and exports, for
+ * whoever looks at them later. It's written as JSON with -dump-dictionary
+ * and served at /api/dictionary:
+ *
+ *     {"version": "...", "normalization": "canonical/1", "format": "#s:#q",
+ *      "fingerprints": [{"hash": "...", "text": "...", "sample": "..."}, ...]}
+ *
+ * The normalization and format say how the texts were made, since the same
+ * query hashes differently if they change between runs. Samples are raw
+ * queries with their values in them, so they're only kept if asked for.
+ *
+ * A dictionary from an older canonicalizer can be migrated to the current one
+ * by fingerprinting its samples again, which tells us what the old hashes are
+ * called now.
+ *
+ */
+
+package sniffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+var trackDictionary bool = false
+var dictionarySamples bool = false
+var dictionaryFile string
+var formatString string
+
+// dictionary maps fingerprint hashes to their entries.
+var dictionary map[uint64]*DictionaryEntry = make(map[uint64]*DictionaryEntry)
+
+// Dictionary is what -dump-dictionary writes.
+type Dictionary struct {
+	Time             time.Time          `json:"time"`
+	Version          string             `json:"version"`       // of the sniffer
+	Normalization    string             `json:"normalization"` // how the texts were made
+	CanonicalVersion int                `json:"canonical_version"`
+	Format           string             `json:"format"`
+	Fingerprints     []*DictionaryEntry `json:"fingerprints"`
+}
+
+// DictionaryEntry is one fingerprint.
+type DictionaryEntry struct {
+	Hash   string `json:"hash"`
+	Text   string `json:"text"`
+	Sample string `json:"sample,omitempty"`
+
+	// After a migration, the hashes this fingerprint had before.
+	MigratedFrom []string `json:"migrated_from,omitempty"`
+}
+
+// normalization describes what the texts in the dictionary are.
+func normalization() string {
+	switch {
+	case dirty:
+		return "raw"
+	case groupShape:
+		return fmt.Sprintf("shape/%d", canonical.VERSION)
+	}
+	return fmt.Sprintf("canonical/%d", canonical.VERSION) + foldSuffix(foldColumns)
+}
+
+// recordDictionary adds the query of a source, if it's new.
+func recordDictionary(rs *source, hash uint64) {
+	if _, ok := dictionary[hash]; ok {
+		return
+	}
+	entry := &DictionaryEntry{Hash: fmt.Sprintf("%016x", hash), Text: rs.qcanon}
+	if dictionarySamples {
+		entry.Sample = rs.qraw
+	}
+	dictionary[hash] = entry
+}
+
+// writeDictionary writes the dictionary as JSON, sorted by hash.
+func writeDictionary(w io.Writer) error {
+	dict := &Dictionary{Time: clock().UTC(), Version: VERSION, Normalization: normalization(),
+		CanonicalVersion: canonical.VERSION, Format: formatString,
+		Fingerprints: make([]*DictionaryEntry, 0, len(dictionary))}
+	for _, entry := range dictionary {
+		if redacting {
+			entry = &DictionaryEntry{Hash: entry.Hash, Text: redactQuery(entry.Text),
+				MigratedFrom: entry.MigratedFrom}
+		}
+		dict.Fingerprints = append(dict.Fingerprints, entry)
+	}
+	return encodeDictionary(w, dict)
+}
+
+// encodeDictionary writes a dictionary as JSON, sorted by hash.
+func encodeDictionary(w io.Writer, dict *Dictionary) error {
+	sort.Slice(dict.Fingerprints, func(i, j int) bool {
+		return dict.Fingerprints[i].Hash < dict.Fingerprints[j].Hash
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dict)
+}
+
+// dumpDictionary replaces the dictionary file, so readers never see half of
+// one.
+func dumpDictionary() error {
+	tmp := dictionaryFile + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := writeDictionary(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dictionaryFile)
+}
+
+// serveDictionary writes the dictionary. It's encoded before it's sent, so a
+// slow client doesn't hold up the parser.
+func serveDictionary(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	parser.Lock()
+	writeDictionary(&buf)
+	parser.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+// MigrateDictionary reads a dictionary written by -dump-dictionary and writes
+// it out again for the current canonicalizer. Fingerprints with a sample are
+// fingerprinted again, remembering their old hashes; those without are kept as
+// they were, with a warning, since there's nothing to fingerprint.
+func MigrateDictionary(r io.Reader, w io.Writer) error {
+	var old Dictionary
+	if err := json.NewDecoder(r).Decode(&old); err != nil {
+		return fmt.Errorf("Failed to read the dictionary: %s", err.Error())
+	}
+	if !strings.HasPrefix(old.Normalization, "canonical/") || old.Format != "#q" {
+		return fmt.Errorf("Only dictionaries of canonical queries (-f #q) can be migrated, "+
+			"this one is %s with format %s", old.Normalization, old.Format)
+	}
+	if old.CanonicalVersion != canonical.VERSION {
+		log.Printf("%sMigrating a dictionary from canonicalizer version %d to %d%s", COLOR_YELLOW,
+			old.CanonicalVersion, canonical.VERSION, COLOR_DEFAULT)
+	}
+
+	// Fold the columns the way the dictionary was.
+	fold, err := parseFold(foldOf(old.Normalization))
+	if err != nil {
+		return err
+	}
+
+	migrated := make(map[string]*DictionaryEntry)
+	var changed, unsampled int
+	for _, entry := range old.Fingerprints {
+		if entry.Sample == "" {
+			unsampled++
+			if _, ok := migrated[entry.Hash]; !ok {
+				migrated[entry.Hash] = entry
+			}
+			continue
+		}
+		text := foldInsertColumns(canonical.Fingerprint(entry.Sample), fold)
+		hash := fmt.Sprintf("%016x", fingerprintHash(text))
+		into, ok := migrated[hash]
+		if !ok {
+			into = &DictionaryEntry{Hash: hash, Text: text, Sample: entry.Sample}
+			migrated[hash] = into
+		}
+		if hash != entry.Hash {
+			changed++
+			into.MigratedFrom = append(into.MigratedFrom, entry.Hash)
+			into.MigratedFrom = append(into.MigratedFrom, entry.MigratedFrom...)
+		}
+	}
+
+	dict := &Dictionary{Time: clock().UTC(), Version: VERSION, Format: old.Format,
+		Normalization: fmt.Sprintf("canonical/%d", canonical.VERSION) + foldSuffix(fold)}
+	dict.CanonicalVersion = canonical.VERSION
+	for _, entry := range migrated {
+		dict.Fingerprints = append(dict.Fingerprints, entry)
+	}
+	log.Printf("%d fingerprints, %d with new hashes", len(old.Fingerprints), changed)
+	if unsampled > 0 && old.CanonicalVersion != canonical.VERSION {
+		log.Printf("%sWARNING: %d fingerprints have no sample and were kept as they were, "+
+			"their hashes may not match what this version makes of the same queries%s",
+			COLOR_RED, unsampled, COLOR_DEFAULT)
+	}
+	return encodeDictionary(w, dict)
+}
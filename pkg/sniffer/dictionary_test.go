@@ -0,0 +1,135 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDictionary(t *testing.T) {
+	defer func() {
+		dictionary, dictionarySamples, dictionaryFile = make(map[uint64]*DictionaryEntry), false, ""
+	}()
+	dictionary, dictionarySamples = make(map[uint64]*DictionaryEntry), true
+	dictionaryFile = filepath.Join(t.TempDir(), "dictionary.json")
+	formatString = "#q"
+
+	rs := &source{qcanon: "select * from a where id = ?", qraw: "select * from a where id = 5"}
+	recordDictionary(rs, fingerprintHash(rs.qcanon))
+	// Later samples don't replace the first.
+	rs.qraw = "select * from a where id = 6"
+	recordDictionary(rs, fingerprintHash(rs.qcanon))
+	dictionarySamples = false
+	recordDictionary(&source{qcanon: "commit", qraw: "commit"}, fingerprintHash("commit"))
+
+	if err := dumpDictionary(); err != nil {
+		t.Fatalf("Failed to dump: %s", err.Error())
+	}
+	file, err := os.Open(dictionaryFile)
+	if err != nil {
+		t.Fatalf("Failed to open: %s", err.Error())
+	}
+	defer file.Close()
+	var dict Dictionary
+	if err := json.NewDecoder(file).Decode(&dict); err != nil {
+		t.Fatalf("Failed to decode: %s", err.Error())
+	}
+
+	if dict.Version != VERSION || dict.Normalization != "canonical/1" || dict.Format != "#q" {
+		t.Errorf("For header\n    Got %s, %s, %s\n    Expected %s, canonical/1, #q", dict.Version,
+			dict.Normalization, dict.Format, VERSION)
+	}
+	expected := map[string]DictionaryEntry{
+		fmt.Sprintf("%016x", fingerprintHash(rs.qcanon)): {Text: rs.qcanon,
+			Sample: "select * from a where id = 5"},
+		fmt.Sprintf("%016x", fingerprintHash("commit")): {Text: "commit"},
+	}
+	for _, entry := range dict.Fingerprints {
+		want := expected[entry.Hash]
+		if entry.Text != want.Text || entry.Sample != want.Sample {
+			t.Errorf("For %s\n    Got %+v\n    Expected %+v", entry.Hash, entry, want)
+		}
+	}
+	if len(dict.Fingerprints) != 2 || dict.Fingerprints[0].Hash > dict.Fingerprints[1].Hash {
+		t.Errorf("For fingerprints\n    Got %+v\n    Expected 2 sorted by hash", dict.Fingerprints)
+	}
+
+	server := httptest.NewServer(httpHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/api/dictionary")
+	if err != nil {
+		t.Fatalf("Failed to get dictionary: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	var served Dictionary
+	if err := json.NewDecoder(resp.Body).Decode(&served); err != nil || len(served.Fingerprints) != 2 {
+		t.Errorf("For /api/dictionary\n    Got %+v (%v)\n    Expected 2 fingerprints", served, err)
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	defer func() { dirty, groupShape = false, false }()
+	for _, test := range []struct {
+		dirty, shape bool
+		expected     string
+	}{
+		{false, false, "canonical/1"},
+		{false, true, "shape/1"},
+		{true, false, "raw"},
+	} {
+		dirty, groupShape = test.dirty, test.shape
+		if got := normalization(); got != test.expected {
+			t.Errorf("For dirty=%t shape=%t\n    Got %s\n    Expected %s", test.dirty, test.shape,
+				got, test.expected)
+		}
+	}
+}
+
+func TestMigrateDictionary(t *testing.T) {
+	sampled := "select * from a where id in (1, 2)"
+	old := `{"normalization": "canonical/0", "canonical_version": 0, "format": "#q",
+		"fingerprints": [
+			{"hash": "0000000000000001", "text": "select * from a where id in (?, ?)",
+			 "sample": "select * from a where id in (1, 2)"},
+			{"hash": "0000000000000002", "text": "select * from a where id in (?, ?, ?)",
+			 "sample": "select * from a where id in (3, 4, 5)"},
+			{"hash": "0000000000000003", "text": "commit"}]}`
+
+	var out strings.Builder
+	if err := MigrateDictionary(strings.NewReader(old), &out); err != nil {
+		t.Fatalf("Failed to migrate: %s", err.Error())
+	}
+	var dict Dictionary
+	if err := json.Unmarshal([]byte(out.String()), &dict); err != nil {
+		t.Fatalf("Failed to decode: %s", err.Error())
+	}
+
+	if dict.CanonicalVersion != 1 || dict.Normalization != "canonical/1" {
+		t.Errorf("For version\n    Got %d, %s\n    Expected 1, canonical/1", dict.CanonicalVersion,
+			dict.Normalization)
+	}
+	// Both lists collapse to one fingerprint now.
+	hash := fmt.Sprintf("%016x", fingerprintHash(cleanupQuery([]byte(sampled))))
+	byHash := make(map[string]*DictionaryEntry)
+	for _, entry := range dict.Fingerprints {
+		byHash[entry.Hash] = entry
+	}
+	if entry := byHash[hash]; len(dict.Fingerprints) != 2 || entry == nil ||
+		strings.Join(entry.MigratedFrom, ",") != "0000000000000001,0000000000000002" {
+		t.Errorf("For migrated fingerprints\n    Got %+v\n    Expected %s from 1 and 2",
+			dict.Fingerprints, hash)
+	}
+	if entry := byHash["0000000000000003"]; entry == nil || entry.Text != "commit" {
+		t.Errorf("For unsampled fingerprint\n    Got %+v\n    Expected it kept", entry)
+	}
+
+	if err := MigrateDictionary(strings.NewReader(`{"normalization": "raw", "format": "#q"}`),
+		&out); err == nil {
+		t.Errorf("For raw dictionary\n    Got no error\n    Expected an error")
+	}
+}
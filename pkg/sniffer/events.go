@@ -0,0 +1,193 @@
+/*
+ * events.go
+ *
+ * A live stream of completed queries over a WebSocket at /events, one JSON
+ * Event per message. Subscribers pick what they want in the request:
+ *
+ *     /events?hash=<fingerprint hash>&client=<ip>&min_latency=<duration>
+ *
+ * Each subscriber has its own bounded queue. The capture path never waits on
+ * one; if a subscriber falls behind, its events are dropped and counted.
+ *
+ */
+
+package sniffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const EVENTS_QUEUE = 1024
+
+// Event is a completed query as streamed from /events.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`            // ip:port
+	Server    string    `json:"server"`            // ip:port, or its -server-group label
+	Address   string    `json:"address,omitempty"` // ip:port, if Server is a label
+	User      string    `json:"user,omitempty"`
+	Hash      string    `json:"hash"` // of the statement, as in the dictionary
+	Query     string    `json:"query"`
+	LatencyMs float64   `json:"latency_ms"`
+	Bytes     uint64    `json:"bytes"`
+	ErrorCode int       `json:"error,omitempty"`
+}
+
+// subscriber is one /events connection and what it asked for.
+type subscriber struct {
+	hash       string
+	client     string
+	minLatency time.Duration
+	queue      chan []byte
+	dropped    uint64
+}
+
+var subscribers struct {
+	sync.Mutex
+	list map[*subscriber]bool
+}
+
+// streaming is nonzero when anybody is subscribed, so the capture path can skip
+// building events otherwise.
+var streaming int32
+
+// wants returns whether the event passes the subscriber's filters. The client
+// is the event's before it was redacted, which is what subscribers ask for.
+func (self *subscriber) wants(ev *Event, client string, latency time.Duration) bool {
+	if self.hash != "" && self.hash != ev.Hash {
+		return false
+	}
+	if self.client != "" && !strings.HasPrefix(client, self.client+":") {
+		return false
+	}
+	return latency >= self.minLatency
+}
+
+// publishEvent hands a completed query to the subscribers that want it.
+func publishEvent(rs *source, latency uint64, bytes uint64, errcode int) {
+	ev := &Event{Time: clock(), Client: redactClient(rs.src), Server: serverOf(rs),
+		User: redactUser(rs.user), Hash: fmt.Sprintf("%016x", fingerprintHash(rs.qcanon)),
+		Query: redactQuery(rs.qcanon), LatencyMs: float64(latency) / 1000000, Bytes: bytes,
+		ErrorCode: errcode}
+	if rs.server != "" {
+		ev.Address = rs.dst
+	}
+
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	var msg []byte
+	for sub := range subscribers.list {
+		if !sub.wants(ev, rs.src, time.Duration(latency)) {
+			continue
+		}
+		if msg == nil {
+			msg, _ = json.Marshal(ev)
+		}
+		select {
+		case sub.queue <- msg:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			atomic.AddUint64(&stats.events.dropped, 1)
+		}
+	}
+}
+
+// serveEvents streams events to one subscriber until they go away. Pages from
+// other sites can't subscribe, or any page open in a browser on the same host
+// could read the queries.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross origin", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	sub := &subscriber{hash: query.Get("hash"), client: query.Get("client"),
+		queue: make(chan []byte, EVENTS_QUEUE)}
+	if val := query.Get("min_latency"); val != "" {
+		minLatency, err := time.ParseDuration(val)
+		if err != nil {
+			http.Error(w, "bad min_latency: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sub.minLatency = minLatency
+	}
+
+	ws, err := wsUpgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	subscribers.Lock()
+	if subscribers.list == nil {
+		subscribers.list = make(map[*subscriber]bool)
+	}
+	subscribers.list[sub] = true
+	atomic.StoreInt32(&streaming, int32(len(subscribers.list)))
+	subscribers.Unlock()
+	defer func() {
+		subscribers.Lock()
+		delete(subscribers.list, sub)
+		atomic.StoreInt32(&streaming, int32(len(subscribers.list)))
+		subscribers.Unlock()
+		if dropped := atomic.LoadUint64(&sub.dropped); dropped > 0 {
+			log.Printf("Events subscriber %s dropped %d events", r.RemoteAddr, dropped)
+		}
+	}()
+
+	// We don't expect anything from the subscriber, but we have to read to
+	// notice them leaving and to answer pings.
+	gone := make(chan bool)
+	go func() {
+		defer close(gone)
+		for {
+			if _, err := ws.readMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-sub.queue:
+			if err := ws.writeFrame(WS_TEXT, msg); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// WatchEvents subscribes to the /events stream at url, e.g.
+// "ws://localhost:8080/events?min_latency=100ms", and calls fn with every event
+// until the stream ends.
+func WatchEvents(url string, fn func(*Event)) error {
+	ws, err := wsDial(url)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	for {
+		msg, err := ws.readMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var ev Event
+		if err := json.Unmarshal(msg, &ev); err != nil {
+			return fmt.Errorf("bad event: %s", err.Error())
+		}
+		fn(&ev)
+	}
+}
@@ -0,0 +1,121 @@
+package sniffer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	// Subscribers from an earlier run may still be hanging on.
+	subscribers.Lock()
+	subscribers.list = nil
+	atomic.StoreInt32(&streaming, 0)
+	subscribers.Unlock()
+
+	server := httptest.NewServer(httpHandler())
+	defer server.Close()
+
+	url := "ws://" + strings.TrimPrefix(server.URL, "http://") +
+		"/events?client=10.0.0.2&min_latency=5ms"
+	events := make(chan *Event, 10)
+	go WatchEvents(url, func(ev *Event) { events <- ev })
+	for i := 0; atomic.LoadInt32(&streaming) == 0; i++ {
+		if i > 100 {
+			t.Fatalf("Subscriber never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, ev := range []struct {
+		client  string
+		latency time.Duration
+	}{
+		{"10.0.0.1:1000", 10 * time.Millisecond},
+		{"10.0.0.2:1000", time.Millisecond},
+		{"10.0.0.2:1000", 10 * time.Millisecond},
+		{"10.0.0.20:1000", 10 * time.Millisecond},
+	} {
+		// The key has the client in it, the event's hash and query don't.
+		rs := &source{src: ev.client, dst: "10.0.0.9:3306", qtext: ev.client + ":select * from a",
+			qcanon: "select * from a"}
+		publishEvent(rs, uint64(ev.latency), 100, 0)
+	}
+
+	select {
+	case ev := <-events:
+		got := fmt.Sprintf("%s %s %0.2f %d %s", ev.Client, ev.Query, ev.LatencyMs, ev.Bytes,
+			ev.Hash)
+		expected := fmt.Sprintf("10.0.0.2:1000 select * from a 10.00 100 %016x",
+			fingerprintHash("select * from a"))
+		if got != expected {
+			t.Errorf("For event\n    Got %s\n    Expected %s", got, expected)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Never got an event")
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("For filtered events\n    Got %+v\n    Expected nothing", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventDrops(t *testing.T) {
+	sub := &subscriber{queue: make(chan []byte, 1)}
+	subscribers.Lock()
+	subscribers.list = map[*subscriber]bool{sub: true}
+	subscribers.Unlock()
+	defer func() { subscribers.list = nil }()
+
+	rs := &source{src: "10.0.0.1:1000", qcanon: "select 1"}
+	for i := 0; i < 3; i++ {
+		publishEvent(rs, 1, 1, 0)
+	}
+	if len(sub.queue) != 1 || sub.dropped != 2 {
+		t.Errorf("For a full queue\n    Got %d queued, %d dropped\n    Expected 1 queued, 2 dropped",
+			len(sub.queue), sub.dropped)
+	}
+}
+
+func TestEventRedactedClient(t *testing.T) {
+	sub := &subscriber{client: "10.0.0.2", queue: make(chan []byte, 2)}
+	subscribers.Lock()
+	subscribers.list = map[*subscriber]bool{sub: true}
+	subscribers.Unlock()
+	redacting = true
+	defer func() { subscribers.list, redacting = nil, false }()
+
+	publishEvent(&source{src: "10.0.0.2:1000", qcanon: "select 1"}, 1, 1, 0)
+	publishEvent(&source{src: "10.0.0.3:1000", qcanon: "select 1"}, 1, 1, 0)
+	if len(sub.queue) != 1 {
+		t.Fatalf("For a client filter while redacting\n    Got %d events\n    Expected 1",
+			len(sub.queue))
+	}
+	if msg := string(<-sub.queue); strings.Contains(msg, "10.0.0.2") {
+		t.Errorf("For the event\n    Got %s\n    Expected the client redacted", msg)
+	}
+}
+
+func TestEventCrossOrigin(t *testing.T) {
+	server := httptest.NewServer(httpHandler())
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", "http://evil.example")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to request /events: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("For a cross origin subscriber\n    Got %s\n    Expected it refused", resp.Status)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * filter.go
+ *
+ * Filters that decide which traffic makes it into the aggregation.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// verbAliases expands the convenience names accepted by -only-verbs and
+// -skip-verbs into the verbs they stand for.
+var verbAliases map[string][]string = map[string][]string{
+	"read":  []string{"select", "show", "describe", "desc", "explain"},
+	"write": []string{"insert", "update", "delete", "replace", "load", "truncate"},
+}
+
+var onlyVerbs map[string]bool
+var skipVerbs map[string]bool
+var onlyClients CIDRList
+var skipClients CIDRList
+var onlyUsers map[string]bool
+var skipUsers map[string]bool
+var unknownUsers bool = true
+var minLatency time.Duration
+
+// CIDRList is a repeatable flag holding IPs or CIDRs. A bare IP is treated as a
+// network of just that host.
+type CIDRList []*net.IPNet
+
+// parseVerbList turns a comma separated list of verbs (and aliases) into a set.
+// An empty list returns nil, meaning "no filter".
+func parseVerbList(list string) (map[string]bool, error) {
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return nil, nil
+	}
+
+	verbs := make(map[string]bool)
+	for _, verb := range strings.Split(list, ",") {
+		verb = strings.ToLower(strings.TrimSpace(verb))
+		if verb == "" {
+			continue
+		}
+		if alias, ok := verbAliases[verb]; ok {
+			for _, v := range alias {
+				verbs[v] = true
+			}
+			continue
+		}
+		if strings.IndexFunc(verb, func(r rune) bool { return r < 'a' || r > 'z' }) >= 0 {
+			return nil, fmt.Errorf("Invalid verb in filter: %s", verb)
+		}
+		verbs[verb] = true
+	}
+	return verbs, nil
+}
+
+// parseUserList turns a comma separated list of MySQL users into a set. An
+// empty list returns nil, meaning "no filter".
+func parseUserList(list string) map[string]bool {
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return nil
+	}
+
+	users := make(map[string]bool)
+	for _, user := range strings.Split(list, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			users[user] = true
+		}
+	}
+	return users
+}
+
+// queryVerb returns the lowercased leading keyword of a statement, skipping any
+// whitespace and comments in front of it. This is the one place statements get
+// classified by verb, so anything that cares about verbs should go through here.
+func queryVerb(query []byte) string {
+	i := skipSpaceAndComments(query, 0)
+
+	// What's in an executable comment runs, on servers as new as its version.
+	if strings.HasPrefix(string(query[i:]), "/*!") {
+		for i += 3; i < len(query) && query[i] >= '0' && query[i] <= '9'; i++ {
+		}
+		i = skipSpaceAndComments(query, i)
+	}
+
+	start := i
+	for i < len(query) && ((query[i] >= 'a' && query[i] <= 'z') ||
+		(query[i] >= 'A' && query[i] <= 'Z')) {
+		i++
+	}
+	return strings.ToLower(string(query[start:i]))
+}
+
+// skipSpaceAndComments returns the position of the first byte at or after pos
+// that isn't whitespace or part of a comment. Executable comments (/*! ... */)
+// and optimizer hints (/*+ ... */) aren't skipped, since the server reads them.
+func skipSpaceAndComments(query []byte, pos int) int {
+	for pos < len(query) {
+		b := query[pos]
+		switch {
+		case b == ' ' || (b >= 9 && b <= 13):
+			pos++
+		case b == '#' || (b == '-' && pos+1 < len(query) && query[pos+1] == '-' &&
+			(pos+2 == len(query) || query[pos+2] <= ' ')):
+			for pos < len(query) && query[pos] != '\n' {
+				pos++
+			}
+		case b == '/' && pos+1 < len(query) && query[pos+1] == '*' &&
+			(pos+2 == len(query) || (query[pos+2] != '!' && query[pos+2] != '+')):
+			end := strings.Index(string(query[pos+2:]), "*/")
+			if end < 0 {
+				return len(query)
+			}
+			pos += end + 4
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+// verbAllowed tells us whether a query with the given verb should be aggregated
+// according to -only-verbs and -skip-verbs.
+func verbAllowed(verb string) bool {
+	if onlyVerbs != nil && !onlyVerbs[verb] {
+		return false
+	}
+	if skipVerbs != nil && skipVerbs[verb] {
+		return false
+	}
+	return true
+}
+
+func (self *CIDRList) String() string {
+	parts := make([]string, 0, len(*self))
+	for _, ipnet := range *self {
+		parts = append(parts, ipnet.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (self *CIDRList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return fmt.Errorf("invalid IP: %s", item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return err
+		}
+		*self = append(*self, ipnet)
+	}
+	return nil
+}
+
+func (self CIDRList) contains(ip net.IP) bool {
+	for _, ipnet := range self {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// bpfClause returns a BPF expression matching any of the networks in the list.
+func (self CIDRList) bpfClause() string {
+	parts := make([]string, 0, len(self))
+	for _, ipnet := range self {
+		if ones, bits := ipnet.Mask.Size(); ones == bits {
+			parts = append(parts, "host "+ipnet.IP.String())
+		} else {
+			parts = append(parts, "net "+ipnet.String())
+		}
+	}
+	return strings.Join(parts, " or ")
+}
+
+// userAllowed tells us whether queries from a connection logged in as the given
+// user should be aggregated. An empty user means we never saw the handshake.
+func userAllowed(user string) bool {
+	if user == "" {
+		return unknownUsers
+	}
+	if onlyUsers != nil && !onlyUsers[user] {
+		return false
+	}
+	if skipUsers != nil && skipUsers[user] {
+		return false
+	}
+	return true
+}
+
+// clientAllowed tells us whether traffic from this client should be looked at
+// according to -client and -skip-client.
+func clientAllowed(ip net.IP) bool {
+	if len(onlyClients) > 0 && !onlyClients.contains(ip) {
+		return false
+	}
+	if len(skipClients) > 0 && skipClients.contains(ip) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package sniffer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func verbHelper(t *testing.T, input, expected string) {
+	var out string = queryVerb([]byte(input))
+	if out != expected {
+		t.Errorf("For query %s\n    Got %s\n    Expected %s", input, out, expected)
+	}
+}
+
+func TestQueryVerb(t *testing.T) {
+	verbHelper(t, "select * from table", "select")
+	verbHelper(t, "  \n\tUPDATE table set x=1", "update")
+	verbHelper(t, "/* host:route */ INSERT INTO table VALUES (1)", "insert")
+	verbHelper(t, "-- comment\ndelete from table", "delete")
+	verbHelper(t, "# comment\n/* another */ show tables", "show")
+	verbHelper(t, "/*!40101 SET NAMES utf8 */", "set")
+	verbHelper(t, "/* dump */ /*!40014 set unique_checks=0 */", "set")
+	verbHelper(t, "/* unterminated", "")
+	verbHelper(t, "", "")
+}
+
+func TestVerbList(t *testing.T) {
+	verbs, err := parseVerbList("write, select")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, verb := range []string{"insert", "update", "delete", "replace", "select"} {
+		if !verbs[verb] {
+			t.Errorf("Expected %s in verb list", verb)
+		}
+	}
+	if verbs["show"] {
+		t.Errorf("Didn't expect show in verb list")
+	}
+	if verbs, _ := parseVerbList("  "); verbs != nil {
+		t.Errorf("Expected empty verb list to be nil")
+	}
+	if _, err := parseVerbList("select, drop-table"); err == nil {
+		t.Errorf("Expected an error for an invalid verb")
+	}
+}
+
+func TestClientFilter(t *testing.T) {
+	var nets CIDRList
+	if err := nets.Set("10.0.0.0/8,192.168.1.5"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := nets.Set("not-an-ip"); err == nil {
+		t.Errorf("Expected error for invalid IP")
+	}
+
+	for ip, expected := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+	} {
+		if nets.contains(net.ParseIP(ip)) != expected {
+			t.Errorf("For %s expected %t", ip, expected)
+		}
+	}
+
+	if out := nets.bpfClause(); out != "net 10.0.0.0/8 or host 192.168.1.5" {
+		t.Errorf("Got BPF clause %s", out)
+	}
+}
+
+func TestMinLatency(t *testing.T) {
+	defer func() { clock, minLatency = time.Now, 0 }()
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+
+	for _, test := range []struct {
+		min        time.Duration
+		fast, slow uint64
+	}{
+		{0, 0, 3},
+		{5 * time.Millisecond, 2, 1},
+		{time.Second, 3, 0},
+	} {
+		qbuf, format, querycount, minLatency = make(map[string]*queryData), nil, 0, test.min
+		stats.fast.queries, stats.fast.bytes = 0, 0
+		parseFormat("#q")
+		rs := &source{synced: true}
+		for _, latency := range []time.Duration{time.Millisecond, 2 * time.Millisecond,
+			10 * time.Millisecond} {
+			processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...))
+			now = now.Add(latency)
+			processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+		}
+
+		var slow uint64
+		if qdata := qbuf["select ?"]; qdata != nil {
+			slow = qdata.count
+		}
+		if querycount != 3 || stats.fast.queries != test.fast || slow != test.slow {
+			t.Errorf("For -min-latency %s\n    Got %d queries, %d fast, %d aggregated\n"+
+				"    Expected 3, %d fast, %d aggregated", test.min, querycount,
+				stats.fast.queries, slow, test.fast, test.slow)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+/*
+ * forward.go
+ *
+ * Shipping of query events from many sniffers (agents) to one central sniffer
+ * (the collector), which aggregates them into a single view.
+ *
+ * Events are sent over TCP in batches. Each batch is a frame consisting of a
+ * 4 byte little endian payload length followed by the payload:
+ *
+ *     version      byte (FORWARD_VERSION)
+ *     count        uvarint
+ *     count times:
+ *       time       uvarint, unix nanoseconds
+ *       server     string
+ *       client     string
+ *       hash       8 bytes little endian, see fingerprintHash
+ *       hastext    byte, 1 if the text and verb follow
+ *       text       string, only the first time a hash is sent on a connection
+ *       verb       string, likewise
+ *       latency    uvarint, nanoseconds
+ *       bytes      uvarint
+ *       errcode    uvarint, 0 if the query didn't fail
+ *
+ * where a string is a uvarint length followed by that many bytes. The text is
+ * the statement without what the agent's format adds, see queryStatement, so
+ * the collector aggregates a query from all of its agents' clients together.
+ * The verb picks which of the collector's apdex targets the query is held to.
+ *
+ */
+
+package sniffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FORWARD_VERSION   = 2
+	FORWARD_BATCH     = 256
+	FORWARD_QUEUE     = 16384
+	FORWARD_MAX_FRAME = 64 * 1024 * 1024
+)
+
+type queryEvent struct {
+	time    time.Time
+	server  string
+	client  string
+	hash    uint64
+	text    string
+	verb    string
+	latency uint64 // nanoseconds
+	bytes   uint64
+	errcode int
+
+	// Only used locally, these aren't forwarded.
+	address string // ip:port, if server is a -server-group label
+	user    string
+	db      string
+	rows    uint64
+}
+
+var (
+	forwardQueue chan *queryEvent
+	forwardStop  chan bool // closed to stop the forwarder
+	forwardDone  chan bool // closed once it has
+)
+
+// fingerprintHash returns the stable identifier of an aggregation key, used
+// wherever we need to refer to a fingerprint without its text.
+func fingerprintHash(text string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(text))
+	return hash.Sum64()
+}
+
+// forwardEvent queues an event for the collector. This is called from the
+// capture path, so it never blocks: if the queue is full the event is dropped.
+func forwardEvent(ev *queryEvent) {
+	select {
+	case forwardQueue <- ev:
+	default:
+		atomic.AddUint64(&stats.forward.dropped, 1)
+	}
+}
+
+// startForwarder begins shipping events to the collector at the given address.
+func startForwarder(addr string) {
+	forwardQueue, forwardStop, forwardDone = make(chan *queryEvent, FORWARD_QUEUE),
+		make(chan bool), make(chan bool)
+	go runForwarder(addr, forwardQueue, forwardStop, forwardDone)
+}
+
+// stopForwarder sends what's left of the batch, if we're connected, and waits
+// for the forwarder to hang up.
+func stopForwarder() {
+	close(forwardStop)
+	<-forwardDone
+	forwardQueue, forwardStop, forwardDone = nil, nil, nil
+}
+
+// runForwarder batches up events from queue and writes them out, dialing (and
+// redialing, with backoff) the collector as needed, until stop is closed.
+func runForwarder(addr string, queue chan *queryEvent, stop, done chan bool) {
+	defer close(done)
+	var conn net.Conn
+	var sent map[uint64]bool
+	var nextDial time.Time
+	backoff := time.Second
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	batch := make([]*queryEvent, 0, FORWARD_BATCH)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for stopped := false; !stopped; {
+		select {
+		case ev := <-queue:
+			batch = append(batch, ev)
+			if len(batch) < FORWARD_BATCH {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-stop:
+			stopped = true
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if conn == nil && !stopped && time.Now().After(nextDial) {
+			var err error
+			conn, err = net.DialTimeout("tcp", addr, 5*time.Second)
+			if err != nil {
+				log.Printf("Failed to connect to collector %s: %s", addr, err.Error())
+				conn, nextDial = nil, time.Now().Add(backoff)
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+			} else {
+				sent, backoff = make(map[uint64]bool), time.Second
+			}
+		}
+		if conn == nil {
+			atomic.AddUint64(&stats.forward.dropped, uint64(len(batch)))
+			batch = batch[:0]
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(encodeBatch(batch, sent)); err != nil {
+			log.Printf("Failed to send to collector %s: %s", addr, err.Error())
+			atomic.AddUint64(&stats.forward.dropped, uint64(len(batch)))
+			conn.Close()
+			conn = nil
+		} else {
+			atomic.AddUint64(&stats.forward.sent, uint64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+}
+
+// encodeBatch builds a frame out of the events. sent tracks which fingerprints
+// the other end already knows the text of, and is updated.
+func encodeBatch(batch []*queryEvent, sent map[uint64]bool) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	buf := make([]byte, 4, 4+len(batch)*64)
+
+	putUvarint := func(val uint64) {
+		buf = append(buf, scratch[:binary.PutUvarint(scratch[:], val)]...)
+	}
+	putString := func(val string) {
+		putUvarint(uint64(len(val)))
+		buf = append(buf, val...)
+	}
+
+	buf = append(buf, FORWARD_VERSION)
+	putUvarint(uint64(len(batch)))
+	for _, ev := range batch {
+		putUvarint(uint64(ev.time.UnixNano()))
+		putString(ev.server)
+		putString(ev.client)
+		binary.LittleEndian.PutUint64(scratch[:8], ev.hash)
+		buf = append(buf, scratch[:8]...)
+		if sent[ev.hash] {
+			buf = append(buf, 0)
+		} else {
+			buf = append(buf, 1)
+			putString(ev.text)
+			putString(ev.verb)
+			sent[ev.hash] = true
+		}
+		putUvarint(ev.latency)
+		putUvarint(ev.bytes)
+		putUvarint(uint64(ev.errcode))
+	}
+
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
+	return buf
+}
+
+// forwardedText is what an agent sends once for a fingerprint.
+type forwardedText struct {
+	text string
+	verb string
+}
+
+// decodeBatch reads one frame. dict maps fingerprint hashes to the text we've
+// been sent for them on this connection, and is updated.
+func decodeBatch(r *bufio.Reader, dict map[uint64]forwardedText) ([]*queryEvent, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size > FORWARD_MAX_FRAME {
+		return nil, fmt.Errorf("frame too large: %d bytes", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	var err error
+	getUvarint := func() uint64 {
+		val, n := binary.Uvarint(buf)
+		if n <= 0 {
+			err = errors.New("truncated frame")
+			buf = nil
+			return 0
+		}
+		buf = buf[n:]
+		return val
+	}
+	getBytes := func(n uint64) []byte {
+		if uint64(len(buf)) < n {
+			err = errors.New("truncated frame")
+			buf = nil
+			return nil
+		}
+		val := buf[:n]
+		buf = buf[n:]
+		return val
+	}
+	getString := func() string {
+		return string(getBytes(getUvarint()))
+	}
+
+	if version := getBytes(1); err != nil || version[0] != FORWARD_VERSION {
+		return nil, errors.New("unknown frame version")
+	}
+	// Every event takes at least a byte, so a count beyond what's left in the
+	// frame is garbage, not something to allocate for.
+	count := getUvarint()
+	if err != nil || count > uint64(len(buf)) {
+		return nil, errors.New("bad event count")
+	}
+	events := make([]*queryEvent, 0, count)
+	for i := uint64(0); i < count && err == nil; i++ {
+		ev := &queryEvent{}
+		ev.time = time.Unix(0, int64(getUvarint()))
+		ev.server = getString()
+		ev.client = getString()
+		if hash := getBytes(8); hash != nil {
+			ev.hash = binary.LittleEndian.Uint64(hash)
+		}
+		if hastext := getBytes(1); hastext != nil && hastext[0] == 1 {
+			text := getString()
+			dict[ev.hash] = forwardedText{text: text, verb: getString()}
+		}
+		ev.text, ev.verb = dict[ev.hash].text, dict[ev.hash].verb
+		if ev.text == "" {
+			ev.text = fmt.Sprintf("(unknown fingerprint %016x)", ev.hash)
+		}
+		ev.latency = getUvarint()
+		ev.bytes = getUvarint()
+		ev.errcode = int(getUvarint())
+		events = append(events, ev)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// startCollector listens for agents in place of opening a capture. What they
+// send is aggregated on the collector goroutine, and reported, served and
+// exported just like what we sniff.
+func (self *Sniffer) startCollector() error {
+	listener, err := net.Listen("tcp", self.opts.Collect)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s: %s", self.opts.Collect, err.Error())
+	}
+	if err := startOutputs(self.opts); err != nil {
+		listener.Close()
+		return err
+	}
+	log.Printf("Collecting query events on %s...", self.opts.Collect)
+
+	self.listener = listener
+	go self.reporter()
+	go self.collect()
+	return nil
+}
+
+// collect is the collector's loop, which runs until Stop.
+func (self *Sniffer) collect() {
+	defer close(self.done)
+
+	events := make(chan []*queryEvent, 64)
+	go func() {
+		for {
+			conn, err := self.listener.Accept()
+			if err != nil {
+				// Stop closed the listener.
+				return
+			}
+			go readAgent(conn, events, self.stop)
+		}
+	}()
+
+	ticker := time.NewTicker(self.opts.Period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case rt := <-self.retarget:
+			rt.done <- fmt.Errorf("There are no targets when collecting")
+		case batch := <-events:
+			parser.Lock()
+			for _, ev := range batch {
+				collectEvent(ev)
+			}
+			parser.Unlock()
+		case <-ticker.C:
+			if self.opts.Report && !verbose {
+				select {
+				case self.report <- true:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// readAgent decodes the event stream from one agent until it goes away, or
+// until stop is closed.
+func readAgent(conn net.Conn, events chan []*queryEvent, stop chan bool) {
+	defer conn.Close()
+	log.Printf("Agent connected from %s", conn.RemoteAddr())
+
+	// Closing the connection is what gets us out of a read.
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	dict := make(map[uint64]forwardedText)
+	for {
+		batch, err := decodeBatch(r, dict)
+		if err != nil {
+			if err != io.EOF {
+				select {
+				case <-stop:
+				default:
+					log.Printf("Agent %s: %s", conn.RemoteAddr(), err.Error())
+				}
+			}
+			return
+		}
+		select {
+		case events <- batch:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// collectEvent aggregates an event received from an agent, and passes it on
+// to the exporters. The caller holds the parser lock.
+func collectEvent(ev *queryEvent) {
+	querycount++
+	randn := rand.Intn(timeBuckets)
+	times[randn] = ev.latency
+	target := apdexThreshold(ev.verb)
+	apdex.record(ev.latency, target)
+
+	if forwardQueue != nil {
+		forwardEvent(ev)
+	}
+	if udpQueue != nil {
+		forwardUDP(ev)
+	}
+	if clickhouseQueue != nil {
+		forwardClickhouse(ev)
+	}
+
+	if ev.latency < uint64(minLatency.Nanoseconds()) {
+		stats.fast.queries++
+		stats.fast.bytes += ev.bytes
+		return
+	}
+
+	qdata := aggregate(ev.text, ev.text, randn, ev.latency, ev.bytes, target)
+	if qdata.servers == nil {
+		qdata.servers = make(map[string]uint64)
+	}
+	qdata.servers[ev.server]++
+	if ev.errcode != 0 {
+		qdata.errors++
+	}
+
+	if verbose {
+		log.Printf("    %s[%s] %s %s## %sbytes: %d time: %0.2f%s\n", COLOR_GREEN, ev.server,
+			ev.text, COLOR_RED, COLOR_YELLOW, ev.bytes, float64(ev.latency)/1000000,
+			COLOR_DEFAULT)
+	}
+}
@@ -0,0 +1,159 @@
+package sniffer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestForwardRoundTrip(t *testing.T) {
+	events := []*queryEvent{
+		&queryEvent{time: time.Unix(1434500000, 12345), server: "10.0.0.1:3306",
+			client: "10.0.0.2:50000", hash: fingerprintHash("select ?"), text: "select ?",
+			verb: "select", latency: 1500000, bytes: 120},
+		&queryEvent{time: time.Unix(1434500001, 0), server: "10.0.0.1:3306",
+			client: "10.0.0.3:50001", hash: fingerprintHash("select ?"), text: "select ?",
+			verb: "select", latency: 2500000, bytes: 80, errcode: ER_LOCK_DEADLOCK},
+	}
+
+	// The second batch shouldn't need to carry the text again.
+	sent := make(map[uint64]bool)
+	first, second := encodeBatch(events[:1], sent), encodeBatch(events[1:], sent)
+	if len(second) >= len(first) {
+		t.Errorf("Expected second batch to omit the text")
+	}
+
+	r := bufio.NewReader(bytes.NewReader(append(first, second...)))
+	dict := make(map[uint64]forwardedText)
+	for _, expected := range events {
+		batch, err := decodeBatch(r, dict)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(batch) != 1 {
+			t.Fatalf("Got %d events, expected 1", len(batch))
+		}
+		got := batch[0]
+		if !got.time.Equal(expected.time) || got.server != expected.server ||
+			got.client != expected.client || got.hash != expected.hash ||
+			got.text != expected.text || got.verb != expected.verb ||
+			got.latency != expected.latency ||
+			got.bytes != expected.bytes || got.errcode != expected.errcode {
+			t.Errorf("Got %+v\n    Expected %+v", *got, *expected)
+		}
+	}
+}
+
+func TestCollectEventTarget(t *testing.T) {
+	defer func() { apdexWrite, apdex = 0, apdexScore{} }()
+	qbuf, apdex, apdexWrite = make(map[string]*queryData), apdexScore{}, time.Second
+
+	// The write target applies to what the agent says is a write.
+	collectEvent(&queryEvent{server: "10.0.0.1:3306", hash: fingerprintHash("update t1"),
+		text: "update t1", verb: "update", latency: uint64(500 * time.Millisecond)})
+	if apdex.satisfied != 1 {
+		t.Errorf("For an update of 500ms with a write target of 1s\n    Got %+v\n"+
+			"    Expected it satisfied", apdex)
+	}
+}
+
+func TestForwardTruncated(t *testing.T) {
+	frame := encodeBatch([]*queryEvent{&queryEvent{text: "select ?"}}, make(map[uint64]bool))
+	frame[0] -= 3
+	r := bufio.NewReader(bytes.NewReader(frame[:len(frame)-3]))
+	if _, err := decodeBatch(r, make(map[uint64]forwardedText)); err == nil {
+		t.Errorf("Expected error decoding truncated frame")
+	}
+}
+
+func TestForwardHugeCount(t *testing.T) {
+	// A frame of nothing but a version and an absurd event count.
+	frame := []byte{11, 0, 0, 0, FORWARD_VERSION,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	r := bufio.NewReader(bytes.NewReader(frame))
+	if _, err := decodeBatch(r, make(map[uint64]forwardedText)); err == nil {
+		t.Errorf("Expected error decoding a frame claiming too many events")
+	}
+}
+
+func TestForwarderStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	// Connect the forwarder with a full batch, then stop it with one pending.
+	startForwarder(listener.Addr().String())
+	for i := 0; i < FORWARD_BATCH; i++ {
+		forwardEvent(&queryEvent{text: "select ?", hash: fingerprintHash("select ?")})
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %s", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	dict := make(map[uint64]forwardedText)
+	if batch, err := decodeBatch(r, dict); err != nil || len(batch) != FORWARD_BATCH {
+		t.Fatalf("For the first batch\n    Got %d events, %v\n    Expected %d", len(batch), err,
+			FORWARD_BATCH)
+	}
+
+	forwardEvent(&queryEvent{text: "select ?", hash: fingerprintHash("select ?")})
+	stopForwarder()
+	if forwardQueue != nil {
+		t.Errorf("For the queue\n    Got %v\n    Expected it gone", forwardQueue)
+	}
+	if batch, err := decodeBatch(r, dict); err != nil || len(batch) != 1 {
+		t.Errorf("For the last batch\n    Got %d events, %v\n    Expected 1", len(batch), err)
+	}
+	if _, err := decodeBatch(r, dict); err != io.EOF {
+		t.Errorf("For the connection\n    Got %v\n    Expected it closed", err)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Format, opts.Collect = "#q", "127.0.0.1:0"
+	s, err := New(opts)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	defer func() { collecting = false }()
+	qbuf, querycount = make(map[string]*queryData), 0
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		s.Stop()
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	conn.Write(encodeBatch([]*queryEvent{&queryEvent{time: time.Now(),
+		server: "10.0.0.1:3306", client: "10.0.0.2:50000", hash: fingerprintHash("select ?"),
+		text: "select ?", latency: 1500000, bytes: 120}}, make(map[uint64]bool)))
+
+	var snap *Snapshot
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if snap = s.Snapshot(); snap.Queries > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+	s.Stop() // does nothing the second time
+	if snap.Queries != 1 || len(snap.Stats) != 1 || snap.Stats[0].Key != "select ?" ||
+		snap.Stats[0].Servers["10.0.0.1:3306"] != 1 {
+		t.Errorf("For the collected event\n    Got %+v\n    Expected select ? from 10.0.0.1",
+			snap)
+	}
+	if s.listener != nil {
+		t.Errorf("For the listener\n    Got %v\n    Expected it closed", s.listener)
+	}
+}
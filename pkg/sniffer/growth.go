@@ -0,0 +1,73 @@
+/*
+ * growth.go
+ *
+ * Rates over the last status interval compared to the one before it, so the
+ * growth sort can show what just got hot instead of the usual heavy hitters.
+ *
+ */
+
+package sniffer
+
+import (
+	"math"
+)
+
+const (
+	// Queries need this many executions in both intervals to be ranked by
+	// growth, since small counts make for noisy rates.
+	GROWTH_MIN_SAMPLES = 10
+)
+
+var growthRelative bool = false
+
+// lastStatus is when the current interval started, and prevInterval is how
+// long the previous one was, in seconds.
+var lastStatus int64 = UnixNow()
+var prevInterval float64
+
+// growth returns how much the rate of a query went up in the current interval
+// compared to the previous one, in qps or relative to the previous rate. Queries
+// without enough samples get -Inf so they sort last.
+func growth(qdata *queryData, now int64) float64 {
+	qdata.roll()
+	cur := qdata.count - qdata.mark
+	interval := float64(now - lastStatus)
+	if cur < GROWTH_MIN_SAMPLES || qdata.prevDelta < GROWTH_MIN_SAMPLES || interval <= 0 ||
+		prevInterval <= 0 {
+		return math.Inf(-1)
+	}
+
+	rate, prevRate := float64(cur)/interval, float64(qdata.prevDelta)/prevInterval
+	if growthRelative {
+		return (rate - prevRate) / prevRate
+	}
+	return rate - prevRate
+}
+
+// intervals counts the intervals that have ended. Rather than markInterval
+// going through every query, each catches up on the intervals it missed when
+// it's next counted or looked at.
+var intervals uint64
+
+// markInterval ends the current interval.
+func markInterval(now int64) {
+	intervals++
+	prevInterval, lastStatus = float64(now-lastStatus), now
+}
+
+// roll brings the marks of a query up to the current interval. Anything
+// counting against a query, or reading its marks, rolls it first.
+func (self *queryData) roll() {
+	switch intervals - self.interval {
+	case 0:
+		return
+	case 1:
+		self.prevDelta = self.count - self.mark
+	default:
+		// Nothing came in during the intervals after the one it was last in.
+		self.prevDelta = 0
+	}
+	self.mark, self.bytesMark, self.errorsMark = self.count, self.bytes, self.errors
+	self.arrivals.reset()
+	self.interval = intervals
+}
@@ -0,0 +1,33 @@
+package sniffer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGrowth(t *testing.T) {
+	defer func() { growthRelative = false }()
+	qbuf = map[string]*queryData{"steady": {count: 100}, "hot": {count: 20}, "rare": {count: 5}}
+	lastStatus, prevInterval, intervals = 0, 0, 0
+	markInterval(10)
+
+	// As aggregate does, catching up on the interval before counting.
+	for q, n := range map[string]uint64{"steady": 100, "hot": 200, "rare": 50} {
+		qbuf[q].roll()
+		qbuf[q].count += n
+	}
+
+	for _, relative := range []bool{false, true} {
+		growthRelative = relative
+		for q, expected := range map[string]float64{
+			"steady": 0,
+			"hot":    map[bool]float64{false: 18, true: 9}[relative],
+			"rare":   math.Inf(-1),
+		} {
+			if got := growth(qbuf[q], 20); got != expected {
+				t.Errorf("For growth of %s (relative=%t)\n    Got %f\n    Expected %f", q,
+					relative, got, expected)
+			}
+		}
+	}
+}
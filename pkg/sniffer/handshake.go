@@ -0,0 +1,194 @@
+/*
+ * handshake.go
+ *
+ * Parsing of the MySQL connection setup, so we can learn things about a
+ * connection (like who is on the other end) when we see it being opened, or
+ * when COM_CHANGE_USER logs it in again as someone else (as poolers like
+ * ProxySQL do when handing a backend connection to another user).
+ *
+ */
+
+package sniffer
+
+import (
+	"bytes"
+)
+
+const (
+	// MySQL capability flags
+	CLIENT_CONNECT_WITH_DB                = 0x00000008
+	CLIENT_PROTOCOL_41                    = 0x00000200
+	CLIENT_SECURE_CONNECTION              = 0x00008000
+	CLIENT_PLUGIN_AUTH                    = 0x00080000
+	CLIENT_CONNECT_ATTRS                  = 0x00100000
+	CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA = 0x00200000
+)
+
+// parseHandshakeResponse tries to interpret the start of a request stream as the
+// client's HandshakeResponse packet. It returns the username and the database
+// logged into, if any, if the data looks like one.
+func parseHandshakeResponse(data []byte) (user, db string, ok bool) {
+	user, db, _, ok = parseHandshake(data)
+	return user, db, ok
+}
+
+// parseHandshake is parseHandshakeResponse, also returning the connection
+// attributes the client sent, if any.
+func parseHandshake(data []byte) (user, db string, attrs map[string]string, ok bool) {
+	if len(data) < 4 {
+		return "", "", nil, false
+	}
+
+	// The handshake response is always the second packet of the connection.
+	size := int(data[0]) + int(data[1])<<8 + int(data[2])<<16
+	if data[3] != 1 || len(data) < size+4 {
+		return "", "", nil, false
+	}
+	payload := data[4 : size+4]
+	if len(payload) < 2 {
+		return "", "", nil, false
+	}
+	caps := uint32(payload[0]) | uint32(payload[1])<<8
+	if caps&CLIENT_PROTOCOL_41 == 0 {
+		user, db, ok = parseOldHandshakeResponse(payload, caps)
+		return user, db, nil, ok
+	}
+
+	// 4 bytes capabilities, 4 bytes max packet size, 1 byte charset and 23 bytes
+	// of zeroed filler, then the NUL terminated username.
+	if len(payload) < 33 {
+		return "", "", nil, false
+	}
+	caps |= uint32(payload[2])<<16 | uint32(payload[3])<<24
+	for _, b := range payload[9:32] {
+		if b != 0 {
+			return "", "", nil, false
+		}
+	}
+	user, pos, ok := nulString(payload, 32)
+	if !ok {
+		return "", "", nil, false
+	}
+
+	// Then the auth response, with its length in front, and the database.
+	var auth int
+	switch {
+	case caps&CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA != 0:
+		size := lenencSize(payload[pos:])
+		if size == 0 {
+			return user, "", nil, true
+		}
+		length := lenencInt(payload[pos:])
+		if uint64(len(payload)-pos) < length {
+			return user, "", nil, true
+		}
+		pos, auth = pos+size, int(length)
+	case caps&CLIENT_SECURE_CONNECTION != 0:
+		if pos >= len(payload) {
+			return user, "", nil, true
+		}
+		pos, auth = pos+1, int(payload[pos])
+	default:
+		if _, pos, ok = nulString(payload, pos); !ok {
+			return user, "", nil, true
+		}
+	}
+	pos += auth
+	if caps&CLIENT_CONNECT_WITH_DB != 0 {
+		if db, pos, ok = nulString(payload, pos); !ok {
+			return user, "", nil, true
+		}
+	}
+
+	// Then the auth plugin, and the attributes, a length encoded block of
+	// length encoded keys and values.
+	if caps&CLIENT_PLUGIN_AUTH != 0 {
+		if _, pos, ok = nulString(payload, pos); !ok {
+			return user, db, nil, true
+		}
+	}
+	if caps&CLIENT_CONNECT_ATTRS != 0 {
+		if block, _, ok := lenencBytes(payload, pos); ok {
+			attrs = parseConnectAttrs(block)
+		}
+	}
+	return user, db, attrs, true
+}
+
+// parseConnectAttrs reads the keys and values of connection attributes.
+func parseConnectAttrs(block []byte) map[string]string {
+	attrs := make(map[string]string)
+	for pos := 0; pos < len(block); {
+		key, next, ok := lenencBytes(block, pos)
+		if !ok {
+			break
+		}
+		value, after, ok := lenencBytes(block, next+len(key))
+		if !ok {
+			break
+		}
+		attrs[string(key)] = string(value)
+		pos = after + len(value)
+	}
+	return attrs
+}
+
+// parseOldHandshakeResponse reads a pre-4.1 HandshakeResponse: 2 bytes
+// capabilities and 3 bytes max packet size, then the NUL terminated username
+// and scrambled password and the database, if any.
+func parseOldHandshakeResponse(payload []byte, caps uint32) (user, db string, ok bool) {
+	user, pos, ok := nulString(payload, 5)
+	if !ok || user == "" {
+		return "", "", false
+	}
+	// Nothing else has a sequence of 1 from the client, but be sure it's a name.
+	for _, b := range []byte(user) {
+		if b < 0x20 || b == 0x7f {
+			return "", "", false
+		}
+	}
+	if caps&CLIENT_CONNECT_WITH_DB != 0 {
+		if _, pos, ok = nulString(payload, pos); ok {
+			db, _, _ = nulString(payload, pos)
+		}
+	}
+	return user, db, true
+}
+
+// parseChangeUser reads the username and database of a COM_CHANGE_USER: the
+// NUL terminated username, the auth response (with its length in front, for
+// clients with CLIENT_SECURE_CONNECTION) and the NUL terminated database.
+func parseChangeUser(payload []byte, secure bool) (user, db string, ok bool) {
+	user, pos, ok := nulString(payload, 0)
+	if !ok || user == "" {
+		return "", "", false
+	}
+	for _, b := range []byte(user) {
+		if b < 0x20 || b == 0x7f {
+			return "", "", false
+		}
+	}
+	if secure {
+		if pos >= len(payload) {
+			return user, "", true
+		}
+		pos += 1 + int(payload[pos])
+	} else if _, pos, ok = nulString(payload, pos); !ok {
+		return user, "", true
+	}
+	db, _, _ = nulString(payload, pos)
+	return user, db, true
+}
+
+// nulString returns the NUL terminated string at pos and the position after it,
+// or false if it isn't terminated.
+func nulString(data []byte, pos int) (string, int, bool) {
+	if pos >= len(data) {
+		return "", pos, false
+	}
+	end := bytes.IndexByte(data[pos:], 0)
+	if end < 0 {
+		return "", pos, false
+	}
+	return string(data[pos : pos+end]), pos + end + 1, true
+}
@@ -0,0 +1,225 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+// makeHandshakeResponse builds a 4.1 style HandshakeResponse packet.
+func makeHandshakeResponse(user string) []byte {
+	payload := []byte{0x0d, 0xa2, 0x00, 0x00, 0, 0, 0, 1, 33}
+	payload = append(payload, make([]byte, 23)...)
+	payload = append(payload, []byte(user)...)
+	payload = append(payload, 0, 0)
+	return append([]byte{byte(len(payload)), 0, 0, 1}, payload...)
+}
+
+// makeDatabaseLogin builds a HandshakeResponse logging into a database, with a
+// length encoded auth response.
+func makeDatabaseLogin(user, db string) []byte {
+	payload := []byte{0x0d, 0xa2, 0x20, 0x00, 0, 0, 0, 1, 33}
+	payload = append(payload, make([]byte, 23)...)
+	payload = append(payload, []byte(user)...)
+	payload = append(payload, 0, 4, 1, 2, 3, 4)
+	payload = append(payload, []byte(db)...)
+	return mysqlPacket(1, append(payload, 0)...)
+}
+
+func TestHandshakeResponse(t *testing.T) {
+	user, db, ok := parseHandshakeResponse(makeHandshakeResponse("app_rw"))
+	if !ok || user != "app_rw" || db != "" {
+		t.Errorf("Got user %s, database %q (ok=%t), expected app_rw and none", user, db, ok)
+	}
+
+	// Logging into a database, with the auth response's length in front of it.
+	login := makeDatabaseLogin("app_rw", "shop")
+	if user, db, ok := parseHandshakeResponse(login); !ok || user != "app_rw" || db != "shop" {
+		t.Errorf("For a login into shop\n    Got %s, %q (ok=%t)\n    Expected app_rw, shop",
+			user, db, ok)
+	}
+
+	// An auth response longer than the packet is as far as we get.
+	login = mysqlPacket(1, append(append(makeDatabaseLogin("app_rw", "")[4:43],
+		0xfe, 0x2b, 0, 0, 0, 0, 0, 0, 0x80), "shop\x00"...)...)
+	if user, db, ok := parseHandshakeResponse(login); !ok || user != "app_rw" || db != "" {
+		t.Errorf("For a login with a huge auth response\n    Got %s, %q (ok=%t)\n"+
+			"    Expected app_rw and no database", user, db, ok)
+	}
+
+	// A COM_QUERY is sequence 0 and should never be mistaken for a login.
+	query := []byte{9, 0, 0, 0, COM_QUERY, 's', 'e', 'l', 'e', 'c', 't', ' ', '1'}
+	if _, _, ok := parseHandshakeResponse(query); ok {
+		t.Errorf("Query parsed as a handshake response")
+	}
+
+	// Pre-4.1 clients send 2 bytes of capabilities and 3 of max packet size.
+	old := []byte{0x85, 0x20, 0, 0, 1, 'l', 'e', 'g', 'a', 'c', 'y', 0}
+	old = append(old, []byte("abcdefgh")...)
+	if user, _, ok := parseHandshakeResponse(mysqlPacket(1, old...)); !ok || user != "legacy" {
+		t.Errorf("For an old style handshake response\n    Got %s (ok=%t)\n    Expected legacy",
+			user, ok)
+	}
+	old = append(old, []byte("\x00shop\x00")...)
+	old[0] |= CLIENT_CONNECT_WITH_DB
+	if _, db, ok := parseHandshakeResponse(mysqlPacket(1, old...)); !ok || db != "shop" {
+		t.Errorf("For an old style login into shop\n    Got %q (ok=%t)\n    Expected shop", db, ok)
+	}
+}
+
+func TestUserFormat(t *testing.T) {
+	format = nil
+	parseFormat("#u:#q")
+
+	rs := &source{}
+	if key := formatQuery(rs, []byte("select 1")); key != "(unknown):select ?" {
+		t.Errorf("For a connection we didn't see log in\n    Got %s\n    Expected "+
+			"(unknown):select ?", key)
+	}
+	if user, _, ok := parseHandshakeResponse(makeHandshakeResponse("app_rw")); ok {
+		rs.user = user
+	}
+	if key := formatQuery(rs, []byte("select 1")); key != "app_rw:select ?" {
+		t.Errorf("For a connection logged in as app_rw\n    Got %s\n    Expected "+
+			"app_rw:select ?", key)
+	}
+}
+
+func TestDatabaseFormat(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	parseFormat("#d.#q")
+
+	client := [4]byte{10, 0, 0, 4}
+	ok := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...)
+	greeting := mysqlPacket(0, append([]byte{10}, "5.6.24\x00"...)...)
+
+	// Logged into shop, then switching to orders with COM_INIT_DB.
+	handlePacket(tcpPacket(client, 50000, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, greeting))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, makeDatabaseLogin("app", "shop")))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, mysqlPacket(2, 0, 0, 0, 2, 0, 0, 0)))
+	for _, request := range [][]byte{query,
+		mysqlPacket(0, append([]byte{COM_INIT_DB}, "orders"...)...), query} {
+		handlePacket(tcpPacket(client, 50000, true, TCP_ACK, request))
+		now = now.Add(time.Millisecond)
+		handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+	}
+
+	// And a connection we didn't see log in.
+	handlePacket(tcpPacket(client, 50001, true, TCP_ACK, query))
+	now = now.Add(time.Millisecond)
+	handlePacket(tcpPacket(client, 50001, false, TCP_ACK, ok))
+
+	for _, key := range []string{"shop.select ?", "orders.select ?", "(unknown).select ?"} {
+		if qdata := qbuf[key]; qdata == nil || qdata.count != 1 {
+			t.Errorf("For %s\n    Got %v\n    Expected one execution", key, qbuf)
+		}
+	}
+}
+
+func TestChangeUser(t *testing.T) {
+	change := append([]byte("reports\x00\x04abcd"), "stats\x00"...)
+	if user, db, ok := parseChangeUser(change, true); !ok || user != "reports" ||
+		db != "stats" {
+		t.Errorf("For a change to reports\n    Got %s, %q (ok=%t)\n    Expected reports, stats",
+			user, db, ok)
+	}
+	old := []byte("legacy\x00abcdefgh\x00shop\x00")
+	if user, db, ok := parseChangeUser(old, false); !ok || user != "legacy" || db != "shop" {
+		t.Errorf("For an old style change\n    Got %s, %q (ok=%t)\n    Expected legacy, shop",
+			user, db, ok)
+	}
+	if _, _, ok := parseChangeUser([]byte("\x01\x02"), true); ok {
+		t.Errorf("For garbage\n    Got a change of user\n    Expected none")
+	}
+
+	// Behind a pooler, the queries after the change are the new user's, and
+	// the auth switch in between isn't a query.
+	defer func() { trackUsers = false }()
+	trackUsers, users, qbuf, querycount = true, make(map[string]*userData),
+		make(map[string]*queryData), 0
+	rs := &source{}
+	processPacket(rs, true, makeDatabaseLogin("app_rw", "shop"))
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_CHANGE_USER}, change...)...))
+	processPacket(rs, false, mysqlPacket(1, append([]byte{0xfe}, "mysql_native_password\x00"...)...))
+	processPacket(rs, true, mysqlPacket(2, 1, 2, 3, 4))
+	processPacket(rs, false, mysqlPacket(3, 0, 0, 0, 2, 0, 0, 0))
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select 2"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+	if rs.user != "reports" || rs.db != "stats" || querycount != 2 {
+		t.Errorf("For a change of user\n    Got %s, %q, %d queries\n    Expected reports, stats, 2",
+			rs.user, rs.db, querycount)
+	}
+	for _, name := range []string{"app_rw", "reports"} {
+		if user, ok := users[name]; !ok || user.count != 1 {
+			t.Errorf("For user %s\n    Got %v\n    Expected 1 query", name, users)
+		}
+	}
+}
+
+// makeAttrsLogin builds a HandshakeResponse as MySQL 8 connectors send it, with
+// the auth plugin and connection attributes.
+func makeAttrsLogin(user string, attrs ...string) []byte {
+	payload := []byte{0x05, 0xa2, 0x3a, 0x00, 0, 0, 0, 1, 33}
+	payload = append(payload, make([]byte, 23)...)
+	payload = append(payload, []byte(user)...)
+	payload = append(payload, 0, 4, 1, 2, 3, 4)
+	payload = append(payload, "caching_sha2_password\x00"...)
+	var block []byte
+	for _, attr := range attrs {
+		block = append(append(block, byte(len(attr))), attr...)
+	}
+	payload = append(append(payload, byte(len(block))), block...)
+	return mysqlPacket(1, payload...)
+}
+
+func TestConnectAttrs(t *testing.T) {
+	login := makeAttrsLogin("app", "_client_name", "libmysql", "_client_version", "8.0.21",
+		"program_name", "billing-api")
+	if user, _, attrs, ok := parseHandshake(login); !ok || user != "app" || len(attrs) != 3 ||
+		attrs["program_name"] != "billing-api" || attrs["_client_name"] != "libmysql" {
+		t.Errorf("For a login with attributes\n    Got %s, %v (ok=%t)\n    Expected app and 3 "+
+			"attributes", user, attrs, ok)
+	}
+
+	// With a value running past the end, the attributes before it are kept.
+	login = makeAttrsLogin("app", "_client_name", "libmysql", "program_name", "billing-api")
+	login[len(login)-12] = 0x40
+	if _, _, attrs, ok := parseHandshake(login); !ok || len(attrs) != 1 ||
+		attrs["_client_name"] != "libmysql" {
+		t.Errorf("For broken attributes\n    Got %v (ok=%t)\n    Expected only _client_name",
+			attrs, ok)
+	}
+
+	// Aggregating by program, with connections that didn't say as unknown.
+	defer func() { clock = time.Now }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	parseFormat("#p:#q")
+	client := [4]byte{10, 0, 0, 6}
+	greeting := mysqlPacket(0, append([]byte{10}, "8.0.21\x00"...)...)
+	ok := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...)
+	for i, login := range [][]byte{makeAttrsLogin("app", "program_name", "billing-api"),
+		makeAttrsLogin("cron", "_os", "Linux"), makeHandshakeResponse("legacy")} {
+		port := uint16(50000 + i)
+		handlePacket(tcpPacket(client, port, true, TCP_SYN, nil))
+		handlePacket(tcpPacket(client, port, false, TCP_ACK, greeting))
+		handlePacket(tcpPacket(client, port, true, TCP_ACK, login))
+		handlePacket(tcpPacket(client, port, false, TCP_ACK, mysqlPacket(2, 0, 0, 0, 2, 0, 0, 0)))
+		handlePacket(tcpPacket(client, port, true, TCP_ACK, query))
+		now = now.Add(time.Millisecond)
+		handlePacket(tcpPacket(client, port, false, TCP_ACK, ok))
+	}
+	for key, count := range map[string]uint64{"billing-api:select ?": 1, "(unknown):select ?": 2} {
+		if qdata := qbuf[key]; qdata == nil || qdata.count != count {
+			t.Errorf("For %s\n    Got %v\n    Expected %d executions", key, qbuf, count)
+		}
+	}
+}
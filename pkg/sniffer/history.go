@@ -0,0 +1,161 @@
+/*
+ * history.go
+ *
+ * An append-only CSV of every status interval, for graphing. Rows are only
+ * ever added, so the file can be read while we're still writing it:
+ *
+ *     time,hash,count,qps,p50_ms,p95_ms,p99_ms,bytes,errors,threads_running,
+ *     threads_connected,query,canonical
+ *
+ * The count, qps, bytes and errors are for the interval; the percentiles are
+ * over the recent samples we keep for each query. The threads are the server's
+ * over the interval with -admin-dsn, see serverload.go, and empty without.
+ * The canonical column is the canonicalizer version, since a new one can
+ * fingerprint the same queries differently and the history of those queries
+ * won't line up.
+ *
+ */
+
+package sniffer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+var history *csv.Writer
+var historyTop int
+var historyMatch *regexp.Regexp
+
+var historyHeader []string = []string{"time", "hash", "count", "qps", "p50_ms", "p95_ms",
+	"p99_ms", "bytes", "errors", "threads_running", "threads_connected", "query", "canonical"}
+
+// startHistory opens the history file for appending, writing the header if
+// the file is new. Files from another canonicalizer are appended to with a
+// warning, but files with other columns are refused.
+func startHistory(filename string) error {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == nil {
+		if strings.Join(header, ",") != strings.Join(historyHeader, ",") {
+			file.Close()
+			return fmt.Errorf("%s was written by another version with other columns", filename)
+		}
+		var last []string
+		for record, err := reader.Read(); err == nil; record, err = reader.Read() {
+			last = record
+		}
+		if len(last) == len(historyHeader) &&
+			last[len(last)-1] != strconv.Itoa(canonical.VERSION) {
+			log.Printf("%sWARNING: %s was written by canonicalizer version %s, this is %d, so "+
+				"the same queries may have different hashes before and after now%s", COLOR_RED,
+				filename, last[len(last)-1], canonical.VERSION, COLOR_DEFAULT)
+		}
+	} else if err != io.EOF {
+		file.Close()
+		return err
+	}
+
+	history = csv.NewWriter(file)
+	if header == nil {
+		history.Write(historyHeader)
+		history.Flush()
+	}
+	return history.Error()
+}
+
+// percentiles returns the given percentiles (0-100) of the samples, in
+// milliseconds.
+func percentiles(timings []uint64, pcts ...float64) []float64 {
+	return scaledPercentiles(timings, 1000000, pcts...)
+}
+
+// scaledPercentiles returns the given percentiles (0-100) of the samples,
+// divided by scale.
+func scaledPercentiles(values []uint64, scale float64, pcts ...float64) []float64 {
+	var samples []float64
+	for _, val := range values {
+		if val > 0 {
+			samples = append(samples, float64(val)/scale)
+		}
+	}
+	sort.Float64s(samples)
+
+	result := make([]float64, len(pcts))
+	if len(samples) == 0 {
+		return result
+	}
+	for i, pct := range pcts {
+		pos := int(pct / 100 * float64(len(samples)))
+		if pos >= len(samples) {
+			pos = len(samples) - 1
+		}
+		result[i] = samples[pos]
+	}
+	return result
+}
+
+// writeHistory appends the rows for the interval that's ending now: the busiest
+// queries in it, or the ones matching -history-match.
+func writeHistory(now int64) {
+	interval := float64(now - lastStatus)
+	if interval <= 0 {
+		interval = 1
+	}
+
+	var tmp sortableSlice
+	for q, c := range qbuf {
+		c.roll()
+		delta := c.count - c.mark
+		if delta == 0 || (historyMatch != nil && !historyMatch.MatchString(q)) {
+			continue
+		}
+		tmp = append(tmp, sortable{float64(delta), q})
+	}
+	sort.Sort(sort.Reverse(tmp))
+	if historyTop > 0 && len(tmp) > historyTop {
+		tmp = tmp[:historyTop]
+	}
+
+	stamp := time.Unix(now, 0).UTC().Format(time.RFC3339)
+	running, connected := loadColumns()
+	for _, row := range tmp {
+		c := qbuf[row.line]
+		pcts := percentiles(c.latencies(), 50, 95, 99)
+		history.Write([]string{
+			stamp,
+			fmt.Sprintf("%016x", fingerprintHash(row.line)),
+			strconv.FormatUint(c.count-c.mark, 10),
+			strconv.FormatFloat(float64(c.count-c.mark)/interval, 'f', 2, 64),
+			strconv.FormatFloat(pcts[0], 'f', 2, 64),
+			strconv.FormatFloat(pcts[1], 'f', 2, 64),
+			strconv.FormatFloat(pcts[2], 'f', 2, 64),
+			strconv.FormatUint(c.bytes-c.bytesMark, 10),
+			strconv.FormatUint(c.errors-c.errorsMark, 10),
+			running,
+			connected,
+			redactQuery(row.line),
+			strconv.Itoa(canonical.VERSION),
+		})
+	}
+	history.Flush()
+	if err := history.Error(); err != nil {
+		log.Printf("%sFailed to write history: %s%s", COLOR_RED, err.Error(), COLOR_DEFAULT)
+	}
+}
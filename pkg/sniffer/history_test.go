@@ -0,0 +1,99 @@
+package sniffer
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPercentiles(t *testing.T) {
+	var timings [TIME_BUCKETS]uint64
+	for i := 0; i < 100; i++ {
+		timings[i] = uint64(i+1) * 1000000
+	}
+	got := percentiles(timings[:], 50, 95, 99)
+	for i, expected := range []float64{51, 96, 100} {
+		if got[i] != expected {
+			t.Errorf("For percentile %d\n    Got %f\n    Expected %f", i, got[i], expected)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	defer func() { history, historyTop, historyMatch = nil, 0, nil }()
+	filename := filepath.Join(t.TempDir(), "history.csv")
+
+	qbuf = map[string]*queryData{
+		"select * from a": {count: 30, bytes: 300, errors: 1},
+		"select * from b": {count: 20, bytes: 200},
+		"select * from c": {count: 10},
+	}
+	lastStatus, historyTop, intervals = 0, 2, 0
+	for interval := int64(1); interval <= 2; interval++ {
+		// Reopening shouldn't write the header again.
+		if err := startHistory(filename); err != nil {
+			t.Fatalf("Failed to start history: %s", err.Error())
+		}
+		writeHistory(interval * 10)
+		markInterval(interval * 10)
+		qbuf["select * from c"].roll()
+		qbuf["select * from c"].count += 50
+	}
+	historyMatch = regexp.MustCompile("from b")
+	qbuf["select * from b"].roll()
+	qbuf["select * from b"].count++
+	writeHistory(30)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read history: %s", err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var got []string
+	for _, line := range lines {
+		fields := strings.Split(line, ",")
+		got = append(got, strings.Join(append(fields[:1:1], fields[2:4]...), " ")+" "+
+			fields[7]+" "+fields[8]+" "+fields[11])
+	}
+	expected := []string{
+		"time count qps bytes errors query",
+		"1970-01-01T00:00:10Z 30 3.00 300 1 select * from a",
+		"1970-01-01T00:00:10Z 20 2.00 200 0 select * from b",
+		"1970-01-01T00:00:20Z 50 5.00 0 0 select * from c",
+		"1970-01-01T00:00:30Z 1 0.10 0 0 select * from b",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("For history\n    Got %s\n    Expected %s", strings.Join(got, "\n    "),
+			strings.Join(expected, "\n    "))
+	}
+}
+
+func TestHistoryVersions(t *testing.T) {
+	defer func() { history = nil }()
+	dir := t.TempDir()
+
+	old := filepath.Join(dir, "old.csv")
+	os.WriteFile(old, []byte("time,hash,count,qps,p50_ms,p95_ms,p99_ms,bytes,errors,query\n"), 0644)
+	if err := startHistory(old); err == nil {
+		t.Errorf("For history with other columns\n    Got no error\n    Expected an error")
+	}
+
+	// Another canonicalizer only gets a warning, and we keep appending.
+	other := filepath.Join(dir, "other.csv")
+	os.WriteFile(other, []byte(strings.Join(historyHeader, ",")+"\n"+
+		"1970-01-01T00:00:10Z,0,1,0.10,1,1,1,0,0,,,select ?,0\n"), 0644)
+	if err := startHistory(other); err != nil {
+		t.Fatalf("For history from another canonicalizer\n    Got %s\n    Expected no error",
+			err.Error())
+	}
+	qbuf, lastStatus, historyTop, historyMatch = map[string]*queryData{"select ?": {count: 1}}, 0, 0, nil
+	intervals = 0
+	writeHistory(10)
+	data, _ := os.ReadFile(other)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 ||
+		!strings.HasSuffix(lines[2], ",,,select ?,1") {
+		t.Errorf("For appended history\n    Got %s\n    Expected a row for version 1", data)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * http.go
+ *
+ * The embedded HTTP listener: a JSON API for the current aggregate and a
+ * dashboard built on it. Everything is read-only, but for changing the targets
+ * with -http-targets, and all the data goes through the API, so the dashboard
+ * can't show anything a script couldn't get.
+ *
+ *     /                the dashboard
+ *     /api/status      the current Snapshot as JSON
+ *     /api/dictionary  the text behind the fingerprint hashes, see dictionary.go
+ *     /events          a WebSocket stream of completed queries, see events.go
+ *     /config/targets  the servers we sniff, POST to change them, see targets.go
+ *
+ */
+
+package sniffer
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The dashboard and anything it needs are embedded, since the database network
+// we're running on may well not reach the internet.
+//
+//go:embed web
+var webFiles embed.FS
+
+// httpListener is what we serve on, until stopHTTP.
+var httpListener net.Listener
+
+// startHTTP listens on addr and serves on it in the background.
+func startHTTP(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	httpListener = listener
+	log.Printf("Serving the dashboard and API on http://%s/", listener.Addr())
+	go func() {
+		err := http.Serve(listener, httpHandler())
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Failed to serve HTTP: %s", err.Error())
+		}
+	}()
+	return nil
+}
+
+// stopHTTP stops listening, leaving any requests in progress to finish.
+func stopHTTP() {
+	httpListener.Close()
+	httpListener = nil
+}
+
+// httpHandler returns the handler for all of the endpoints.
+func httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", readOnly(serveStatus))
+	mux.HandleFunc("/api/dictionary", readOnly(serveDictionary))
+	mux.HandleFunc("/events", readOnly(serveEvents))
+	if retargeter != nil {
+		mux.HandleFunc("/config/targets", serveTargets)
+	}
+	mux.HandleFunc("/", readOnly(serveDashboard))
+	return mux
+}
+
+// readOnly rejects anything that isn't a GET.
+func readOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "read only", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// sameOrigin says whether a request is from a page we served, or from
+// something other than a browser, which doesn't send an Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// serveStatus writes the current Snapshot.
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	parser.Lock()
+	snap := snapshot()
+	parser.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(snap)
+}
+
+// serveDashboard writes the dashboard page.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	page, err := webFiles.ReadFile("web/dashboard.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
@@ -0,0 +1,67 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	qbuf = map[string]*queryData{"select * from a": {count: 3, bytes: 30}}
+	server := httptest.NewServer(httpHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/status")
+	if err != nil {
+		t.Fatalf("Failed to get status: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	var snap Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		t.Fatalf("Failed to decode status: %s", err.Error())
+	}
+	if len(snap.Stats) != 1 || snap.Stats[0].Key != "select * from a" || snap.Stats[0].Count != 3 {
+		t.Errorf("For status\n    Got %+v\n    Expected select * from a with count 3", snap.Stats)
+	}
+}
+
+func TestHTTPDashboard(t *testing.T) {
+	server := httptest.NewServer(httpHandler())
+	defer server.Close()
+
+	for path, expected := range map[string]int{"/": 200, "/nope": 404} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %s", path, err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("For GET %s\n    Got %d\n    Expected %d", path, resp.StatusCode, expected)
+		}
+	}
+
+	resp, err := http.Post(server.URL+"/api/status", "text/plain", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("Failed to post: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("For POST /api/status\n    Got %d\n    Expected %d", resp.StatusCode,
+			http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPListenFails(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer taken.Close()
+	if err := startHTTP(taken.Addr().String()); err == nil {
+		stopHTTP()
+		t.Errorf("For %s\n    Got no error\n    Expected it in use", taken.Addr())
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * infile.go
+ *
+ * LOAD DATA LOCAL INFILE. The server answers the query with a 0xfb packet
+ * naming the file, and the client sends the file's contents as packets of no
+ * command at all, ending with an empty one, before the server's OK or ERR ends
+ * the response. The packets are cut wherever the file is, so a segment of the
+ * file can look like anything, commands included; while the file comes we only
+ * follow its packets, counting its bytes towards the query.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+)
+
+// infileTransfer is where we are in a file the client is sending.
+type infileTransfer struct {
+	header []byte // a packet header split across segments
+	left   int    // bytes of the packet's payload still to come
+	bytes  uint64
+}
+
+// feedInfile follows the packets of the file a stream is sending, returning
+// what comes after the empty packet that ends it.
+func feedInfile(rs *source, data []byte) []byte {
+	inf := &rs.infile
+	for len(data) > 0 {
+		if inf.left > 0 {
+			n := inf.left
+			if n > len(data) {
+				n = len(data)
+			}
+			inf.left -= n
+			data = data[n:]
+			continue
+		}
+
+		need := 4 - len(inf.header)
+		if len(data) < need {
+			inf.header = append(inf.header, data...)
+			return nil
+		}
+		header := append(inf.header, data[:need]...)
+		inf.header = nil
+		data = data[need:]
+
+		size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		if size == 0 {
+			// The server's OK or ERR is next.
+			trace(rs, "LOCAL INFILE of %d bytes sent", inf.bytes)
+			stats.infile.transfers++
+			rs.resp.phase, rs.resp.seq = RES_FIRST, header[3]+1
+			rs.infile = infileTransfer{}
+			return data
+		}
+		inf.left = size
+		inf.bytes += uint64(size)
+		stats.infile.bytes += uint64(size)
+		switch rs.respTo {
+		case RESP_QUERY:
+			rs.qdata.bytes += uint64(size)
+		case RESP_FAST:
+			stats.fast.bytes += uint64(size)
+		}
+	}
+	return nil
+}
+
+// infileAnswered ends a file the server answered before we saw its end, since
+// we missed it or the server gave up on it.
+func infileAnswered(rs *source, data []byte) {
+	trace(rs, "answered before the end of the LOCAL INFILE")
+	rs.resp.phase = RES_FIRST
+	if len(data) >= 4 {
+		rs.resp.seq = data[3]
+	}
+	rs.infile = infileTransfer{}
+}
+
+// printInfile shows the files clients sent with LOAD DATA LOCAL INFILE.
+func printInfile(w io.Writer) {
+	if stats.infile.transfers == 0 {
+		return
+	}
+	reportf(w, "%d LOAD DATA LOCAL INFILE transfers, %s uploaded", stats.infile.transfers,
+		formatBytes(stats.infile.bytes))
+}
@@ -0,0 +1,57 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func TestInfile(t *testing.T) {
+	qbuf, format, querycount, stats.desyncs = make(map[string]*queryData), nil, 0, 0
+	stats.infile.transfers, stats.infile.bytes = 0, 0
+	parseFormat("#q")
+	rs := &source{synced: true}
+	load := mysqlPacket(0, append([]byte{COM_QUERY},
+		"load data local infile 'f' into table t"...)...)
+	ok := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+
+	// A file whose second segment starts with what looks like a query.
+	junk := append([]byte{9, 0, 0, 0, COM_QUERY}, "drop db"...)
+	chunk := append([]byte("1,2\n"), junk...)
+	file := append(mysqlPacket(2, chunk...), mysqlPacket(3, []byte("3,4\n")...)...)
+	file = append(file, mysqlPacket(4)...)
+	processPacket(rs, true, load)
+	processPacket(rs, false, mysqlPacket(1, 0xfb, 'f'))
+	processPacket(rs, true, file[:8])
+	processPacket(rs, true, file[8:len(file)-2])
+	processPacket(rs, true, file[len(file)-2:])
+	processPacket(rs, false, mysqlPacket(5, 0, 2, 0, 2, 0, 0, 0))
+
+	// And the stream goes on as before.
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...))
+	processPacket(rs, false, ok)
+
+	qdata := qbuf["load data local infile ? into table t"]
+	if querycount != 2 || qdata == nil || qbuf["select ?"] == nil || stats.desyncs != 0 ||
+		!rs.synced {
+		t.Fatalf("For a LOCAL INFILE\n    Got %d queries (%v), %d desyncs\n    Expected the "+
+			"load and the select, in sync", querycount, qbuf, stats.desyncs)
+	}
+	size := uint64(len(chunk) + 4)
+	if stats.infile.transfers != 1 || stats.infile.bytes != size ||
+		qdata.bytes < size {
+		t.Errorf("For the file\n    Got %d transfers of %d bytes, %d bytes for the query\n"+
+			"    Expected 1 of %d, counted for the query", stats.infile.transfers,
+			stats.infile.bytes, qdata.bytes, size)
+	}
+
+	// If we miss the end of the file, the server's answer ends it.
+	processPacket(rs, true, load)
+	processPacket(rs, false, mysqlPacket(1, 0xfb, 'f'))
+	processPacket(rs, true, mysqlPacket(2, []byte("1,2\n")...))
+	processPacket(rs, false, mysqlPacket(4, 0, 1, 0, 2, 0, 0, 0))
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...))
+	processPacket(rs, false, ok)
+	if qbuf["select ?"].count != 2 || stats.desyncs != 0 || stats.infile.transfers != 1 {
+		t.Errorf("For a file we missed the end of\n    Got %d selects, %d desyncs\n"+
+			"    Expected 2, none", qbuf["select ?"].count, stats.desyncs)
+	}
+}
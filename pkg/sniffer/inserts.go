@@ -0,0 +1,147 @@
+/*
+ * inserts.go
+ *
+ * Folding the column lists of INSERTs. ORMs write the columns of an insert in
+ * whatever order their models have, and leave out the ones without values, so
+ * one workload turns into many fingerprints:
+ *
+ *     insert into t (a, b, c) values (?)
+ *     insert into t (c, b, a) values (?)
+ *     insert into t (a, b) values (?)
+ *
+ * With -fold-insert-columns sort, the first two come out the same; with
+ * collapse, all three are "insert into t (…) values (?)". The table is kept.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+// How to fold insert columns, "" for not at all.
+var foldColumns string
+
+const (
+	FOLD_SORT     = "sort"
+	FOLD_COLLAPSE = "collapse"
+)
+
+// parseFold checks a -fold-insert-columns mode.
+func parseFold(mode string) (string, error) {
+	switch mode {
+	case "", FOLD_SORT, FOLD_COLLAPSE:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown insert column folding: %s", mode)
+}
+
+// foldSuffix is what the folding adds to the dictionary's normalization, and
+// foldOf reads it back.
+func foldSuffix(mode string) string {
+	if mode == "" {
+		return ""
+	}
+	return "+columns=" + mode
+}
+
+func foldOf(normalization string) string {
+	if i := strings.Index(normalization, "+columns="); i >= 0 {
+		return normalization[i+len("+columns="):]
+	}
+	return ""
+}
+
+// spanToken is a token with where it is in the query.
+type spanToken struct {
+	sqlToken
+	start, end int
+}
+
+// foldInsertColumns sorts or collapses the column list of an INSERT or
+// REPLACE, and leaves anything else alone.
+func foldInsertColumns(query string, mode string) string {
+	if mode == "" {
+		return query
+	}
+
+	var tokens []spanToken
+	data := []byte(query)
+	for i := skipSpaceAndComments(data, 0); i < len(data); i = skipSpaceAndComments(data, i) {
+		length, toktype := canonical.ScanToken(data[i:])
+		text := query[i : i+length]
+		if toktype == canonical.TOKEN_WORD {
+			text = strings.ToLower(text)
+		}
+		tokens = append(tokens, spanToken{sqlToken{toktype, text}, i, i + length})
+		i += length
+	}
+	text := func(pos int) string {
+		if pos >= len(tokens) {
+			return ""
+		}
+		return tokens[pos].text
+	}
+
+	if text(0) != "insert" && text(0) != "replace" {
+		return query
+	}
+	pos := 1
+	for text(pos) == "low_priority" || text(pos) == "delayed" || text(pos) == "high_priority" ||
+		text(pos) == "ignore" || text(pos) == "into" {
+		pos++
+	}
+
+	// The table, maybe quoted and with its schema.
+	table := pos
+	for pos < len(tokens) && (tokens[pos].toktype == canonical.TOKEN_WORD ||
+		text(pos) == "." || text(pos) == "`") {
+		pos++
+	}
+	if pos == table || text(pos) != "(" || text(pos+1) == "select" {
+		return query
+	}
+
+	open, depth := pos, 0
+	var columns []string
+	from := tokens[open].end
+	for ; pos < len(tokens); pos++ {
+		switch text(pos) {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ",":
+			if depth == 1 {
+				columns = append(columns, strings.TrimSpace(query[from:tokens[pos].start]))
+				from = tokens[pos].end
+			}
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	if pos >= len(tokens) {
+		return query
+	}
+	columns = append(columns, strings.TrimSpace(query[from:tokens[pos].start]))
+	if next := text(pos + 1); next != "values" && next != "value" && next != "select" &&
+		next != "(" {
+		return query
+	}
+
+	folded := "(…)"
+	if mode == FOLD_SORT {
+		sort.Slice(columns, func(i, j int) bool {
+			return strings.ToLower(strings.Trim(columns[i], "`")) <
+				strings.ToLower(strings.Trim(columns[j], "`"))
+		})
+		folded = "(" + strings.Join(columns, ", ") + ")"
+	}
+	return query[:tokens[open].start] + folded + query[tokens[pos].end:]
+}
@@ -0,0 +1,46 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func TestFoldInsertColumns(t *testing.T) {
+	tests := []struct {
+		query, sorted, collapsed string
+	}{
+		{"insert into t (c, b, a) values (?)", "insert into t (a, b, c) values (?)",
+			"insert into t (…) values (?)"},
+		{"INSERT IGNORE INTO db.`t` (`b`,`a`) VALUES (?)", "INSERT IGNORE INTO db.`t` (`a`, `b`) VALUES (?)",
+			"INSERT IGNORE INTO db.`t` (…) VALUES (?)"},
+		{"replace into t (b, a) select b, a from u", "replace into t (a, b) select b, a from u",
+			"replace into t (…) select b, a from u"},
+		{"insert into t values (?)", "insert into t values (?)", "insert into t values (?)"},
+		{"insert into t set a = ?", "insert into t set a = ?", "insert into t set a = ?"},
+		{"insert into t (select * from u)", "insert into t (select * from u)",
+			"insert into t (select * from u)"},
+		{"select * from t where (b, a) in (?)", "select * from t where (b, a) in (?)",
+			"select * from t where (b, a) in (?)"},
+	}
+	for _, test := range tests {
+		if got := foldInsertColumns(test.query, FOLD_SORT); got != test.sorted {
+			t.Errorf("For sorting %s\n    Got %s\n    Expected %s", test.query, got, test.sorted)
+		}
+		if got := foldInsertColumns(test.query, FOLD_COLLAPSE); got != test.collapsed {
+			t.Errorf("For collapsing %s\n    Got %s\n    Expected %s", test.query, got,
+				test.collapsed)
+		}
+		if got := foldInsertColumns(test.query, ""); got != test.query {
+			t.Errorf("For not folding %s\n    Got %s", test.query, got)
+		}
+	}
+
+	defer func() { foldColumns = "" }()
+	foldColumns = FOLD_SORT
+	if got := cleanupQuery([]byte("insert into t (b, a) values (1, 'x')")); got !=
+		"insert into t (a, b) values (?)" {
+		t.Errorf("For the fingerprint\n    Got %s\n    Expected insert into t (a, b) values (?)", got)
+	}
+	if got := normalization(); got != "canonical/1+columns=sort" {
+		t.Errorf("For the normalization\n    Got %s\n    Expected canonical/1+columns=sort", got)
+	}
+}
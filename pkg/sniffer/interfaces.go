@@ -0,0 +1,135 @@
+/*
+ * interfaces.go
+ *
+ * Listing the interfaces we could sniff on, whether we're allowed to, and
+ * which of them are seeing MySQL traffic.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akrennmair/gopcap"
+)
+
+type interfaceProbe struct {
+	iface   pcap.Interface
+	flags   string
+	err     string
+	packets int
+}
+
+// ListInterfaces prints every capture device, whether we can open it, and how
+// many packets on the port it saw while we watched it for the probe duration.
+func ListInterfaces(port uint16, probe time.Duration) error {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return fmt.Errorf("Failed to list interfaces: %s", err.Error())
+	}
+	if len(devs) == 0 {
+		log.Printf("No interfaces found. %s", permissionHint(""))
+		return nil
+	}
+
+	log.Printf("Probing %d interfaces for %s of traffic on port %d...", len(devs), probe, port)
+	probes := make([]*interfaceProbe, len(devs))
+	var wg sync.WaitGroup
+	for i, dev := range devs {
+		probes[i] = &interfaceProbe{iface: dev, flags: interfaceFlags(dev.Name)}
+		wg.Add(1)
+		go func(p *interfaceProbe) {
+			defer wg.Done()
+			p.packets, p.err = probeInterface(p.iface.Name, port, probe)
+		}(probes[i])
+	}
+	wg.Wait()
+
+	for _, p := range probes {
+		color := COLOR_DEFAULT
+		status := "no traffic"
+		switch {
+		case p.err != "":
+			color, status = COLOR_RED, "can't open: "+p.err
+		case p.packets > 0:
+			color, status = COLOR_GREEN, fmt.Sprintf("%d packets on port %d", p.packets, port)
+		}
+		log.Printf("%s%-12s%s %s  %s%s%s", COLOR_WHITE, p.iface.Name, COLOR_CYAN, p.flags,
+			color, status, COLOR_DEFAULT)
+		if p.iface.Description != "" {
+			log.Printf("    %s", p.iface.Description)
+		}
+		for _, addr := range p.iface.Addresses {
+			if addr.IP != nil {
+				log.Printf("    %s", addr.IP)
+			}
+		}
+		if hint := permissionHint(p.err); p.err != "" && hint != "" {
+			log.Printf("    %s%s%s", COLOR_YELLOW, hint, COLOR_DEFAULT)
+		}
+	}
+	return nil
+}
+
+// probeInterface counts the packets on the port an interface sees in the time
+// given, or returns why it couldn't be opened.
+func probeInterface(name string, port uint16, probe time.Duration) (int, string) {
+	iface, err := pcap.Openlive(name, 128, false, 100)
+	if iface == nil || err != nil {
+		if err != nil {
+			return 0, err.Error()
+		}
+		return 0, "unknown error"
+	}
+	defer iface.Close()
+	if err := iface.Setfilter(fmt.Sprintf("tcp port %d", port)); err != nil {
+		return 0, err.Error()
+	}
+
+	packets := 0
+	for deadline := time.Now().Add(probe); time.Now().Before(deadline); {
+		pkt, rv := iface.NextEx()
+		if rv < 0 {
+			break
+		}
+		if pkt != nil {
+			packets++
+		}
+	}
+	return packets, ""
+}
+
+// interfaceFlags describes the state of the interface as the OS sees it, since
+// pcap doesn't tell us.
+func interfaceFlags(name string) string {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "[        ]"
+	}
+	up, loopback := "down", "  "
+	if iface.Flags&net.FlagUp != 0 {
+		up = "up  "
+	}
+	if iface.Flags&net.FlagLoopback != 0 {
+		loopback = "lo"
+	}
+	return "[" + up + " " + loopback + "]"
+}
+
+// permissionHint explains the usual reason for failing to open an interface.
+// An empty error means we didn't find any at all, which is the same problem.
+func permissionHint(err string) string {
+	err = strings.ToLower(err)
+	if err == "" || strings.Contains(err, "permission") ||
+		strings.Contains(err, "not permitted") {
+		return "Sniffing needs root or the CAP_NET_RAW capability " +
+			"(setcap cap_net_raw,cap_net_admin=eip mysql-sniffer)."
+	}
+	return ""
+}
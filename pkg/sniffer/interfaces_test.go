@@ -0,0 +1,18 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func TestPermissionHint(t *testing.T) {
+	for err, hinted := range map[string]bool{
+		"": true,
+		"eth0: You don't have permission to capture on that device": true,
+		"socket: Operation not permitted":                           true,
+		"eth7: No such device exists":                               false,
+	} {
+		if (permissionHint(err) != "") != hinted {
+			t.Errorf("For error %q\n    Got %t\n    Expected %t", err, !hinted, hinted)
+		}
+	}
+}
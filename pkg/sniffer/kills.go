@@ -0,0 +1,72 @@
+/*
+ * kills.go
+ *
+ * KILL, whether as a statement or COM_PROCESS_KILL. Queries being killed on a
+ * primary is something to know about as it happens, not at the next status
+ * update, so each one is printed right away.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+// parseKill returns whether a KILL statement kills only the query rather than
+// the connection, and the thread it kills, or "?" if it isn't a literal.
+func parseKill(query []byte) (bool, string) {
+	tokens := lexQuery(query)
+	pos, onlyQuery := 1, false
+	switch {
+	case isWord(tokens, pos, "query"):
+		pos, onlyQuery = pos+1, true
+	case isWord(tokens, pos, "connection"):
+		pos++
+	}
+	if pos < len(tokens) && tokens[pos].toktype == canonical.TOKEN_NUMBER {
+		return onlyQuery, tokens[pos].text
+	}
+	return onlyQuery, "?"
+}
+
+// alertKill counts a kill and prints it.
+func alertKill(rs *source, onlyQuery bool, thread string) {
+	what := "connection"
+	if onlyQuery {
+		stats.kills.queries++
+		what = "query"
+	} else {
+		stats.kills.connections++
+	}
+	user := redactUser(rs.user)
+	if user == "" {
+		user = "(unknown)"
+	}
+	log.Printf("%s%s kill %s of thread %s from %s (user %s)%s", COLOR_RED,
+		clock().Format("2006/01/02 15:04:05"), what, thread, redactClient(rs.src), user,
+		COLOR_DEFAULT)
+}
+
+// killThread returns the thread a COM_PROCESS_KILL payload kills.
+func killThread(pdata []byte) string {
+	if len(pdata) < 4 {
+		return "?"
+	}
+	thread := uint64(pdata[0]) | uint64(pdata[1])<<8 | uint64(pdata[2])<<16 | uint64(pdata[3])<<24
+	return strconv.FormatUint(thread, 10)
+}
+
+// printKills shows the kills seen since the start.
+func printKills(w io.Writer) {
+	if stats.kills.connections+stats.kills.queries == 0 {
+		return
+	}
+	reportf(w, "%s%d kills: %d of connections, %d of queries%s", COLOR_RED,
+		stats.kills.connections+stats.kills.queries, stats.kills.connections,
+		stats.kills.queries, COLOR_DEFAULT)
+}
@@ -0,0 +1,75 @@
+package sniffer
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKill(t *testing.T) {
+	tests := []struct {
+		query     string
+		onlyQuery bool
+		thread    string
+	}{
+		{"KILL 1234", false, "1234"},
+		{"kill connection 77", false, "77"},
+		{"KILL QUERY 98765", true, "98765"},
+		{"kill query ?", true, "?"},
+		{"/* pt-kill */ kill @id", false, "?"},
+	}
+	for _, test := range tests {
+		if onlyQuery, thread := parseKill([]byte(test.query)); onlyQuery != test.onlyQuery ||
+			thread != test.thread {
+			t.Errorf("For %s\n    Got %t, %s\n    Expected %t, %s", test.query, onlyQuery,
+				thread, test.onlyQuery, test.thread)
+		}
+	}
+}
+
+func TestKillAlerts(t *testing.T) {
+	defer func() { clock = time.Now }()
+	clock = func() time.Time { return time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC) }
+	qbuf, format, querycount = make(map[string]*queryData), nil, 0
+	stats.kills.connections, stats.kills.queries = 0, 0
+	parseFormat("#q")
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	rs := &source{synced: true, src: "10.0.0.8:50000", user: "dba"}
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "KILL QUERY 4242"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+	processPacket(rs, true, mysqlPacket(0, COM_PROCESS_KILL, 0x39, 0x30, 0, 0))
+	processPacket(rs, false, mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0))
+
+	for _, expected := range []string{
+		"2015/06/17 12:00:00 kill query of thread 4242 from 10.0.0.8:50000 (user dba)",
+		"2015/06/17 12:00:00 kill connection of thread 12345 from 10.0.0.8:50000 (user dba)",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("For the kills\n    Got %q\n    Expected %q", out.String(), expected)
+		}
+	}
+	if stats.kills.connections != 1 || stats.kills.queries != 1 || !rs.synced {
+		t.Errorf("For the kills\n    Got %+v, synced %v\n    Expected one of each, in sync",
+			stats.kills, rs.synced)
+	}
+
+	out.Reset()
+	printKills(&out)
+	if !strings.Contains(out.String(), "2 kills: 1 of connections, 1 of queries") {
+		t.Errorf("For the status\n    Got %q\n    Expected the kills counted", out.String())
+	}
+
+	redacting = true
+	defer func() { redacting = false }()
+	out.Reset()
+	alertKill(rs, true, "4242")
+	if strings.Contains(out.String(), "10.0.0.8") || strings.Contains(out.String(), "dba") {
+		t.Errorf("For the redacted kill\n    Got %q\n    Expected no client or user", out.String())
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * large.go
+ *
+ * Commands of 16MB and over. The protocol splits a payload that big into
+ * packets of 0xffffff bytes followed by a shorter one (empty if need be), and
+ * only the first has the command byte. Without putting them back together a
+ * big multi-row INSERT or blob write is a query followed by garbage, and the
+ * stream desyncs.
+ *
+ * So a command packet of 0xffffff bytes starts a large payload on the stream,
+ * which takes every byte the client sends until the short packet ends it, and
+ * then goes on as the one command. We only keep up to -max-payload of it; past
+ * that we go on counting, and a query is counted as OVERSIZED_QUERY since its
+ * text would be cut off somewhere in the middle.
+ *
+ * This needs the whole of every packet, which live captures don't have, so in
+ * practice it's for reading pcap files captured without a snap length.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+)
+
+const (
+	MAX_PACKET          = 0xffffff
+	DEFAULT_MAX_PAYLOAD = 64 << 20
+
+	// Where queries we kept only some of are counted.
+	OVERSIZED_QUERY = "(query over -max-payload)"
+)
+
+var maxPayload uint64 = DEFAULT_MAX_PAYLOAD
+
+// largePayload is a command split over several packets.
+type largePayload struct {
+	ptype  int
+	data   []byte
+	bytes  uint64 // all of it, including what we didn't keep
+	capped bool
+
+	need   int    // of the current packet, still to come
+	last   bool   // the current packet is the last one
+	header []byte // of the next packet, as far as we have it
+	seq    byte   // that the next packet should have
+}
+
+var largeStats struct {
+	count  uint64
+	capped uint64
+	bytes  uint64
+}
+
+// startLarge starts a large payload from the first packet of a command, given
+// its type and what we have of its payload. It returns what comes after.
+func startLarge(rs *source, ptype int, data []byte) []byte {
+	trace(rs, "large payload")
+	rs.large = &largePayload{ptype: ptype, need: MAX_PACKET - 1, seq: 1, bytes: 1}
+	return feedLarge(rs, data)
+}
+
+// largeStart tells us whether a buffer starts with the first packet of a large
+// command.
+func largeStart(buf []byte) bool {
+	return len(buf) > 4 && buf[0] == 0xff && buf[1] == 0xff && buf[2] == 0xff && buf[3] == 0 &&
+		buf[4] <= COM_LAST
+}
+
+// feedLarge adds the bytes of a segment to the stream's large payload,
+// handling the command once it's whole. It returns what comes after.
+func feedLarge(rs *source, data []byte) []byte {
+	lp := rs.large
+	for len(data) > 0 {
+		if lp.need == 0 {
+			n := 4 - len(lp.header)
+			if n > len(data) {
+				n = len(data)
+			}
+			lp.header, data = append(lp.header, data[:n]...), data[n:]
+			if len(lp.header) < 4 {
+				return nil
+			}
+			size := int(lp.header[0]) | int(lp.header[1])<<8 | int(lp.header[2])<<16
+			if lp.header[3] != lp.seq {
+				desync(rs, DESYNC_SEQUENCE, "sequence gap in a large payload")
+				return nil
+			}
+			lp.need, lp.last, lp.header, lp.seq = size, size < MAX_PACKET, nil, lp.seq+1
+		}
+
+		n := lp.need
+		if n > len(data) {
+			n = len(data)
+		}
+		keep := n
+		if room := int(maxPayload) - len(lp.data); keep > room {
+			keep, lp.capped = room, true
+		}
+		lp.data = append(lp.data, data[:keep]...)
+		lp.bytes += uint64(n)
+		lp.need, data = lp.need-n, data[n:]
+		if lp.need == 0 && lp.last {
+			endLarge(rs)
+			return data
+		}
+	}
+	return nil
+}
+
+// endLarge handles a large payload that's whole.
+func endLarge(rs *source) {
+	lp := rs.large
+	rs.large = nil
+	largeStats.count++
+	largeStats.bytes += lp.bytes
+	trace(rs, "large payload of %d bytes", lp.bytes)
+	pdata := lp.data
+	if lp.capped {
+		largeStats.capped++
+		if lp.ptype == COM_QUERY {
+			pdata = []byte(OVERSIZED_QUERY)
+		}
+	}
+	handleRequest(rs, lp.ptype, pdata)
+}
+
+// printLarge prints how many large payloads we put back together.
+func printLarge(w io.Writer) {
+	if largeStats.count == 0 {
+		return
+	}
+	reportf(w, "%d payloads of 16MB and over (%s), %d over the %s cap", largeStats.count,
+		formatBytes(largeStats.bytes), largeStats.capped, formatBytes(maxPayload))
+}
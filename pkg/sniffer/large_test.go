@@ -0,0 +1,63 @@
+package sniffer
+
+import (
+	"strings"
+	"testing"
+)
+
+// largeQuery returns the segments of a query of over 16MB, and its length.
+func largeQuery() ([][]byte, int) {
+	payload := append([]byte{COM_QUERY}, "insert into t values "+
+		strings.Repeat("(1),", MAX_PACKET/4+100)+"(1)"...)
+	data := append(mysqlPacket(0, payload[:MAX_PACKET]...),
+		mysqlPacket(1, payload[MAX_PACKET:]...)...)
+
+	// Odd sized segments, so headers fall across them.
+	var segments [][]byte
+	for len(data) > 0 {
+		n := 65531
+		if n > len(data) {
+			n = len(data)
+		}
+		segments, data = append(segments, data[:n]), data[n:]
+	}
+	return segments, len(payload)
+}
+
+func TestLargePayload(t *testing.T) {
+	defer func() { maxPayload = DEFAULT_MAX_PAYLOAD }()
+	segments, size := largeQuery()
+	ok := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+
+	for _, test := range []struct {
+		max      uint64
+		expected string
+		capped   uint64
+	}{
+		{DEFAULT_MAX_PAYLOAD, "insert into t values ", 0},
+		{1 << 20, OVERSIZED_QUERY, 1},
+	} {
+		qbuf, format, querycount, maxPayload = make(map[string]*queryData), nil, 0, test.max
+		largeStats.count, largeStats.capped, largeStats.bytes = 0, 0, 0
+		parseFormat("#q")
+		rs := &source{synced: true}
+		for _, segment := range segments {
+			processPacket(rs, true, segment)
+		}
+		processPacket(rs, false, ok)
+
+		var key string
+		for key = range qbuf {
+		}
+		if querycount != 1 || len(qbuf) != 1 || !strings.HasPrefix(key, test.expected) ||
+			!rs.synced || rs.large != nil {
+			t.Errorf("For a large query capped at %d\n    Got %d queries, %.40q, synced %v\n"+
+				"    Expected one, %q", test.max, querycount, key, rs.synced, test.expected)
+		}
+		if largeStats.count != 1 || largeStats.capped != test.capped ||
+			largeStats.bytes != uint64(size) {
+			t.Errorf("For the counters capped at %d\n    Got %+v\n    Expected one of %d "+
+				"bytes, %d capped", test.max, largeStats, size, test.capped)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * latency.go
+ *
+ * How long a response took to the end. A query's latency is the time to the
+ * first packet of its response, which is when the server has done its
+ * thinking, but a report streaming megabytes of rows back keeps the client
+ * (and a server thread) busy until the last one. With -latency full the table
+ * shows the time to the last packet of the response instead, the end being the
+ * EOF, OK or ERR that closes it, or for responses we don't follow the last
+ * segment before the next command, with the average to the first packet in a
+ * column of its own.
+ *
+ */
+
+package sniffer
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	LATENCY_FIRST = "first"
+	LATENCY_FULL  = "full"
+)
+
+var latencyMode string = LATENCY_FIRST
+var fullTimes [TIME_BUCKETS]uint64
+
+// fullStats is the times of a query's responses to their last packet.
+type fullStats struct {
+	samples []uint64
+	timed   uint64
+	total   uint64
+	max     uint64
+}
+
+// recordFull records how long a stream's response took to its last packet,
+// now that it's over.
+func recordFull(rs *source) {
+	sent := rs.respSent
+	rs.respSent = time.Time{}
+	if latencyMode != LATENCY_FULL || sent.IsZero() || rs.qdata == nil ||
+		(rs.qempty && !includeEmpty) {
+		return
+	}
+	elapsed := uint64(rs.respLast.Sub(sent).Nanoseconds())
+	if elapsed == 0 {
+		return
+	}
+	trace(rs, "response over after %0.2fms", float64(elapsed)/1000000)
+	fullTimes[rand.Intn(TIME_BUCKETS)] = elapsed
+
+	full := rs.qdata.full
+	if full == nil {
+		full = &fullStats{samples: make([]uint64, timeBuckets)}
+		rs.qdata.full = full
+	}
+	full.samples[rand.Intn(len(full.samples))] = elapsed
+	full.timed++
+	full.total += elapsed
+	if elapsed > full.max {
+		full.max = elapsed
+	}
+}
+
+// firstAverage is the average time of a query's responses to their first
+// packet, in milliseconds.
+func (self *queryData) firstAverage() float64 {
+	if self.timed == 0 {
+		return 0
+	}
+	return float64(self.timeTotal) / float64(self.timed) / 1000000
+}
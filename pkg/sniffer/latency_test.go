@@ -0,0 +1,66 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFullLatency(t *testing.T) {
+	defer func() { clock, latencyMode = time.Now, LATENCY_FIRST }()
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+	coldef := []byte{3, 'd', 'e', 'f', 0, 0, 0, 1, 'a', 0, 0x0c, 0x3f, 0, 1, 0, 0, 0, 8, 0x81, 0,
+		0, 0, 0}
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select a from reports"...)...)
+
+	for _, mode := range []string{LATENCY_FIRST, LATENCY_FULL} {
+		qbuf, format, querycount, latencyMode = make(map[string]*queryData), nil, 0, mode
+		parseFormat("#q")
+		rs := &source{synced: true}
+
+		// The rows trickle in for a second after the first packet.
+		processPacket(rs, true, query)
+		now = now.Add(10 * time.Millisecond)
+		processPacket(rs, false, append(mysqlPacket(1, 1), mysqlPacket(2, coldef...)...))
+		now = now.Add(500 * time.Millisecond)
+		processPacket(rs, false, append(mysqlPacket(3, 0xfe, 0, 0, 2, 0), mysqlPacket(4, 1, '1')...))
+		now = now.Add(500 * time.Millisecond)
+		processPacket(rs, false, mysqlPacket(5, 0xfe, 0, 0, 2, 0))
+
+		qdata := qbuf["select a from reports"]
+		if qdata == nil {
+			t.Fatalf("For -latency %s\n    Got no query\n    Expected one", mode)
+		}
+		_, avg, _ := calculateTimes(qdata.latencies())
+		expected := map[string]float64{LATENCY_FIRST: 10, LATENCY_FULL: 1010}[mode]
+		if avg != expected || qdata.firstAverage() != 10 {
+			t.Errorf("For -latency %s\n    Got %0.2fms, %0.2fms to the first packet\n"+
+				"    Expected %0.2fms, 10ms", mode, avg, qdata.firstAverage(), expected)
+		}
+		if mode == LATENCY_FULL && sortValue("", qdata, "max") != 1010 {
+			t.Errorf("For sorting by max\n    Got %g\n    Expected 1010", sortValue("", qdata, "max"))
+		}
+	}
+
+	// A LOCAL INFILE is over with the OK after the file.
+	qbuf, format, latencyMode = make(map[string]*queryData), nil, LATENCY_FULL
+	parseFormat("#q")
+	rs := &source{synced: true}
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY},
+		"load data local infile 'f' into table t"...)...))
+	now = now.Add(time.Millisecond)
+	processPacket(rs, false, mysqlPacket(1, 0xfb, 'f'))
+	processPacket(rs, true, append(mysqlPacket(2, []byte("1,2\n")...), mysqlPacket(3)...))
+	now = now.Add(time.Millisecond)
+	processPacket(rs, false, mysqlPacket(4, 0, 1, 0, 2, 0, 0, 0))
+	now = now.Add(time.Second)
+	processPacket(rs, true, query)
+	if len(qbuf) != 1 {
+		t.Errorf("For a LOCAL INFILE\n    Got %d queries\n    Expected 1", len(qbuf))
+	}
+	for text, qdata := range qbuf {
+		if _, avg, _ := calculateTimes(qdata.latencies()); qdata.full == nil || avg != 2 {
+			t.Errorf("For a LOCAL INFILE\n    Got %s after %0.2fms\n    Expected 2ms", text, avg)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * lists.go
+ *
+ * The sizes of IN lists and multi-row VALUES, which canonicalization collapses
+ * away. Huge IN lists and one-row-at-a-time inserts both hide behind the same
+ * fingerprint as their well behaved versions.
+ *
+ */
+
+package sniffer
+
+var trackLists bool = false
+var listSizeWarn int
+
+// listStats keeps the list sizes seen for a fingerprint.
+type listStats struct {
+	count uint64
+	total uint64
+	max   int
+}
+
+func (self *listStats) record(size int) {
+	self.count++
+	self.total += uint64(size)
+	if size > self.max {
+		self.max = size
+	}
+}
+
+// avg returns the average list size, or 0 if we haven't seen any lists.
+func (self *listStats) avg() float64 {
+	if self.count == 0 {
+		return 0
+	}
+	return float64(self.total) / float64(self.count)
+}
+
+// listSize returns the number of rows in a VALUES clause or the length of the
+// longest IN list in a query, whichever is bigger, or 0 if it has neither.
+func listSize(query []byte) int {
+	tokens := lexQuery(query)
+	size := 0
+	for i := range tokens {
+		n := 0
+		if isWord(tokens, i, "in") {
+			n = inListLength(tokens, i+1)
+		} else if isWord(tokens, i, "values") || isWord(tokens, i, "value") {
+			n = valuesRows(tokens, i+1)
+		}
+		if n > size {
+			size = n
+		}
+	}
+	return size
+}
+
+// inListLength counts the items in the parenthesized list starting at pos.
+// Subqueries aren't lists.
+func inListLength(tokens []sqlToken, pos int) int {
+	if pos >= len(tokens) || tokens[pos].text != "(" || isWord(tokens, pos+1, "select") {
+		return 0
+	}
+
+	items, depth := 1, 0
+	for ; pos < len(tokens); pos++ {
+		switch tokens[pos].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return items
+			}
+		case ",":
+			if depth == 1 {
+				items++
+			}
+		}
+	}
+	return items
+}
+
+// valuesRows counts the parenthesized rows following VALUES.
+func valuesRows(tokens []sqlToken, pos int) int {
+	rows, depth := 0, 0
+	for ; pos < len(tokens); pos++ {
+		switch tokens[pos].text {
+		case "(":
+			if depth == 0 {
+				rows++
+			}
+			depth++
+		case ")":
+			depth--
+		case ",":
+		default:
+			if depth == 0 {
+				return rows
+			}
+		}
+	}
+	return rows
+}
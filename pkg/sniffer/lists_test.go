@@ -0,0 +1,22 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func listHelper(t *testing.T, query string, expected int) {
+	if size := listSize([]byte(query)); size != expected {
+		t.Errorf("For query %s\n    Got %d\n    Expected %d", query, size, expected)
+	}
+}
+
+func TestListSize(t *testing.T) {
+	listHelper(t, "select * from t where id = 1", 0)
+	listHelper(t, "select * from t where id in (1, 2, 'three')", 3)
+	listHelper(t, "select * from t where a in (1) and b IN (4,5,6,7)", 4)
+	listHelper(t, "select * from t where id in (select id from u where x in (1, 2))", 2)
+	listHelper(t, "select * from t where id in (f(1, 2), 3)", 2)
+	listHelper(t, "insert into t (a, b) values (1, 2)", 1)
+	listHelper(t, "insert into t (a, b) VALUES (1, 2), (3, f(4, 5)), (6, 7) on duplicate key update b = 1", 3)
+	listHelper(t, "insert into t value (1)", 1)
+}
@@ -0,0 +1,159 @@
+/*
+ * locking.go
+ *
+ * Tracking of statements that take explicit locks, since those are usually the
+ * ones behind lock wait timeouts and deadlocks.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type lockData struct {
+	count     uint64
+	total     uint64 // nanoseconds spent in this statement
+	lockWaits uint64
+	deadlocks uint64
+	clients   map[string]uint64
+}
+
+var trackLocks bool = false
+var locks map[string]*lockData = make(map[string]*lockData)
+var lockTimes [TIME_BUCKETS]uint64
+
+// isLockingStatement tells us whether the query takes explicit locks: SELECT ...
+// FOR UPDATE, SELECT ... LOCK IN SHARE MODE / FOR SHARE, or LOCK TABLES.
+func isLockingStatement(tokens []sqlToken) bool {
+	if isWord(tokens, 0, "lock") {
+		return isWord(tokens, 1, "tables") || isWord(tokens, 1, "table")
+	}
+	if !isWord(tokens, 0, "select") {
+		return false
+	}
+	for i := range tokens {
+		if isWord(tokens, i, "for") &&
+			(isWord(tokens, i+1, "update") || isWord(tokens, i+1, "share")) {
+			return true
+		}
+		if isWord(tokens, i, "lock") && isWord(tokens, i+1, "in") &&
+			isWord(tokens, i+2, "share") && isWord(tokens, i+3, "mode") {
+			return true
+		}
+	}
+	return false
+}
+
+// recordLockRequest checks whether the query is a locking statement, and if so
+// returns it for the response to be attributed to, and remembers it on the
+// source so any lock errors later in the transaction can be too.
+func recordLockRequest(rs *source, fingerprint string, query []byte) *lockData {
+	if !isLockingStatement(lexQuery(query)) {
+		return nil
+	}
+
+	ld, ok := locks[fingerprint]
+	if !ok {
+		ld = &lockData{clients: make(map[string]uint64)}
+		locks[fingerprint] = ld
+	}
+	ld.count++
+	ld.clients[clientOf(rs).id]++
+
+	for _, held := range rs.txnLocks {
+		if held == ld {
+			return ld
+		}
+	}
+	rs.txnLocks = append(rs.txnLocks, ld)
+	return ld
+}
+
+// recordLockResponse is called with the first response packet to a query. Lock
+// wait timeouts and deadlocks are blamed on every locking statement the
+// connection has issued in its current transaction.
+func recordLockResponse(rs *source, randn int, reqtime uint64, errcode int) {
+	if rs.lock != nil {
+		rs.lock.total += reqtime
+		lockTimes[randn] = reqtime
+		rs.lock = nil
+	}
+
+	switch errcode {
+	case ER_LOCK_WAIT_TIMEOUT:
+		stats.errors.lockWaits++
+		for _, ld := range rs.txnLocks {
+			ld.lockWaits++
+		}
+	case ER_LOCK_DEADLOCK:
+		stats.errors.deadlocks++
+		for _, ld := range rs.txnLocks {
+			ld.deadlocks++
+		}
+	}
+
+	if !rs.inTxn {
+		rs.txnLocks = nil
+	}
+}
+
+// printLocks shows the locking statements we've seen, their latency, and how
+// much of the lock trouble they're involved in.
+func printLocks(w io.Writer, displaycount int) {
+	if len(locks) == 0 {
+		return
+	}
+
+	var total uint64
+	var tmp sortableSlice = make(sortableSlice, 0, len(locks))
+	for fingerprint, ld := range locks {
+		total += ld.count
+		tmp = append(tmp, sortable{float64(ld.lockWaits + ld.deadlocks), fingerprint})
+	}
+	sort.Sort(sort.Reverse(tmp))
+
+	lmin, lavg, lmax := calculateTimes(lockTimes[:])
+	reportf(w, " ")
+	reportf(w, "%slocking: %d statements, %0.2fms min / %0.2fms avg / %0.2fms max, "+
+		"%d lock wait timeouts, %d deadlocks%s", COLOR_RED, total, lmin, lavg, lmax,
+		stats.errors.lockWaits, stats.errors.deadlocks, COLOR_DEFAULT)
+	reportf(w, "%s count  %s avg ms  %slockwait%%  deadlock%%%s", COLOR_YELLOW, COLOR_YELLOW,
+		COLOR_RED, COLOR_DEFAULT)
+
+	if len(tmp) < displaycount {
+		displaycount = len(tmp)
+	}
+	for _, item := range tmp[:displaycount] {
+		ld := locks[item.line]
+		reportf(w, "%s%6d  %s%7.2f  %s%8.1f%%  %8.1f%%  %s%s%s", COLOR_YELLOW, ld.count,
+			COLOR_YELLOW, float64(ld.total)/float64(ld.count)/1000000, COLOR_RED,
+			percentOf(ld.lockWaits, stats.errors.lockWaits),
+			percentOf(ld.deadlocks, stats.errors.deadlocks), COLOR_WHITE,
+			redactQuery(item.line), COLOR_DEFAULT)
+
+		var clients sortableSlice = make(sortableSlice, 0, len(ld.clients))
+		for client, count := range ld.clients {
+			clients = append(clients, sortable{float64(count), client})
+		}
+		sort.Sort(sort.Reverse(clients))
+		var top []string
+		for i := 0; i < len(clients) && i < 3; i++ {
+			top = append(top, fmt.Sprintf("%s (%d)", redactClient(clients[i].line),
+				uint64(clients[i].value)))
+		}
+		reportf(w, "        %sfrom %s%s", COLOR_CYAN, strings.Join(top, ", "), COLOR_DEFAULT)
+	}
+}
+
+// percentOf returns part as a percentage of total, or 0 if there is no total.
+func percentOf(part, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total) * 100
+}
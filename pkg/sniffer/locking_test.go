@@ -0,0 +1,33 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func TestLockingStatement(t *testing.T) {
+	for query, expected := range map[string]bool{
+		"select * from a where id=1 for update":             true,
+		"SELECT * FROM a WHERE id=1 LOCK IN SHARE MODE":     true,
+		"select * from a where id=1 for share":              true,
+		"lock tables a write, b read":                       true,
+		"select * from a where note='for update'":           false,
+		"select * from a /* for update */":                  false,
+		"update a set x=1 where id=1":                       false,
+		"select * from a where id=1 for update skip locked": true,
+	} {
+		if isLockingStatement(lexQuery([]byte(query))) != expected {
+			t.Errorf("For query %s expected %t", query, expected)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	errpkt := []byte{0x17, 0, 0, 1, 0xff, 0xb5, 0x04, '#', 'H', 'Y', '0', '0', '0'}
+	if code := parseErrorCode(errpkt); code != ER_LOCK_WAIT_TIMEOUT {
+		t.Errorf("Got error code %d, expected %d", code, ER_LOCK_WAIT_TIMEOUT)
+	}
+	okpkt := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+	if code := parseErrorCode(okpkt); code != 0 {
+		t.Errorf("Got error code %d for OK packet", code)
+	}
+}
@@ -0,0 +1,339 @@
+/*
+ * logs.go
+ *
+ * Reading queries from MySQL's general and slow query logs instead of off the
+ * wire, for when all you have is the logs.
+ *
+ */
+
+package sniffer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_GENERAL = iota
+	LOG_SLOW
+)
+
+// A general log entry looks like one of:
+//
+//	2015-06-17T12:00:00.123456Z	   10 Query	SELECT 1
+//	150617 12:00:00	   10 Query	SELECT 1
+//			   10 Query	SELECT 1
+//
+// and anything that doesn't is the continuation of a multi-line query.
+var generalEntry *regexp.Regexp = regexp.MustCompile(
+	`^(\d{4}-\d\d-\d\dT\S+|\d{6} +\d?\d:\d\d:\d\d)?\s+(\d+) ([A-Z][a-z]+(?: [A-Za-z]+)?)\t(.*)$`)
+
+// The "user@host" part of a general log Connect entry, or the User@Host line of
+// a slow log entry.
+var generalConnect *regexp.Regexp = regexp.MustCompile(`^(\S*)@(\S*) on (\S*)`)
+var slowUserHost *regexp.Regexp = regexp.MustCompile(
+	`^# User@Host: ([^\[\s]*)\[[^\]]*\] @ (\S*) \[([^\]]*)\](?:\s+Id:\s+(\d+))?`)
+var slowQueryTime *regexp.Regexp = regexp.MustCompile(`Query_time: ([\d.]+)`)
+
+var logTime time.Time
+
+// logReader reads lines from a log, optionally waiting for more to be written
+// when it reaches the end.
+type logReader struct {
+	r       *bufio.Reader
+	follow  bool
+	partial string
+}
+
+// readLine returns the next full line without its newline, or io.EOF when the
+// log is finished.
+func (self *logReader) readLine() (string, error) {
+	for {
+		line, err := self.r.ReadString('\n')
+		self.partial += line
+		if err == nil {
+			line, self.partial = strings.TrimRight(self.partial, "\r\n"), ""
+			return line, nil
+		}
+		if err != io.EOF {
+			return "", err
+		}
+		if !self.follow {
+			if self.partial != "" {
+				line, self.partial = self.partial, ""
+				return line, nil
+			}
+			return "", io.EOF
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// parseLogTime understands the timestamps used by the various MySQL versions.
+func parseLogTime(ts string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+		return t, true
+	}
+	if t, err := time.ParseInLocation("060102 15:04:05", strings.Join(strings.Fields(ts), " "),
+		time.Local); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// setLogTime moves our idea of "now" forward to the time in the log, so that
+// rates are calculated over the time the log covers.
+func setLogTime(t time.Time) {
+	if logTime.IsZero() {
+		start, lastStatus = t.Unix(), t.Unix()
+	}
+	if t.After(logTime) {
+		logTime = t
+	}
+}
+
+// RunLog reads queries from a general or slow log, printing a status update
+// every period (when following) and at the end.
+func RunLog(filename string, logtype int, follow bool, period time.Duration,
+	status func()) error {
+	var input io.Reader = os.Stdin
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return fmt.Errorf("Failed to open log: %s", err.Error())
+		}
+		defer file.Close()
+		input = file
+	}
+	reader := &logReader{r: bufio.NewReaderSize(input, 1024*1024), follow: follow}
+	clock = func() time.Time { return logTime }
+
+	log.Printf("Reading MySQL %s log from %s...",
+		map[int]string{LOG_GENERAL: "general", LOG_SLOW: "slow"}[logtype], filename)
+
+	// Periodic status updates are only useful when we might be reading forever.
+	if follow && !verbose {
+		ticker, done := time.NewTicker(period), make(chan bool)
+		defer func() {
+			ticker.Stop()
+			close(done)
+		}()
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					select {
+					case logStatus <- true:
+					default:
+						// One is already waiting to be printed.
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+	if logtype == LOG_GENERAL {
+		err = readGeneralLog(reader, status)
+	} else {
+		err = readSlowLog(reader, status)
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Failed to read log: %s", err.Error())
+	}
+	if !verbose {
+		status()
+	}
+	return nil
+}
+
+// logStatus asks the log reader to print a status update between entries, so
+// the reporting happens on the same goroutine as the aggregation.
+var logStatus chan bool = make(chan bool, 1)
+
+func checkLogStatus(status func()) {
+	select {
+	case <-logStatus:
+		status()
+	default:
+	}
+}
+
+// logSource returns the stand-in for a connection in the log, which is what the
+// format specifiers and filters look at.
+func logSource(sources map[string]*source, id, host string) *source {
+	rs, ok := sources[id]
+	if !ok {
+		rs = &source{src: "conn " + id, srcip: "(unknown)"}
+		sources[id] = rs
+	}
+	if host != "" {
+		rs.srcip = host
+		rs.src = host + " conn " + id
+	}
+	return rs
+}
+
+func readGeneralLog(reader *logReader, status func()) error {
+	sources := make(map[string]*source)
+
+	// Queries can span lines, so we only know one is done when the next entry
+	// starts (or the log ends).
+	var pending *source
+	var query string
+	flush := func() {
+		if pending != nil {
+			recordLogQuery(pending, query, 0)
+		}
+		pending = nil
+	}
+	defer flush()
+
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			return err
+		}
+
+		match := generalEntry.FindStringSubmatch(line)
+		if match == nil {
+			if pending != nil {
+				query += "\n" + line
+			}
+			continue
+		}
+		flush()
+		checkLogStatus(status)
+
+		if t, ok := parseLogTime(match[1]); ok {
+			setLogTime(t)
+		}
+		switch match[3] {
+		case "Connect":
+			rs := logSource(sources, match[2], "")
+			if conn := generalConnect.FindStringSubmatch(match[4]); conn != nil {
+				rs.user, rs.srcip, rs.src = conn[1], conn[2], conn[2]+" conn "+match[2]
+			}
+		case "Quit":
+			delete(sources, match[2])
+		case "Query", "Execute":
+			pending, query = logSource(sources, match[2], ""), match[4]
+		}
+	}
+}
+
+func readSlowLog(reader *logReader, status func()) error {
+	sources := make(map[string]*source)
+	var rs *source = logSource(sources, "0", "")
+	var latency time.Duration
+	var query []string
+	flush := func() {
+		if len(query) > 0 {
+			recordLogQuery(rs, strings.TrimSuffix(strings.Join(query, "\n"), ";"), latency)
+		}
+		query, latency = nil, 0
+	}
+	defer flush()
+
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case strings.HasPrefix(line, "# Time: "):
+			flush()
+			checkLogStatus(status)
+			if t, ok := parseLogTime(strings.TrimSpace(line[8:])); ok {
+				setLogTime(t)
+			}
+		case strings.HasPrefix(line, "# User@Host: "):
+			flush()
+			checkLogStatus(status)
+			if match := slowUserHost.FindStringSubmatch(line); match != nil {
+				host := match[3]
+				if host == "" {
+					host = match[2]
+				}
+				rs = logSource(sources, match[4], host)
+				rs.user = match[1]
+			}
+		case strings.HasPrefix(line, "# "):
+			if match := slowQueryTime.FindStringSubmatch(line); match != nil {
+				if secs, err := strconv.ParseFloat(match[1], 64); err == nil {
+					latency = time.Duration(secs * float64(time.Second))
+				}
+			}
+		case len(query) == 0 && strings.HasPrefix(line, "SET timestamp="):
+			if secs, err := strconv.ParseInt(strings.TrimSuffix(line[14:], ";"), 10, 64); err == nil {
+				setLogTime(time.Unix(secs, 0))
+			}
+		case len(query) == 0 && strings.HasPrefix(strings.ToLower(line), "use "):
+			// The slow log repeats the database, but it isn't a query.
+		case strings.HasPrefix(line, "/") || strings.HasPrefix(line, "Tcp port:") ||
+			strings.HasPrefix(line, "Time "):
+			// Server startup banner.
+		default:
+			query = append(query, line)
+		}
+	}
+}
+
+// recordLogQuery aggregates a query read from a log. A latency of 0 means the
+// log didn't tell us, so we only count it.
+func recordLogQuery(rs *source, query string, latency time.Duration) {
+	pdata := []byte(strings.TrimSpace(query))
+	if len(pdata) == 0 || !userAllowed(rs.user) || !verbAllowed(queryVerb(pdata)) {
+		return
+	}
+
+	querycount++
+	text := formatQuery(rs, pdata)
+	if groupShape {
+		text = queryShape(pdata)
+	}
+	reqtime := uint64(latency.Nanoseconds())
+
+	var qdata *queryData
+	if reqtime == 0 {
+		qdata = aggregate(text, string(pdata), 0, 0, uint64(len(pdata)), 0)
+	} else {
+		randn := rand.Intn(timeBuckets)
+		target := apdexThreshold(queryVerb(pdata))
+		times[randn] = reqtime
+		apdex.record(reqtime, target)
+		if latency < minLatency {
+			stats.fast.queries++
+			stats.fast.bytes += uint64(len(pdata))
+			return
+		}
+		qdata = aggregate(text, string(pdata), randn, reqtime, uint64(len(pdata)), target)
+	}
+	if groupShape {
+		if qdata.fingerprints == nil {
+			qdata.fingerprints = make(map[string]uint64)
+		}
+		qdata.fingerprints[formatQuery(rs, pdata)]++
+	}
+	if trackLists {
+		if size := listSize(pdata); size > 0 {
+			qdata.lists.record(size)
+		}
+	}
+
+	if verbose {
+		log.Printf("    %s%s %s## %sbytes: %d time: %0.2f%s\n", COLOR_GREEN, text, COLOR_RED,
+			COLOR_YELLOW, len(pdata), float64(reqtime)/1000000, COLOR_DEFAULT)
+	}
+}
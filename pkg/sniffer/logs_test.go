@@ -0,0 +1,60 @@
+package sniffer
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"time"
+)
+
+// readTestLog runs a log from testdata through the aggregation, starting from
+// a clean slate.
+func readTestLog(t *testing.T, filename string, logtype int) {
+	qbuf, format, querycount = make(map[string]*queryData), nil, 0
+	parseFormat("#q")
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", filename, err)
+	}
+	defer file.Close()
+
+	reader := &logReader{r: bufio.NewReader(file)}
+	if logtype == LOG_GENERAL {
+		err = readGeneralLog(reader, func() {})
+	} else {
+		err = readSlowLog(reader, func() {})
+	}
+	if err != nil && err.Error() != "EOF" {
+		t.Fatalf("Failed to read %s: %s", filename, err)
+	}
+}
+
+func TestGeneralLog(t *testing.T) {
+	readTestLog(t, "testdata/general.log", LOG_GENERAL)
+
+	if querycount != 3 {
+		t.Errorf("Got %d queries, expected 3", querycount)
+	}
+	if qdata, ok := qbuf["SELECT * FROM orders WHERE id = ?"]; !ok || qdata.count != 2 {
+		t.Errorf("Expected multi-line query to be aggregated with the single line one")
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	readTestLog(t, "testdata/slow.log", LOG_SLOW)
+
+	qdata, ok := qbuf["SELECT * FROM orders WHERE status = ?"]
+	if !ok || qdata.count != 2 {
+		t.Fatalf("Expected both queries to be aggregated together, got %v", qbuf)
+	}
+	if _, avg, max := calculateTimes(qdata.latencies()); avg != 500 || max != 750 {
+		t.Errorf("Got avg %0.2fms max %0.2fms, expected 500ms and 750ms", avg, max)
+	}
+}
+
+func TestRunLogMissing(t *testing.T) {
+	if err := RunLog("testdata/missing.log", LOG_GENERAL, false, time.Second, func() {}); err == nil {
+		t.Errorf("For a missing log\n    Got no error\n    Expected one")
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * loss.go
+ *
+ * Correcting for packets libpcap drops. When the capture can't keep up, the
+ * counts we report are short by however much was dropped, so every interval
+ * we scale the queries seen in it by the share of packets that got through,
+ * and report that estimate next to what we actually saw.
+ *
+ * Drops also cost us the request or response of some queries, which skews the
+ * latencies towards whatever survives, so above a small loss we say they're
+ * unreliable rather than correct them.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+
+	"github.com/akrennmair/gopcap"
+)
+
+const (
+	// Above this share of packets dropped in an interval, latencies are
+	// unreliable.
+	LOSS_UNRELIABLE = 0.01
+)
+
+var loss struct {
+	mark      pcap.Stat // libpcap's counters at the end of the last interval
+	queryMark int       // querycount then
+	interval  float64   // share of packets dropped in the last interval
+	estimated float64   // queries before the last interval, corrected for drops
+
+	// Totals across the capture.
+	received uint64
+	dropped  uint64
+}
+
+// recordLoss works out the drops in the interval ending now from libpcap's
+// counters (nil if there aren't any), and corrects the interval's queries.
+func recordLoss(pstats *pcap.Stat) {
+	loss.interval = 0
+	if pstats != nil {
+		// The counters are 32 bits and wrap. On Linux, received includes
+		// what was dropped by the kernel, but not by the interface.
+		received := uint64(pstats.PacketsReceived-loss.mark.PacketsReceived) +
+			uint64(pstats.PacketsIfDropped-loss.mark.PacketsIfDropped)
+		dropped := uint64(pstats.PacketsDropped-loss.mark.PacketsDropped) +
+			uint64(pstats.PacketsIfDropped-loss.mark.PacketsIfDropped)
+		loss.mark = *pstats
+		if received > 0 && dropped <= received {
+			loss.interval = float64(dropped) / float64(received)
+		}
+		loss.received += received
+		loss.dropped += dropped
+	}
+	loss.estimated = estimateQueries()
+	loss.queryMark = querycount
+}
+
+// estimateQueries returns how many queries there probably were. Those since the
+// last interval are corrected by its losses, as the best guess we have.
+func estimateQueries() float64 {
+	current := float64(querycount - loss.queryMark)
+	if loss.interval < 1 {
+		current /= 1 - loss.interval
+	}
+	return loss.estimated + current
+}
+
+// captureLoss returns the share of packets dropped over the whole capture.
+func captureLoss() float64 {
+	if loss.received == 0 {
+		return 0
+	}
+	return float64(loss.dropped) / float64(loss.received)
+}
+
+// latenciesReliable says whether few enough packets were dropped lately for the
+// latencies to mean much.
+func latenciesReliable() bool {
+	return loss.interval <= LOSS_UNRELIABLE
+}
+
+// printLoss shows the corrected rate, if we've dropped anything.
+func printLoss(w io.Writer, elapsed float64) {
+	if loss.dropped == 0 {
+		return
+	}
+	reportf(w, "%sobserved %0.2f qps; est. actual %0.2f ± capture losses %0.1f%% "+
+		"(%0.1f%% in the last interval)%s", COLOR_RED, float64(querycount)/elapsed,
+		estimateQueries()/elapsed, captureLoss()*100, loss.interval*100, COLOR_DEFAULT)
+}
@@ -0,0 +1,55 @@
+package sniffer
+
+import (
+	"math"
+	"testing"
+
+	"github.com/akrennmair/gopcap"
+)
+
+func TestCaptureLoss(t *testing.T) {
+	// The counters start near the top and wrap in the second interval.
+	loss.mark = pcap.Stat{PacketsReceived: math.MaxUint32 - 999}
+	loss.queryMark, loss.interval, loss.estimated = 0, 0, 0
+	loss.received, loss.dropped = 0, 0
+	querycount = 0
+
+	tests := []struct {
+		stat      pcap.Stat
+		queries   int
+		interval  float64
+		estimated float64
+		reliable  bool
+	}{
+		{pcap.Stat{PacketsReceived: math.MaxUint32 - 999}, 100, 0, 100, true},
+		{pcap.Stat{PacketsReceived: 1000, PacketsDropped: 100}, 90, 0.05, 100 + 90/0.95, false},
+		{pcap.Stat{PacketsReceived: 3000, PacketsDropped: 110}, 99, 0.005, 100 + 90/0.95 +
+			99/0.995, true},
+		{pcap.Stat{PacketsReceived: 4000, PacketsDropped: 110, PacketsIfDropped: 250}, 50, 0.2,
+			100 + 90/0.95 + 99/0.995 + 50/0.8, false},
+	}
+	for i, test := range tests {
+		querycount += test.queries
+		recordLoss(&test.stat)
+		if math.Abs(loss.interval-test.interval) > 1e-9 ||
+			math.Abs(estimateQueries()-test.estimated) > 1e-9 ||
+			latenciesReliable() != test.reliable {
+			t.Errorf("For interval %d\n    Got loss %f, %f queries, reliable %t\n"+
+				"    Expected loss %f, %f queries, reliable %t", i, loss.interval,
+				estimateQueries(), latenciesReliable(), test.interval, test.estimated,
+				test.reliable)
+		}
+	}
+	if expected := 360.0 / 5250; math.Abs(captureLoss()-expected) > 1e-9 {
+		t.Errorf("For the capture\n    Got loss %f\n    Expected %f", captureLoss(), expected)
+	}
+
+	// Offline, nothing is corrected.
+	querycount += 10
+	recordLoss(nil)
+	if !latenciesReliable() || math.Abs(estimateQueries()-(tests[3].estimated+10)) > 1e-9 {
+		t.Errorf("For no libpcap counters\n    Got %f queries, reliable %t\n"+
+			"    Expected %f, reliable", estimateQueries(), latenciesReliable(),
+			tests[3].estimated+10)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * memory.go
+ *
+ * A memory budget, so the sniffer can't run the host it's watching out of
+ * memory. We account roughly what each stream holds (its buffers, the payload
+ * history and queued commands) and what each query in the aggregate holds
+ * (mostly its latency samples, plus its text and dictionary entry), and when
+ * the total goes over -max-memory we shed, in this order:
+ *
+ *   - idle streams, largest first, which pick up again at their next query if
+ *     they ever come back
+ *   - the queries with the fewest executions, which are the least interesting
+ *     rows of the report
+ *
+ * until we're back under a margin below the budget. The accounting is an
+ * estimate of what we hold, not what the Go runtime has, so leave headroom.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Rough sizes of the structures themselves, with their map entries.
+	STREAM_OVERHEAD = 1024
+	QUERY_OVERHEAD  = 512
+
+	// How many packets between checks of the budget.
+	MEMORY_CHECK = 10000
+
+	// Streams without a packet for this long can be shed.
+	STREAM_IDLE = time.Minute
+)
+
+var maxMemory uint64 = 0
+var memoryTick int
+
+// ByteSize is a number of bytes, which as a flag takes suffixes like 512MB.
+type ByteSize uint64
+
+func (self *ByteSize) String() string {
+	return formatBytes(uint64(*self))
+}
+
+func (self *ByteSize) Set(value string) error {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	mult := uint64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   uint64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"K", 1 << 10}, {"M", 1 << 20},
+		{"G", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, mult = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size: %s", value)
+	}
+	*self = ByteSize(n * float64(mult))
+	return nil
+}
+
+// formatBytes shows a number of bytes in the largest unit that fits.
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// streamMemory estimates what a stream holds.
+func streamMemory(rs *source) uint64 {
+	size := STREAM_OVERHEAD + cap(rs.reqbuffer) + cap(rs.resbuffer) + len(rs.qtext) +
+		len(rs.qraw) + len(rs.qbound) + len(rs.resp.prefix) + cap(rs.zreq) + cap(rs.zres)
+	if rs.large != nil {
+		size += cap(rs.large.data)
+	}
+	for _, seg := range rs.history {
+		size += len(seg.data)
+	}
+	for _, cmd := range rs.queue {
+		size += 128 + len(cmd.text) + len(cmd.raw) + len(cmd.fprint) + len(cmd.stmt) +
+			len(cmd.bound)
+		for _, bq := range cmd.batch {
+			size += 32 + len(bq.text)
+		}
+	}
+	for _, bq := range rs.qbatch {
+		size += 32 + len(bq.text)
+	}
+	for _, stmt := range rs.stmts {
+		size += 48 + len(stmt.text) + len(stmt.types)
+	}
+	return uint64(size)
+}
+
+// queryMemory estimates what a query in the aggregate holds.
+func queryMemory(key string, qdata *queryData) uint64 {
+	size := QUERY_OVERHEAD + len(key) + len(qdata.splitOf) + 8*len(qdata.times)
+	if qdata.full != nil {
+		size += 32 + 8*len(qdata.full.samples)
+	}
+	for fingerprint := range qdata.fingerprints {
+		size += 32 + len(fingerprint)
+	}
+	for server := range qdata.servers {
+		size += 32 + len(server)
+	}
+	if entry := dictionary[fingerprintHash(key)]; entry != nil {
+		size += 64 + len(entry.Hash) + len(entry.Text) + len(entry.Sample)
+	}
+	return uint64(size)
+}
+
+// accountedMemory totals what we hold.
+func accountedMemory() uint64 {
+	var total uint64
+	for _, rs := range chmap {
+		total += streamMemory(rs)
+	}
+	for key, qdata := range qbuf {
+		total += queryMemory(key, qdata)
+	}
+	if detailLimit > 0 {
+		total += tierMemory()
+	}
+	return total
+}
+
+// checkMemory sheds what it takes to get back under the budget, if we're over.
+// Packets call it often, so it only looks every MEMORY_CHECK of them unless
+// forced to.
+func checkMemory(force bool) {
+	if maxMemory == 0 {
+		return
+	}
+	if memoryTick++; !force && memoryTick < MEMORY_CHECK {
+		return
+	}
+	memoryTick = 0
+	stats.memory.accounted = accountedMemory()
+	if stats.memory.accounted <= maxMemory {
+		return
+	}
+
+	// Shed down to 90% so we aren't back at it on the next check.
+	target := maxMemory / 10 * 9
+	over := stats.memory.accounted - target
+	var freed uint64
+
+	now := clock()
+	var idle sortableSlice
+	for src, rs := range chmap {
+		if now.Sub(rs.lastSeen) >= STREAM_IDLE {
+			idle = append(idle, sortable{float64(streamMemory(rs)), src})
+		}
+	}
+	sort.Sort(sort.Reverse(idle))
+	streams := 0
+	for _, item := range idle {
+		if freed >= over {
+			break
+		}
+		rs := chmap[item.line]
+		concEnd(rs)
+		delete(chmap, item.line)
+		freed += uint64(item.value)
+		streams++
+	}
+
+	var queries sortableSlice
+	if freed < over {
+		for key, qdata := range qbuf {
+			queries = append(queries, sortable{float64(qdata.count), key})
+		}
+		sort.Sort(queries)
+	}
+	dropped := 0
+	for _, item := range queries {
+		if freed >= over {
+			break
+		}
+		freed += queryMemory(item.line, qbuf[item.line])
+		delete(dictionary, fingerprintHash(item.line))
+		delete(qbuf, item.line)
+		dropped++
+	}
+
+	stats.memory.accounted -= freed
+	stats.memory.streams += uint64(streams)
+	stats.memory.queries += uint64(dropped)
+	stats.memory.shed += freed
+	log.Printf("%sOver the memory budget of %s: shed %d idle streams and %d queries, %s%s",
+		COLOR_RED, formatBytes(maxMemory), streams, dropped, formatBytes(freed), COLOR_DEFAULT)
+}
+
+// printMemory shows what we hold against the budget.
+func printMemory(w io.Writer) {
+	if maxMemory == 0 {
+		return
+	}
+	checkMemory(true)
+	reportf(w, "%s of %s memory budget / %d streams and %d queries shed so far",
+		formatBytes(stats.memory.accounted), formatBytes(maxMemory), stats.memory.streams,
+		stats.memory.queries)
+}
@@ -0,0 +1,61 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteSize(t *testing.T) {
+	for value, expected := range map[string]uint64{
+		"512MB": 512 << 20, "1g": 1 << 30, "64 KB": 64 << 10, "1000": 1000, "1.5M": 3 << 19,
+	} {
+		var size ByteSize
+		if err := size.Set(value); err != nil || uint64(size) != expected {
+			t.Errorf("For %s\n    Got %d, %v\n    Expected %d", value, size, err, expected)
+		}
+	}
+	var size ByteSize
+	if err := size.Set("lots"); err == nil {
+		t.Errorf("For lots\n    Got no error\n    Expected an error")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	defer func() { maxMemory, clock = 0, time.Now }()
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+	chmap, qbuf, dictionary = make(map[string]*source), make(map[string]*queryData),
+		make(map[uint64]*DictionaryEntry)
+	stats.memory.streams, stats.memory.queries = 0, 0
+
+	// An idle stream holding a lot, an idle one holding little, and a busy one.
+	chmap["big"] = &source{lastSeen: now.Add(-time.Hour), reqbuffer: make([]byte, 100000)}
+	chmap["small"] = &source{lastSeen: now.Add(-time.Hour)}
+	chmap["busy"] = &source{lastSeen: now, reqbuffer: make([]byte, 100000)}
+	for i, key := range []string{"select a", "select b", "select c"} {
+		qbuf[key] = &queryData{count: uint64(i + 1), times: make([]uint64, TIME_BUCKETS)}
+	}
+
+	// Room for everything but the big idle stream.
+	maxMemory = accountedMemory() - 50000
+	checkMemory(true)
+	if chmap["big"] != nil || chmap["small"] == nil || chmap["busy"] == nil || len(qbuf) != 3 {
+		t.Errorf("For a small overrun\n    Got %d streams, %d queries\n"+
+			"    Expected only the big idle stream shed", len(chmap), len(qbuf))
+	}
+
+	// Room for the busy stream and one query: the rarest queries go.
+	maxMemory = (STREAM_OVERHEAD + 100000 + QUERY_OVERHEAD + TIME_BUCKETS*8 + 100) * 10 / 9
+	checkMemory(true)
+	if chmap["small"] != nil || chmap["busy"] == nil || len(qbuf) != 1 || qbuf["select c"] == nil {
+		t.Errorf("For a big overrun\n    Got %d streams, %d queries\n"+
+			"    Expected the busy stream and the busiest query kept", len(chmap), len(qbuf))
+	}
+	if stats.memory.streams != 2 || stats.memory.queries != 2 {
+		t.Errorf("For the counters\n    Got %d streams, %d queries shed\n    Expected 2 and 2",
+			stats.memory.streams, stats.memory.queries)
+	}
+	if accounted := accountedMemory(); accounted > maxMemory {
+		t.Errorf("For what's left\n    Got %d\n    Expected under %d", accounted, maxMemory)
+	}
+}
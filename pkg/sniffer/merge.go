@@ -0,0 +1,274 @@
+/*
+ * merge.go
+ *
+ * One report over several hosts, after the fact. RunMerge reads Snapshots
+ * written as JSON (by /api/status, or -merge-json) and aggregates them as if
+ * we'd seen all their queries, so the status report and its options work over
+ * the lot, with each query's servers in the srvs column as when collecting.
+ *
+ * Snapshots only keep a histogram of each query's latencies, so that's what
+ * the merged samples are made from: the percentiles are as good as the
+ * histogram's buckets, but the min and max are exact. Snapshots from different
+ * canonicalizers aren't merged, since the same queries would have different
+ * keys, and a hash that comes with different texts is reported rather than
+ * merged, since one of them isn't what the others think it is.
+ *
+ */
+
+package sniffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const LATENCY_BUCKETS = 32
+
+// A hash that came with two texts.
+type mergeConflict struct {
+	hash        string
+	first, text string
+	file        string
+}
+
+var mergeConflicts []mergeConflict
+
+// latencyHistogram counts the samples by latency bucket, scaled to count
+// executions, and trimmed of empty buckets at the end.
+func latencyHistogram(samples []uint64, count uint64) []uint64 {
+	var hist [LATENCY_BUCKETS]uint64
+	var sampled, last uint64
+	for _, val := range samples {
+		if val == 0 {
+			continue
+		}
+		i := uint64(bits.Len64(val / 1000))
+		if i >= LATENCY_BUCKETS {
+			i = LATENCY_BUCKETS - 1
+		}
+		hist[i]++
+		sampled++
+		if i+1 > last {
+			last = i + 1
+		}
+	}
+	if sampled == 0 {
+		return nil
+	}
+	result := make([]uint64, last)
+	for i := range result {
+		result[i] = uint64(math.Round(float64(hist[i]) * float64(count) / float64(sampled)))
+	}
+	return result
+}
+
+// bucketLatency is the latency we stand in for a bucket's executions with, in
+// nanoseconds: three quarters of the way up, in the middle on a log scale.
+func bucketLatency(i int) uint64 {
+	if i == 0 {
+		return 500
+	}
+	return uint64(1500) << uint(i-1)
+}
+
+// mergeSamples makes the samples of a merged query from its histogram, with
+// its min and max as they were.
+func mergeSamples(hist []uint64, min, max uint64) []uint64 {
+	var total uint64
+	for _, n := range hist {
+		total += n
+	}
+	samples := make([]uint64, timeBuckets)
+	if total == 0 {
+		return samples
+	}
+	pos := 0
+	for i, n := range hist {
+		share := int(math.Round(float64(n) * float64(timeBuckets) / float64(total)))
+		for j := 0; j < share && pos < timeBuckets; j++ {
+			samples[pos] = bucketLatency(i)
+			pos++
+		}
+	}
+	samples[0], samples[timeBuckets-1] = min, max
+	return samples
+}
+
+// loadSnapshot reads a Snapshot written as JSON.
+func loadSnapshot(filename string) (*Snapshot, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var snap Snapshot
+	if err := json.NewDecoder(file).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return &snap, nil
+}
+
+// RunMerge aggregates the Snapshots in the files, for a status report or
+// another Snapshot over all of them.
+func RunMerge(filenames []string) error {
+	var snaps []*Snapshot
+	for _, filename := range filenames {
+		snap, err := loadSnapshot(filename)
+		if err != nil {
+			return err
+		}
+		if len(snaps) > 0 && snap.CanonicalVersion != snaps[0].CanonicalVersion {
+			return fmt.Errorf("%s is from canonicalizer version %d and %s from %d, so their "+
+				"queries don't line up", filenames[0], snaps[0].CanonicalVersion, filename,
+				snap.CanonicalVersion)
+		}
+		if snap.Host == "" {
+			snap.Host = filepath.Base(filename)
+		}
+		snaps = append(snaps, snap)
+	}
+	if len(snaps) == 0 {
+		return fmt.Errorf("No snapshots to merge")
+	}
+
+	parser.Lock()
+	defer parser.Unlock()
+	collecting = true
+	first, last := snaps[0].Time.Add(-snaps[0].Elapsed), snaps[0].Time
+	hashes := make(map[string]string)
+	hists := make(map[string][]uint64)
+	var apdexTotal float64
+	for i, snap := range snaps {
+		if began := snap.Time.Add(-snap.Elapsed); began.Before(first) {
+			first = began
+		}
+		if snap.Time.After(last) {
+			last = snap.Time
+		}
+		querycount += snap.Queries
+		stats.packets.rcvd += snap.Packets
+		stats.packets.rcvd_sync += snap.SyncedPackets
+		stats.desyncs += snap.Desyncs
+		stats.streams += snap.Streams
+		apdexTotal += snap.Apdex * float64(snap.Queries)
+
+		for _, qs := range snap.Stats {
+			hash := qs.Hash
+			if hash == "" {
+				hash = fmt.Sprintf("%016x", fingerprintHash(qs.Key))
+			}
+			if text, ok := hashes[hash]; ok && text != qs.Key {
+				mergeConflicts = append(mergeConflicts, mergeConflict{hash: hash, first: text,
+					text: qs.Key, file: filenames[i]})
+			} else if !ok {
+				hashes[hash] = qs.Key
+			}
+			mergeQuery(snap.Host, &qs, hists)
+		}
+	}
+
+	for key, qdata := range qbuf {
+		if hist := hists[key]; hist != nil {
+			qdata.times = mergeSamples(hist, qdata.times[0], qdata.timeMax)
+		}
+	}
+	if querycount > 0 {
+		apdex = apdexScore{satisfied: uint64(apdexTotal), total: uint64(querycount)}
+	}
+	start = first.Unix()
+	clock = func() time.Time { return last }
+
+	log.Printf("Merged %d snapshots from %s to %s", len(snaps), first.Format(time.RFC3339),
+		last.Format(time.RFC3339))
+	for _, mc := range mergeConflicts {
+		log.Printf("%sHash %s in %s is %s%s%s, but was %s%s%s before: kept apart%s", COLOR_RED,
+			mc.hash, mc.file, COLOR_WHITE, mc.text, COLOR_RED, COLOR_WHITE, mc.first, COLOR_RED,
+			COLOR_DEFAULT)
+	}
+	return nil
+}
+
+// mergeQuery adds a query of a host's Snapshot to the aggregate. Until the
+// samples are made from the histogram, its first sample is the min.
+func mergeQuery(host string, qs *QueryStats, hists map[string][]uint64) {
+	qdata, ok := qbuf[qs.Key]
+	if !ok {
+		qdata = &queryData{interval: intervals, times: make([]uint64, timeBuckets),
+			servers: make(map[string]uint64)}
+		qbuf[qs.Key] = qdata
+	}
+	qdata.count += qs.Count
+	qdata.bytes += qs.Bytes
+	qdata.errors += qs.Errors
+	qdata.aborted += qs.Aborted
+	qdata.oks += qs.OKs
+	qdata.rows += qs.Rows
+	qdata.results += qs.Results
+	qdata.sets += qs.ResultSets
+	multiResults = multiResults || qs.ResultSets > qs.Results
+	qdata.returned += qs.Returned
+	qdata.fetches += qs.Fetches
+	qdata.fetchTime += qs.Fetches * uint64(qs.FetchAvg)
+	cursorFetches = cursorFetches || qs.Fetches > 0
+	if len(qs.Servers) > 0 {
+		// A merge of merges, or a collector's.
+		for server, count := range qs.Servers {
+			qdata.servers[server] += count
+		}
+	} else {
+		qdata.servers[host] += qs.Count
+	}
+	qdata.apdex.satisfied += uint64(qs.Apdex * float64(qs.Count))
+	qdata.apdex.total += qs.Count
+	if qs.ListAvg > 0 {
+		qdata.lists.count += qs.Count
+		qdata.lists.total += uint64(qs.ListAvg * float64(qs.Count))
+		if qs.ListMax > qdata.lists.max {
+			qdata.lists.max = qs.ListMax
+		}
+	}
+
+	if qs.ColumnsMax > 0 {
+		qdata.columns.fold(columnStats{count: qs.Results, min: qs.ColumnsMin,
+			total: uint64(qs.ColumnsAvg * float64(qs.Results)), max: qs.ColumnsMax})
+	}
+
+	if qs.Avg <= 0 {
+		return
+	}
+	min, max := uint64(qs.Min.Nanoseconds()), uint64(qs.Max.Nanoseconds())
+	qdata.timed += qs.Count
+	qdata.timeTotal += uint64(qs.Avg.Nanoseconds()) * qs.Count
+	if max > qdata.timeMax {
+		qdata.timeMax = max
+	}
+	if qdata.times[0] == 0 || min < qdata.times[0] {
+		qdata.times[0] = min
+	}
+
+	// Older snapshots have no histogram, so their executions are all at
+	// their average.
+	hist := qs.Histogram
+	if hist == nil {
+		i := bits.Len64(uint64(qs.Avg.Nanoseconds()) / 1000)
+		if i >= LATENCY_BUCKETS {
+			i = LATENCY_BUCKETS - 1
+		}
+		hist = make([]uint64, i+1)
+		hist[i] = qs.Count
+	}
+	merged := hists[qs.Key]
+	for len(merged) < len(hist) {
+		merged = append(merged, 0)
+	}
+	for i, n := range hist {
+		merged[i] += n
+	}
+	hists[qs.Key] = merged
+}
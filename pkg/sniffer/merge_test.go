@@ -0,0 +1,75 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	// 1.5ms is in the bucket up to 2048us, 3ms in the one up to 4096us.
+	samples := []uint64{1500000, 1500000, 3000000, 0}
+	hist := latencyHistogram(samples, 30)
+	if len(hist) != 13 || hist[11] != 20 || hist[12] != 10 {
+		t.Errorf("For the histogram\n    Got %v\n    Expected 20 and 10 at the end", hist)
+	}
+	if pcts := percentiles(mergeSamples(hist, 1400000, 3100000), 50); pcts[0] != 1.536 {
+		t.Errorf("For the median\n    Got %0.3fms\n    Expected 1.536ms", pcts[0])
+	}
+}
+
+func TestMerge(t *testing.T) {
+	defer func() { clock, collecting = time.Now, false }()
+	qbuf, querycount, mergeConflicts, timeBuckets = make(map[string]*queryData), 0, nil, TIME_BUCKETS
+	dir := t.TempDir()
+	end := time.Unix(1434510000, 0)
+
+	write := func(name string, snap Snapshot) string {
+		filename := filepath.Join(dir, name)
+		data, _ := json.Marshal(snap)
+		os.WriteFile(filename, data, 0644)
+		return filename
+	}
+	a := write("a.json", Snapshot{Host: "db1", Time: end, Elapsed: time.Minute, Queries: 30,
+		CanonicalVersion: 1, Stats: []QueryStats{
+			{Key: "select ?", Hash: "0001", Count: 20, Min: time.Millisecond,
+				Avg: 2 * time.Millisecond, Max: 3 * time.Millisecond, Histogram: []uint64{0, 0, 0,
+					0, 0, 0, 0, 0, 0, 0, 0, 20}},
+			{Key: "select a", Hash: "0002", Count: 10, Avg: time.Millisecond,
+				Min: time.Millisecond, Max: time.Millisecond},
+		}})
+	b := write("b.json", Snapshot{Time: end.Add(-time.Second), Elapsed: 2 * time.Minute,
+		Queries: 5, CanonicalVersion: 1, Stats: []QueryStats{
+			{Key: "select ?", Hash: "0001", Count: 4, Min: 500 * time.Microsecond,
+				Avg: time.Millisecond, Max: 9 * time.Millisecond},
+			{Key: "select b", Hash: "0002", Count: 1, Avg: time.Millisecond},
+		}})
+	other := write("other.json", Snapshot{CanonicalVersion: 2})
+
+	if err := RunMerge([]string{a, other}); err == nil {
+		t.Errorf("For snapshots of two canonicalizers\n    Got no error\n    Expected one")
+	}
+	if err := RunMerge([]string{a, b}); err != nil {
+		t.Fatalf("For the merge\n    Got %s\n    Expected no error", err.Error())
+	}
+
+	qdata := qbuf["select ?"]
+	if querycount != 35 || qdata == nil || qdata.count != 24 || qdata.servers["db1"] != 20 ||
+		qdata.servers["b.json"] != 4 {
+		t.Fatalf("For the merged query\n    Got %d queries, %+v\n    Expected 24 from two hosts",
+			querycount, qdata)
+	}
+	qmin, _, qmax := calculateTimes(qdata.latencies())
+	if qmin != 0.5 || qmax != 9 {
+		t.Errorf("For the latencies\n    Got min %0.2fms, max %0.2fms\n    Expected 0.50, 9.00",
+			qmin, qmax)
+	}
+	if len(mergeConflicts) != 1 || mergeConflicts[0].text != "select b" {
+		t.Errorf("For the hashes\n    Got %+v\n    Expected select b in conflict", mergeConflicts)
+	}
+	if elapsed := UnixNow() - start; elapsed != 121 {
+		t.Errorf("For the time covered\n    Got %ds\n    Expected 121s", elapsed)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * mirror.go
+ *
+ * Checking that we see both directions of the traffic. Fed from a SPAN port or
+ * a tap, it's easy to end up with only the requests or only the responses,
+ * and then the report is quietly wrong: no queries complete, or latencies come
+ * out as nonsense. We count what we see each way per server, and shout when a
+ * server or stream has had traffic one way and nothing back for too long.
+ *
+ * Every packet counts, including bare ACKs, so a long result set being read
+ * (which the client ACKs) or a slow query (whose request the server ACKs)
+ * don't look one way.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// How long traffic can go one way before we say so, 0 to not check.
+var oneWayAfter time.Duration = 30 * time.Second
+var requireBidirectional bool = false
+var reportMirror bool = false
+
+// trafficWay is what we've seen going one way.
+type trafficWay struct {
+	packets uint64
+	bytes   uint64
+	last    time.Time
+}
+
+// mirrorData is what we've seen both ways, for a server or a stream.
+type mirrorData struct {
+	first     time.Time
+	requests  trafficWay
+	responses trafficWay
+}
+
+// endpoints are the servers we've seen traffic for.
+var endpoints map[string]*mirrorData = make(map[string]*mirrorData)
+
+// record counts a packet.
+func (self *mirrorData) record(request bool, bytes int, now time.Time) {
+	if self.first.IsZero() {
+		self.first = now
+	}
+	dir := &self.responses
+	if request {
+		dir = &self.requests
+	}
+	dir.packets++
+	dir.bytes += uint64(bytes)
+	dir.last = now
+}
+
+// oneWay returns "requests" or "responses" if that's all we've seen lately, or
+// "" if traffic is going both ways (or neither).
+func (self *mirrorData) oneWay(now time.Time) string {
+	if oneWayAfter <= 0 || now.Sub(self.first) < oneWayAfter {
+		return ""
+	}
+	recent := func(dir *trafficWay) bool {
+		return !dir.last.IsZero() && now.Sub(dir.last) < oneWayAfter
+	}
+	switch {
+	case recent(&self.requests) && !recent(&self.responses):
+		return "requests"
+	case recent(&self.responses) && !recent(&self.requests):
+		return "responses"
+	}
+	return ""
+}
+
+// bidirectional tells us whether we've seen both ways of a stream and it isn't
+// one way now.
+func (self *mirrorData) bidirectional(now time.Time) bool {
+	return self.requests.packets > 0 && self.responses.packets > 0 && self.oneWay(now) == ""
+}
+
+// recordDirection counts a packet for its stream and server. It returns false
+// if the packet shouldn't be parsed because we require both directions and
+// haven't got them.
+func recordDirection(rs *source, request bool, bytes int) bool {
+	if oneWayAfter <= 0 {
+		return true
+	}
+	now := clock()
+	if rs.endpoint == nil {
+		rs.endpoint = endpoints[rs.dst]
+		if rs.endpoint == nil {
+			rs.endpoint = &mirrorData{}
+			endpoints[rs.dst] = rs.endpoint
+		}
+	}
+	rs.endpoint.record(request, bytes, now)
+	rs.mirror.record(request, bytes, now)
+
+	if requireBidirectional && bytes > 0 && !rs.mirror.bidirectional(now) {
+		stats.mirror.skipped++
+		return false
+	}
+	return true
+}
+
+// mirrorServers returns the servers we've seen, sorted.
+func mirrorServers() []string {
+	var servers []string
+	for server := range endpoints {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// printMirrorWarnings warns about servers and streams we only see one way.
+func printMirrorWarnings(w io.Writer) {
+	if oneWayAfter <= 0 {
+		return
+	}
+	now := clock()
+	for _, server := range mirrorServers() {
+		ep := endpoints[server]
+		if way := ep.oneWay(now); way != "" {
+			reportf(w, "%sWARNING: only %s seen for %s in the last %s, is the capture "+
+				"missing a direction?%s", COLOR_RED, way, server, oneWayAfter, COLOR_DEFAULT)
+		}
+	}
+
+	oneWay := map[string]int{}
+	for _, rs := range chmap {
+		if way := rs.mirror.oneWay(now); way != "" {
+			oneWay[way]++
+		}
+	}
+	if oneWay["requests"] > 0 || oneWay["responses"] > 0 {
+		reportf(w, "%s%d streams with only requests / %d with only responses%s", COLOR_RED,
+			oneWay["requests"], oneWay["responses"], COLOR_DEFAULT)
+	}
+	if stats.mirror.skipped > 0 {
+		reportf(w, "%d packets skipped on one way streams", stats.mirror.skipped)
+	}
+}
+
+// printMirror shows the traffic each way per server.
+func printMirror(w io.Writer) {
+	servers := mirrorServers()
+	if len(servers) == 0 {
+		return
+	}
+	reportf(w, " ")
+	reportf(w, "%s        requests                  responses%s", COLOR_YELLOW, COLOR_DEFAULT)
+	reportf(w, "%s packets        bytes     packets        bytes  server%s", COLOR_YELLOW,
+		COLOR_DEFAULT)
+	for _, server := range servers {
+		ep := endpoints[server]
+		reportf(w, "%8d %12d    %8d %12d  %s%s%s", ep.requests.packets, ep.requests.bytes,
+			ep.responses.packets, ep.responses.bytes, COLOR_WHITE, server, COLOR_DEFAULT)
+	}
+}
@@ -0,0 +1,75 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOneWay(t *testing.T) {
+	base := time.Unix(1434510000, 0)
+
+	for name, test := range map[string]struct {
+		requests, responses []int // seconds at which we saw packets
+		now                 int
+		expected            string
+	}{
+		"both ways":      {[]int{0, 40, 50}, []int{1, 41, 51}, 60, ""},
+		"requests only":  {[]int{0, 20, 40, 55}, nil, 60, "requests"},
+		"responses gone": {[]int{0, 20, 40, 55}, []int{1, 21}, 60, "requests"},
+		"responses only": {nil, []int{0, 30, 59}, 60, "responses"},
+		"too soon":       {[]int{0, 10}, nil, 15, ""},
+		"idle":           {[]int{0}, []int{1}, 60, ""},
+	} {
+		var mirror mirrorData
+		for _, at := range test.requests {
+			mirror.record(true, 10, base.Add(time.Duration(at)*time.Second))
+		}
+		for _, at := range test.responses {
+			mirror.record(false, 10, base.Add(time.Duration(at)*time.Second))
+		}
+		if got := mirror.oneWay(base.Add(time.Duration(test.now) * time.Second)); got != test.expected {
+			t.Errorf("For %s\n    Got %q\n    Expected %q", name, got, test.expected)
+		}
+	}
+}
+
+func TestRequireBidirectional(t *testing.T) {
+	defer func() { requireBidirectional, clock = false, time.Now }()
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	endpoints, stats.mirror.skipped = make(map[string]*mirrorData), 0
+	parseFormat("#q")
+	requireBidirectional = true
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	ok := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+
+	// A stream we only see requests on never gets parsed.
+	oneway := [4]byte{10, 0, 0, 2}
+	for i := 0; i < 3; i++ {
+		handlePacket(tcpPacket(oneway, 50000, true, TCP_ACK, query))
+		now = now.Add(20 * time.Second)
+	}
+
+	// One that's fine is parsed once we've seen it both ways, so its first query
+	// is lost.
+	fine := [4]byte{10, 0, 0, 3}
+	for i := 0; i < 3; i++ {
+		handlePacket(tcpPacket(fine, 50000, true, TCP_ACK, query))
+		handlePacket(tcpPacket(fine, 50000, false, TCP_ACK, ok))
+	}
+
+	if qdata := qbuf["select ?"]; qdata == nil || qdata.count != 2 {
+		t.Errorf("For select ?\n    Got %+v\n    Expected 2 executions", qdata)
+	}
+	if stats.mirror.skipped != 4 {
+		t.Errorf("For skipped packets\n    Got %d\n    Expected 4", stats.mirror.skipped)
+	}
+	if ep := endpoints["10.0.0.1:3306"]; ep == nil || ep.requests.packets != 6 ||
+		ep.responses.packets != 3 || ep.requests.bytes != 6*uint64(len(query)) {
+		t.Errorf("For endpoint\n    Got %+v\n    Expected 6 requests and 3 responses", ep)
+	}
+	if way := chmap["10.0.0.2:50000"].mirror.oneWay(now); way != "requests" {
+		t.Errorf("For one way stream\n    Got %q\n    Expected requests", way)
+	}
+}
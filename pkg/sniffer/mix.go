@@ -0,0 +1,93 @@
+/*
+ * mix.go
+ *
+ * The mix of protocol commands, so what isn't queries (pools pinging every
+ * connection they check out, monitoring asking for COM_STATISTICS, prepared
+ * statement housekeeping) can be weighed against what is. Streams we haven't
+ * synced on only count the commands that are nothing but the command byte,
+ * which are hard to mistake for anything else.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+var commandCounts [COM_LAST + 1]uint64
+
+// bareCommand tells us whether a command never has anything after its byte.
+func bareCommand(ptype int) bool {
+	switch ptype {
+	case COM_QUIT, COM_STATISTICS, COM_PROCESS_INFO, COM_DEBUG, COM_PING,
+		COM_RESET_CONNECTION:
+		return true
+	}
+	return false
+}
+
+// countCommand counts a command carved from a stream.
+func countCommand(rs *source, ptype int, pdata []byte) {
+	if ptype < 0 || ptype > COM_LAST {
+		return
+	}
+	if rs.synced || ptype == COM_QUERY || (len(pdata) == 0 && bareCommand(ptype)) {
+		commandCounts[ptype]++
+	}
+}
+
+// commandName is the name of a command, or its number if it has none.
+func commandName(ptype int) string {
+	if name, ok := commandNames[ptype]; ok {
+		return name
+	}
+	return fmt.Sprintf("COM_0x%02x", ptype)
+}
+
+// commandShares is the status bar's one line of the mix: the shares of the
+// commands that are queries, executes, prepares and everything else.
+func commandShares() string {
+	var total uint64
+	for _, count := range commandCounts {
+		total += count
+	}
+	if total == 0 {
+		return ""
+	}
+	share := func(count uint64) float64 {
+		return float64(count) / float64(total) * 100
+	}
+	query, execute := commandCounts[COM_QUERY], commandCounts[COM_STMT_EXECUTE]
+	prepare := commandCounts[COM_STMT_PREPARE]
+	return fmt.Sprintf("commands: %0.0f%% query, %0.0f%% execute, %0.0f%% prepare, %0.0f%% other",
+		share(query), share(execute), share(prepare), share(total-query-execute-prepare))
+}
+
+// printCommandMix shows how many of each command there were, if there were any
+// but queries.
+func printCommandMix(w io.Writer, elapsed float64) {
+	var total uint64
+	var mix sortableSlice
+	for ptype, count := range commandCounts {
+		total += count
+		if count > 0 {
+			mix = append(mix, sortable{float64(count), commandName(ptype)})
+		}
+	}
+	if total == commandCounts[COM_QUERY] {
+		return
+	}
+	sort.Sort(sort.Reverse(mix))
+
+	reportf(w, " ")
+	reportf(w, "%s   count         /s  share  %scommand%s", COLOR_YELLOW, COLOR_WHITE,
+		COLOR_DEFAULT)
+	for _, item := range mix {
+		reportf(w, "%s%8d  %7.2f/s  %4.1f%%  %s%s%s", COLOR_YELLOW, uint64(item.value),
+			item.value/elapsed, item.value/float64(total)*100, COLOR_WHITE, item.line,
+			COLOR_DEFAULT)
+	}
+}
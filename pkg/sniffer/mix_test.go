@@ -0,0 +1,65 @@
+package sniffer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandMix(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	commandCounts, stats.desyncs = [COM_LAST + 1]uint64{}, 0
+	parseFormat("#q")
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...)
+	ping := mysqlPacket(0, COM_PING)
+	ok := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+	client := [4]byte{10, 0, 0, 8}
+
+	// A pool pinging a connection it picked up before it ever sends a query.
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, ping))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+
+	// Then a query, a ping and another query, the pings timing nothing.
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+	now = now.Add(10 * time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, ping))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+	now = now.Add(20 * time.Millisecond)
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+
+	// And COM_PROCESS_INFO, answered with a result set.
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, mysqlPacket(0, COM_PROCESS_INFO)))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, mysqlPackets([]byte{1},
+		[]byte{3, 'd', 'e', 'f', 0, 0, 0, 2, 'I', 'd', 0, 0x0c, 0x3f, 0, 1, 0, 0, 0, 8, 0x81, 0, 0,
+			0, 0}, []byte{0xfe, 0, 0, 2, 0}, []byte{1, '1'}, []byte{0xfe, 0, 0, 2, 0})))
+
+	qdata := qbuf["select ?"]
+	if rs := chmap["10.0.0.8:50000"]; rs == nil || !rs.synced || stats.desyncs != 0 {
+		t.Errorf("For pings between queries\n    Got %d desyncs\n    Expected the stream synced",
+			stats.desyncs)
+	}
+	if qdata == nil || qdata.count != 2 || qdata.timeTotal != uint64(30*time.Millisecond) {
+		t.Errorf("For the queries around a ping\n    Got %+v\n    Expected 2 taking 30ms", qdata)
+	}
+	if commandCounts[COM_PING] != 2 || commandCounts[COM_QUERY] != 2 ||
+		commandCounts[COM_PROCESS_INFO] != 1 {
+		t.Errorf("For the commands\n    Got %v\n    Expected 2 pings, 2 queries and a process "+
+			"list", commandCounts)
+	}
+
+	var out bytes.Buffer
+	printCommandMix(&out, 10)
+	if !strings.Contains(out.String(), "       2     0.20/s  40.0%  "+COLOR_WHITE+"COM_PING") {
+		t.Errorf("For the mix\n    Got %q\n    Expected the pings", out.String())
+	}
+	expected := "commands: 40% query, 0% execute, 0% prepare, 60% other"
+	if shares := commandShares(); shares != expected {
+		t.Errorf("For the shares\n    Got %q\n    Expected %q", shares, expected)
+	}
+}
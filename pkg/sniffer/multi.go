@@ -0,0 +1,102 @@
+/*
+ * multi.go
+ *
+ * Multi-statements. Clients with CLIENT_MULTI_STATEMENTS can send
+ * "insert ...; update ...; select ..." as one COM_QUERY, which fingerprints as
+ * a key of its own that matches nothing else. We split such a query on its
+ * top level semicolons and count each statement under its own fingerprint,
+ * the bytes of the query shared between them. The server answers the batch as
+ * one response, so its latency (and the response) goes to the last statement;
+ * the others are counted without a time.
+ *
+ * Bodies of stored programs are full of semicolons that don't end anything,
+ * so CREATE and ALTER are never split.
+ *
+ */
+
+package sniffer
+
+import (
+	"bytes"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+// batchQuery is a statement of a multi-statement before the last.
+type batchQuery struct {
+	text  string
+	canon string // the statement, without what the format adds
+	bytes uint64
+}
+
+// splitStatements splits a query on the semicolons outside of its quotes and
+// comments, leaving out empty statements. A query of one statement comes back
+// as it is.
+func splitStatements(query []byte) [][]byte {
+	if bytes.IndexByte(query, ';') < 0 {
+		return [][]byte{query}
+	}
+	switch queryVerb(query) {
+	case "create", "alter":
+		return [][]byte{query}
+	}
+
+	var statements [][]byte
+	start := 0
+	for i := 0; i < len(query); {
+		if end := skipSpaceAndComments(query, i); end > i {
+			i = end
+			continue
+		}
+		if query[i] == '`' {
+			end := bytes.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				break
+			}
+			i += end + 2
+			continue
+		}
+		length, toktype := canonical.ScanToken(query[i:])
+		if toktype == canonical.TOKEN_OTHER && query[i] == ';' {
+			statements = appendStatement(statements, query[start:i])
+			start = i + 1
+		}
+		i += length
+	}
+	statements = appendStatement(statements, query[start:])
+	if len(statements) == 0 {
+		return [][]byte{query}
+	}
+	return statements
+}
+
+// appendStatement adds a statement unless it's only space and comments.
+func appendStatement(statements [][]byte, statement []byte) [][]byte {
+	if skipSpaceAndComments(statement, 0) == len(statement) {
+		return statements
+	}
+	return append(statements, bytes.TrimSpace(statement))
+}
+
+// batchQueryOf is a statement of a multi-statement, with its aggregation key.
+func batchQueryOf(rs *source, statement []byte, bytes uint64) batchQuery {
+	if groupShape {
+		shape := queryShape(statement)
+		return batchQuery{sideLabel(rs) + shape, shape, bytes}
+	}
+	canon := queryStatement(statement)
+	return batchQuery{sideLabel(rs) + formatStatement(rs, statement, canon), canon, bytes}
+}
+
+// aggregateBatch counts the statements of a multi-statement before the last,
+// once the batch is answered.
+func aggregateBatch(rs *source, randn int, fast bool) {
+	for _, bq := range rs.qbatch {
+		if fast {
+			stats.fast.queries++
+			stats.fast.bytes += bq.bytes
+			continue
+		}
+		aggregate(bq.text, bq.canon, randn, 0, bq.bytes, rs.qtarget)
+	}
+}
@@ -0,0 +1,66 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := map[string][]string{
+		"select 1":                               {"select 1"},
+		"select 1;":                              {"select 1"},
+		"select 1; select 2":                     {"select 1", "select 2"},
+		"insert into t values ('a;b'); select 2": {"insert into t values ('a;b')", "select 2"},
+		"select \"x;\" ; select `a;b` from t":    {"select \"x;\"", "select `a;b` from t"},
+		"select 1 /* ; */; -- ;\nselect 2":       {"select 1 /* ; */", "-- ;\nselect 2"},
+		"select 'it''s;' ;;; select 2 ;":         {"select 'it''s;'", "select 2"},
+		"create procedure p() begin select 1; select 2; end": {
+			"create procedure p() begin select 1; select 2; end"},
+	}
+	for query, expected := range tests {
+		got := splitStatements([]byte(query))
+		same := len(got) == len(expected)
+		for i := 0; same && i < len(got); i++ {
+			same = string(got[i]) == expected[i]
+		}
+		if !same {
+			t.Errorf("For %q\n    Got %q\n    Expected %q", query, got, expected)
+		}
+	}
+}
+
+func TestMultiStatements(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+	qbuf, format, querycount, groupShape = make(map[string]*queryData), nil, 0, false
+	parseFormat("#q")
+	rs := &source{synced: true}
+
+	query := "insert into t values ('a;b'); update t set a = 1 where id = 2; select 3"
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, query...)...))
+	now = now.Add(10 * time.Millisecond)
+	processPacket(rs, false, mysqlPacket(1, 0xfe, 0, 0, 2, 0))
+
+	var bytes uint64
+	for _, key := range []string{"insert into t values (?)",
+		"update t set a = ? where id = ?", "select ?"} {
+		q, ok := qbuf[key]
+		if !ok || q.count != 1 {
+			t.Errorf("For %s\n    Got %+v\n    Expected it counted once", key, q)
+			continue
+		}
+		bytes += q.bytes
+	}
+	// The query and the 9 bytes of its response, which go with the last.
+	if bytes != uint64(len(query))+9 || querycount != 3 {
+		t.Errorf("For the bytes of the batch\n    Got %d in %d queries\n    Expected %d in 3",
+			bytes, querycount, len(query)+9)
+	}
+	if q := qbuf["select ?"]; q == nil || q.timed != 1 || q.timeTotal != 10000000 {
+		t.Errorf("For the latency of the batch\n    Got %+v\n    Expected it on the last", q)
+	}
+	if q := qbuf["insert into t values (?)"]; q == nil || q.timed != 0 {
+		t.Errorf("For an earlier statement\n    Got %+v\n    Expected no latency", q)
+	}
+}
@@ -0,0 +1,270 @@
+/*
+ * params.go
+ *
+ * The values bound to a prepared statement. With -v, executions are printed
+ * with the values of the COM_STMT_EXECUTE in place of the ? markers, as they
+ * would have been written in a plain query, so the one bad execution can be
+ * tried by hand. The aggregation still goes by the statement prepared.
+ *
+ * The values are in the binary protocol: a bitmap of the NULLs, the types of
+ * the parameters (with the first execute, or whenever they change), then each
+ * value encoded by its type. Blobs are shown by their size only, and values
+ * sent ahead with COM_STMT_SEND_LONG_DATA aren't in the execute at all.
+ *
+ */
+
+package sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+// Column types of the binary protocol.
+const (
+	TYPE_DECIMAL     = 0x00
+	TYPE_TINY        = 0x01
+	TYPE_SHORT       = 0x02
+	TYPE_LONG        = 0x03
+	TYPE_FLOAT       = 0x04
+	TYPE_DOUBLE      = 0x05
+	TYPE_NULL        = 0x06
+	TYPE_TIMESTAMP   = 0x07
+	TYPE_LONGLONG    = 0x08
+	TYPE_INT24       = 0x09
+	TYPE_DATE        = 0x0a
+	TYPE_TIME        = 0x0b
+	TYPE_DATETIME    = 0x0c
+	TYPE_YEAR        = 0x0d
+	TYPE_VARCHAR     = 0x0f
+	TYPE_BIT         = 0x10
+	TYPE_JSON        = 0xf5
+	TYPE_NEWDECIMAL  = 0xf6
+	TYPE_ENUM        = 0xf7
+	TYPE_SET         = 0xf8
+	TYPE_TINY_BLOB   = 0xf9
+	TYPE_MEDIUM_BLOB = 0xfa
+	TYPE_LONG_BLOB   = 0xfb
+	TYPE_BLOB        = 0xfc
+	TYPE_VAR_STRING  = 0xfd
+	TYPE_STRING      = 0xfe
+
+	// In the second byte of a parameter's type.
+	TYPE_UNSIGNED = 0x80
+)
+
+// statement is a statement prepared on a stream.
+type statement struct {
+	text   string
+	params int
+	types  []byte // two bytes a parameter, from the last execute that sent them
+
+	// The query fetches from its open cursor count toward, see cursors.go.
+	cursor *queryData
+}
+
+// boundQuery returns the text of an execution of a statement with its values,
+// from the payload of the COM_STMT_EXECUTE. Values we can't make out are left
+// as ?, and long is the sizes of those sent with COM_STMT_SEND_LONG_DATA.
+func boundQuery(id uint32, stmt *statement, data []byte, long map[uint16]uint64) string {
+	values := bindValues(stmt, data, long)
+	text := []byte(stmt.text)
+	var bound strings.Builder
+	param := 0
+	for i := 0; i < len(text); {
+		if end := skipSpaceAndComments(text, i); end > i {
+			bound.Write(text[i:end])
+			i = end
+			continue
+		}
+		length, toktype := canonical.ScanToken(text[i:])
+		if toktype == canonical.TOKEN_OTHER && text[i] == '?' && param < len(values) {
+			bound.WriteString(values[param])
+			param++
+		} else {
+			bound.Write(text[i : i+length])
+		}
+		i += length
+	}
+	return fmt.Sprintf("%s /* stmt %d */", bound.String(), id)
+}
+
+// bindValues decodes the values of an execute, ? for any it can't.
+func bindValues(stmt *statement, data []byte, long map[uint16]uint64) []string {
+	values := make([]string, stmt.params)
+	for i := range values {
+		values[i] = "?"
+	}
+
+	// The statement id, flags and iteration count, then the NULL bitmap.
+	pos := 9 + (stmt.params+7)/8
+	if stmt.params == 0 || len(data) < pos+1 {
+		return values
+	}
+	nulls := data[9:pos]
+	if data[pos] == 1 {
+		if len(data) < pos+1+2*stmt.params {
+			return values
+		}
+		stmt.types = append(stmt.types[:0], data[pos+1:pos+1+2*stmt.params]...)
+		pos += 2 * stmt.params
+	}
+	pos++
+	if len(stmt.types) != 2*stmt.params {
+		// Sent with an execute we didn't see.
+		return values
+	}
+
+	for i := range values {
+		if size, ok := long[uint16(i)]; ok {
+			values[i] = fmt.Sprintf("<long data:%db>", size)
+			continue
+		}
+		if nulls[i/8]&(1<<uint(i%8)) != 0 {
+			values[i] = "NULL"
+			continue
+		}
+		value, size := binaryValue(stmt.types[2*i], stmt.types[2*i+1]&TYPE_UNSIGNED != 0,
+			data[pos:])
+		if size < 0 {
+			// Without knowing its size, we don't know where the next starts.
+			break
+		}
+		values[i], pos = value, pos+size
+	}
+	return values
+}
+
+// binaryValue returns the value at the start of data as a literal, and how many
+// bytes it took, or -1 if it's truncated or of a type we don't know.
+func binaryValue(typ byte, unsigned bool, data []byte) (string, int) {
+	fixed := map[byte]int{TYPE_TINY: 1, TYPE_SHORT: 2, TYPE_YEAR: 2, TYPE_LONG: 4,
+		TYPE_INT24: 4, TYPE_FLOAT: 4, TYPE_LONGLONG: 8, TYPE_DOUBLE: 8}
+	if size, ok := fixed[typ]; ok {
+		if len(data) < size {
+			return "", -1
+		}
+		var value uint64
+		for i := size - 1; i >= 0; i-- {
+			value = value<<8 | uint64(data[i])
+		}
+		switch {
+		case typ == TYPE_FLOAT:
+			return strconv.FormatFloat(float64(math.Float32frombits(uint32(value))), 'g', -1,
+				32), size
+		case typ == TYPE_DOUBLE:
+			return strconv.FormatFloat(math.Float64frombits(value), 'g', -1, 64), size
+		case unsigned:
+			return strconv.FormatUint(value, 10), size
+		}
+		// Sign extend from the size it was sent in.
+		shift := uint(64 - 8*size)
+		return strconv.FormatInt(int64(value<<shift)>>shift, 10), size
+	}
+
+	switch typ {
+	case TYPE_NULL:
+		return "NULL", 0
+	case TYPE_DATE, TYPE_DATETIME, TYPE_TIMESTAMP:
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return "", -1
+		}
+		return binaryDatetime(typ, data[1:1+int(data[0])]), 1 + int(data[0])
+	case TYPE_TIME:
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return "", -1
+		}
+		return binaryTime(data[1 : 1+int(data[0])]), 1 + int(data[0])
+	case TYPE_DECIMAL, TYPE_NEWDECIMAL, TYPE_VARCHAR, TYPE_BIT, TYPE_JSON, TYPE_ENUM,
+		TYPE_SET, TYPE_VAR_STRING, TYPE_STRING, TYPE_TINY_BLOB, TYPE_MEDIUM_BLOB,
+		TYPE_LONG_BLOB, TYPE_BLOB:
+		head := lenencSize(data)
+		if head == 0 || uint64(len(data)-head) < lenencInt(data) {
+			return "", -1
+		}
+		size := int(lenencInt(data))
+		value := data[head : head+size]
+		switch typ {
+		case TYPE_DECIMAL, TYPE_NEWDECIMAL:
+			return string(value), head + size
+		case TYPE_BIT, TYPE_TINY_BLOB, TYPE_MEDIUM_BLOB, TYPE_LONG_BLOB, TYPE_BLOB:
+			return fmt.Sprintf("<blob:%db>", size), head + size
+		}
+		return quoteLiteral(value), head + size
+	}
+	return "", -1
+}
+
+// binaryDatetime formats a date, datetime or timestamp, whose encoding leaves
+// off the parts that are zero.
+func binaryDatetime(typ byte, data []byte) string {
+	var year, month, day, hour, minute, second, micro int
+	if len(data) >= 4 {
+		year = int(binary.LittleEndian.Uint16(data))
+		month, day = int(data[2]), int(data[3])
+	}
+	if len(data) >= 7 {
+		hour, minute, second = int(data[4]), int(data[5]), int(data[6])
+	}
+	if len(data) >= 11 {
+		micro = int(binary.LittleEndian.Uint32(data[7:]))
+	}
+	text := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if typ != TYPE_DATE {
+		text += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+	}
+	if micro > 0 {
+		text += fmt.Sprintf(".%06d", micro)
+	}
+	return "'" + text + "'"
+}
+
+// binaryTime formats a time, which is days and hours and so on, and can be
+// negative.
+func binaryTime(data []byte) string {
+	var sign string
+	var hours, minute, second, micro int
+	if len(data) >= 8 {
+		if data[0] == 1 {
+			sign = "-"
+		}
+		hours = int(binary.LittleEndian.Uint32(data[1:]))*24 + int(data[5])
+		minute, second = int(data[6]), int(data[7])
+	}
+	if len(data) >= 12 {
+		micro = int(binary.LittleEndian.Uint32(data[8:]))
+	}
+	text := fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, minute, second)
+	if micro > 0 {
+		text += fmt.Sprintf(".%06d", micro)
+	}
+	return "'" + text + "'"
+}
+
+// quoteLiteral quotes a string the way it would be written in a query.
+func quoteLiteral(value []byte) string {
+	var quoted strings.Builder
+	quoted.WriteByte('\'')
+	for _, b := range value {
+		switch b {
+		case '\'', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(b)
+		case 0:
+			quoted.WriteString("\\0")
+		case '\n':
+			quoted.WriteString("\\n")
+		case '\r':
+			quoted.WriteString("\\r")
+		default:
+			quoted.WriteByte(b)
+		}
+	}
+	quoted.WriteByte('\'')
+	return quoted.String()
+}
@@ -0,0 +1,73 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func TestBoundQuery(t *testing.T) {
+	stmt := &statement{text: "select * from users where id=? and name = '?' /* ? */ and " +
+		"created > ? and score < ? and avatar = ? and deleted is ?", params: 5}
+	execute := []byte{7, 0, 0, 0, 0, 1, 0, 0, 0,
+		0x10, // the fifth is NULL
+		1,    // types follow
+		TYPE_LONGLONG, 0, TYPE_DATETIME, 0, TYPE_DOUBLE, 0, TYPE_BLOB, 0, TYPE_NULL, 0,
+		0x39, 0x30, 0, 0, 0, 0, 0, 0, // 12345
+		7, 0xdf, 0x07, 6, 17, 12, 30, 5, // 2015-06-17 12:30:05
+		0, 0, 0, 0, 0, 0, 0xf8, 0x3f, // 1.5
+		4, 'a', 'b', 'c', 'd'}
+	expected := "select * from users where id=12345 and name = '?' /* ? */ and " +
+		"created > '2015-06-17 12:30:05' and score < 1.5 and avatar = <blob:4b> and " +
+		"deleted is NULL /* stmt 7 */"
+	if got := boundQuery(7, stmt, execute, nil); got != expected {
+		t.Errorf("For an execute with its types\n    Got %s\n    Expected %s", got, expected)
+	}
+
+	// The next execute can leave the types off, and send a value ahead.
+	execute = []byte{7, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // -1
+		4, 0xdf, 0x07, 6, 17,
+		0, 0, 0, 0, 0, 0, 0xf8, 0x3f}
+	expected = "select * from users where id=-1 and name = '?' /* ? */ and " +
+		"created > '2015-06-17 00:00:00' and score < 1.5 and avatar = <long data:5000b> and " +
+		"deleted is NULL /* stmt 7 */"
+	if got := boundQuery(7, stmt, execute, map[uint16]uint64{3: 5000}); got != expected {
+		t.Errorf("For an execute without types\n    Got %s\n    Expected %s", got, expected)
+	}
+
+	// Without the types, nothing can be made out.
+	stmt = &statement{text: "select ?, ?", params: 2}
+	if got := boundQuery(1, stmt, []byte{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 1, 2}, nil); got !=
+		"select ?, ? /* stmt 1 */" {
+		t.Errorf("For an execute of types we missed\n    Got %s\n    Expected the markers", got)
+	}
+}
+
+func TestBinaryValue(t *testing.T) {
+	for _, test := range []struct {
+		typ      byte
+		unsigned bool
+		data     []byte
+		expected string
+		size     int
+	}{
+		{TYPE_TINY, false, []byte{0xff}, "-1", 1},
+		{TYPE_TINY, true, []byte{0xff}, "255", 1},
+		{TYPE_LONG, false, []byte{0x2e, 0xfb, 0xff, 0xff}, "-1234", 4},
+		{TYPE_FLOAT, false, []byte{0, 0, 0xc0, 0x3f}, "1.5", 4},
+		{TYPE_VAR_STRING, false, []byte{5, 'i', 't', '\'', 's', '\n'}, `'it\'s\n'`, 6},
+		{TYPE_NEWDECIMAL, false, []byte{4, '9', '.', '9', '5'}, "9.95", 5},
+		{TYPE_DATE, false, []byte{4, 0xdf, 0x07, 6, 17}, "'2015-06-17'", 5},
+		{TYPE_DATETIME, false, []byte{11, 0xdf, 0x07, 6, 17, 1, 2, 3, 0x40, 0xe2, 1, 0},
+			"'2015-06-17 01:02:03.123456'", 12},
+		{TYPE_TIME, false, []byte{8, 1, 1, 0, 0, 0, 2, 30, 0}, "'-26:30:00'", 9},
+		{TYPE_LONGLONG, false, []byte{1, 2}, "", -1},
+		{TYPE_VAR_STRING, false, []byte{5, 'a'}, "", -1},
+		{0x42, false, []byte{1, 2, 3}, "", -1},
+	} {
+		got, size := binaryValue(test.typ, test.unsigned, test.data)
+		if got != test.expected || size != test.size {
+			t.Errorf("For type %#x %v\n    Got %s (%d bytes)\n    Expected %s (%d bytes)",
+				test.typ, test.data, got, size, test.expected, test.size)
+		}
+	}
+}
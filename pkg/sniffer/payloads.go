@@ -0,0 +1,159 @@
+/*
+ * payloads.go
+ *
+ * Replaying of captured TCP payloads through the protocol parser, so that the
+ * streams which confuse it can be reproduced, debugged, and turned into tests.
+ *
+ * The payload format is plain text. A stream starts with a line naming it, and
+ * each following line is one TCP segment's payload in hex, prefixed with the
+ * direction it was going in (> for client to server, < for server to client).
+ * Whitespace in the hex is ignored and lines starting with # are comments:
+ *
+ *     # expect-queries: 1
+ *     stream 10.0.0.2:50000
+ *     > 0900000003 73656c6563742031
+ *     < 0100000101 ...
+ *
+ * Comments of the form "# expect-<counter>: <n>" are used by the tests to
+ * check what the parser made of the file.
+ *
+ */
+
+package sniffer
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// How many segments of each stream we keep around for dumping when it
+	// desyncs.
+	PAYLOAD_HISTORY = 64
+)
+
+type payloadSegment struct {
+	request bool
+	data    []byte
+}
+
+type payloadStream struct {
+	name     string
+	segments []payloadSegment
+}
+
+var desyncDump *os.File
+
+// readPayloads parses the payload format, returning the streams in it along
+// with any expectations given in comments.
+func readPayloads(r io.Reader) ([]*payloadStream, map[string]uint64, error) {
+	var streams []*payloadStream
+	expect := make(map[string]uint64)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "# expect-"):
+			parts := strings.SplitN(line[9:], ":", 2)
+			if len(parts) != 2 {
+				return nil, nil, fmt.Errorf("line %d: bad expectation", lineno)
+			}
+			val, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s", lineno, err.Error())
+			}
+			expect[strings.TrimSpace(parts[0])] = val
+		case line[0] == '#':
+		case strings.HasPrefix(line, "stream "):
+			streams = append(streams, &payloadStream{name: strings.TrimSpace(line[7:])})
+		case line[0] == '>' || line[0] == '<':
+			if len(streams) == 0 {
+				return nil, nil, fmt.Errorf("line %d: segment outside of a stream", lineno)
+			}
+			data, err := hex.DecodeString(strings.Join(strings.Fields(line[1:]), ""))
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s", lineno, err.Error())
+			}
+			stream := streams[len(streams)-1]
+			stream.segments = append(stream.segments, payloadSegment{line[0] == '>', data})
+		default:
+			return nil, nil, fmt.Errorf("line %d: unexpected %q", lineno, line)
+		}
+	}
+	return streams, expect, scanner.Err()
+}
+
+// writePayloads writes a stream out in the payload format.
+func writePayloads(w io.Writer, name string, segments []payloadSegment) {
+	fmt.Fprintf(w, "stream %s\n", name)
+	for _, seg := range segments {
+		dir := '<'
+		if seg.request {
+			dir = '>'
+		}
+		fmt.Fprintf(w, "%c %s\n", dir, hex.EncodeToString(seg.data))
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// rememberPayload keeps the last few segments of a stream for -dump-desyncs.
+func rememberPayload(rs *source, request bool, data []byte) {
+	if len(rs.history) >= PAYLOAD_HISTORY {
+		rs.history = rs.history[1:]
+	}
+	rs.history = append(rs.history, payloadSegment{request, append([]byte(nil), data...)})
+}
+
+// ReplayPayloads feeds the streams in a payload file through the parser,
+// printing what it makes of each segment.
+func ReplayPayloads(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Failed to open payloads: %s", err.Error())
+	}
+	defer file.Close()
+
+	streams, _, err := readPayloads(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read payloads: %s", err.Error())
+	}
+
+	for _, stream := range streams {
+		log.Printf("%sstream %s%s", COLOR_RED, stream.name, COLOR_DEFAULT)
+		rs := &source{src: stream.name, srcip: strings.Split(stream.name, ":")[0],
+			trace: tracing(stream.name)}
+		for i, seg := range stream.segments {
+			dir := "<"
+			if seg.request {
+				dir = ">"
+			}
+			synced, desyncs, qtext := rs.synced, stats.desyncs, rs.qtext
+			pending := rs.reqSent != nil
+
+			processPacket(rs, seg.request, seg.data)
+
+			log.Printf("  %3d %s %5d bytes  synced=%t", i, dir, len(seg.data), rs.synced)
+			if stats.desyncs != desyncs || (synced && !rs.synced) {
+				log.Printf("      %slost sync%s", COLOR_RED, COLOR_DEFAULT)
+			} else if !synced && rs.synced {
+				log.Printf("      %sgained sync%s", COLOR_GREEN, COLOR_DEFAULT)
+			}
+			if rs.reqSent != nil && (!pending || rs.qtext != qtext) {
+				log.Printf("      %squery: %s%s", COLOR_WHITE, rs.qtext, COLOR_DEFAULT)
+			}
+			if pending && rs.reqSent == nil && seg.request == false {
+				log.Printf("      %sresponse to: %s%s", COLOR_YELLOW, rs.qtext, COLOR_DEFAULT)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package sniffer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// replayFixture runs every stream in a payload file through processPacket from
+// a clean slate, returning the counters the fixtures set expectations on.
+func replayFixture(t *testing.T, filename string) (map[string]uint64, map[string]uint64) {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", filename, err)
+	}
+	defer file.Close()
+
+	streams, expect, err := readPayloads(file)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", filename, err)
+	}
+
+	qbuf, format, querycount = make(map[string]*queryData), nil, 0
+	stats.desyncs = 0
+	parseFormat("#q")
+
+	got := make(map[string]uint64)
+	for _, stream := range streams {
+		rs := &source{src: stream.name}
+		for _, seg := range stream.segments {
+			processPacket(rs, seg.request, seg.data)
+		}
+		if rs.user != "" {
+			got["users"]++
+		}
+	}
+	got["queries"] = uint64(querycount)
+	got["desyncs"] = stats.desyncs
+	for _, qdata := range qbuf {
+		got["completed"] += qdata.count
+		got["bytes"] += qdata.bytes
+		got["result-sets"] += qdata.sets
+		got["returned"] += qdata.returned
+	}
+	return got, expect
+}
+
+func TestPayloadFixtures(t *testing.T) {
+	files, err := filepath.Glob("testdata/streams/*.txt")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No payload fixtures found")
+	}
+
+	for _, filename := range files {
+		got, expect := replayFixture(t, filename)
+		for counter, expected := range expect {
+			if got[counter] != expected {
+				t.Errorf("%s: got %d %s, expected %d", filename, got[counter], counter, expected)
+			}
+		}
+	}
+}
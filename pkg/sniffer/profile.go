@@ -0,0 +1,189 @@
+/*
+ * profile.go
+ *
+ * Keeping the sniffer's own cost down on small hosts. The "full" profile is
+ * everything as usual; "lite" follows a sample of the connections, caps the
+ * fingerprints (the rest are counted together), keeps no raw samples and
+ * fewer latency samples per query, and reports at most once a minute.
+ *
+ * On top of that, with a CPU limit (a percentage of one core, 5% for lite) we
+ * watch our own CPU time and halve the share of connections we follow while
+ * we're over it, doubling it again (up to where it started) once we're well
+ * under. Which connections are followed goes by a hash of the client address,
+ * so a connection is either followed throughout or not at all.
+ *
+ */
+
+package sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	PROFILE_FULL = "full"
+	PROFILE_LITE = "lite"
+
+	// What lite does, unless told otherwise.
+	LITE_SAMPLE_RATE  = 0.25
+	LITE_FINGERPRINTS = 1000
+	LITE_BUCKETS      = 500
+	LITE_CPU          = 5.0
+	LITE_PERIOD       = time.Minute
+
+	// How often we look at our CPU time, and the smallest share of
+	// connections we'll go down to.
+	CPU_CHECK       = 5 * time.Second
+	MIN_SAMPLE_RATE = 1.0 / 64
+
+	// Where queries over the fingerprint cap are counted.
+	OTHER_QUERIES = "(other queries)"
+)
+
+var sampleRate, baseSampleRate float64 = 1, 1
+var maxFingerprints int = 0
+var timeBuckets int = TIME_BUCKETS
+var cpuLimit float64 = 0
+
+var throttle struct {
+	checked   time.Time
+	cpu       time.Duration // our CPU time when last checked
+	usage     float64       // the percentage of a core we used since the check before
+	tightened uint64
+	loosened  uint64
+	skipped   uint64 // packets of connections we aren't following
+	capped    uint64 // executions counted as OTHER_QUERIES
+}
+
+// applyProfile fills in what the profile sets and the options don't.
+func applyProfile(opts *Options) error {
+	switch opts.Profile {
+	case "", PROFILE_FULL:
+		if opts.SampleRate == 0 {
+			opts.SampleRate = 1
+		}
+	case PROFILE_LITE:
+		if opts.SampleRate == 0 {
+			opts.SampleRate = LITE_SAMPLE_RATE
+		}
+		if opts.MaxFingerprints == 0 {
+			opts.MaxFingerprints = LITE_FINGERPRINTS
+		}
+		if opts.CPULimit == 0 {
+			opts.CPULimit = LITE_CPU
+		}
+		if opts.Period < LITE_PERIOD {
+			opts.Period = LITE_PERIOD
+		}
+		opts.DictionarySamples = false
+	default:
+		return fmt.Errorf("Unknown profile: %s", opts.Profile)
+	}
+	if opts.SampleRate < 0 || opts.SampleRate > 1 {
+		return fmt.Errorf("The sample rate should be between 0 and 1, not %g", opts.SampleRate)
+	}
+	return nil
+}
+
+// sampled tells us whether we follow the connection of a client.
+func sampled(ip []byte, port uint16) bool {
+	if sampleRate >= 1 {
+		return true
+	}
+	var buf [18]byte
+	copy(buf[:16], net.IP(ip).To16())
+	binary.BigEndian.PutUint16(buf[16:], port)
+	hash := fnv.New32a()
+	hash.Write(buf[:])
+	return float64(hash.Sum32()) < sampleRate*math.MaxUint32
+}
+
+// sampledSource is sampled for a stream's ip:port.
+func sampledSource(src string) bool {
+	i := strings.LastIndex(src, ":")
+	if i < 0 {
+		return true
+	}
+	p, err := strconv.ParseUint(src[i+1:], 10, 16)
+	ip := net.ParseIP(src[:i])
+	if err != nil || ip == nil {
+		return true
+	}
+	return sampled(ip, uint16(p))
+}
+
+// cpuTime is the CPU time we've used, user and system.
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// checkCPU looks at the CPU we used since the last check, and follows fewer
+// or more connections accordingly.
+func checkCPU(now time.Time, used time.Duration) {
+	if cpuLimit <= 0 {
+		return
+	}
+	if throttle.checked.IsZero() {
+		throttle.checked, throttle.cpu = now, used
+		return
+	}
+	elapsed := now.Sub(throttle.checked)
+	if elapsed < CPU_CHECK {
+		return
+	}
+	throttle.usage = float64(used-throttle.cpu) / float64(elapsed) * 100
+	throttle.checked, throttle.cpu = now, used
+
+	switch {
+	case throttle.usage > cpuLimit && sampleRate > MIN_SAMPLE_RATE:
+		sampleRate = math.Max(sampleRate/2, MIN_SAMPLE_RATE)
+		throttle.tightened++
+		log.Printf("%sUsing %0.1f%% of a core, over the %0.1f%% limit: following %0.1f%% of "+
+			"connections%s", COLOR_RED, throttle.usage, cpuLimit, sampleRate*100, COLOR_DEFAULT)
+
+		// Forget the streams we no longer follow.
+		for src := range chmap {
+			if !sampledSource(src) {
+				delete(chmap, src)
+			}
+		}
+	case throttle.usage < cpuLimit/2 && sampleRate < baseSampleRate:
+		sampleRate = math.Min(sampleRate*2, baseSampleRate)
+		throttle.loosened++
+	}
+}
+
+// printProfile says what we're leaving out to keep our costs down.
+func printProfile(w io.Writer) {
+	if baseSampleRate >= 1 && maxFingerprints == 0 && cpuLimit == 0 {
+		return
+	}
+	line := fmt.Sprintf("following %0.1f%% of connections", sampleRate*100)
+	if throttle.tightened > 0 || throttle.loosened > 0 {
+		line += fmt.Sprintf(" (throttled %d times, eased %d)", throttle.tightened,
+			throttle.loosened)
+	}
+	if maxFingerprints > 0 {
+		line += fmt.Sprintf(" / %d fingerprints at most, %d executions over", maxFingerprints,
+			throttle.capped)
+	}
+	if cpuLimit > 0 {
+		line += fmt.Sprintf(" / %0.1f%% of a core used (limit %0.1f%%)", throttle.usage,
+			cpuLimit)
+	}
+	reportf(w, "%s", line)
+}
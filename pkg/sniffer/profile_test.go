@@ -0,0 +1,95 @@
+package sniffer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestApplyProfile(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Profile, opts.DictionarySamples = PROFILE_LITE, true
+	if err := applyProfile(&opts); err != nil {
+		t.Fatalf("Failed to apply lite: %s", err)
+	}
+	if opts.SampleRate != LITE_SAMPLE_RATE || opts.MaxFingerprints != LITE_FINGERPRINTS ||
+		opts.CPULimit != LITE_CPU || opts.Period != LITE_PERIOD || opts.DictionarySamples {
+		t.Errorf("For lite\n    Got %+v\n    Expected its defaults", opts)
+	}
+
+	opts = DefaultOptions()
+	opts.Profile, opts.SampleRate = PROFILE_LITE, 0.5
+	applyProfile(&opts)
+	if opts.SampleRate != 0.5 {
+		t.Errorf("For lite with a sample rate\n    Got %g\n    Expected 0.5", opts.SampleRate)
+	}
+
+	opts = DefaultOptions()
+	if applyProfile(&opts); opts.SampleRate != 1 || opts.CPULimit != 0 {
+		t.Errorf("For full\n    Got %g, %g\n    Expected everything", opts.SampleRate, opts.CPULimit)
+	}
+	opts.Profile = "medium"
+	if err := applyProfile(&opts); err == nil {
+		t.Errorf("For an unknown profile\n    Got no error\n    Expected one")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	defer func() { sampleRate, baseSampleRate, cpuLimit = 1, 1, 0 }()
+	sampleRate, baseSampleRate, cpuLimit = 0.5, 0.5, 5
+	throttle.checked, throttle.tightened, throttle.loosened = time.Time{}, 0, 0
+
+	// About half the connections are followed.
+	followed := 0
+	for p := 0; p < 10000; p++ {
+		if sampled([]byte{10, 0, 0, byte(p)}, uint16(40000+p)) {
+			followed++
+		}
+	}
+	if followed < 4500 || followed > 5500 {
+		t.Errorf("For the connections followed\n    Got %d of 10000\n    Expected about half",
+			followed)
+	}
+
+	chmap = make(map[string]*source)
+	for p := 0; p < 100; p++ {
+		src := fmt.Sprintf("10.0.0.%d:%d", p, 40000+p)
+		if sampledSource(src) {
+			chmap[src] = &source{src: src}
+		}
+	}
+	streams := len(chmap)
+
+	// 10% of a core over 5 seconds halves it, and drops the streams left out.
+	now := time.Unix(1000, 0)
+	checkCPU(now, time.Second)
+	checkCPU(now.Add(5*time.Second), time.Second+500*time.Millisecond)
+	if sampleRate != 0.25 || throttle.tightened != 1 || throttle.usage != 10 {
+		t.Errorf("For 10%% of a core\n    Got rate %g, usage %g\n    Expected 0.25, 10",
+			sampleRate, throttle.usage)
+	}
+	if len(chmap) >= streams || len(chmap) == 0 {
+		t.Errorf("For the streams\n    Got %d of %d\n    Expected about half", len(chmap), streams)
+	}
+
+	// 1% eases it back, but not past where it started.
+	checkCPU(now.Add(10*time.Second), time.Second+550*time.Millisecond)
+	checkCPU(now.Add(15*time.Second), time.Second+600*time.Millisecond)
+	if sampleRate != 0.5 || throttle.loosened != 1 {
+		t.Errorf("For 1%% of a core\n    Got rate %g, eased %d times\n    Expected 0.5, once",
+			sampleRate, throttle.loosened)
+	}
+}
+
+func TestFingerprintCap(t *testing.T) {
+	defer func() { maxFingerprints = 0 }()
+	qbuf, maxFingerprints, throttle.capped = make(map[string]*queryData), 2, 0
+	for _, query := range []string{"select a", "select b", "select c", "select d", "select a"} {
+		aggregate(query, query, 0, 1000, 10, 0)
+	}
+	if len(qbuf) != 3 || qbuf["select a"].count != 2 || qbuf[OTHER_QUERIES].count != 2 ||
+		throttle.capped != 2 {
+		t.Errorf("For a cap of 2\n    Got %d fingerprints, %d capped\n"+
+			"    Expected 2 and the other queries", len(qbuf), throttle.capped)
+	}
+}
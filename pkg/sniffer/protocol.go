@@ -0,0 +1,193 @@
+/*
+ * protocol.go
+ *
+ * Helpers for picking apart MySQL protocol packets.
+ *
+ */
+
+package sniffer
+
+import (
+	"strconv"
+)
+
+const (
+	// MySQL command types, in addition to COM_QUERY
+	COM_QUIT                = 0x01
+	COM_INIT_DB             = 0x02
+	COM_FIELD_LIST          = 0x04
+	COM_REFRESH             = 0x07
+	COM_STATISTICS          = 0x09
+	COM_PROCESS_INFO        = 0x0a
+	COM_PROCESS_KILL        = 0x0c
+	COM_DEBUG               = 0x0d
+	COM_PING                = 0x0e
+	COM_CHANGE_USER         = 0x11
+	COM_BINLOG_DUMP         = 0x12
+	COM_REGISTER_SLAVE      = 0x15
+	COM_STMT_PREPARE        = 0x16
+	COM_STMT_EXECUTE        = 0x17
+	COM_STMT_SEND_LONG_DATA = 0x18
+	COM_STMT_CLOSE          = 0x19
+	COM_STMT_RESET          = 0x1a
+	COM_SET_OPTION          = 0x1b
+	COM_STMT_FETCH          = 0x1c
+	COM_BINLOG_DUMP_GTID    = 0x1e
+	COM_RESET_CONNECTION    = 0x1f
+
+	// The last command there is (COM_SUBSCRIBE_GROUP_REPLICATION_STREAM).
+	COM_LAST = 0x21
+)
+
+// syncCommand says whether a command picked up out of sync is one we can start
+// following the stream from: one clients commonly open with or are made of,
+// with a payload that fits it.
+func syncCommand(ptype int, pdata []byte) bool {
+	switch ptype {
+	case COM_QUERY, COM_INIT_DB, COM_STMT_PREPARE:
+		return len(pdata) > 0
+	case COM_PING, COM_QUIT:
+		return len(pdata) == 0
+	case COM_STMT_EXECUTE:
+		return len(pdata) >= 9
+	case COM_STMT_CLOSE:
+		return len(pdata) == 4
+	}
+	return false
+}
+
+const (
+	// MySQL error codes we care about
+	ER_LOCK_WAIT_TIMEOUT = 1205
+	ER_LOCK_DEADLOCK     = 1213
+)
+
+// parseWarnings returns the warning count from an OK or EOF packet payload, and
+// whether it was one. OK packets only come first in a response; anywhere else a
+// leading 0 is part of a row.
+func parseWarnings(payload []byte, first bool) (int, bool) {
+	switch {
+	case len(payload) == 0:
+		return 0, false
+	case payload[0] == 0xfe && len(payload) == 5:
+		// An EOF: the warnings, then the status.
+		return int(payload[1]) | int(payload[2])<<8, true
+	case payload[0] == 0xfe, payload[0] == 0x00 && first:
+		// An OK packet, or one ending a result set when the client doesn't want
+		// EOFs: the affected rows and insert id, then the status and warnings.
+		pos := 1
+		for i := 0; i < 2; i++ {
+			size := lenencSize(payload[pos:])
+			if size == 0 {
+				return 0, false
+			}
+			pos += size
+		}
+		if pos+4 > len(payload) {
+			return 0, false
+		}
+		return int(payload[pos+2]) | int(payload[pos+3])<<8, true
+	}
+	return 0, false
+}
+
+// parseStatus returns the status flags from an OK or EOF packet payload, and
+// whether it was one.
+func parseStatus(payload []byte) (int, bool) {
+	switch {
+	case len(payload) == 0:
+		return 0, false
+	case payload[0] == 0xfe && len(payload) == 5:
+		return int(payload[3]) | int(payload[4])<<8, true
+	case payload[0] == 0xfe, payload[0] == 0x00:
+		pos := 1
+		for i := 0; i < 2; i++ {
+			size := lenencSize(payload[pos:])
+			if size == 0 {
+				return 0, false
+			}
+			pos += size
+		}
+		if pos+2 > len(payload) {
+			return 0, false
+		}
+		return int(payload[pos]) | int(payload[pos+1])<<8, true
+	}
+	return 0, false
+}
+
+// lenencInt returns the length encoded integer at the start of data, or 0 if
+// it's truncated or isn't one.
+func lenencInt(data []byte) uint64 {
+	size := lenencSize(data)
+	if size == 1 {
+		return uint64(data[0])
+	}
+	var value uint64
+	for i := size - 1; i > 0; i-- {
+		value = value<<8 | uint64(data[i])
+	}
+	return value
+}
+
+// lenencSize returns how many bytes the length encoded integer at the start of
+// data takes, or 0 if it's truncated or isn't one.
+func lenencSize(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	size := 1
+	switch data[0] {
+	case 0xfc:
+		size = 3
+	case 0xfd:
+		size = 4
+	case 0xfe:
+		size = 9
+	case 0xfb, 0xff:
+		return 0
+	}
+	if size > len(data) {
+		return 0
+	}
+	return size
+}
+
+// responseClass sums up the first packet of a response for -split-errors: "ok",
+// "rows" for a result set, or the error code.
+func responseClass(data []byte, errcode int) string {
+	switch {
+	case errcode != 0:
+		return strconv.Itoa(errcode)
+	case len(data) > 4 && data[4] == 0x00:
+		return "ok"
+	}
+	return "rows"
+}
+
+// parseAffectedRows returns the affected rows if the data starts with an OK
+// packet, or 0 if it doesn't.
+func parseAffectedRows(data []byte) uint64 {
+	if len(data) < 6 || data[4] != 0x00 {
+		return 0
+	}
+	return lenencInt(data[5:])
+}
+
+// parseSQLState returns the SQL state of an ERR packet, or "" if the data
+// doesn't start with one or it has none.
+func parseSQLState(data []byte) string {
+	if len(data) < 13 || data[4] != 0xff || data[7] != '#' {
+		return ""
+	}
+	return string(data[8:13])
+}
+
+// parseErrorCode returns the error code if the data starts with an ERR packet,
+// or 0 if it doesn't.
+func parseErrorCode(data []byte) int {
+	if len(data) < 7 || data[4] != 0xff {
+		return 0
+	}
+	return int(data[5]) | int(data[6])<<8
+}
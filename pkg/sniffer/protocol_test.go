@@ -0,0 +1,139 @@
+package sniffer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSplitErrors(t *testing.T) {
+	defer func() { splitErrors = false }()
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	splitErrors = true
+	parseFormat("#q")
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	client := [4]byte{10, 0, 0, 2}
+	lockWait := []byte{9, 0, 0, 1, 0xff, 0xb5, 0x04, '#', 'H', 'Y', '0', '0', '0'}
+
+	for _, response := range [][]byte{{1, 0, 0, 1, 1}, lockWait, {1, 0, 0, 1, 1}} {
+		handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+		handlePacket(tcpPacket(client, 50000, false, TCP_ACK, response))
+	}
+
+	for key, expected := range map[string]uint64{"select ? [rows]": 2, "select ? [1205]": 1} {
+		if qdata := qbuf[key]; qdata == nil || qdata.count != expected ||
+			qdata.splitOf != "select ?" {
+			t.Errorf("For %s\n    Got %+v\n    Expected %d executions of select ?", key, qdata,
+				expected)
+		}
+	}
+}
+
+func TestAffectedRows(t *testing.T) {
+	qbuf, format = make(map[string]*queryData), nil
+	parseFormat("#q")
+	rs := &source{synced: true}
+	lockWait := mysqlPacket(1, 0xff, 0xb5, 0x04, '#', 'H', 'Y', '0', '0', '0')
+
+	for _, exec := range []struct {
+		query    string
+		response []byte
+	}{
+		{"update t set a = 1", mysqlPacket(1, 0, 5, 0, 2, 0, 0, 0)},
+		{"update t set a = 2", mysqlPacket(1, 0, 0xfc, 0x2c, 0x01, 0, 2, 0, 0, 0)},
+		{"update t set a = 3", lockWait},
+		{"delete from t", lockWait},
+		{"select 1", mysqlPacket(1, 1)},
+	} {
+		processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, exec.query...)...))
+		processPacket(rs, false, exec.response)
+	}
+
+	for key, expected := range map[string]string{"update t set a = ?": "152.5",
+		"delete from t": "-", "select ?": "-"} {
+		qdata := qbuf[key]
+		got := "-"
+		if avg, ok := qdata.avgRows(); ok {
+			got = fmt.Sprintf("%.1f", avg)
+		}
+		if got != expected || !strings.Contains(formatRow(copyRow(key, qdata), 1), " "+expected+"  ") {
+			t.Errorf("For the rows affected by %s\n    Got %s\n    Expected %s", key, got,
+				expected)
+		}
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	qbuf, format, stats.errors.responses = make(map[string]*queryData), nil, 0
+	parseFormat("#q")
+	rs := &source{synced: true}
+	syntax := mysqlPacket(1, 0xff, 0x28, 0x04, '#', '4', '2', '0', '0', '0', 'o', 'o', 'p', 's')
+
+	for _, exec := range []struct {
+		query    string
+		response []byte
+	}{
+		{"selec 1", syntax},
+		{"selec 2", syntax},
+		{"update t set a = 1", mysqlPacket(1, 0, 1, 0, 2, 0, 0, 0)},
+		{"update t set a = 2", syntax},
+	} {
+		processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, exec.query...)...))
+		processPacket(rs, false, exec.response)
+	}
+
+	if state := parseSQLState(syntax); state != "42000" {
+		t.Errorf("For the SQL state\n    Got %s\n    Expected 42000", state)
+	}
+	if stats.errors.responses != 3 {
+		t.Errorf("For the errors overall\n    Got %d\n    Expected 3", stats.errors.responses)
+	}
+	for key, expected := range map[string]float64{"selec ?": 100, "update t set a = ?": 50} {
+		qdata := qbuf[key]
+		if rate := sortValue(key, qdata, "errors"); rate != expected ||
+			!strings.Contains(formatRow(copyRow(key, qdata), 1), fmt.Sprintf("%5.1f", expected)) {
+			t.Errorf("For the error rate of %s\n    Got %0.1f%%\n    Expected %0.1f%%", key, rate,
+				expected)
+		}
+	}
+}
+
+func TestRowsReturned(t *testing.T) {
+	qbuf, format = make(map[string]*queryData), nil
+	parseFormat("#q")
+	rs := &source{synced: true}
+	eof := []byte{0xfe, 0, 0, 2, 0}
+
+	// Three text rows, then none.
+	for _, rows := range []int{3, 0} {
+		processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select a from t"...)...))
+		response := append(mysqlPacket(1, 1), mysqlPacket(2, 3, 'd', 'e', 'f')...)
+		response = append(response, mysqlPacket(3, eof...)...)
+		for i := 0; i < rows; i++ {
+			response = append(response, mysqlPacket(byte(4+i), 1, 'x')...)
+		}
+		processPacket(rs, false, append(response, mysqlPacket(byte(4+rows), eof...)...))
+	}
+
+	// Binary rows start with 0x00, and don't end the result set.
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_STMT_PREPARE}, "select b"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0, 9, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0))
+	processPacket(rs, true, mysqlPacket(0, COM_STMT_EXECUTE, 9, 0, 0, 0, 0, 1, 0, 0, 0))
+	response := append(mysqlPacket(1, 1), mysqlPacket(2, 3, 'd', 'e', 'f')...)
+	response = append(response, mysqlPacket(3, eof...)...)
+	response = append(response, mysqlPacket(4, 0, 0, 1, 2, 3, 4)...)
+	response = append(response, mysqlPacket(5, 0, 0, 5, 6, 7, 8)...)
+	processPacket(rs, false, append(response, mysqlPacket(6, eof...)...))
+
+	for key, expected := range map[string]string{"select a from t": "1.5", "select b": "2.0"} {
+		qdata := qbuf[key]
+		if qdata == nil {
+			t.Fatalf("For %s\n    Got nothing\n    Expected it counted", key)
+		}
+		got := formatAverage(qdata.avgReturned())
+		if got != expected || sortValue(key, qdata, "returned") == 0 {
+			t.Errorf("For the rows returned by %s\n    Got %s\n    Expected %s", key, got,
+				expected)
+		}
+	}
+}
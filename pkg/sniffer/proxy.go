@@ -0,0 +1,241 @@
+/*
+ * proxy.go
+ *
+ * Sniffing a ProxySQL or MaxScale host, where every query shows up twice: on
+ * the frontend, from the application to the proxy, and on the backend, from
+ * the proxy to MySQL. With -proxy 6033:3306 (frontend ports, then backend
+ * ports, each comma separated) streams know which side they're on, and their
+ * queries are aggregated separately as "[frontend] ..." and "[backend] ...",
+ * so nothing is counted twice.
+ *
+ * To see what the proxy itself costs, we match backend queries to the
+ * frontend queries they came from: the oldest unanswered frontend query with
+ * the same text that was sent shortly before, preferring frontend connections
+ * the backend connection has served before. The frontend latency minus the
+ * backend latency is the proxy's overhead.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SIDE_FRONTEND = "frontend"
+	SIDE_BACKEND  = "backend"
+
+	// How long after a frontend query its backend query may start, and how
+	// long we wait for an answer to a frontend query before giving up on it.
+	PROXY_WINDOW = time.Second
+	PROXY_EXPIRE = time.Minute
+)
+
+// The ports of each side, nil if we aren't sniffing a proxy.
+var proxyFrontend, proxyBackend map[uint16]bool
+
+// proxyQuery is a frontend query waiting for its answer.
+type proxyQuery struct {
+	rs      *source
+	sent    time.Time
+	backend uint64 // the matched backend query's latency, 0 if none yet
+}
+
+// proxyStats is the matched queries of a fingerprint.
+type proxyStats struct {
+	count    uint64
+	frontend uint64
+	backend  uint64
+}
+
+var proxyPending map[string][]*proxyQuery = make(map[string][]*proxyQuery)
+var proxyQueries map[string]*proxyStats = make(map[string]*proxyStats)
+
+// parseProxy reads the ports of -proxy, e.g. "6033:3306" or "6033,6034:3306".
+func parseProxy(spec string) (frontend, backend map[uint16]bool, err error) {
+	if spec == "" {
+		return nil, nil, nil
+	}
+	sides := strings.Split(spec, ":")
+	if len(sides) != 2 {
+		return nil, nil, fmt.Errorf("Proxy ports should be frontend:backend, not %s", spec)
+	}
+	frontend, backend = make(map[uint16]bool), make(map[uint16]bool)
+	for i, ports := range []map[uint16]bool{frontend, backend} {
+		for _, item := range strings.Split(sides[i], ",") {
+			p, err := strconv.ParseUint(strings.TrimSpace(item), 10, 16)
+			if err != nil || p == 0 {
+				return nil, nil, fmt.Errorf("Bad proxy port: %s", item)
+			}
+			ports[uint16(p)] = true
+		}
+	}
+	for p := range frontend {
+		if backend[p] {
+			return nil, nil, fmt.Errorf("Port %d can't be both frontend and backend", p)
+		}
+	}
+	return frontend, backend, nil
+}
+
+// serverPort tells us which end of a packet is the server, and the side it's
+// on when sniffing a proxy.
+func serverPort(srcIP, dstIP []byte, srcPort, dstPort uint16) (server uint16, request bool,
+	side string, ok bool) {
+	if targets != nil {
+		if t, ok := matchTarget(dstIP, dstPort); ok {
+			return dstPort, true, t.side, true
+		}
+		if t, ok := matchTarget(srcIP, srcPort); ok {
+			return srcPort, false, t.side, true
+		}
+		return 0, false, "", false
+	}
+	if proxyFrontend == nil {
+		return port, dstPort == port, "", srcPort == port || dstPort == port
+	}
+	for _, p := range []uint16{dstPort, srcPort} {
+		request = p == dstPort
+		if proxyFrontend[p] {
+			return p, request, SIDE_FRONTEND, true
+		}
+		if proxyBackend[p] {
+			return p, request, SIDE_BACKEND, true
+		}
+	}
+	return 0, false, "", false
+}
+
+// portFilter is the BPF filter for the ports we're sniffing.
+func portFilter() string {
+	if targets != nil {
+		return targetFilter()
+	}
+	if proxyFrontend == nil {
+		return fmt.Sprintf("tcp port %d", port)
+	}
+	var ports []string
+	for _, side := range []map[uint16]bool{proxyFrontend, proxyBackend} {
+		for p := range side {
+			ports = append(ports, fmt.Sprintf("port %d", p))
+		}
+	}
+	sort.Strings(ports)
+	return "tcp and (" + strings.Join(ports, " or ") + ")"
+}
+
+// sideLabel is what goes in front of the queries of a stream.
+func sideLabel(rs *source) string {
+	if rs.side == "" {
+		return ""
+	}
+	return "[" + rs.side + "] "
+}
+
+// proxySent notes a frontend query being sent, to match with its backend query.
+func proxySent(rs *source) {
+	key := strings.TrimPrefix(rs.qtext, sideLabel(rs))
+	proxyPending[key] = append(proxyPending[key], &proxyQuery{rs: rs, sent: *rs.reqSent})
+}
+
+// proxyAnswered matches a backend query to the frontend query it came from, or
+// records the overhead for a frontend query, now that it's been answered.
+func proxyAnswered(rs *source, reqtime uint64) {
+	key := strings.TrimPrefix(rs.qtext, sideLabel(rs))
+	now := clock()
+
+	// Forget about frontend queries we never saw answered.
+	pending := proxyPending[key]
+	for len(pending) > 0 && now.Sub(pending[0].sent) > PROXY_EXPIRE {
+		pending = pending[1:]
+	}
+	proxyPending[key] = pending
+	if len(pending) == 0 {
+		delete(proxyPending, key)
+	}
+
+	if rs.side == SIDE_BACKEND {
+		stats.proxy.backend++
+		var match *proxyQuery
+		for _, pq := range pending {
+			if pq.backend != 0 || pq.sent.After(*rs.reqSent) ||
+				rs.reqSent.Sub(pq.sent) > PROXY_WINDOW {
+				continue
+			}
+			if match == nil || pq.rs == rs.proxyPeer {
+				match = pq
+			}
+			if pq.rs == rs.proxyPeer {
+				break
+			}
+		}
+		if match != nil {
+			match.backend = reqtime
+			rs.proxyPeer = match.rs
+			trace(rs, "backend query for %s", match.rs.src)
+		}
+		return
+	}
+
+	stats.proxy.frontend++
+	for i, pq := range pending {
+		if pq.rs != rs {
+			continue
+		}
+		proxyPending[key] = append(pending[:i:i], pending[i+1:]...)
+		if len(proxyPending[key]) == 0 {
+			delete(proxyPending, key)
+		}
+		if pq.backend == 0 || pq.backend > reqtime {
+			return
+		}
+		stats.proxy.matched++
+		ps, ok := proxyQueries[key]
+		if !ok {
+			ps = &proxyStats{}
+			proxyQueries[key] = ps
+		}
+		ps.count++
+		ps.frontend += reqtime
+		ps.backend += pq.backend
+		trace(rs, "proxy overhead %0.2fms", float64(reqtime-pq.backend)/1000000)
+		return
+	}
+}
+
+// printProxy prints the latencies of both sides and the proxy's overhead for
+// the queries costing the most overhead.
+func printProxy(w io.Writer, displaycount int) {
+	if proxyFrontend == nil {
+		return
+	}
+	reportf(w, " ")
+	reportf(w, "%sProxy: %d frontend and %d backend queries, %d matched%s", COLOR_RED,
+		stats.proxy.frontend, stats.proxy.backend, stats.proxy.matched, COLOR_DEFAULT)
+	if len(proxyQueries) == 0 {
+		return
+	}
+
+	var tmp sortableSlice
+	for key, ps := range proxyQueries {
+		n := float64(ps.count) * 1000000
+		overhead := float64(ps.frontend-ps.backend) / n
+		tmp = append(tmp, sortable{float64(ps.frontend - ps.backend), fmt.Sprintf(
+			"%s%6d  %s%8.2f %8.2f  %s%8.2f  %s%s%s", COLOR_YELLOW, ps.count, COLOR_GREEN,
+			float64(ps.frontend)/n, float64(ps.backend)/n, COLOR_RED, overhead, COLOR_WHITE,
+			redactQuery(key), COLOR_DEFAULT)})
+	}
+	sort.Sort(sort.Reverse(tmp))
+
+	reportf(w, "%s count  %sfrontend  backend  %soverhead  %squery%s", COLOR_YELLOW, COLOR_GREEN,
+		COLOR_RED, COLOR_WHITE, COLOR_DEFAULT)
+	for i := 0; i < len(tmp) && i < displaycount; i++ {
+		fmt.Fprintln(w, tmp[i].line)
+	}
+}
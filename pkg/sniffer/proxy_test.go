@@ -0,0 +1,61 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProxy(t *testing.T) {
+	frontend, backend, err := parseProxy("6033, 6034:3306")
+	if err != nil || len(frontend) != 2 || !frontend[6034] || len(backend) != 1 || !backend[3306] {
+		t.Errorf("For 6033, 6034:3306\n    Got %v, %v, %v\n    Expected 6033 and 6034, 3306",
+			frontend, backend, err)
+	}
+	for _, spec := range []string{"6033", "6033:x", "3306:3306", "6033:3306:1"} {
+		if _, _, err := parseProxy(spec); err == nil {
+			t.Errorf("For %s\n    Got no error\n    Expected an error", spec)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	defer func() { clock, proxyFrontend, proxyBackend = time.Now, nil, nil }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	proxyFrontend, proxyBackend, _ = parseProxy("6033:3306")
+	proxyPending, proxyQueries = make(map[string][]*proxyQuery), make(map[string]*proxyStats)
+	stats.proxy.frontend, stats.proxy.backend, stats.proxy.matched = 0, 0, 0
+	parseFormat("#q")
+	app, proxy := [4]byte{10, 0, 0, 5}, [4]byte{10, 0, 0, 1}
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	ok := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+
+	// The application asks the proxy, which asks MySQL 1ms later; MySQL takes
+	// 5ms and the proxy 2ms more to answer.
+	port = 6033
+	handlePacket(tcpPacket(app, 50000, true, TCP_ACK, query))
+	now = now.Add(time.Millisecond)
+	port = 3306
+	handlePacket(tcpPacket(proxy, 40000, true, TCP_ACK, query))
+	now = now.Add(5 * time.Millisecond)
+	handlePacket(tcpPacket(proxy, 40000, false, TCP_ACK, ok))
+	now = now.Add(2 * time.Millisecond)
+	port = 6033
+	handlePacket(tcpPacket(app, 50000, false, TCP_ACK, ok))
+
+	frontend, backend := qbuf["[frontend] select ?"], qbuf["[backend] select ?"]
+	if len(qbuf) != 2 || frontend == nil || frontend.count != 1 || backend == nil ||
+		backend.count != 1 {
+		t.Errorf("For the sides\n    Got %v\n    Expected one query on each", qbuf)
+	}
+	ps := proxyQueries["select ?"]
+	if stats.proxy.matched != 1 || ps == nil || ps.frontend-ps.backend != uint64(3*time.Millisecond) {
+		t.Errorf("For the overhead\n    Got %d matched, %+v\n    Expected 1 with 3ms overhead",
+			stats.proxy.matched, ps)
+	}
+	if len(proxyPending) != 0 {
+		t.Errorf("For pending queries\n    Got %v\n    Expected none", proxyPending)
+	}
+}
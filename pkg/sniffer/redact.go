@@ -0,0 +1,228 @@
+/*
+ * redact.go
+ *
+ * Reports that can be shared. With -redact, everything we show or send has
+ * its table and column names replaced by pseudonyms (table1, col3, the same
+ * throughout the run), client IPs, users and programs replaced by salted
+ * hashes, and comments and raw samples dropped. The numbers are left alone.
+ *
+ * Only what goes out is redacted; we aggregate on the real queries, so the
+ * fingerprints and their hashes are the same as without -redact. The clients,
+ * servers, users, databases and programs a format puts in the aggregation keys
+ * are the exception: they're redacted as the keys are made, and only the
+ * statements in the keys are given pseudonyms as they go out. With -redact-map,
+ * the pseudonyms and what they stand for are written to a local file after
+ * every status report, to translate questions back.
+ *
+ */
+
+package sniffer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+var redacting bool = false
+var redactMap string
+
+// The pseudonyms handed out, keyed by kind and name, and how many of each
+// kind there are.
+var pseudonyms map[string]string = make(map[string]string)
+var pseudonymCounts map[string]int = make(map[string]int)
+
+// The queries redacted lately, since events redact them on the capture path.
+// It starts over when it has REDACT_CACHE of them.
+const REDACT_CACHE = 10000
+
+var redactedQueries map[string]string = make(map[string]string)
+
+// The pattern of the aggregation keys, and the format it was made for.
+var keyRegexp *regexp.Regexp
+var keyRegexpFormat string
+
+// Hashes are salted per run, since there aren't so many IPs to try.
+var redactSalt []byte
+
+// pseudonym returns the name standing in for a table or column.
+func pseudonym(prefix string, name string) string {
+	key := prefix + "/" + strings.ToLower(name)
+	if alias, ok := pseudonyms[key]; ok {
+		return alias
+	}
+	pseudonymCounts[prefix]++
+	alias := fmt.Sprintf("%s%d", prefix, pseudonymCounts[prefix])
+	pseudonyms[key] = alias
+	return alias
+}
+
+// hashed returns the salted hash standing in for a client or user.
+func hashed(prefix string, name string) string {
+	key := prefix + "/" + name
+	if alias, ok := pseudonyms[key]; ok {
+		return alias
+	}
+	if redactSalt == nil {
+		redactSalt = make([]byte, 16)
+		rand.Read(redactSalt)
+	}
+	sum := sha256.Sum256(append(append([]byte(nil), redactSalt...), name...))
+	alias := prefix + "-" + hex.EncodeToString(sum[:4])
+	pseudonyms[key] = alias
+	return alias
+}
+
+// redactQuery redacts a query, or an aggregation key, keeping the labels we put
+// in brackets around it.
+func redactQuery(query string) string {
+	if !redacting {
+		return query
+	}
+	if redacted, ok := redactedQueries[query]; ok {
+		return redacted
+	}
+	original, prefix, suffix := query, "", ""
+	if strings.HasPrefix(query, "[") {
+		if i := strings.Index(query, "] "); i > 0 {
+			prefix, query = query[:i+2], query[i+2:]
+		}
+	}
+	if strings.HasSuffix(query, "]") {
+		if i := strings.LastIndex(query, " ["); i > 0 {
+			query, suffix = query[:i], query[i:]
+		}
+	}
+	redacted := prefix + redactKey(query) + suffix
+	if len(redactedQueries) >= REDACT_CACHE {
+		redactedQueries = make(map[string]string)
+	}
+	redactedQueries[original] = redacted
+	return redacted
+}
+
+// redactKey gives the statements in an aggregation key pseudonyms, leaving the
+// rest of what the format put in it, which formatQuery already redacted. What
+// doesn't look like a key of the format is taken to be a statement.
+func redactKey(key string) string {
+	match := keyPattern().FindStringSubmatchIndex(key)
+	if match == nil {
+		return redactStatement(key)
+	}
+	var redacted strings.Builder
+	last := 0
+	for i := 2; i < len(match); i += 2 {
+		redacted.WriteString(key[last:match[i]])
+		redacted.WriteString(redactStatement(key[match[i]:match[i+1]]))
+		last = match[i+1]
+	}
+	redacted.WriteString(key[last:])
+	return redacted.String()
+}
+
+// redactStatement gives the tables and columns of a statement pseudonyms.
+func redactStatement(statement string) string {
+	return canonical.Redact(statement, func(kind int, ident string) string {
+		if kind == canonical.IDENT_TABLE {
+			return pseudonym("table", ident)
+		}
+		return pseudonym("col", ident)
+	})
+}
+
+// keyPattern matches the aggregation keys formatQuery makes with -redact,
+// with a group for each statement (or route, which may be one) in them.
+func keyPattern() *regexp.Regexp {
+	described := fmt.Sprint(format)
+	if keyRegexp != nil && described == keyRegexpFormat {
+		return keyRegexp
+	}
+	client := `client-[0-9a-f]{8}(?::\d+)?`
+	pattern := "(?s)^"
+	for _, item := range format {
+		switch item := item.(type) {
+		case string:
+			pattern += regexp.QuoteMeta(item)
+		case int:
+			switch item {
+			case F_QUERY, F_ROUTE:
+				pattern += "(.*?)"
+			case F_SOURCE, F_SOURCEIP, F_SERVER:
+				pattern += client
+			case F_USER:
+				pattern += "(?:user-[0-9a-f]{8}|" + regexp.QuoteMeta(UNKNOWN_USER) + ")"
+			case F_DATABASE:
+				pattern += `(?:db\d+|` + regexp.QuoteMeta(UNKNOWN_DATABASE) + ")"
+			case F_PROGRAM:
+				pattern += "(?:program-[0-9a-f]{8}|" + regexp.QuoteMeta(UNKNOWN_PROGRAM) + ")"
+			}
+		}
+	}
+	keyRegexp, keyRegexpFormat = regexp.MustCompile(pattern+"$"), described
+	return keyRegexp
+}
+
+// redactClient redacts a client IP, ip:port or subnet, keeping the port.
+func redactClient(client string) string {
+	if !redacting {
+		return client
+	}
+	if i := strings.LastIndex(client, ":"); i > 0 && !strings.Contains(client, "/") {
+		return hashed("client", client[:i]) + client[i:]
+	}
+	return hashed("client", client)
+}
+
+// redactUser redacts a user name.
+func redactUser(user string) string {
+	if !redacting || user == "" || user == UNKNOWN_USER {
+		return user
+	}
+	return hashed("user", user)
+}
+
+// redactProgram redacts the program a client said it was.
+func redactProgram(program string) string {
+	if !redacting || program == "" {
+		return program
+	}
+	return hashed("program", program)
+}
+
+// redactDB redacts a database name.
+func redactDB(db string) string {
+	if !redacting || db == "" {
+		return db
+	}
+	return pseudonym("db", db)
+}
+
+// writePseudonyms writes what the pseudonyms stand for, one per line.
+func writePseudonyms(filename string) error {
+	var lines []string
+	for key, alias := range pseudonyms {
+		lines = append(lines, alias+"\t"+key[strings.Index(key, "/")+1:])
+	}
+	sort.Strings(lines)
+
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
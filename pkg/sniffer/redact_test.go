@@ -0,0 +1,116 @@
+package sniffer
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	redacting = true
+	pseudonyms, pseudonymCounts = make(map[string]string), make(map[string]int)
+	redactedQueries = make(map[string]string)
+	defer func() { redacting = false }()
+
+	for _, test := range []struct{ query, expected string }{
+		{"select name from users where id = ?", "select col1 from table1 where col2 = ?"},
+		{"[frontend] select id from users", "[frontend] select col2 from table1"},
+		{"delete from orders where user_id = ? [error 1213]",
+			"delete from table2 where col3 = ? [error 1213]"},
+		{"SELECT Name FROM Users", "SELECT col1 FROM table1"},
+	} {
+		if got := redactQuery(test.query); got != test.expected {
+			t.Errorf("For query %s\n    Got %s\n    Expected %s", test.query, got, test.expected)
+		}
+	}
+
+	client := redactClient("10.0.0.5:41000")
+	if !strings.HasPrefix(client, "client-") || !strings.HasSuffix(client, ":41000") ||
+		strings.Contains(client, "10.0.0.5") {
+		t.Errorf("For the client\n    Got %s\n    Expected a hash with the port", client)
+	}
+	if other := redactClient("10.0.0.5"); other+":41000" != client {
+		t.Errorf("For the client without a port\n    Got %s\n    Expected the same hash", other)
+	}
+	if redactUser("app") == "app" || redactUser(UNKNOWN_USER) != UNKNOWN_USER {
+		t.Errorf("For the users\n    Got %s, %s\n    Expected app hashed", redactUser("app"),
+			redactUser(UNKNOWN_USER))
+	}
+	if program := redactProgram("billing-cron"); !strings.HasPrefix(program, "program-") {
+		t.Errorf("For the program\n    Got %s\n    Expected a hash", program)
+	}
+
+	filename := filepath.Join(t.TempDir(), "pseudonyms")
+	if err := writePseudonyms(filename); err != nil {
+		t.Fatalf("Failed to write the pseudonyms: %s", err)
+	}
+	data, _ := os.ReadFile(filename)
+	for _, line := range []string{"table1\tusers\n", "col3\tuser_id\n", "user-"} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("For the pseudonyms\n    Got %s\n    Expected %q", data, line)
+		}
+	}
+}
+
+func TestRedactKey(t *testing.T) {
+	redacting, clients = true, make(map[string]*clientData)
+	pseudonyms, pseudonymCounts = make(map[string]string), make(map[string]int)
+	redactedQueries = make(map[string]string)
+	defer func() { redacting = false }()
+
+	rs := &source{src: "10.0.0.5:41000", srcip: "10.0.0.5", user: "app", db: "shop"}
+	for _, test := range []struct{ format, expected string }{
+		{"#s:#q", redactClient("10.0.0.5") + ":select col1 from table1"},
+		{"#u@#d:#q", redactUser("app") + "@db1:select col1 from table1"},
+		{"#i #q (#D)", redactClient("10.0.0.5") + " select col1 from table1 (" +
+			redactClient("10.0.0.9:3306") + ")"},
+	} {
+		format = nil
+		parseFormat(test.format)
+		rs.dst = "10.0.0.9:3306"
+		key := formatQuery(rs, []byte("select name from users"))
+		if got := redactQuery(key); got != test.expected {
+			t.Errorf("For %s\n    Got %s\n    Expected %s", test.format, got, test.expected)
+		}
+	}
+
+	// The queries redacted are only remembered for so long.
+	for i := 0; i <= REDACT_CACHE; i++ {
+		redactQuery(fmt.Sprintf("select c%d from t", i))
+	}
+	if len(redactedQueries) > REDACT_CACHE {
+		t.Errorf("For the redacted queries\n    Got %d\n    Expected at most %d",
+			len(redactedQueries), REDACT_CACHE)
+	}
+}
+
+func TestRedactedUnboundedWrite(t *testing.T) {
+	redacting = true
+	customPatterns = []customPattern{{"orders by status", nil}}
+	defer func() {
+		redacting, customPatterns = false, nil
+		delete(unbounded, "delete from orders_secret")
+	}()
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	checkUnboundedWrite(&source{src: "10.0.0.5:41000", user: "app"},
+		[]byte("delete from orders_secret"))
+	for _, hidden := range []string{"10.0.0.5", "app", "orders_secret"} {
+		if strings.Contains(out.String(), hidden) {
+			t.Errorf("For the alert\n    Got %s\n    Expected no %s", out.String(), hidden)
+		}
+	}
+
+	if name := redactPattern("orders by status"); name == "orders by status" {
+		t.Errorf("For the custom pattern\n    Got %s\n    Expected a pseudonym", name)
+	}
+	if name := redactPattern("order by rand()"); name != "order by rand()" {
+		t.Errorf("For our own pattern\n    Got %s\n    Expected it left alone", name)
+	}
+}
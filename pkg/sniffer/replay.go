@@ -0,0 +1,165 @@
+/*
+ * replay.go
+ *
+ * Recording of captured queries in a form that can be replayed against another
+ * server, and a simple replayer for that format.
+ *
+ * The replay file is newline delimited JSON with one object per completed
+ * query, written in the order the queries completed (so queries on any one
+ * connection are always in order):
+ *
+ *     {"t":1.234567,"conn":"10.0.0.2:50000","db":"shop","sql":"SELECT 1"}
+ *
+ *     t     seconds since the start of the recording that the query was sent
+ *     conn  identifier of the connection the query was sent on
+ *     db    the default database of the connection, omitted when not known
+ *     sql   the statement exactly as sent by the client
+ *
+ * requires the MySQL driver for replaying:
+ *   https://github.com/go-sql-driver/mysql
+ *
+ */
+
+package sniffer
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+type replayEntry struct {
+	Time float64 `json:"t"`
+	Conn string  `json:"conn"`
+	DB   string  `json:"db,omitempty"`
+	SQL  string  `json:"sql"`
+}
+
+var recorder *bufio.Writer
+var recordStart time.Time
+
+// startRecording opens the replay file for writing.
+func startRecording(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	recorder = bufio.NewWriter(file)
+	return nil
+}
+
+// flushRecording makes sure everything recorded so far is on disk.
+func flushRecording() {
+	if recorder != nil {
+		recorder.Flush()
+	}
+}
+
+// recordReplay writes out one completed query.
+func recordReplay(rs *source, sent time.Time, query string) {
+	if recordStart.IsZero() {
+		recordStart = sent
+	}
+	line, err := json.Marshal(replayEntry{Time: sent.Sub(recordStart).Seconds(),
+		Conn: rs.src, SQL: query})
+	if err != nil {
+		return
+	}
+	recorder.Write(line)
+	recorder.WriteByte('\n')
+}
+
+// RunReplay executes the statements in a replay file against the server given
+// by the DSN, one connection per recorded connection. The original gaps between
+// queries are divided by factor, or ignored entirely if factor is 0.
+func RunReplay(filename, dsn string, factor float64) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Failed to open replay file: %s", err.Error())
+	}
+	defer file.Close()
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %s", dsn, err.Error())
+	}
+	defer db.Close()
+
+	// Split the recording up by connection, keeping the order within each.
+	var conns map[string][]replayEntry = make(map[string][]replayEntry)
+	var last float64
+	var total int
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry replayEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("Bad replay entry: %s", err.Error())
+		}
+		conns[entry.Conn] = append(conns[entry.Conn], entry)
+		if entry.Time > last {
+			last = entry.Time
+		}
+		total++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read replay file: %s", err.Error())
+	}
+	log.Printf("Replaying %d queries on %d connections...", total, len(conns))
+
+	var executed, failed uint64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for id, entries := range conns {
+		wg.Add(1)
+		go func(id string, entries []replayEntry) {
+			defer wg.Done()
+
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				log.Printf("[%s] failed to connect: %s", id, err.Error())
+				atomic.AddUint64(&failed, uint64(len(entries)))
+				return
+			}
+			defer conn.Close()
+
+			curdb := ""
+			for _, entry := range entries {
+				if factor > 0 {
+					due := start.Add(time.Duration(entry.Time / factor * float64(time.Second)))
+					time.Sleep(due.Sub(time.Now()))
+				}
+				if entry.DB != "" && entry.DB != curdb {
+					if _, err := conn.ExecContext(context.Background(), "USE `"+entry.DB+"`"); err == nil {
+						curdb = entry.DB
+					}
+				}
+				rows, err := conn.QueryContext(context.Background(), entry.SQL)
+				if err != nil {
+					atomic.AddUint64(&failed, 1)
+					continue
+				}
+				rows.Close()
+				atomic.AddUint64(&executed, 1)
+			}
+		}(id, entries)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start).Seconds()
+	log.Printf("%d queries executed, %d failed in %0.2fs", executed, failed, elapsed)
+	if last > 0 && elapsed > 0 {
+		log.Printf("%0.2f qps achieved vs %0.2f qps recorded", float64(executed)/elapsed,
+			float64(total)/last)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package sniffer
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var buf bytes.Buffer
+	recorder, recordStart = bufio.NewWriter(&buf), time.Time{}
+	defer func() { recorder = nil }()
+
+	rs := &source{src: "10.0.0.2:50000"}
+	sent := time.Unix(1434500000, 0)
+	recordReplay(rs, sent, "SELECT 1")
+	recordReplay(rs, sent.Add(1500*time.Millisecond), "SELECT \"two\"")
+	flushRecording()
+
+	expected := `{"t":0,"conn":"10.0.0.2:50000","sql":"SELECT 1"}` + "\n" +
+		`{"t":1.5,"conn":"10.0.0.2:50000","sql":"SELECT \"two\""}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Got %s\n    Expected %s", buf.String(), expected)
+	}
+}
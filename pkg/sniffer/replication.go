@@ -0,0 +1,143 @@
+/*
+ * replication.go
+ *
+ * Writes that aren't safe for statement based replication, because running them
+ * again on a replica can change different rows or produce different values.
+ * Before changing the replication format or topology, this is the list of
+ * statements to fix (or to be sure about).
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+	"sort"
+
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+)
+
+var trackReplication bool = false
+
+// replicationWrites counts the writes we've checked, and replicationUnsafe maps
+// reason to fingerprint to the number of executions that were unsafe for it.
+var replicationWrites uint64
+var replicationUnsafeWrites uint64
+var replicationUnsafe map[string]map[string]uint64 = make(map[string]map[string]uint64)
+
+// nondeterministicFuncs return something different on the replica.
+var nondeterministicFuncs map[string]bool = map[string]bool{
+	"uuid": true, "uuid_short": true, "now": true, "sysdate": true, "rand": true,
+	"user": true, "current_user": true, "connection_id": true, "found_rows": true,
+	"row_count": true, "load_file": true,
+}
+
+// detectReplicationUnsafe returns the reasons a write isn't replication safe.
+func detectReplicationUnsafe(tokens []sqlToken) []string {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	var found []string
+	switch tokens[0].text {
+	case "update", "delete":
+		if hasWord(tokens, "limit") && !hasOrderBy(tokens) {
+			found = append(found, "limit without order by")
+		}
+
+	case "insert", "replace":
+		for i := range tokens {
+			if tokens[i].toktype == canonical.TOKEN_WORD && nondeterministicFuncs[tokens[i].text] &&
+				i+1 < len(tokens) && tokens[i+1].text == "(" {
+				found = append(found, "nondeterministic function")
+				break
+			}
+		}
+
+		rows := 0
+		for i := range tokens {
+			if isWord(tokens, i, "values") || isWord(tokens, i, "value") {
+				rows = valuesRows(tokens, i+1)
+				break
+			}
+		}
+		for i := range tokens {
+			if isWord(tokens, i, "on") && isWord(tokens, i+1, "duplicate") {
+				if rows > 1 {
+					found = append(found, "multi-row on duplicate key update")
+				} else if hasWord(tokens, "select") {
+					found = append(found, "insert select on duplicate key update")
+				}
+				break
+			}
+		}
+	}
+	return found
+}
+
+// hasOrderBy tells us whether the query has an ORDER BY outside of parentheses.
+func hasOrderBy(tokens []sqlToken) bool {
+	depth := 0
+	for i, tok := range tokens {
+		switch {
+		case tok.text == "(":
+			depth++
+		case tok.text == ")":
+			depth--
+		case depth == 0 && isWord(tokens, i, "order") && isWord(tokens, i+1, "by"):
+			return true
+		}
+	}
+	return false
+}
+
+// recordReplicationSafety checks a write and keeps track of what it finds
+// against the given fingerprint.
+func recordReplicationSafety(fingerprint string, query []byte) {
+	found := detectReplicationUnsafe(lexQuery(query))
+	replicationWrites++
+	if len(found) > 0 {
+		replicationUnsafeWrites++
+	}
+
+	for _, reason := range found {
+		fingerprints, ok := replicationUnsafe[reason]
+		if !ok {
+			fingerprints = make(map[string]uint64)
+			replicationUnsafe[reason] = fingerprints
+		}
+		fingerprints[fingerprint]++
+	}
+}
+
+// printReplicationSafety shows the mix of safe and unsafe writes, then every
+// unsafe fingerprint by reason.
+func printReplicationSafety(w io.Writer) {
+	if replicationWrites == 0 {
+		return
+	}
+
+	reportf(w, " ")
+	reportf(w, "%s%d of %d writes (%0.2f%%) unsafe for statement based replication%s",
+		COLOR_RED, replicationUnsafeWrites, replicationWrites,
+		float64(replicationUnsafeWrites)/float64(replicationWrites)*100, COLOR_DEFAULT)
+
+	var reasons []string
+	for reason := range replicationUnsafe {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		reportf(w, "%s  %s%s", COLOR_YELLOW, reason, COLOR_DEFAULT)
+
+		var worst sortableSlice = make(sortableSlice, 0, len(replicationUnsafe[reason]))
+		for fingerprint, count := range replicationUnsafe[reason] {
+			worst = append(worst, sortable{float64(count), fingerprint})
+		}
+		sort.Sort(sort.Reverse(worst))
+		for _, item := range worst {
+			reportf(w, "    %s%8d  %s%s%s", COLOR_YELLOW, uint64(item.value), COLOR_WHITE,
+				redactQuery(item.line), COLOR_DEFAULT)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package sniffer
+
+import (
+	"strings"
+	"testing"
+)
+
+func replicationHelper(t *testing.T, query string, expected ...string) {
+	found := detectReplicationUnsafe(lexQuery([]byte(query)))
+	if strings.Join(found, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("For query %s\n    Got %v\n    Expected %v", query, found, expected)
+	}
+}
+
+func TestReplicationUnsafe(t *testing.T) {
+	replicationHelper(t, "update t set a = 1 where b = 2")
+	replicationHelper(t, "update t set a = 1 where b = 2 limit 10", "limit without order by")
+	replicationHelper(t, "delete from t where b = 2 order by id limit 10")
+	replicationHelper(t, "delete from t where id in (select id from u order by id) limit 1",
+		"limit without order by")
+	replicationHelper(t, "insert into t (id, a) values (uuid(), 1)", "nondeterministic function")
+	replicationHelper(t, "insert into t (id, now) values (1, 2)")
+	replicationHelper(t, "insert into t (a, b) values (1, 2) on duplicate key update b = 2")
+	replicationHelper(t, "insert into t (a, b) values (1, 2), (3, 4) on duplicate key update b = 2",
+		"multi-row on duplicate key update")
+	replicationHelper(t, "insert into t (a) select a from u on duplicate key update a = 1",
+		"insert select on duplicate key update")
+	replicationHelper(t, "select uuid() from t limit 1")
+}
@@ -0,0 +1,338 @@
+/*
+ * report.go
+ *
+ * The query table of the status report. With many thousands of fingerprints,
+ * working out every row's latencies, formatting it and sorting the lot holds
+ * up the capture every period, only to show the top -d of them. Instead we
+ * rank the queries on numbers we already have (keeping running latency totals
+ * for the avg and max sorts), keep the top rows in a heap as we go, and only
+ * work out and format those.
+ *
+ * The capture waits while we hold the parser lock, so under it we only copy
+ * out what each query is ranked on, and later what the top rows show. The
+ * ranking and the formatting happen after, see statusReport. Even the copying
+ * takes long enough with 100k queries to drop packets, so the reporter lets
+ * the capture have the lock every RANK_CHUNK queries.
+ *
+ */
+
+package sniffer
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How many queries we copy out for ranking before letting the capture in.
+const RANK_CHUNK = 1024
+
+// reportRow is a query being ranked for the table.
+type reportRow struct {
+	key    string
+	sorted float64
+}
+
+// tableRow is what the table shows of a query, copied out of the aggregate so
+// it can be formatted without holding up the capture.
+type tableRow struct {
+	text     string    // the key as the table shows it, redacted
+	qdata    queryData // without its samples, maps and sizes, which are below
+	samples  []uint64
+	conc     int
+	shapes   int // the fingerprints grouped into it
+	servers  int
+	p95, max uint64 // response sizes
+	outliers uint64
+}
+
+// statusReport is a status update as it's taken from the aggregate: the
+// sections around the query table already printed, and the queries ranked.
+type statusReport struct {
+	elapsed       float64
+	count         int
+	ranked        []reportRow
+	rows          []tableRow
+	before, after bytes.Buffer
+
+	// If set, called under the parser lock every RANK_CHUNK queries ranked,
+	// to let the capture have it for a moment; see yieldParser.
+	yield func()
+}
+
+// worse says whether a ranks below b. Ties go by key, so the table is stable.
+func (self reportRow) worse(other reportRow) bool {
+	return self.sorted < other.sorted || (self.sorted == other.sorted && self.key > other.key)
+}
+
+// rowHeap keeps the rows ranked so far with the worst on top.
+type rowHeap []reportRow
+
+func (self rowHeap) Len() int            { return len(self) }
+func (self rowHeap) Less(i, j int) bool  { return self[i].worse(self[j]) }
+func (self rowHeap) Swap(i, j int)       { self[i], self[j] = self[j], self[i] }
+func (self *rowHeap) Push(x interface{}) { *self = append(*self, x.(reportRow)) }
+func (self *rowHeap) Pop() interface{} {
+	old := *self
+	row := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return row
+}
+
+// sortValue is what a query is ranked on, higher first.
+func sortValue(key string, c *queryData, sortby string) float64 {
+	switch sortby {
+	case "avg":
+		if latencyMode == LATENCY_FULL {
+			if c.full == nil || c.full.timed == 0 {
+				return 0
+			}
+			return float64(c.full.total) / float64(c.full.timed) / 1000000
+		}
+		if c.timed > 0 {
+			return float64(c.timeTotal) / float64(c.timed) / 1000000
+		}
+		return 0
+	case "max":
+		if latencyMode == LATENCY_FULL {
+			if c.full == nil {
+				return 0
+			}
+			return float64(c.full.max) / 1000000
+		}
+		return float64(c.timeMax) / 1000000
+	case "maxbytes":
+		return float64(c.bytes)
+	case "avgbytes":
+		if c.count > 0 {
+			return float64(uint64(float64(c.bytes) / float64(c.count)))
+		}
+		return 0
+	case "apdex":
+		// Worst first.
+		return 1 - c.apdex.value()
+	case "conc":
+		return float64(concPeak(key))
+	case "growth":
+		return growth(c, UnixNow())
+	case "errors":
+		return errorRate(c)
+	case "rows":
+		avg, _ := c.avgRows()
+		return avg
+	case "returned":
+		avg, _ := c.avgReturned()
+		return avg
+	case "warnings":
+		return float64(c.warnings)
+	case "respp95":
+		p95, _ := responseSizes(c)
+		return float64(p95)
+	case "burst":
+		// Unscored queries sort after the most regular ones.
+		if score, ok := c.arrivals.burstiness(); ok {
+			return score
+		}
+		return -2
+	}
+	return float64(c.count)
+}
+
+// rankRows appends what every query at or over cutoff qps is ranked on to
+// rows. This is most of what the capture waits for, so it does nothing else;
+// the queries are rolled to the interval here when it matters to the report.
+// If yield isn't nil, it's called every RANK_CHUNK queries. Queries added
+// meanwhile may or may not be ranked, and those shed are left out by fill.
+func rankRows(rows []reportRow, sortby string, cutoff int, elapsed float64,
+	yield func()) []reportRow {
+	roll := trackBursts || sortby == "burst"
+	if cap(rows)-len(rows) < len(qbuf) {
+		// Growing it as we go would be a long wait in the middle of a chunk.
+		rows = append(make([]reportRow, 0, len(rows)+len(qbuf)), rows...)
+	}
+	seen := 0
+	for key, c := range qbuf {
+		if seen++; yield != nil && seen%RANK_CHUNK == 0 {
+			yield()
+		}
+		if float64(c.count)/elapsed < float64(cutoff) {
+			continue
+		}
+		if roll {
+			c.roll()
+		}
+		rows = append(rows, reportRow{key, sortValue(key, c, sortby)})
+	}
+	return rows
+}
+
+// yieldParser lets anything waiting for the parser lock have it, and takes it
+// back.
+func yieldParser() {
+	parser.Unlock()
+	runtime.Gosched()
+	parser.Lock()
+}
+
+// topRows returns the top count of the ranked rows, best first.
+func topRows(ranked []reportRow, count int) []reportRow {
+	if count <= 0 {
+		return nil
+	}
+	rows := make(rowHeap, 0, count)
+	for _, row := range ranked {
+		if len(rows) < count {
+			heap.Push(&rows, row)
+		} else if rows[0].worse(row) {
+			rows[0] = row
+			heap.Fix(&rows, 0)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[j].worse(rows[i]) })
+	return rows
+}
+
+// copyRow copies what the table shows of a query, with it rolled to the
+// interval for -bursts.
+func copyRow(key string, c *queryData) tableRow {
+	if trackBursts {
+		c.roll()
+	}
+	row := tableRow{text: redactQuery(key), qdata: *c, conc: concPeak(key),
+		shapes: len(c.fingerprints), servers: len(c.servers)}
+	row.samples = append([]uint64(nil), c.latencies()...)
+	row.p95, row.max = responseSizes(c)
+	if c.sizes != nil {
+		row.outliers = c.sizes.outliers
+	}
+	row.qdata.times, row.qdata.sizes, row.qdata.full = nil, nil, nil
+	row.qdata.fingerprints, row.qdata.servers = nil, nil
+	return row
+}
+
+// fill copies the rows of the table for the top queries, which is the other
+// part of the report taken under the lock. Queries shed since they were
+// ranked are left out.
+func (self *statusReport) fill(top []reportRow) {
+	for _, row := range top {
+		if c, ok := qbuf[row.key]; ok {
+			self.rows = append(self.rows, copyRow(row.key, c))
+		}
+	}
+}
+
+// print formats the table and writes out the report, in one go so nothing
+// else logged ends up in the middle of it.
+func (self *statusReport) print() {
+	var buf bytes.Buffer
+	buf.Write(self.before.Bytes())
+	for _, row := range self.rows {
+		buf.WriteString(formatRow(row, self.elapsed) + "\n")
+	}
+	buf.Write(self.after.Bytes())
+	log.Writer().Write(buf.Bytes())
+}
+
+// reportf writes a line of a status report to w, ending it as log.Printf
+// would, since the report doesn't go through the log until it's all written.
+func reportf(w io.Writer, format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	io.WriteString(w, line)
+}
+
+// errorRate returns the share of a query's executions that failed, in percent.
+func errorRate(c *queryData) float64 {
+	if c.count == 0 {
+		return 0
+	}
+	return float64(c.errors) / float64(c.count) * 100
+}
+
+// formatAverage formats an average for the table, "-" if there's none.
+func formatAverage(avg float64, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", avg)
+}
+
+// formatRow is the line of the table for a query.
+func formatRow(row tableRow, elapsed float64) string {
+	c := &row.qdata
+	qps := float64(c.count) / elapsed
+	qmin, qavg, qmax := calculateTimes(row.samples)
+	var bavg uint64
+	if c.count > 0 {
+		bavg = uint64(float64(c.bytes) / float64(c.count))
+	}
+
+	affected, returned := formatAverage(c.avgRows()), formatAverage(c.avgReturned())
+
+	extra := ""
+	if latencyMode == LATENCY_FULL {
+		extra += fmt.Sprintf("%s%9.2f  ", COLOR_YELLOW, c.firstAverage())
+	}
+	if splitErrors {
+		// The outcomes of one query share its hash.
+		extra += fmt.Sprintf("%s%08x  ", COLOR_CYAN, fingerprintHash(c.splitOf)>>32)
+	}
+	if groupShape {
+		extra += fmt.Sprintf("%s%5d  ", COLOR_CYAN, row.shapes)
+	}
+	if collecting {
+		extra += fmt.Sprintf("%s%5d  ", COLOR_CYAN, row.servers)
+	}
+	if trackLists {
+		color := COLOR_CYAN
+		if listSizeWarn > 0 && c.lists.max > listSizeWarn {
+			color = COLOR_RED
+		}
+		extra += fmt.Sprintf("%s%7.1f/%-5d ", color, c.lists.avg(), c.lists.max)
+	}
+	if trackWarnings {
+		var wavg float64
+		if c.count > 0 {
+			wavg = float64(c.warnings) / float64(c.count)
+		}
+		extra += fmt.Sprintf("%s%8.2f %8.2f  ", COLOR_RED, float64(c.warnings)/elapsed, wavg)
+	}
+	if trackBursts {
+		if score, ok := c.arrivals.burstiness(); ok {
+			extra += fmt.Sprintf("%s%5.2f  ", COLOR_CYAN, score)
+		} else {
+			extra += fmt.Sprintf("%s%5s  ", COLOR_CYAN, "-")
+		}
+	}
+	if trackSizes {
+		extra += fmt.Sprintf("%s%8s %8s %5d  ", COLOR_GREEN, formatBytes(row.p95),
+			formatBytes(row.max), row.outliers)
+	}
+	if multiResults {
+		extra += fmt.Sprintf("%s%9s  ", COLOR_CYAN, formatAverage(c.avgSets()))
+	}
+	if trackColumns {
+		extra += formatColumns(&c.columns)
+	}
+	if cursorFetches {
+		extra += formatFetches(c)
+	}
+	if trackStalls {
+		extra += fmt.Sprintf("%s%6d %8.1f  ", COLOR_RED, c.stalls.count,
+			float64(c.stalls.time)/float64(time.Millisecond))
+	}
+
+	return fmt.Sprintf(
+		"%s%6d  %s%7.2f/s  %s%6.2f %6.2f %6.2f  %5.2f %5d  %s%9db %6db %s%8s  %8s  %s%5.1f  %s%s%s%s",
+		COLOR_YELLOW, c.count, COLOR_CYAN, qps, COLOR_YELLOW, qmin, qavg, qmax,
+		c.apdex.value(), row.conc, COLOR_GREEN, c.bytes, bavg, COLOR_CYAN, affected, returned,
+		COLOR_RED, errorRate(c), extra, COLOR_WHITE, row.text, COLOR_DEFAULT)
+}
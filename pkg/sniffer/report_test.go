@@ -0,0 +1,158 @@
+package sniffer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopRows(t *testing.T) {
+	qbuf = make(map[string]*queryData)
+	for i, count := range []uint64{5, 50, 1, 20, 50, 7} {
+		qbuf[fmt.Sprintf("q%d", i)] = &queryData{count: count, timed: 1, timeTotal: 10 - count,
+			timeMax: count * 1000000}
+	}
+
+	for _, test := range []struct {
+		count    int
+		sortby   string
+		cutoff   int
+		expected []string
+	}{
+		{3, "count", 0, []string{"q1", "q4", "q3"}},
+		{10, "count", 2, []string{"q1", "q4", "q3", "q5", "q0"}},
+		{2, "max", 0, []string{"q1", "q4"}},
+		{0, "count", 0, nil},
+	} {
+		rows := topRows(rankRows(nil, test.sortby, test.cutoff, 1, nil), test.count)
+		var got []string
+		for _, row := range rows {
+			got = append(got, row.key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("For top %d by %s over %d/s\n    Got %v\n    Expected %v", test.count,
+				test.sortby, test.cutoff, got, test.expected)
+		}
+	}
+}
+
+func TestTopRowsFullSort(t *testing.T) {
+	defer func() { latencyMode = LATENCY_FIRST }()
+	latencyMode = LATENCY_FULL
+	qbuf = make(map[string]*queryData)
+	for i := 0; i < 200; i++ {
+		// Plenty of ties, and some queries never timed to the end.
+		qdata := &queryData{count: uint64(i % 7)}
+		if i%5 != 0 {
+			qdata.full = &fullStats{timed: uint64(i%3 + 1), total: uint64(i%4) * 1000000}
+		} else if i%10 == 0 {
+			qdata.full = &fullStats{}
+		}
+		qbuf[fmt.Sprintf("q%03d", i)] = qdata
+	}
+
+	for _, sortby := range []string{"count", "avg", "max"} {
+		ranked := rankRows(nil, sortby, 0, 1, nil)
+		for _, row := range ranked {
+			if math.IsNaN(row.sorted) {
+				t.Fatalf("For %s by %s\n    Got NaN", row.key, sortby)
+			}
+		}
+		full := append([]reportRow(nil), ranked...)
+		sort.Slice(full, func(i, j int) bool { return full[j].worse(full[i]) })
+		for _, count := range []int{1, 15, 199, 200, 250} {
+			expected := full
+			if count < len(full) {
+				expected = full[:count]
+			}
+			got := topRows(ranked, count)
+			if fmt.Sprint(got) != fmt.Sprint(expected) {
+				t.Errorf("For top %d by %s\n    Got %v\n    Expected %v", count, sortby, got,
+					expected)
+			}
+		}
+	}
+}
+
+func TestRankRowsYields(t *testing.T) {
+	qbuf = make(map[string]*queryData)
+	for i := 0; i < 2*RANK_CHUNK+5; i++ {
+		qbuf[fmt.Sprintf("q%d", i)] = &queryData{count: 1}
+	}
+	defer func() { qbuf = make(map[string]*queryData) }()
+
+	yields := 0
+	rows := rankRows(nil, "count", 0, 1, func() { yields++ })
+	if yields != 2 || len(rows) != len(qbuf) {
+		t.Errorf("For %d queries\n    Got %d ranked, %d yields\n    Expected all, 2 yields",
+			len(qbuf), len(rows), yields)
+	}
+}
+
+func TestStatusReportCopies(t *testing.T) {
+	qbuf, chmap = make(map[string]*queryData), make(map[string]*source)
+	qbuf["select ?"] = &queryData{count: 3, times: []uint64{1000000, 2000000, 3000000}}
+	qbuf["delete from t"] = &queryData{count: 1}
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	report := &statusReport{}
+	report.take(1, "count", 0, "")
+	report.fill(topRows(report.ranked, 1))
+	report.endInterval()
+
+	// What the capture does after doesn't change the report.
+	qbuf["select ?"].count, qbuf["select ?"].times[0] = 100, 9000000
+	report.print()
+	if len(report.rows) != 1 || !strings.Contains(out.String(), "     3  ") ||
+		!strings.Contains(out.String(), " 1.00   2.00   3.00") {
+		t.Errorf("For the report\n    Got %q\n    Expected select ? as it was taken", out.String())
+	}
+}
+
+// BenchmarkStatusReport is what a status report with 100k fingerprints costs
+// the capture, which waits while it's taken from the aggregate, but not while
+// it's ranked and formatted. The longest the capture waits at once is given as
+// ms/hold. The queries have no latency samples, which would take 8GB and are
+// only read for the rows shown.
+func BenchmarkStatusReport(b *testing.B) {
+	qbuf, chmap, format = make(map[string]*queryData), make(map[string]*source), nil
+	parseFormat("#q")
+	for i := 0; i < 100000; i++ {
+		qdata := &queryData{count: uint64(i%977 + 1), timed: 1, timeTotal: uint64(i)}
+		qbuf[fmt.Sprintf("select * from t%d where id = ?", i)] = qdata
+	}
+	defer func() { log.SetOutput(os.Stderr); qbuf = make(map[string]*queryData) }()
+	log.SetOutput(io.Discard)
+
+	var held, longest time.Duration
+	mark := time.Now()
+	hold := func() {
+		if held = time.Since(mark); held > longest {
+			longest = held
+		}
+	}
+	report := &statusReport{yield: func() { hold(); mark = time.Now() }}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mark = time.Now()
+		report.take(15, "count", 0, "")
+		hold()
+		b.StopTimer()
+		top := topRows(report.ranked, 15)
+		b.StartTimer()
+		mark = time.Now()
+		report.fill(top)
+		report.endInterval()
+		hold()
+	}
+	b.ReportMetric(float64(longest)/float64(time.Millisecond), "ms/hold")
+}
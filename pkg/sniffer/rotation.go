@@ -0,0 +1,200 @@
+/*
+ * rotation.go
+ *
+ * Reading a set of capture files, like the ones "tcpdump -G 300 -w
+ * trace-%s.pcap" leaves behind, as if they were one. -r takes a directory or a
+ * glob as well as a file; the files are read in the order of their first
+ * packets, one after the other through the same streams, so a connection
+ * going across a file boundary carries on as if nothing happened. Files that
+ * end before the -from/-to window or start after it aren't opened at all.
+ *
+ * With -follow we keep watching for more files. tcpdump is still writing the
+ * newest one, so we only read a file once a newer one shows up.
+ *
+ */
+
+package sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/gopcap"
+)
+
+const (
+	// How often -follow looks for newly finished files.
+	ROTATION_POLL = 2 * time.Second
+)
+
+// captureFile is a file of the set, and when its first packet was captured.
+type captureFile struct {
+	name  string
+	first time.Time
+}
+
+// captureSet is the files of a set we have yet to read.
+type captureSet struct {
+	spec    string
+	follow  bool
+	pending []captureFile
+	seen    map[string]bool
+	over    bool // a file started after the window, so nothing more is in it
+}
+
+// isCaptureSet tells us whether -r names a set of files rather than one.
+func isCaptureSet(spec string) bool {
+	if strings.ContainsAny(spec, "*?[") {
+		return true
+	}
+	info, err := os.Stat(spec)
+	return err == nil && info.IsDir()
+}
+
+// pcapFirstPacket returns when the first packet in a pcap file was captured,
+// or false if it has none yet.
+func pcapFirstPacket(filename string) (time.Time, bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer file.Close()
+
+	var head [40]byte
+	n, err := io.ReadFull(file, head[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return time.Time{}, false, err
+	}
+	if n < 4 {
+		return time.Time{}, false, nil
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if binary.BigEndian.Uint32(head[:4])&0xffff0000 == 0xa1b20000 {
+		order = binary.BigEndian
+	}
+	var scale time.Duration
+	switch order.Uint32(head[:4]) {
+	case 0xa1b2c3d4:
+		scale = time.Microsecond
+	case 0xa1b23c4d:
+		scale = time.Nanosecond
+	default:
+		return time.Time{}, false, fmt.Errorf("%s isn't a pcap file", filename)
+	}
+	if n < len(head) {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(int64(order.Uint32(head[24:28])), 0).Add(
+		time.Duration(order.Uint32(head[28:32])) * scale), true, nil
+}
+
+// listCaptures returns the files of a set that have packets, by their first
+// packet. Files that aren't captures are left out, with a warning.
+func listCaptures(spec string) ([]captureFile, error) {
+	pattern := spec
+	if info, err := os.Stat(spec); err == nil && info.IsDir() {
+		pattern = filepath.Join(spec, "*")
+	}
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []captureFile
+	for _, name := range names {
+		if info, err := os.Stat(name); err != nil || info.IsDir() {
+			continue
+		}
+		first, ok, err := pcapFirstPacket(name)
+		if err != nil {
+			log.Printf("%sSkipping %s: %s%s", COLOR_YELLOW, name, err.Error(), COLOR_DEFAULT)
+			continue
+		}
+		if ok {
+			files = append(files, captureFile{name, first})
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].first.Before(files[j].first) })
+	return files, nil
+}
+
+// refresh adds the files of the set we haven't seen to those to read, leaving
+// out those outside the window, and when following, the newest.
+func (self *captureSet) refresh() error {
+	files, err := listCaptures(self.spec)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 && !windowResolved {
+		windowStart, windowEnd = windowFrom.resolve(files[0].first), windowTo.resolve(files[0].first)
+		windowResolved = true
+	}
+
+	finished := len(files)
+	if self.follow {
+		finished--
+	}
+	for i := 0; i < finished; i++ {
+		file := files[i]
+		if self.seen[file.name] {
+			continue
+		}
+		self.seen[file.name] = true
+		switch {
+		case !windowEnd.IsZero() && file.first.After(windowEnd):
+			self.over = true
+		case !windowStart.IsZero() && i+1 < len(files) && !files[i+1].first.After(windowStart):
+			// It ends where the next one starts.
+		default:
+			self.pending = append(self.pending, file)
+		}
+	}
+	return nil
+}
+
+// nextCapture opens the next file of the set, waiting for one when following.
+// It returns nil when there are no more, or we're stopped while waiting.
+func (self *Sniffer) nextCapture() (*pcap.Pcap, error) {
+	set := self.captures
+	for len(set.pending) == 0 {
+		if set.over || (!set.follow && set.seen != nil) {
+			return nil, nil
+		}
+		if set.seen == nil {
+			set.seen = make(map[string]bool)
+		} else {
+			select {
+			case <-self.stop:
+				return nil, nil
+			case <-time.After(ROTATION_POLL):
+			}
+		}
+		if err := set.refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	file := set.pending[0]
+	set.pending = set.pending[1:]
+	log.Printf("Reading %s, from %s...", file.name, file.first.Format("2006/01/02 15:04:05"))
+	iface, err := pcap.Openoffline(file.name)
+	if iface == nil || err != nil {
+		msg := "unknown error"
+		if err != nil {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("Failed to open %s: %s", file.name, msg)
+	}
+	if err := iface.Setfilter(captureFilter()); err != nil {
+		iface.Close()
+		return nil, fmt.Errorf("Failed to set port filter: %s", err.Error())
+	}
+	return iface, nil
+}
@@ -0,0 +1,95 @@
+package sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePcap writes a pcap file with the header and a packet captured at first,
+// or no packets if first is zero.
+func writePcap(t *testing.T, filename string, order binary.ByteOrder, first time.Time) {
+	head := make([]byte, 24, 40)
+	order.PutUint32(head, 0xa1b2c3d4)
+	if !first.IsZero() {
+		head = head[:40]
+		order.PutUint32(head[24:], uint32(first.Unix()))
+		order.PutUint32(head[28:], uint32(first.Nanosecond()/1000))
+	}
+	if err := os.WriteFile(filename, head, 0644); err != nil {
+		t.Fatalf("Failed to write %s: %s", filename, err)
+	}
+}
+
+func TestCaptureSet(t *testing.T) {
+	defer func() {
+		windowFrom, windowTo, windowResolved = windowBound{}, windowBound{}, false
+		log.SetOutput(os.Stderr)
+	}()
+	log.SetOutput(io.Discard)
+	dir := t.TempDir()
+	base := time.Unix(1434510000, 0)
+
+	// Named out of order, one big endian, one not a capture, one still empty.
+	for name, at := range map[string]int{"c.pcap": 0, "a.pcap": 600, "b.pcap": 300,
+		"d.pcap": 900} {
+		order := binary.ByteOrder(binary.LittleEndian)
+		if name == "b.pcap" {
+			order = binary.BigEndian
+		}
+		writePcap(t, filepath.Join(dir, name), order, base.Add(time.Duration(at)*time.Second))
+	}
+	writePcap(t, filepath.Join(dir, "e.pcap"), binary.LittleEndian, time.Time{})
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a capture"), 0644)
+
+	if !isCaptureSet(dir) || !isCaptureSet(filepath.Join(dir, "*.pcap")) ||
+		isCaptureSet(filepath.Join(dir, "a.pcap")) {
+		t.Errorf("For telling sets from files\n    Got the wrong answer\n    Expected dirs and globs")
+	}
+
+	names := func(files []captureFile) []string {
+		var got []string
+		for _, file := range files {
+			got = append(got, filepath.Base(file.name))
+		}
+		return got
+	}
+	for _, test := range []struct {
+		from, to string
+		follow   bool
+		expected []string
+	}{
+		{"", "", false, []string{"c.pcap", "b.pcap", "a.pcap", "d.pcap"}},
+		{"", "", true, []string{"c.pcap", "b.pcap", "a.pcap"}},
+		{"+5m", "", false, []string{"b.pcap", "a.pcap", "d.pcap"}},
+		{"+7m", "+11m", false, []string{"b.pcap", "a.pcap"}},
+	} {
+		windowFrom, _ = parseWindowBound(test.from)
+		windowTo, _ = parseWindowBound(test.to)
+		windowResolved = false
+		set := &captureSet{spec: dir, follow: test.follow, seen: make(map[string]bool)}
+		if err := set.refresh(); err != nil {
+			t.Fatalf("For the files in %s\n    Got %s\n    Expected them listed", dir, err)
+		}
+		if got := names(set.pending); fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("For files from %q to %q, following %t\n    Got %v\n    Expected %v",
+				test.from, test.to, test.follow, got, test.expected)
+		}
+	}
+
+	// Following, the newest is read once another comes after it.
+	windowFrom, windowTo, windowResolved = windowBound{}, windowBound{}, false
+	set := &captureSet{spec: dir, follow: true, seen: make(map[string]bool)}
+	set.refresh()
+	set.pending = nil
+	writePcap(t, filepath.Join(dir, "f.pcap"), binary.LittleEndian, base.Add(20*time.Minute))
+	set.refresh()
+	if got := names(set.pending); fmt.Sprint(got) != "[d.pcap]" {
+		t.Errorf("For a new file while following\n    Got %v\n    Expected [d.pcap]", got)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * selftest.go
+ *
+ * A self test that runs a known workload against a MySQL server while sniffing
+ * it, and checks that what we saw matches what we did. When no server is given
+ * we start a tiny fake one on the loopback interface.
+ *
+ */
+
+package sniffer
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/akrennmair/gopcap"
+)
+
+type selftestQuery struct {
+	sql   string
+	delay time.Duration
+	count int
+}
+
+var selftestQueries []selftestQuery = []selftestQuery{
+	{"SELECT SLEEP(0.05) /* mysql-sniffer selftest fast */", 50 * time.Millisecond, 5},
+	{"SELECT SLEEP(0.2) /* mysql-sniffer selftest slow */", 200 * time.Millisecond, 3},
+}
+
+var fakeSleep *regexp.Regexp = regexp.MustCompile(`(?i)sleep\(([\d.]+)\)`)
+
+// RunSelftest runs the workload and returns whether everything checked out.
+func RunSelftest(eth, dsn string) bool {
+	if dsn == "" {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Printf("FAIL: couldn't start fake server: %s", err.Error())
+			return false
+		}
+		defer listener.Close()
+		go runFakeServer(listener)
+
+		port = uint16(listener.Addr().(*net.TCPAddr).Port)
+		dsn = "selftest:selftest@tcp(" + listener.Addr().String() + ")/"
+		log.Printf("Started fake MySQL server on %s", listener.Addr())
+	}
+
+	format = nil
+	parseFormat("#q")
+
+	log.Printf("Sniffing %s:%d...", eth, port)
+	iface, err := pcap.Openlive(eth, 65535, false, 100)
+	if iface == nil || err != nil {
+		msg := "unknown error"
+		if err != nil {
+			msg = err.Error()
+		}
+		log.Printf("FAIL: couldn't open %s: %s (are you root or do you have CAP_NET_RAW?)",
+			eth, msg)
+		return false
+	}
+	if err := iface.Setfilter("tcp port " + strconv.Itoa(int(port))); err != nil {
+		log.Printf("FAIL: couldn't set filter: %s", err.Error())
+		return false
+	}
+
+	// The workload runs alongside the capture, which stays on this goroutine.
+	done := make(chan error, 1)
+	go func() {
+		done <- runSelftestWorkload(dsn)
+	}()
+
+	var workerr error
+	finished := false
+	var deadline time.Time
+	for !finished || time.Now().Before(deadline) {
+		if pkt, rv := iface.NextEx(); pkt != nil {
+			handlePacket(pkt)
+		} else if rv < 0 {
+			break
+		}
+		if !finished {
+			select {
+			case workerr = <-done:
+				// Give the last responses a moment to be captured.
+				finished, deadline = true, time.Now().Add(time.Second)
+			default:
+			}
+		}
+	}
+	if workerr != nil {
+		log.Printf("FAIL: workload failed: %s", workerr.Error())
+		return false
+	}
+
+	passed := true
+	for _, query := range selftestQueries {
+		fingerprint := cleanupQuery([]byte(query.sql))
+		qdata, ok := qbuf[fingerprint]
+		if !ok {
+			log.Printf("FAIL: never saw %s", fingerprint)
+			passed = false
+			continue
+		}
+
+		_, avg, _ := calculateTimes(qdata.latencies())
+		delay := float64(query.delay) / float64(time.Millisecond)
+		if qdata.count != uint64(query.count) {
+			log.Printf("FAIL: saw %s %d times, expected %d", fingerprint, qdata.count,
+				query.count)
+			passed = false
+		} else if avg < delay*0.9 || avg > delay+100 {
+			log.Printf("FAIL: %s took %0.2fms on average, expected about %0.2fms",
+				fingerprint, avg, delay)
+			passed = false
+		} else {
+			log.Printf("PASS: %s seen %d times, %0.2fms avg", fingerprint, qdata.count, avg)
+		}
+	}
+	return passed
+}
+
+// runSelftestWorkload runs each of the self test queries the right number of
+// times, one at a time over a single connection.
+func runSelftestWorkload(dsn string) error {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Let the capture settle before we start.
+	time.Sleep(500 * time.Millisecond)
+	for _, query := range selftestQueries {
+		for i := 0; i < query.count; i++ {
+			rows, err := db.Query(query.sql)
+			if err != nil {
+				return err
+			}
+			rows.Close()
+		}
+	}
+	return nil
+}
+
+// runFakeServer accepts connections for the fake MySQL server.
+func runFakeServer(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go fakeConnection(conn)
+	}
+}
+
+// fakeConnection speaks just enough of the protocol to log a client in and
+// answer its queries with OK packets, sleeping if the query asks it to.
+func fakeConnection(conn net.Conn) {
+	defer conn.Close()
+
+	greeting := []byte{10}
+	greeting = append(greeting, "5.6.24-fake\x00"...)
+	greeting = append(greeting, 1, 0, 0, 0)
+	greeting = append(greeting, "abcdefgh\x00"...)
+	greeting = append(greeting, 0xff, 0xf7, 33, 2, 0, 0x7f, 0x80, 21)
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, "ijklmnopqrst\x00"...)
+	greeting = append(greeting, "mysql_native_password\x00"...)
+	ok := []byte{0, 0, 0, 2, 0, 0, 0}
+
+	if writeFakePacket(conn, 0, greeting) != nil {
+		return
+	}
+	if _, _, err := readFakePacket(conn); err != nil {
+		return
+	}
+	if writeFakePacket(conn, 2, ok) != nil {
+		return
+	}
+
+	for {
+		_, payload, err := readFakePacket(conn)
+		if err != nil || len(payload) == 0 || payload[0] == COM_QUIT {
+			return
+		}
+		if payload[0] == COM_QUERY {
+			if match := fakeSleep.FindSubmatch(payload[1:]); match != nil {
+				if secs, err := strconv.ParseFloat(string(match[1]), 64); err == nil {
+					time.Sleep(time.Duration(secs * float64(time.Second)))
+				}
+			}
+		}
+		if writeFakePacket(conn, 1, ok) != nil {
+			return
+		}
+	}
+}
+
+func readFakePacket(conn net.Conn) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	_, err := io.ReadFull(conn, payload)
+	return header[3], payload, err
+}
+
+func writeFakePacket(conn net.Conn, seq byte, payload []byte) error {
+	buf := make([]byte, 4, 4+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(len(payload)))
+	buf[3] = seq
+	_, err := conn.Write(append(buf, payload...))
+	return err
+}
@@ -0,0 +1,30 @@
+package sniffer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFakeServer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeConnection(server)
+
+	if _, greeting, err := readFakePacket(client); err != nil || greeting[0] != 10 {
+		t.Fatalf("Expected a greeting, got %v (%v)", greeting, err)
+	}
+	writeFakePacket(client, 1, makeHandshakeResponse("selftest")[4:])
+	if _, ok, err := readFakePacket(client); err != nil || ok[0] != 0 {
+		t.Fatalf("Expected login OK, got %v (%v)", ok, err)
+	}
+
+	started := time.Now()
+	writeFakePacket(client, 0, append([]byte{COM_QUERY}, "select sleep(0.05)"...))
+	if _, ok, err := readFakePacket(client); err != nil || ok[0] != 0 {
+		t.Fatalf("Expected query OK, got %v (%v)", ok, err)
+	}
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the fake server to sleep, took %s", elapsed)
+	}
+}
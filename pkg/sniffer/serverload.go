@@ -0,0 +1,215 @@
+/*
+ * serverload.go
+ *
+ * The server's own view of how busy it is, next to ours. With -admin-dsn we
+ * poll SHOW GLOBAL STATUS every LOAD_POLL for Threads_running and
+ * Threads_connected, and each status report puts them beside the latency we
+ * measured on the wire over the same interval. Latency rising along with
+ * Threads_running is the server running out of room; latency rising while
+ * Threads_running stays flat points somewhere else, at locks, plans or the
+ * network.
+ *
+ * requires the MySQL driver:
+ *   https://github.com/go-sql-driver/mysql
+ *
+ */
+
+package sniffer
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	LOAD_POLL = 2 * time.Second
+
+	// How much latency has to change between intervals to count, and how
+	// far Threads_running has to climb over the last interval's average,
+	// as a share and in threads.
+	LOAD_CHANGE  = 0.2
+	LOAD_THREADS = 4
+)
+
+var pollingLoad bool = false
+
+// loadInterval is the wire latency and the server's threads over an interval.
+type loadInterval struct {
+	queries   uint64
+	latency   uint64 // total, in nanoseconds
+	polls     uint64
+	running   uint64 // total over the polls
+	peak      uint64
+	connected uint64 // as of the last poll
+}
+
+var loadCur, loadPrev loadInterval
+
+func (self *loadInterval) avgLatency() float64 {
+	if self.queries == 0 {
+		return 0
+	}
+	return float64(self.latency) / float64(self.queries) / 1000000
+}
+
+func (self *loadInterval) avgRunning() float64 {
+	if self.polls == 0 {
+		return 0
+	}
+	return float64(self.running) / float64(self.polls)
+}
+
+// loadStop is closed to stop the poller.
+var loadStop chan bool
+
+// startServerLoad connects to the server and starts polling it in the
+// background.
+func startServerLoad(dsn string) error {
+	db, err := openServer(dsn)
+	if err != nil {
+		return err
+	}
+	loadStop = make(chan bool)
+	go runServerLoad(db, loadStop)
+	return nil
+}
+
+// stopServerLoad stops the poller, without waiting, as stopCoverage does.
+func stopServerLoad() {
+	close(loadStop)
+	loadStop = nil
+}
+
+// runServerLoad polls the server's thread counts every LOAD_POLL until stop is
+// closed. A poll that fails is logged and tried again at the next.
+func runServerLoad(db *sql.DB, stop chan bool) {
+	defer db.Close()
+
+	for {
+		running, connected, err := readLoad(db)
+		if err != nil {
+			log.Printf("%sFailed to read the server status: %s%s", COLOR_RED, err.Error(),
+				COLOR_DEFAULT)
+		} else {
+			parser.Lock()
+			recordLoad(running, connected)
+			parser.Unlock()
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(LOAD_POLL):
+		}
+	}
+}
+
+// readLoad returns the server's Threads_running, not counting our own poll,
+// and Threads_connected.
+func readLoad(db *sql.DB) (uint64, uint64, error) {
+	rows, err := db.Query("SHOW GLOBAL STATUS WHERE Variable_name IN " +
+		"('Threads_running', 'Threads_connected')")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	var running, connected uint64
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return 0, 0, err
+		}
+		count, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Bad %s: %s", name, value)
+		}
+		switch name {
+		case "Threads_running":
+			running = count
+		case "Threads_connected":
+			connected = count
+		}
+	}
+	if running > 0 {
+		running--
+	}
+	return running, connected, rows.Err()
+}
+
+// recordLoad records a poll of the server's threads.
+func recordLoad(running, connected uint64) {
+	loadCur.polls++
+	loadCur.running += running
+	loadCur.connected = connected
+	if running > loadCur.peak {
+		loadCur.peak = running
+	}
+}
+
+// loadQuery records the latency of a query we saw.
+func loadQuery(reqtime uint64) {
+	loadCur.queries++
+	loadCur.latency += reqtime
+}
+
+// loadNote says what the change in latency since the last interval goes with,
+// or nothing if neither latency nor Threads_running changed much.
+func loadNote(cur, prev *loadInterval) string {
+	if cur.polls == 0 || prev.polls == 0 || cur.queries == 0 || prev.queries == 0 {
+		return ""
+	}
+	change := cur.avgLatency()/prev.avgLatency() - 1
+	spiked := float64(cur.peak) >= math.Max(prev.avgRunning()*(1+LOAD_CHANGE),
+		prev.avgRunning()+LOAD_THREADS)
+	switch {
+	case change >= LOAD_CHANGE && spiked:
+		return fmt.Sprintf("latency %+0.0f%% while Threads_running %d -> likely saturation",
+			change*100, cur.peak)
+	case change >= LOAD_CHANGE:
+		return fmt.Sprintf("latency %+0.0f%% with Threads_running flat at %d -> not concurrency; "+
+			"locks, plans or the network?", change*100, cur.peak)
+	case spiked:
+		return fmt.Sprintf("Threads_running %d with latency %+0.0f%% -> absorbing it", cur.peak,
+			change*100)
+	}
+	return ""
+}
+
+// printServerLoad prints the server's threads beside the wire latency for the
+// interval.
+func printServerLoad(w io.Writer) {
+	if !pollingLoad {
+		return
+	}
+	reportf(w, " ")
+	if loadCur.polls == 0 {
+		reportf(w, "%sServer:%s no status polled this interval", COLOR_RED, COLOR_DEFAULT)
+		return
+	}
+	reportf(w, "%sServer:%s Threads_running %0.1f avg / %d peak, Threads_connected %d, "+
+		"wire latency %0.2fms avg", COLOR_RED, COLOR_DEFAULT, loadCur.avgRunning(), loadCur.peak,
+		loadCur.connected, loadCur.avgLatency())
+	if note := loadNote(&loadCur, &loadPrev); note != "" {
+		reportf(w, "%s    %s%s", COLOR_YELLOW, note, COLOR_DEFAULT)
+	}
+}
+
+// loadColumns is the server's threads for the history, empty if we didn't
+// poll them.
+func loadColumns() (string, string) {
+	if !pollingLoad || loadCur.polls == 0 {
+		return "", ""
+	}
+	return strconv.FormatFloat(loadCur.avgRunning(), 'f', 1, 64),
+		strconv.FormatUint(loadCur.connected, 10)
+}
+
+// rollLoad starts a new interval.
+func rollLoad() {
+	loadPrev, loadCur = loadCur, loadInterval{}
+}
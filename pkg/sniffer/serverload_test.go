@@ -0,0 +1,65 @@
+package sniffer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadNote(t *testing.T) {
+	interval := func(latency, running, peak uint64) *loadInterval {
+		return &loadInterval{queries: 10, latency: 10 * latency * 1000000, polls: 2,
+			running: 2 * running, peak: peak}
+	}
+	for _, test := range []struct {
+		cur, prev *loadInterval
+		expected  string
+	}{
+		{interval(14, 30, 62), interval(10, 10, 12), "latency +40% while Threads_running 62"},
+		{interval(14, 10, 12), interval(10, 10, 12), "Threads_running flat at 12"},
+		{interval(10, 30, 62), interval(10, 10, 12), "absorbing it"},
+		{interval(11, 10, 12), interval(10, 10, 12), ""},
+		{interval(14, 30, 62), &loadInterval{}, ""},
+	} {
+		note := loadNote(test.cur, test.prev)
+		if (test.expected == "") != (note == "") || !strings.Contains(note, test.expected) {
+			t.Errorf("For %+v after %+v\n    Got %q\n    Expected %q", *test.cur, *test.prev,
+				note, test.expected)
+		}
+	}
+}
+
+func TestServerLoad(t *testing.T) {
+	pollingLoad, loadCur, loadPrev = true, loadInterval{}, loadInterval{}
+	defer func() { pollingLoad = false }()
+
+	if running, connected := loadColumns(); running != "" || connected != "" {
+		t.Errorf("For no polls\n    Got %q, %q\n    Expected nothing", running, connected)
+	}
+	recordLoad(4, 100)
+	recordLoad(9, 120)
+	loadQuery(2000000)
+	if running, connected := loadColumns(); running != "6.5" || connected != "120" {
+		t.Errorf("For the polls\n    Got %q, %q\n    Expected 6.5, 120", running, connected)
+	}
+	if loadCur.peak != 9 || loadCur.avgLatency() != 2 {
+		t.Errorf("For the interval\n    Got peak %d, %0.2fms\n    Expected 9, 2.00ms",
+			loadCur.peak, loadCur.avgLatency())
+	}
+	rollLoad()
+	if loadPrev.peak != 9 || loadCur.polls != 0 {
+		t.Errorf("For the next interval\n    Got %+v after %+v\n    Expected a fresh one",
+			loadCur, loadPrev)
+	}
+}
+
+func TestServerLoadBadDSN(t *testing.T) {
+	opts := DefaultOptions()
+	opts.AdminDSN = "not a dsn"
+	if err := startOutputs(opts); err == nil {
+		stopOutputs()
+		t.Errorf("For DSN %s\n    Got no error\n    Expected one", opts.AdminDSN)
+	}
+	if loadStop != nil {
+		t.Errorf("For the poller\n    Got it running\n    Expected it not started")
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * servers.go
+ *
+ * Addresses that are one server as far as we're concerned. When a VIP fails
+ * over or DNS moves to a new primary, the traffic moves to another address and
+ * everything kept per server starts over. With -server-group
+ * "10.0.0.5,10.0.0.6=primary-1" both addresses go by the label: in #D of the
+ * format, the per-server reports and what we export, with the address the
+ * traffic actually went to still in the events.
+ *
+ * We also note when the traffic of a group moves from one address to another,
+ * once the old one has been quiet for FAILOVER_QUIET, since when a failover
+ * happened is worth having when going over an incident.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	FAILOVER_QUIET = 5 * time.Second
+)
+
+// ServerGroups maps addresses, ip or ip:port, to the label of their group. It
+// takes a flag like "10.0.0.5,10.0.0.6=primary-1", repeated for more groups.
+type ServerGroups map[string]string
+
+func (self *ServerGroups) String() string {
+	groups := make(map[string][]string)
+	for addr, label := range *self {
+		groups[label] = append(groups[label], addr)
+	}
+	var parts []string
+	for label, addrs := range groups {
+		sort.Strings(addrs)
+		parts = append(parts, strings.Join(addrs, ",")+"="+label)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+func (self *ServerGroups) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 || strings.TrimSpace(value[i+1:]) == "" {
+		return fmt.Errorf("server groups are addresses=label, not %s", value)
+	}
+	label := strings.TrimSpace(value[i+1:])
+	if *self == nil {
+		*self = make(ServerGroups)
+	}
+	for _, addr := range strings.Split(value[:i], ",") {
+		addr = strings.TrimSpace(addr)
+		host := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid server address: %s", addr)
+		}
+		if other, ok := (*self)[addr]; ok && other != label {
+			return fmt.Errorf("%s is in both %s and %s", addr, other, label)
+		}
+		(*self)[addr] = label
+	}
+	return nil
+}
+
+// Failover is the traffic of a server group moving to another address.
+type Failover struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"` // the label
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+
+	// The last traffic to the old address and the first to the new.
+	LastFrom time.Time `json:"last_from"`
+	FirstTo  time.Time `json:"first_to"`
+}
+
+// groupState is where the traffic of a group is going.
+type groupState struct {
+	active  string
+	members map[string]*memberSeen
+}
+
+// memberSeen is when we saw traffic to an address of a group.
+type memberSeen struct {
+	first time.Time
+	last  time.Time
+}
+
+var serverGroups ServerGroups
+var groupStates map[string]*groupState = make(map[string]*groupState)
+var failovers []Failover
+
+// serverLabel returns the label of a server's group, or "" if it isn't in one.
+func serverLabel(dst string) string {
+	if label, ok := serverGroups[dst]; ok {
+		return label
+	}
+	if host, _, err := net.SplitHostPort(dst); err == nil {
+		return serverGroups[host]
+	}
+	return ""
+}
+
+// serverOf is the server of a stream: its group, or else its address.
+func serverOf(rs *source) string {
+	if rs.server != "" {
+		return rs.server
+	}
+	return rs.dst
+}
+
+// noteServer notes a request to a grouped server, and whether the group's
+// traffic has moved to it.
+func noteServer(rs *source) {
+	gs, ok := groupStates[rs.server]
+	if !ok {
+		gs = &groupState{members: make(map[string]*memberSeen)}
+		groupStates[rs.server] = gs
+	}
+	now := clock()
+	seen, ok := gs.members[rs.dst]
+	if !ok {
+		seen = &memberSeen{first: now}
+		gs.members[rs.dst] = seen
+	}
+	seen.last = now
+
+	if gs.active == "" {
+		gs.active = rs.dst
+		return
+	}
+	old := gs.members[gs.active]
+	if gs.active == rs.dst || now.Sub(old.last) < FAILOVER_QUIET {
+		return
+	}
+	fo := Failover{Time: now, Server: rs.server, From: gs.active, To: rs.dst,
+		LastFrom: old.last, FirstTo: seen.first}
+	failovers = append(failovers, fo)
+	log.Printf("%s%s server %s failed over from %s to %s (last traffic there %s, first here %s)%s",
+		COLOR_YELLOW, now.Format("2006/01/02 15:04:05"), fo.Server, fo.From, fo.To,
+		fo.LastFrom.Format("15:04:05.000"), fo.FirstTo.Format("15:04:05.000"), COLOR_DEFAULT)
+
+	// Should it come back, it starts afresh.
+	delete(gs.members, gs.active)
+	gs.active = rs.dst
+}
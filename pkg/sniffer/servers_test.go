@@ -0,0 +1,76 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerGroups(t *testing.T) {
+	var groups ServerGroups
+	if err := groups.Set("10.0.0.5, 10.0.0.6:3306=primary-1"); err != nil {
+		t.Fatalf("For the group\n    Got %s\n    Expected no error", err.Error())
+	}
+	if err := groups.Set("10.0.0.7=replica-1"); err != nil || len(groups) != 3 {
+		t.Errorf("For another group\n    Got %v, %v\n    Expected three addresses", groups, err)
+	}
+	if s := groups.String(); s != "10.0.0.5,10.0.0.6:3306=primary-1 10.0.0.7=replica-1" {
+		t.Errorf("For the flag\n    Got %s\n    Expected both groups", s)
+	}
+	for _, value := range []string{"10.0.0.5", "10.0.0.5=", "db1=primary-1", "10.0.0.5=other"} {
+		if err := groups.Set(value); err == nil {
+			t.Errorf("For %s\n    Got no error\n    Expected an error", value)
+		}
+	}
+
+	serverGroups = groups
+	defer func() { serverGroups = nil }()
+	for dst, expected := range map[string]string{"10.0.0.5:3306": "primary-1",
+		"10.0.0.6:3306": "primary-1", "10.0.0.6:3307": "", "10.0.0.8:3306": ""} {
+		if label := serverLabel(dst); label != expected {
+			t.Errorf("For %s\n    Got %q\n    Expected %q", dst, label, expected)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Unix(1000, 0)
+	clock = func() time.Time { return now }
+	groupStates, failovers = make(map[string]*groupState), nil
+
+	from := &source{dst: "10.0.0.5:3306", server: "primary-1"}
+	to := &source{dst: "10.0.0.6:3306", server: "primary-1"}
+	noteServer(from)
+
+	// Traffic to both isn't a failover, until the first goes quiet.
+	now = now.Add(time.Second)
+	noteServer(to)
+	now = now.Add(time.Second)
+	noteServer(from)
+	now = now.Add(FAILOVER_QUIET - time.Second)
+	noteServer(to)
+	if len(failovers) != 0 {
+		t.Errorf("For both in use\n    Got %+v\n    Expected no failover", failovers)
+	}
+	now = now.Add(time.Second)
+	noteServer(to)
+	if len(failovers) != 1 || failovers[0].From != from.dst || failovers[0].To != to.dst ||
+		failovers[0].FirstTo != time.Unix(1001, 0) || failovers[0].LastFrom != time.Unix(1002, 0) {
+		t.Errorf("For the first quiet\n    Got %+v\n    Expected a failover", failovers)
+	}
+
+	// The format and what we export go by the label.
+	if serverOf(to) != "primary-1" || serverOf(&source{dst: "10.0.0.8:3306"}) != "10.0.0.8:3306" {
+		t.Errorf("For the servers\n    Got %s\n    Expected primary-1", serverOf(to))
+	}
+	format = nil
+	parseFormat("#D:#q")
+	if key := formatQuery(to, []byte("select 1")); key != "primary-1:select ?" {
+		t.Errorf("For #D\n    Got %s\n    Expected primary-1:select ?", key)
+	}
+	format = nil
+	parseFormat("#D/#d")
+	if key := formatQuery(to, []byte("select 1")); key != "primary-1/"+UNKNOWN_DATABASE {
+		t.Errorf("For #D and #d\n    Got %s\n    Expected the server and database", key)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * session.go
+ *
+ * Session state tracking. Clients with CLIENT_SESSION_TRACK have the server
+ * say in its OK packets what a command changed about the session, including
+ * the current schema, which catches a USE we can't see as one: in a prepared
+ * statement, a stored procedure or a multi-statement we didn't follow.
+ *
+ */
+
+package sniffer
+
+const (
+	// The OK packet status flag saying session state changes follow.
+	SERVER_SESSION_STATE_CHANGED = 0x4000
+
+	// Session state change types
+	SESSION_TRACK_SYSTEM_VARIABLES = 0x00
+	SESSION_TRACK_SCHEMA           = 0x01
+
+	// How much of an OK packet we keep, enough for the session state
+	// changes before the schema.
+	OK_PREFIX = 512
+)
+
+// sessionSchema returns the schema an OK packet payload says the session
+// switched to, and whether it says one.
+func sessionSchema(payload []byte) (string, bool) {
+	if len(payload) == 0 || payload[0] != 0x00 {
+		return "", false
+	}
+	status, ok := parseStatus(payload)
+	if !ok || status&SERVER_SESSION_STATE_CHANGED == 0 {
+		return "", false
+	}
+
+	// The affected rows, insert id, status and warnings, then the info and the
+	// state changes, as length encoded strings.
+	pos := 1
+	for i := 0; i < 2; i++ {
+		pos += lenencSize(payload[pos:])
+	}
+	info, pos, ok := lenencBytes(payload, pos+4)
+	if !ok {
+		return "", false
+	}
+	changes, _, ok := lenencBytes(payload, pos+len(info))
+	if !ok {
+		return "", false
+	}
+
+	// Each change is its type, then its data as a length encoded string; the
+	// schema's data is the name, itself a length encoded string.
+	for len(changes) > 0 {
+		data, next, ok := lenencBytes(changes, 1)
+		if !ok {
+			return "", false
+		}
+		if changes[0] == SESSION_TRACK_SCHEMA {
+			name, _, ok := lenencBytes(data, 0)
+			return string(name), ok
+		}
+		changes = changes[next+len(data):]
+	}
+	return "", false
+}
+
+// lenencBytes returns the length encoded string at pos in data, where its
+// contents start, and whether it's all there.
+func lenencBytes(data []byte, pos int) ([]byte, int, bool) {
+	if pos >= len(data) {
+		return nil, pos, false
+	}
+	size := lenencSize(data[pos:])
+	if size == 0 || uint64(len(data)-pos-size) < lenencInt(data[pos:]) {
+		return nil, pos, false
+	}
+	pos += size
+	return data[pos : pos+int(lenencInt(data[pos-size:]))], pos, true
+}
+
+// prefixSize says how much of a response packet to keep, given its first
+// byte: more of an OK packet, which may carry a schema change.
+func (self *response) prefixSize(first byte) int {
+	if self.phase == RES_FIRST && first == 0x00 {
+		return OK_PREFIX
+	}
+	return RESPONSE_PREFIX
+}
@@ -0,0 +1,77 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+// OK packet payloads as MySQL 8.0 sends them with session_track_schema on: one
+// answering USE test, and one from a procedure that also turned autocommit off.
+var (
+	useTestOK = []byte{0x00, 0x00, 0x00, 0x02, 0x40, 0x00, 0x00, 0x00, 0x07, 0x01, 0x05, 0x04,
+		't', 'e', 's', 't'}
+	autocommitUseOK = []byte{0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x1b, 0x00, 0x0f,
+		0x0a, 'a', 'u', 't', 'o', 'c', 'o', 'm', 'm', 'i', 't', 0x03, 'O', 'F', 'F', 0x01, 0x08,
+		0x07, 'r', 'e', 'p', 'o', 'r', 't', 's'}
+)
+
+func TestSessionSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		schema  string
+		ok      bool
+	}{
+		{"USE test", useTestOK, "test", true},
+		{"autocommit and USE reports", autocommitUseOK, "reports", true},
+		{"a plain OK", []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}, "", false},
+		{"a variable change alone", autocommitUseOK[:26], "", false},
+		{"a truncated change", useTestOK[:14], "", false},
+		{"an EOF", []byte{0xfe, 0x00, 0x00, 0x02, 0x40}, "", false},
+	}
+	for _, test := range tests {
+		if schema, ok := sessionSchema(test.payload); schema != test.schema || ok != test.ok {
+			t.Errorf("For %s\n    Got %q (ok=%t)\n    Expected %q (ok=%t)", test.name,
+				schema, ok, test.schema, test.ok)
+		}
+	}
+}
+
+func TestSessionSchemaStream(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	parseFormat("#d.#q")
+
+	client := [4]byte{10, 0, 0, 9}
+	ok := mysqlPacket(1, 0, 0, 0, 2, 0, 0, 0)
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...)
+
+	// Logged into shop, then switching schemas in ways only the server's
+	// session tracking tells us about.
+	handlePacket(tcpPacket(client, 50000, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK,
+		mysqlPacket(0, append([]byte{10}, "8.0.21\x00"...)...)))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, makeDatabaseLogin("app", "shop")))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, mysqlPacket(2, 0, 0, 0, 2, 0, 0, 0)))
+	for _, exchange := range [][2][]byte{
+		{query, ok},
+		{mysqlPacket(0, append([]byte{COM_QUERY}, "call switch_db()"...)...),
+			mysqlPacket(1, useTestOK...)},
+		{query, ok},
+		{mysqlPacket(0, append([]byte{COM_QUERY}, "call batch_setup()"...)...),
+			mysqlPacket(1, autocommitUseOK...)},
+		{query, ok},
+	} {
+		handlePacket(tcpPacket(client, 50000, true, TCP_ACK, exchange[0]))
+		now = now.Add(time.Millisecond)
+		handlePacket(tcpPacket(client, 50000, false, TCP_ACK, exchange[1]))
+	}
+
+	for _, key := range []string{"shop.select ?", "test.select ?", "reports.select ?"} {
+		if qdata := qbuf[key]; qdata == nil || qdata.count != 1 {
+			t.Errorf("For %s\n    Got %v\n    Expected one execution", key, qbuf)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * sizes.go
+ *
+ * How big each query's responses are. The bytes per query average hides the
+ * one execution returning 100MB among thousands returning 2KB, which is
+ * usually a code path missing a predicate. With -response-sizes each query
+ * keeps a sample of its response sizes, the way it keeps its latencies, and
+ * the table shows their p95 and max; executions more than -size-outlier
+ * times over the p99 of their query are logged as they happen.
+ *
+ * A response is everything the server sent for a command, from its first
+ * packet to its last.
+ *
+ */
+
+package sniffer
+
+import (
+	"log"
+	"math/rand"
+)
+
+const (
+	// Queries need this many responses before we call one an outlier, and
+	// their p99 is worked out again every this many.
+	SIZE_MIN_SAMPLES = 100
+)
+
+var trackSizes bool = false
+var sizeOutlier float64 = 10
+
+// Outliers are logged as they happen only when asked for, with -response-sizes
+// or -v, not when sorting by size turns on the tracking.
+var logSizes bool = false
+
+// sizeStats is the response sizes of a query.
+type sizeStats struct {
+	count    uint64
+	max      uint64
+	samples  []uint64
+	outliers uint64
+
+	// The percentiles as of the count at, so they aren't sorted out of
+	// every response.
+	p95, p99 uint64
+	at       uint64
+}
+
+// refresh works out the percentiles again, if there have been responses
+// since, or at least every SIZE_MIN_SAMPLES unless forced.
+func (self *sizeStats) refresh(force bool) {
+	if self.count == self.at || (!force && self.count-self.at < SIZE_MIN_SAMPLES) {
+		return
+	}
+	pcts := scaledPercentiles(self.samples, 1, 95, 99)
+	self.p95, self.p99, self.at = uint64(pcts[0]), uint64(pcts[1]), self.count
+}
+
+// responseDone records the size of a stream's response (and with -latency full,
+// how long it took), now that it's over.
+func responseDone(rs *source) {
+	recordFull(rs)
+	size := rs.respBytes
+	rs.respBytes = 0
+	if !trackSizes || size == 0 || rs.qdata == nil {
+		return
+	}
+
+	qdata := rs.qdata
+	if qdata.sizes == nil {
+		qdata.sizes = &sizeStats{samples: make([]uint64, timeBuckets)}
+	}
+	sizes := qdata.sizes
+	sizes.count++
+	sizes.samples[rand.Intn(len(sizes.samples))] = size
+	if size > sizes.max {
+		sizes.max = size
+	}
+
+	sizes.refresh(false)
+	if sizes.count > SIZE_MIN_SAMPLES && sizes.p99 > 0 &&
+		float64(size) > float64(sizes.p99)*sizeOutlier {
+		sizes.outliers++
+		trace(rs, "response of %d bytes, %0.0fx the p99", size,
+			float64(size)/float64(sizes.p99))
+		if !logSizes {
+			return
+		}
+		log.Printf("%sResponse of %s to %s%s%s from %s, %0.0fx its p99 of %s%s", COLOR_RED,
+			formatBytes(size), COLOR_WHITE, redactQuery(rs.qtext), COLOR_RED,
+			redactClient(rs.src), float64(size)/float64(sizes.p99), formatBytes(sizes.p99),
+			COLOR_DEFAULT)
+	}
+}
+
+// responseSizes returns the p95 and max response size of a query.
+func responseSizes(qdata *queryData) (uint64, uint64) {
+	if qdata.sizes == nil {
+		return 0, 0
+	}
+	qdata.sizes.refresh(true)
+	return qdata.sizes.p95, qdata.sizes.max
+}
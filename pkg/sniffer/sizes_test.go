@@ -0,0 +1,75 @@
+package sniffer
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseSizes(t *testing.T) {
+	trackSizes, sizeOutlier, timeBuckets = true, 10, TIME_BUCKETS
+	defer func() { trackSizes, logSizes = false, false }()
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	// 2KB responses, then one of 100KB, counted but only logged when asked for.
+	qdata := &queryData{times: make([]uint64, TIME_BUCKETS)}
+	rs := &source{src: "10.0.1.8:50000", qdata: qdata, qtext: "select * from t where id = ?"}
+	for i := 0; i < 2*SIZE_MIN_SAMPLES; i++ {
+		rs.respBytes = 2048
+		responseDone(rs)
+	}
+	for _, logging := range []bool{false, true} {
+		logSizes = logging
+		out.Reset()
+		rs.respBytes = 100 << 10
+		responseDone(rs)
+		if strings.Contains(out.String(), "Response of 100.0KB") != logging {
+			t.Errorf("For logging %t\n    Got %q", logging, out.String())
+		}
+	}
+
+	if qdata.sizes.outliers != 2 {
+		t.Errorf("For the outliers\n    Got %d\n    Expected 2", qdata.sizes.outliers)
+	}
+	if p95, max := responseSizes(qdata); p95 != 2048 || max != 100<<10 {
+		t.Errorf("For the sizes\n    Got p95 %d, max %d\n    Expected 2048, %d", p95, max, 100<<10)
+	}
+	if rs.respBytes != 0 {
+		t.Errorf("For the stream\n    Got %d bytes left\n    Expected 0", rs.respBytes)
+	}
+	if sortValue("", qdata, "respp95") != 2048 {
+		t.Errorf("For sorting\n    Got %0.0f\n    Expected 2048", sortValue("", qdata, "respp95"))
+	}
+}
+
+func TestResponseSizesCaptured(t *testing.T) {
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	trackSizes = true
+	defer func() { clock, trackSizes = time.Now, false }()
+	now := time.Unix(1000, 0)
+	clock = func() time.Time { return now }
+	parseFormat("#q")
+
+	client := [4]byte{10, 0, 1, 8}
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	ok := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+	for i := 0; i < 3; i++ {
+		handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+		now = now.Add(time.Millisecond)
+		handlePacket(tcpPacket(client, 50000, false, TCP_ACK, ok))
+	}
+
+	qdata := qbuf["select ?"]
+	if qdata == nil || qdata.sizes == nil {
+		t.Fatalf("For the query\n    Got no response sizes\n    Expected some")
+	}
+	if qdata.sizes.count != 3 || qdata.sizes.max == 0 {
+		t.Errorf("For the responses\n    Got %d, max %d\n    Expected 3 with a size",
+			qdata.sizes.count, qdata.sizes.max)
+	}
+}
@@ -0,0 +1,1646 @@
+/*
+ * sniffer.go
+ *
+ * The core of the sniffer: pulling MySQL packets out of the captured TCP
+ * streams, following the protocol, and aggregating the queries.
+ *
+ * FIXME: this assumes IPv4.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"github.com/akrennmair/gopcap"
+	_ "github.com/davecgh/go-spew/spew"
+	"github.com/zorkian/mysql-sniffer/pkg/canonical"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Internal tuning
+	TIME_BUCKETS = 10000
+
+	// ANSI colors
+	COLOR_RED     = "\x1b[31m"
+	COLOR_GREEN   = "\x1b[32m"
+	COLOR_YELLOW  = "\x1b[33m"
+	COLOR_CYAN    = "\x1b[36m"
+	COLOR_WHITE   = "\x1b[37m"
+	COLOR_DEFAULT = "\x1b[39m"
+
+	// MySQL packet types
+	COM_QUERY = 3
+
+	// These are used for formatting outputs
+	F_NONE = iota
+	F_QUERY
+	F_ROUTE
+	F_SOURCE
+	F_SOURCEIP
+	F_SERVER
+	F_USER
+	F_DATABASE
+	F_PROGRAM
+)
+
+const (
+	// Where executions of statements we didn't see prepared are counted.
+	UNKNOWN_STATEMENT = "(unknown prepared statement)"
+
+	// Where statements of nothing but whitespace and comments are counted.
+	EMPTY_STATEMENT = "(empty statement)"
+
+	// What #d shows for connections we haven't seen choose a database.
+	UNKNOWN_DATABASE = "(unknown)"
+
+	// What #p shows for connections that didn't say what program they are.
+	UNKNOWN_PROGRAM = "(unknown)"
+)
+
+// What the bytes of the response in progress are counted towards.
+const (
+	RESP_NONE  = iota // nothing, like the response to a prepare
+	RESP_QUERY        // the query in qdata
+	RESP_FAST         // the fast queries, see -min-latency
+)
+
+type packet struct {
+	request bool // request or response
+	data    []byte
+}
+
+type sortable struct {
+	value float64
+	line  string
+}
+type sortableSlice []sortable
+
+type source struct {
+	src       string
+	srcip     string
+	client    *clientData
+	account   *userData
+	dst       string
+	server    string // the -server-group label of dst, if it has one
+	version   string // the server's, from its greeting
+	user      string
+	db        string
+	program   string // the program_name connection attribute, from the login
+	charset   byte   // the collation id the client logged in with, see charsets.go
+	synced    bool
+	inTxn     bool
+	txn       txnState
+	lock      *lockData
+	txnLocks  []*lockData
+	reqbuffer []byte
+	large     *largePayload // a command of 16MB or more, until it's all here
+	resbuffer []byte
+	reqSent   *time.Time
+	qbytes    uint64
+	qdata     *queryData
+	respTo    int // see RESP_NONE
+	qtext     string
+	qfprint   string
+	qcanon    string // the statement of qtext, without what the format adds
+	qtarget   uint64
+	qlist     int
+	qempty    bool
+	qwarnings int
+	resSkip   int
+	resHeader []byte
+	qconc     *concurrency
+	closed    bool
+	quit      bool      // the client sent COM_QUIT
+	queries   uint64    // over the life of the stream
+	opened    time.Time // when we started tracking the stream
+	connStart time.Time
+	authStart time.Time
+	login     int // see LOGIN_NONE
+	qraw      string
+	history   []payloadSegment
+	trace     bool
+
+	// While the client has a zero window, when it started, and the last query
+	// a stall was counted against.
+	stallStart time.Time
+	stalledOn  *queryData
+
+	// When we last saw a packet with a payload.
+	lastSeen time.Time
+
+	// The traffic we've seen each way, on this stream and for its server.
+	mirror   mirrorData
+	endpoint *mirrorData
+
+	// The commands waiting behind the current one, how far we are through
+	// its response, and the statements prepared on this connection.
+	queue []*command
+	resp  response
+	qstmt string
+	stmts map[uint32]*statement
+
+	// The file being sent for LOCAL INFILE.
+	infile infileTransfer
+
+	// The bytes sent with COM_STMT_SEND_LONG_DATA for the next execute, and
+	// with -v, how many of them for each parameter.
+	longData   uint64
+	longParams map[uint16]uint64
+
+	// With -v, the execute being answered with its values, see params.go.
+	qbound string
+
+	// The statements of a multi-statement before the one in qtext.
+	qbatch []batchQuery
+
+	// The statement the execute being answered opens a cursor on, or the
+	// query the fetch being answered counts toward and when it was sent.
+	qcursor   *statement
+	qfetch    *queryData
+	fetchSent time.Time
+
+	// Sniffing a proxy, which side of it this is, and the frontend stream a
+	// backend stream last served.
+	side      string
+	proxyPeer *source
+
+	// What of the stream we couldn't decode: the category we've given up on
+	// it as, the categories it has counted in, and the bytes it has counted
+	// as never synced.
+	blind     int
+	blindSeen uint8
+	unsynced  uint64
+
+	// Whether the client asked for the compressed protocol in its login,
+	// whether it's on, and the frames cut off at the end of the last segment
+	// each way, see compress.go.
+	compressLogin bool
+	compressed    bool
+	zreq, zres    []byte
+
+	// Whether the client logged in without CLIENT_SECURE_CONNECTION, which
+	// changes how a COM_CHANGE_USER is laid out.
+	oldAuth bool
+
+	// A replica reading the binlog, see binlog.go.
+	replica bool
+
+	// When the stream last had nothing outstanding, for think times.
+	idleSince time.Time
+
+	// The timed commands sent on the stream, answered, and given up on, for
+	// -verify.
+	cmds struct {
+		sent    uint64
+		matched uint64
+		dropped uint64
+	}
+
+	// When and why the stream last lost sync, until it syncs again.
+	desyncedAt  time.Time
+	desyncCause int
+
+	// The bytes of the response so far.
+	respBytes uint64
+
+	// When the command being answered was sent, and when the last of the
+	// response came, for -latency full.
+	respSent time.Time
+	respLast time.Time
+}
+
+type queryData struct {
+	count    uint64
+	bytes    uint64
+	apdex    apdexScore
+	lists    listStats
+	aborted  uint64
+	errors   uint64
+	warnings uint64
+	arrivals arrivalStats
+	stalls   stallData
+
+	// The counters at the end of the last status interval, and how many came
+	// in during the interval before that.
+	mark       uint64
+	bytesMark  uint64
+	errorsMark uint64
+	prevDelta  uint64
+	interval   uint64 // the interval the marks are from, see roll
+
+	// When grouping by shape, the fingerprints that fell into this shape.
+	fingerprints map[string]uint64
+
+	// When collecting, the servers this query was seen on.
+	servers map[string]uint64
+
+	// With -split-errors, the query this is one outcome of.
+	splitOf string
+
+	// The executions answered with an OK packet, and the rows they affected.
+	oks  uint64
+	rows uint64
+
+	// The executions answered with result sets, the result sets (more than
+	// one each for procedures and multi-statements), and the rows in them.
+	results  uint64
+	sets     uint64
+	returned uint64
+
+	// With -columns, the columns of the result sets.
+	columns columnStats
+
+	// The fetches from cursors the executions opened, and their total time.
+	fetches   uint64
+	fetchTime uint64
+
+	// Running latency totals, for ranking queries without going through
+	// their times.
+	timed     uint64
+	timeTotal uint64
+	timeMax   uint64
+
+	// The latency samples, timeBuckets of them allocated with the first.
+	// They're most of the size of a query, and kept apart so passes over all
+	// the queries (like ranking them for the report) don't have to page
+	// through them.
+	times []uint64
+
+	// With -response-sizes, allocated with the first.
+	sizes *sizeStats
+
+	// With -latency full, the times to the last packet of the responses.
+	full *fullStats
+
+	// With -detail, the time it had lately and the bucket it's rolled into if
+	// it loses its row, see tiers.go.
+	score  tierScore
+	bucket string
+}
+
+// avgRows returns the average rows affected by the executions answered with
+// an OK packet, or false if there weren't any.
+func (self *queryData) avgRows() (float64, bool) {
+	if self.oks == 0 {
+		return 0, false
+	}
+	return float64(self.rows) / float64(self.oks), true
+}
+
+// avgReturned returns the average rows returned by the executions answered
+// with result sets, or false if there weren't any.
+func (self *queryData) avgReturned() (float64, bool) {
+	if self.results == 0 {
+		return 0, false
+	}
+	return float64(self.returned) / float64(self.results), true
+}
+
+// avgSets returns the average result sets of the executions answered with
+// result sets, or false if there weren't any.
+func (self *queryData) avgSets() (float64, bool) {
+	if self.results == 0 {
+		return 0, false
+	}
+	return float64(self.sets) / float64(self.results), true
+}
+
+// latencies returns the latency samples of a query.
+func (self *queryData) latencies() []uint64 {
+	if latencyMode == LATENCY_FULL {
+		if self.full == nil {
+			return nil
+		}
+		return self.full.samples
+	}
+	return self.times
+}
+
+var clock func() time.Time = time.Now
+var start int64 = UnixNow()
+var qbuf map[string]*queryData = make(map[string]*queryData)
+var querycount int
+var chmap map[string]*source = make(map[string]*source)
+var verbose bool = false
+var noclean bool = false
+var dirty bool = false
+var groupShape bool = false
+var collecting bool = false
+var splitErrors bool = false
+var includeEmpty bool = false
+var format []interface{}
+var port uint16
+var times [TIME_BUCKETS]uint64
+
+var stats struct {
+	packets struct {
+		rcvd      uint64
+		rcvd_sync uint64
+		truncated uint64
+	}
+	desyncs  uint64
+	streams  uint64 // opened since the start; those still open are chmap
+	filtered struct {
+		packets uint64
+		queries uint64
+	}
+	fast struct {
+		queries uint64
+		bytes   uint64
+	}
+	infile struct {
+		transfers uint64
+		bytes     uint64
+	}
+	binlog struct {
+		streams uint64
+		packets uint64
+		bytes   uint64
+	}
+	synced struct {
+		queries uint64 // streams synced on a query
+		others  uint64 // and on another command, like a prepare or a ping
+	}
+	unbounded uint64
+	kills     struct {
+		connections uint64
+		queries     uint64
+	}
+	forward struct {
+		sent    uint64
+		dropped uint64
+	}
+	events struct {
+		dropped uint64
+	}
+	udp struct {
+		sent    uint64
+		dropped uint64
+	}
+	clickhouse struct {
+		sent    uint64
+		dropped uint64
+	}
+	errors struct {
+		responses uint64 // all ERR packets
+		mark      uint64 // responses at the last status update
+		lockWaits uint64
+		deadlocks uint64
+	}
+	teardowns struct {
+		clientFin uint64
+		clientRst uint64
+		serverFin uint64
+		serverRst uint64
+		quit      uint64 // connections closed with COM_QUIT
+	}
+	aborted uint64
+	stalls  struct {
+		count      uint64
+		time       uint64
+		keepalives uint64
+		probes     uint64
+	}
+	mirror struct {
+		skipped uint64
+	}
+	pipelined  uint64
+	compressed uint64 // streams we took the compression off
+
+	desyncReasons map[string]uint64
+	evicted       uint64 // streams replaced by a new connection before closing
+	memory        struct {
+		accounted uint64
+		shed      uint64
+		streams   uint64
+		queries   uint64
+	}
+	proxy struct {
+		frontend uint64
+		backend  uint64
+		matched  uint64
+	}
+}
+
+func UnixNow() int64 {
+	return clock().Unix()
+}
+
+func calculateTimes(timings []uint64) (fmin, favg, fmax float64) {
+	var counts, total, min, max, avg uint64 = 0, 0, 0, 0, 0
+	has_min := false
+	for _, val := range timings {
+		if val == 0 {
+			// Queries should never take 0 nanoseconds. We are using 0 as a
+			// trigger to mean 'uninitialized reading'.
+			continue
+		}
+		if val < min || !has_min {
+			has_min = true
+			min = val
+		}
+		if val > max {
+			max = val
+		}
+		counts++
+		total += val
+	}
+	if counts > 0 {
+		avg = total / counts // integer division
+	}
+	return float64(min) / 1000000, float64(avg) / 1000000,
+		float64(max) / 1000000
+}
+
+// handleStatusUpdate prints a status update. The reporter does the same, but
+// holds the parser lock only for take, and fill and endInterval.
+func handleStatusUpdate(displaycount int, sortby string, cutoff int, drill string) {
+	report := &statusReport{}
+	report.take(displaycount, sortby, cutoff, drill)
+	report.fill(topRows(report.ranked, displaycount))
+	report.endInterval()
+	report.print()
+}
+
+// take prints the sections of a status update into the report, and ranks the
+// queries for its table. A report can be taken again once it's printed.
+func (self *statusReport) take(displaycount int, sortby string, cutoff int, drill string) {
+	elapsed := float64(UnixNow() - start)
+	self.elapsed, self.ranked, self.rows = elapsed, self.ranked[:0], self.rows[:0]
+	self.before.Reset()
+	self.after.Reset()
+	w := &self.before
+
+	// print status bar, with the time as the log would have put it
+	reportf(w, "\n")
+	reportf(w, "%s %s%d total queries, %0.2f per second%s",
+		time.Now().Format("2006/01/02 15:04:05"), COLOR_RED, querycount,
+		float64(querycount)/elapsed, COLOR_DEFAULT)
+	if stats.errors.responses > 0 {
+		reportf(w, "%s%d errors, %d since the last update%s", COLOR_RED, stats.errors.responses,
+			stats.errors.responses-stats.errors.mark, COLOR_DEFAULT)
+	}
+	printLoss(w, elapsed)
+	printLarge(w)
+
+	if stats.packets.rcvd > 0 {
+		reportf(w, "%d packets (%0.2f%% on synchronized streams) / %d desyncs / %d streams "+
+			"(%d open) / %d clients", stats.packets.rcvd,
+			float64(stats.packets.rcvd_sync)/float64(stats.packets.rcvd)*100, stats.desyncs,
+			stats.streams, len(chmap), len(clients))
+	}
+	if shares := commandShares(); shares != "" {
+		reportf(w, "%s", shares)
+	}
+	printDesyncs(w)
+	printEncrypted(w)
+	printXProtocol(w)
+	if stats.compressed > 0 {
+		reportf(w, "%d compressed streams followed", stats.compressed)
+	}
+	printInfile(w)
+	printReplication(w)
+	if stats.synced.others > 0 {
+		reportf(w, "%d streams synced on a query, %d on another command", stats.synced.queries,
+			stats.synced.others)
+	}
+	printProfile(w)
+	printMirrorWarnings(w)
+	printMemory(w)
+	if stats.pipelined > 0 {
+		reportf(w, "%d commands pipelined behind another's response", stats.pipelined)
+	}
+	if stats.filtered.packets > 0 || stats.filtered.queries > 0 {
+		reportf(w, "%d packets / %d queries filtered", stats.filtered.packets,
+			stats.filtered.queries)
+	}
+	if stats.errors.lockWaits > 0 || stats.errors.deadlocks > 0 {
+		reportf(w, "%d lock wait timeouts / %d deadlocks", stats.errors.lockWaits,
+			stats.errors.deadlocks)
+	}
+	if td := stats.teardowns; td.clientFin+td.clientRst+td.serverFin+td.serverRst+td.quit > 0 {
+		reportf(w, "%d COM_QUIT, %d/%d FIN and %s%d/%d RST%s by client/server, %d queries "+
+			"aborted", td.quit, td.clientFin, td.serverFin, COLOR_RED, td.clientRst, td.serverRst,
+			COLOR_DEFAULT,
+			stats.aborted)
+	}
+	if forwardQueue != nil {
+		reportf(w, "%d events forwarded / %d dropped", atomic.LoadUint64(&stats.forward.sent),
+			atomic.LoadUint64(&stats.forward.dropped))
+	}
+	if udpQueue != nil {
+		reportf(w, "%d events sent over UDP / %d dropped", atomic.LoadUint64(&stats.udp.sent),
+			atomic.LoadUint64(&stats.udp.dropped))
+	}
+	if clickhouseQueue != nil {
+		reportf(w, "%d rows inserted into ClickHouse / %d dropped",
+			atomic.LoadUint64(&stats.clickhouse.sent), atomic.LoadUint64(&stats.clickhouse.dropped))
+	}
+	if dropped := atomic.LoadUint64(&stats.events.dropped); dropped > 0 {
+		reportf(w, "%d events dropped by slow /events subscribers", dropped)
+	}
+	if st := stats.stalls; st.count > 0 || st.keepalives > 0 {
+		reportf(w, "%d zero window stalls by clients (%0.2fs) / %d window probes / %d keepalives",
+			st.count, float64(st.time)/float64(time.Second), st.probes, st.keepalives)
+	}
+	if minLatency > 0 {
+		reportf(w, "%d fast queries (under %s), %0.2f per second, %d bytes",
+			stats.fast.queries, minLatency, float64(stats.fast.queries)/elapsed,
+			stats.fast.bytes)
+	}
+
+	// global timing values
+	gmin, gavg, gmax := calculateTimes(times[:])
+	unreliable := ""
+	if !latenciesReliable() {
+		unreliable = fmt.Sprintf(" %s(unreliable: %0.1f%% of packets dropped)%s", COLOR_RED,
+			loss.interval*100, COLOR_DEFAULT)
+	}
+	reportf(w, "%0.2fms min / %0.2fms avg / %0.2fms max query times, apdex %0.2f (T=%s)%s",
+		gmin, gavg, gmax, apdex.value(), apdexTarget, unreliable)
+	if latencyMode == LATENCY_FULL {
+		fmin, favg, fmax := calculateTimes(fullTimes[:])
+		reportf(w, "%0.2fms min / %0.2fms avg / %0.2fms max to the end of the response",
+			fmin, favg, fmax)
+	}
+	printBusy(w, clock())
+	reportf(w, "%d unique results in this filter", len(qbuf))
+	reportf(w, " ")
+	extra := ""
+	if latencyMode == LATENCY_FULL {
+		extra += COLOR_YELLOW + "first avg  "
+	}
+	if splitErrors {
+		extra += COLOR_CYAN + "  query   "
+	}
+	if groupShape {
+		extra += COLOR_CYAN + "  fps  "
+	}
+	if collecting {
+		extra += COLOR_CYAN + " srvs  "
+	}
+	if trackLists {
+		extra += COLOR_CYAN + "lst avg/max  "
+	}
+	if trackWarnings {
+		extra += COLOR_RED + "  warn/s  warn/qry  "
+	}
+	if trackBursts {
+		extra += COLOR_CYAN + "burst  "
+	}
+	if trackSizes {
+		extra += COLOR_GREEN + "resp p95      max  outl  "
+	}
+	if multiResults {
+		extra += COLOR_CYAN + "sets/call  "
+	}
+	if trackColumns {
+		extra += COLOR_CYAN + "cols min   avg   max  "
+	}
+	if cursorFetches {
+		extra += COLOR_CYAN + "fetches  ms/fetch  "
+	}
+	if trackStalls {
+		extra += COLOR_RED + "stalls stall ms  "
+	}
+	reportf(w, "%s count     %sqps     %s  min    avg   max  apdex  conc      %sbytes      per qry  "+
+		"%saffected  returned  %serr%%  %s%s", COLOR_YELLOW, COLOR_CYAN, COLOR_YELLOW, COLOR_GREEN,
+		COLOR_CYAN, COLOR_RED, extra, COLOR_DEFAULT)
+
+	self.ranked = rankRows(self.ranked, sortby, cutoff, elapsed, self.yield)
+	w = &self.after
+	printTail(w, elapsed)
+
+	if groupShape && drill != "" {
+		printShape(w, drill)
+	}
+	if timelineBucket > 0 {
+		printTimeline(w)
+	}
+	printCommandMix(w, elapsed)
+	printAborted(w, displaycount)
+	printConnects(w, displaycount)
+	printAuths(w, displaycount)
+	printServers(w, displaycount)
+	printTransactions(w)
+	printProxy(w, displaycount)
+	printCoverage(w)
+	printServerLoad(w)
+	printUnbounded(w)
+	printKills(w)
+	if trackLocks {
+		printLocks(w, displaycount)
+	}
+	if trackWarnings {
+		printWarnings(w, displaycount, elapsed)
+	}
+	if trackReplication {
+		printReplicationSafety(w)
+	}
+	if trackUsers {
+		printUsers(w, elapsed)
+	}
+	if reportClients {
+		printClients(w, displaycount, elapsed)
+	}
+	if reportMirror {
+		printMirror(w)
+	}
+	if reportBlind {
+		printBlind(w, displaycount)
+	}
+	if reportThink {
+		printThink(w, displaycount)
+	}
+	if analyze {
+		printAntipatterns(w, 3)
+	}
+}
+
+// endInterval starts the next interval of the status updates, once the report
+// has everything it needs of this one.
+func (self *statusReport) endInterval() {
+	w := &self.after
+
+	resetConcurrency()
+	resetBusy(clock())
+	if history != nil {
+		writeHistory(UnixNow())
+	}
+	rollLoad()
+	if dictionaryFile != "" {
+		if err := dumpDictionary(); err != nil {
+			reportf(w, "Failed to write the dictionary: %s", err.Error())
+		}
+	}
+	if redactMap != "" {
+		if err := writePseudonyms(redactMap); err != nil {
+			reportf(w, "Failed to write the pseudonyms: %s", err.Error())
+		}
+	}
+	if verifying {
+		verifyTotals()
+	}
+	stats.errors.mark = stats.errors.responses
+	markInterval(UnixNow())
+}
+
+// Do something with a packet for a source.
+func processPacket(rs *source, request bool, data []byte) {
+	//		log.Printf("[%s] request=%t, got %d bytes", rs.src, request,
+	//			len(data))
+
+	if rs.replica {
+		countReplication(data)
+		return
+	}
+	if verifying {
+		defer verifyStream(rs)
+	}
+	stats.packets.rcvd++
+	if rs.synced {
+		stats.packets.rcvd_sync++
+	}
+	countDesynced(rs, len(data))
+	blind.total += uint64(len(data))
+	if rs.blind != BLIND_NONE {
+		if !request && !rs.authStart.IsZero() {
+			checkAuthResponse(rs, data)
+		}
+		recordBlind(rs, rs.blind, len(data))
+		return
+	} else if !rs.synced {
+		recordBlind(rs, BLIND_UNSYNCED, len(data))
+	}
+	if desyncDump != nil || verifying {
+		rememberPayload(rs, request, data)
+	}
+	if !rs.synced && !rs.compressed && xProtocol(rs, request, data) {
+		goBlind(rs, BLIND_XPROTOCOL)
+		return
+	}
+	if request && !rs.synced && !rs.compressed && compressedFrames(data) {
+		startCompression(rs, "picked up mid-stream")
+	}
+	if rs.compressed {
+		plain, ok := uncompress(rs, request, data)
+		if !ok {
+			goBlind(rs, BLIND_COMPRESSED)
+			return
+		}
+		// What we count the queries' bytes against is what they are
+		// uncompressed.
+		blind.total = blind.total - uint64(len(data)) + uint64(len(plain))
+		if len(plain) == 0 {
+			return
+		}
+		data = plain
+	}
+
+	if request {
+		// If we still have response buffer, we're in some weird state and
+		// didn't successfully process the response.
+		if rs.resbuffer != nil {
+			//				log.Printf("[%s] possibly pipelined request? %d bytes",
+			//					rs.src, len(rs.resbuffer))
+			desync(rs, DESYNC_PIPELINED, "pipelined request")
+			rs.resbuffer = nil
+		}
+		tracePacket(rs, request, data)
+		// Commands start at sequence 0, the login doesn't.
+		if !rs.connStart.IsZero() && len(data) > 4 && data[3] == 0 {
+			recordConnect(rs)
+		}
+		if loggingIn(rs) && len(data) > 4 && data[3] == 0 {
+			// We missed the end of the login.
+			rs.login, rs.authStart = LOGIN_DONE, time.Time{}
+		}
+		if !rs.authStart.IsZero() {
+			checkAuthRequest(rs, data)
+		}
+		// Connections we see from the start tell us who is logging in, and
+		// whether we'll be able to follow them.
+		if !rs.synced {
+			if sslRequest(data) || tlsRecord(data) {
+				goBlind(rs, BLIND_ENCRYPTED)
+				return
+			}
+			if rs.login == LOGIN_NONE || rs.login == LOGIN_GREETING {
+				if user, db, attrs, ok := parseHandshake(data); ok {
+					trace(rs, "handshake response, user %s, database %q, attributes %v",
+						user, db, attrs)
+					rs.user, rs.db, rs.program = user, db, attrs["program_name"]
+					rs.charset = handshakeCharset(data)
+					// Compression starts once the server has let them in.
+					rs.compressLogin = handshakeCaps(data)&CLIENT_COMPRESS != 0
+					rs.oldAuth = handshakeCaps(data)&CLIENT_SECURE_CONNECTION == 0
+					rs.login = LOGIN_AUTH
+					return
+				}
+			}
+			// The rest of the login (auth switches, caching_sha2_password's
+			// full authentication and its public key) isn't commands.
+			if loggingIn(rs) {
+				trace(rs, "auth exchange, skipping")
+				return
+			}
+		}
+
+		// A file for LOCAL INFILE comes before any more commands.
+		if rs.synced && rs.resp.phase == RES_INFILE {
+			if data = feedInfile(rs, data); len(data) == 0 {
+				return
+			}
+		}
+
+		// Clients can send several commands in a segment.
+		rs.reqbuffer = data
+		if rs.large != nil {
+			rs.reqbuffer = feedLarge(rs, data)
+		}
+		for len(rs.reqbuffer) > 4 {
+			if rs.synced && largeStart(rs.reqbuffer) {
+				rs.reqbuffer = startLarge(rs, int(rs.reqbuffer[4]), rs.reqbuffer[5:])
+				continue
+			}
+			ptype, seq, pdata := carvePacket(&rs.reqbuffer)
+			if ptype == -1 {
+				// No (full) packet detected yet. Continue on our way.
+				return
+			}
+			if seq != 0 {
+				// Commands start at 0. Only the exchanges we don't follow (like
+				// the auth of a COM_CHANGE_USER) have the client send more of
+				// one, so anything else means we aren't where we think we are.
+				if rs.synced && responds(rs.resp.ptype) {
+					desync(rs, DESYNC_SEQUENCE, "command out of sequence")
+					continue
+				}
+				trace(rs, "skipping packet %d of a command", seq)
+				continue
+			}
+			if rs.synced && ptype > COM_LAST {
+				desync(rs, DESYNC_LENGTH, "bad packet length")
+				continue
+			}
+			countCommand(rs, ptype, pdata)
+			// Out of sync, only believe one that's all the client sent.
+			if replicationCommand(ptype, pdata) && (rs.synced || len(rs.reqbuffer) == 0) {
+				startReplication(rs, commandName(ptype))
+				return
+			}
+
+			// The synchronization logic: if we're not presently, then we want to
+			// keep going until we are capable of carving off of a request/query.
+			if !rs.synced {
+				if !syncCommand(ptype, pdata) {
+					trace(rs, "not synced, skipping until a command")
+					continue
+				}
+				// Whatever follows a command in the segment is another, so a
+				// packet out of sequence after it means we landed mid-packet.
+				if len(rs.reqbuffer) >= 4 && rs.reqbuffer[3] != 0 {
+					trace(rs, "not synced, %s followed by packet %d", commandName(ptype),
+						rs.reqbuffer[3])
+					continue
+				}
+				trace(rs, "synced on %s", commandName(ptype))
+				rs.synced = true
+				if ptype == COM_QUERY {
+					stats.synced.queries++
+				} else {
+					stats.synced.others++
+				}
+				unblind(rs, BLIND_NONE)
+				resynced(rs)
+			}
+			handleRequest(rs, ptype, pdata)
+		}
+		return
+	}
+
+	// FIXME: For now we're not doing much with response data, just following the
+	// packets to know which command they answer, and using the first packet of a
+	// response to determine latency.
+	tracePacket(rs, request, data)
+	// The greeting is the only thing the server sends at sequence 0.
+	if !rs.synced && rs.user == "" && len(data) > 4 && data[3] == 0 && data[4] == 10 {
+		if rs.connStart.IsZero() {
+			connectStarted(rs, "greeting")
+		}
+		if version, ok := parseGreeting(data); ok {
+			noteVersion(rs, version)
+		}
+		authStarted(rs)
+	} else if loggingIn(rs) {
+		if over, ok := loginResponse(rs, data); over {
+			rs.login = LOGIN_DONE
+			if !rs.authStart.IsZero() {
+				recordAuth(rs, ok)
+			} else {
+				trace(rs, "login over, ok %t", ok)
+			}
+			if ok && rs.compressLogin {
+				startCompression(rs, "from the login")
+			}
+		}
+	}
+	rs.resbuffer = nil
+	if !rs.synced && binlogEvent(data) {
+		startReplication(rs, "binlog events")
+		return
+	}
+	if !rs.synced {
+		trace(rs, "not synced, skipping until a command")
+		rs.reqbuffer = nil
+		return
+	}
+	handleResponse(rs, data)
+}
+
+// respond handles the part of a response segment that answers the current
+// command. If this is the first of it, we record the timing and store it with
+// this channel so we can keep track of that.
+func respond(rs *source, pdata []byte) {
+	plen := uint64(len(pdata))
+	rs.respBytes += plen
+	rs.respLast = clock()
+	if rs.qstmt != "" {
+		recordPrepare(rs, pdata)
+		rs.qstmt = ""
+	}
+	if rs.qfetch != nil {
+		recordFetch(rs, plen)
+		return
+	}
+
+	// Past the first of the response, the bytes go where the first's did.
+	if rs.reqSent == nil {
+		trace(rs, "more of an earlier response")
+		switch rs.respTo {
+		case RESP_QUERY:
+			rs.qdata.roll()
+			rs.qdata.bytes += plen
+			if trackWarnings {
+				scanWarnings(rs, pdata, false)
+			}
+		case RESP_FAST:
+			stats.fast.bytes += plen
+		}
+		return
+	}
+	reqtime := uint64(clock().Sub(*rs.reqSent).Nanoseconds())
+	rs.respSent = *rs.reqSent
+	rs.cmds.matched++
+	concEnd(rs)
+	trace(rs, "response after %0.2fms to %s", float64(reqtime)/1000000, rs.qtext)
+	if rs.side != "" && rs.qtext != "" {
+		proxyAnswered(rs, reqtime)
+	}
+
+	// We keep track of per-client, global, and per-query timings. Empty
+	// statements come back as soon as they arrive, so unless asked for
+	// they're only counted and stay out of the latencies.
+	randn := rand.Intn(timeBuckets)
+	untimed := rs.qempty && !includeEmpty
+	if !untimed {
+		times[randn] = reqtime
+		apdex.record(reqtime, rs.qtarget)
+	}
+
+	errcode := parseErrorCode(pdata)
+	if errcode != 0 {
+		stats.errors.responses++
+	}
+	recordClient(rs, randn, reqtime, errcode)
+	if recorder != nil && rs.qtext != "" {
+		recordReplay(rs, *rs.reqSent, rs.qraw)
+	}
+	if trackDictionary && rs.qtext != "" {
+		recordDictionary(rs, fingerprintHash(rs.qcanon))
+	}
+	if onQuery != nil && rs.qtext != "" {
+		var address string
+		if rs.server != "" {
+			address = rs.dst
+		}
+		onQuery(&QueryEvent{Time: clock(), Client: rs.src, Server: serverOf(rs),
+			Address: address, User: rs.user,
+			Canonical: rs.qtext, Raw: rs.qraw, Latency: time.Duration(reqtime),
+			Bytes: rs.qbytes + plen, ErrorCode: errcode})
+	}
+	if (forwardQueue != nil || udpQueue != nil || clickhouseQueue != nil) && rs.qtext != "" {
+		ev := &queryEvent{time: clock(), server: serverOf(rs), client: redactClient(rs.src),
+			hash: fingerprintHash(rs.qcanon), text: redactQuery(rs.qcanon),
+			verb: queryVerb([]byte(rs.qcanon)), latency: reqtime,
+			bytes: rs.qbytes + plen, errcode: errcode, user: redactUser(rs.user),
+			db: redactDB(rs.db), rows: parseAffectedRows(pdata)}
+		if rs.server != "" {
+			ev.address = rs.dst
+		}
+		if forwardQueue != nil {
+			forwardEvent(ev)
+		}
+		if udpQueue != nil {
+			forwardUDP(ev)
+		}
+		if clickhouseQueue != nil {
+			forwardClickhouse(ev)
+		}
+	}
+	if atomic.LoadInt32(&streaming) > 0 && rs.qtext != "" {
+		publishEvent(rs, reqtime, rs.qbytes+plen, errcode)
+	}
+
+	// Now that we know how long the query took, we can decide whether it
+	// goes in the aggregate or just gets summarized as a fast query.
+	if pollingLoad && !untimed {
+		loadQuery(reqtime)
+	}
+	if !untimed && reqtime < uint64(minLatency.Nanoseconds()) {
+		stats.fast.queries++
+		stats.fast.bytes += rs.qbytes + plen
+		rs.qdata, rs.respTo = nil, RESP_FAST
+		aggregateBatch(rs, randn, true)
+		if rs.qcursor != nil {
+			rs.qcursor.cursor = nil
+		}
+	} else {
+		key := rs.qtext
+		if splitErrors {
+			key += " [" + responseClass(pdata, errcode) + "]"
+		}
+		timed := reqtime
+		if untimed {
+			timed = 0
+		}
+		aggregateBatch(rs, randn, false)
+		rs.qdata = aggregate(key, rs.qcanon, randn, timed, rs.qbytes+plen, rs.qtarget)
+		rs.respTo = RESP_QUERY
+		if splitErrors {
+			rs.qdata.splitOf = rs.qtext
+		}
+		if groupShape {
+			if rs.qdata.fingerprints == nil {
+				rs.qdata.fingerprints = make(map[string]uint64)
+			}
+			rs.qdata.fingerprints[rs.qfprint]++
+		}
+		if rs.qlist > 0 {
+			rs.qdata.lists.record(rs.qlist)
+		}
+		if errcode != 0 {
+			rs.qdata.errors++
+		} else if len(pdata) > 4 && pdata[4] == 0x00 {
+			rs.qdata.oks++
+			rs.qdata.rows += parseAffectedRows(pdata)
+		}
+		if trackUsers {
+			recordUser(rs, randn, reqtime, rs.qbytes+plen, errcode)
+		}
+		if trackWarnings {
+			scanWarnings(rs, pdata, true)
+		}
+		if rs.qcursor != nil {
+			rs.qcursor.cursor = rs.qdata
+		}
+	}
+	rs.reqSent = nil
+	recordLockResponse(rs, randn, reqtime, errcode)
+
+	// If we're in verbose mode, just dump statistics from this one.
+	if verbose && len(rs.qtext) > 0 {
+		text := redactQuery(rs.qtext)
+		if rs.qbound != "" {
+			text = rs.qbound
+		}
+		text = decodeText(rs.charset, text)
+		failed := ""
+		if errcode != 0 {
+			failed = fmt.Sprintf(" %serror: %d (%s)", COLOR_RED, errcode, parseSQLState(pdata))
+		}
+		log.Printf("    %s%s %s## %sbytes: %d time: %0.2f%s%s\n", COLOR_GREEN,
+			text, COLOR_RED, COLOR_YELLOW, rs.qbytes, float64(reqtime)/1000000,
+			failed, COLOR_DEFAULT)
+	}
+}
+
+// handleRequest handles a command from the client.
+func handleRequest(rs *source, ptype int, pdata []byte) {
+	plen, raw, bound := uint64(len(pdata)), pdata, ""
+	var batch []batchQuery
+	var cursor *statement
+	if rs.server != "" {
+		noteServer(rs)
+	}
+	switch ptype {
+	case COM_QUERY:
+		// Keep-alives and ORM leftovers that are only comments fingerprint as
+		// nothing, so they're counted together under a name.
+		if skipSpaceAndComments(pdata, 0) == len(pdata) {
+			trace(rs, "empty statement")
+			pdata = []byte(EMPTY_STATEMENT)
+		}
+
+		// Of a multi-statement, the last is the query, the bytes shared out.
+		if statements := splitStatements(pdata); len(statements) > 1 {
+			trace(rs, "%d statements", len(statements))
+			share := plen / uint64(len(statements))
+			for _, statement := range statements[:len(statements)-1] {
+				txnStatement(rs, queryVerb(statement), statement)
+				batch = append(batch, batchQueryOf(rs, statement, share))
+				plen -= share
+			}
+			querycount += len(batch)
+			pdata = statements[len(statements)-1]
+		}
+	case COM_STMT_EXECUTE:
+		// The text is the statement prepared, with its placeholders.
+		var stmt *statement
+		if len(pdata) >= 4 {
+			stmt = rs.stmts[stmtID(pdata)]
+		}
+		if stmt == nil {
+			// Prepared before we saw the connection, or we missed the prepare.
+			trace(rs, "executing an unknown statement")
+			pdata = []byte(UNKNOWN_STATEMENT)
+		} else {
+			if verbose && !redacting {
+				bound = boundQuery(stmtID(pdata), stmt, pdata, rs.longParams)
+			}
+			pdata = []byte(stmt.text)
+		}
+
+		if stmt != nil && cursorOpened(raw) {
+			cursor = stmt
+		}
+
+		// Parameters sent ahead with COM_STMT_SEND_LONG_DATA are part of it.
+		plen += rs.longData
+		rs.longData, rs.longParams = 0, nil
+	case COM_STMT_PREPARE:
+		sendCommand(rs, &command{ptype: ptype, stmt: string(pdata)})
+		return
+	case COM_INIT_DB:
+		// What USE sends, rather than a query.
+		rs.db = string(pdata)
+		sendCommand(rs, &command{ptype: ptype})
+		return
+	case COM_STMT_SEND_LONG_DATA:
+		// No response to this. The bytes are part of the next execute.
+		trace(rs, "%d bytes of long data", plen)
+		rs.longData += plen
+		if verbose && len(pdata) >= 6 {
+			if rs.longParams == nil {
+				rs.longParams = make(map[uint16]uint64)
+			}
+			rs.longParams[uint16(pdata[4])|uint16(pdata[5])<<8] += plen - 6
+		}
+		return
+	case COM_STMT_CLOSE:
+		// No response to this either, and the statement's id can be given
+		// to the next one prepared.
+		if len(pdata) >= 4 {
+			delete(rs.stmts, stmtID(pdata))
+			rs.longData, rs.longParams = 0, nil
+		}
+		return
+	case COM_QUIT:
+		// No response to this, and nothing more at all after it.
+		rs.quit = true
+		return
+	case COM_CHANGE_USER:
+		// A new login on the connection, so what comes after is someone else's.
+		// The auth exchange that follows is more of the command, and its
+		// response isn't followed, so none of it counts as queries.
+		if user, db, ok := parseChangeUser(pdata, !rs.oldAuth); ok {
+			trace(rs, "changing user from %s to %s, database %q", rs.user, user, db)
+			rs.user, rs.db, rs.account = user, db, nil
+		}
+		// The server rolls back the transaction and drops the statements.
+		if rs.inTxn {
+			txnEnd(rs)
+		}
+		rs.stmts, rs.longData, rs.longParams = nil, 0, nil
+		sendCommand(rs, &command{ptype: ptype})
+		return
+	case COM_STMT_RESET:
+		// Which throws away the long data, and closes the cursor.
+		rs.longData, rs.longParams = 0, nil
+		if len(pdata) >= 4 && rs.stmts[stmtID(pdata)] != nil {
+			rs.stmts[stmtID(pdata)].cursor = nil
+		}
+		sendCommand(rs, &command{ptype: ptype})
+		return
+	case COM_STMT_FETCH:
+		sendCommand(rs, fetchCommand(rs, pdata))
+		return
+	case COM_PROCESS_KILL:
+		alertKill(rs, false, killThread(pdata))
+		sendCommand(rs, &command{ptype: ptype})
+		return
+	default:
+		sendCommand(rs, &command{ptype: ptype})
+		return
+	}
+
+	if checkCoverage {
+		countWireDigest(pdata)
+	}
+
+	verb := queryVerb(pdata)
+	txnStatement(rs, verb, pdata)
+	switch verb {
+	case "use":
+		if tokens := lexQuery(pdata); len(tokens) > 1 {
+			rs.db = tableName(tokens, 1)
+		}
+	case "update", "delete":
+		if whereAlerts {
+			checkUnboundedWrite(rs, pdata)
+		}
+	case "kill":
+		onlyQuery, thread := parseKill(pdata)
+		alertKill(rs, onlyQuery, thread)
+	}
+
+	// Filtered queries still need to consume their response, so make sure the
+	// response isn't attributed to whatever query came before.
+	if !userAllowed(rs.user) || !verbAllowed(verb) {
+		stats.filtered.queries++
+		trace(rs, "filtered out")
+		sendCommand(rs, &command{ptype: ptype})
+		return
+	}
+	cmd := &command{ptype: ptype, sent: clock(), bytes: plen, bound: bound, batch: batch,
+		cursor: cursor, empty: ptype == COM_QUERY && string(pdata) == EMPTY_STATEMENT}
+
+	// Convert this request into whatever format the user wants.
+	querycount++
+	rs.queries++
+	canon := queryStatement(pdata)
+	text := formatStatement(rs, pdata, canon)
+	if analyze {
+		recordAntipatterns(text, pdata, rs.inTxn)
+	}
+	if trackReplication && (verb == "insert" || verb == "replace" || verb == "update" ||
+		verb == "delete") {
+		recordReplicationSafety(text, pdata)
+	}
+	if trackLocks && (verb == "select" || verb == "lock") {
+		cmd.lock = recordLockRequest(rs, text, pdata)
+	}
+
+	// In shape mode the fingerprint is only kept for drilling down, and the
+	// aggregation happens over the shape instead.
+	if groupShape {
+		cmd.fprint, text = text, queryShape(pdata)
+		canon = text
+	}
+	text = sideLabel(rs) + text
+
+	// The aggregation happens once the response arrives, since that's when we
+	// know enough to decide whether to keep it.
+	cmd.text, cmd.canon = text, canon
+	cmd.target = apdexThreshold(verb)
+	if trackLists {
+		cmd.list = listSize(pdata)
+	}
+	if recorder != nil || onQuery != nil || dictionarySamples {
+		cmd.raw = string(pdata)
+		if cmd.empty {
+			cmd.raw = string(raw)
+		}
+	}
+	sendCommand(rs, cmd)
+}
+
+// formatQuery converts a query from a source into the aggregation key, using
+// whatever format the user asked for.
+func formatQuery(rs *source, query []byte) string {
+	return formatStatement(rs, query, queryStatement(query))
+}
+
+// queryStatement is what a query is counted as before the format adds anything
+// to it: its fingerprint, or the query itself with -dirty. This is what the
+// events and the dictionary hash, so the same query from two clients is the
+// same fingerprint whatever the format.
+func queryStatement(query []byte) string {
+	if dirty {
+		return string(query)
+	}
+	return cleanupQuery(query)
+}
+
+// formatStatement is formatQuery for a query whose statement we already have.
+func formatStatement(rs *source, query []byte, statement string) string {
+	var text string
+
+	for _, item := range format {
+		switch item.(type) {
+		case int:
+			switch item.(int) {
+			case F_NONE:
+				log.Fatalf("F_NONE in format string")
+			case F_QUERY:
+				text += statement
+			case F_ROUTE:
+				// Routes are in the query like:
+				//     SELECT /* hostname:route */ FROM ...
+				// We remove the hostname so routes can be condensed.
+				parts := strings.SplitN(string(query), " ", 5)
+				if len(parts) >= 4 && parts[1] == "/*" && parts[3] == "*/" {
+					if strings.Contains(parts[2], ":") {
+						text += strings.SplitN(parts[2], ":", 2)[1]
+					} else {
+						text += parts[2]
+					}
+				} else {
+					text += "(unknown) " + cleanupQuery(query)
+				}
+			case F_SOURCE:
+				text += redactClient(clientOf(rs).id)
+			case F_SOURCEIP:
+				text += redactClient(rs.srcip)
+			case F_SERVER:
+				text += redactClient(serverOf(rs))
+			case F_USER:
+				if rs.user == "" {
+					text += UNKNOWN_USER
+				} else {
+					text += redactUser(rs.user)
+				}
+			case F_DATABASE:
+				if rs.db == "" {
+					text += UNKNOWN_DATABASE
+				} else {
+					text += redactDB(rs.db)
+				}
+			case F_PROGRAM:
+				if rs.program == "" {
+					text += UNKNOWN_PROGRAM
+				} else {
+					text += redactProgram(rs.program)
+				}
+			default:
+				log.Fatalf("Unknown F_XXXXXX int in format string")
+			}
+		case string:
+			text += item.(string)
+		default:
+			log.Fatalf("Unknown type in format string")
+		}
+	}
+	return text
+}
+
+// aggregate records one completed execution of a query in qbuf, returning the
+// queryData it was recorded against. A reqtime of 0 means we don't know how long
+// the query took, so it's only counted. The query is the key's statement,
+// without what the format adds, for the tiers to bucket it by.
+func aggregate(text, query string, randn int, reqtime, bytes, target uint64) *queryData {
+	qdata, ok := qbuf[text]
+	if !ok && detailLimit > 0 {
+		qdata, ok = tieredQuery(text, query, reqtime), true
+	}
+	if !ok && maxFingerprints > 0 && len(qbuf) >= maxFingerprints {
+		throttle.capped++
+		text = OTHER_QUERIES
+		qdata, ok = qbuf[text]
+	}
+	if !ok {
+		qdata = &queryData{interval: intervals}
+		qbuf[text] = qdata
+	}
+	qdata.roll()
+	qdata.count++
+	qdata.bytes += bytes
+	if detailLimit > 0 {
+		qdata.score.add(reqtime, clock())
+	}
+	if trackBursts {
+		qdata.arrivals.record(clock().Add(-time.Duration(reqtime)))
+	}
+	if timelineBucket > 0 {
+		recordTimeline(text, reqtime)
+	}
+	if reqtime > 0 {
+		if qdata.times == nil {
+			qdata.times = make([]uint64, timeBuckets)
+		}
+		qdata.times[randn] = reqtime
+		qdata.timed++
+		qdata.timeTotal += reqtime
+		if reqtime > qdata.timeMax {
+			qdata.timeMax = reqtime
+		}
+		qdata.apdex.record(reqtime, target)
+	}
+	return qdata
+}
+
+// carvePacket tries to pull a packet out of a slice of bytes. If so, it removes
+// those bytes from the slice, and returns the packet's type, sequence number and
+// payload.
+func carvePacket(buf *[]byte) (int, byte, []byte) {
+	datalen := uint32(len(*buf))
+	if datalen < 5 {
+		return -1, 0, nil
+	}
+
+	size := uint32((*buf)[0]) + uint32((*buf)[1])<<8 + uint32((*buf)[2])<<16
+	if size == 0 || datalen < size+4 {
+		return -1, 0, nil
+	}
+
+	// Else, has some length, try to validate it.
+	end := size + 4
+	ptype, seq := int((*buf)[4]), (*buf)[3]
+	data := (*buf)[5 : size+4]
+	if end >= datalen {
+		*buf = nil
+	} else {
+		*buf = (*buf)[end:]
+	}
+
+	//	log.Printf("datalen=%d size=%d end=%d ptype=%d data=%d buf=%d",
+	//		datalen, size, end, ptype, len(data), len(*buf))
+
+	return ptype, seq, data
+}
+
+// extract the data... we have to figure out where it is, which means extracting data
+// from the various headers until we get the location we want.  this is crude, but
+// functional and it should be fast.
+func handlePacket(pkt *pcap.Packet) {
+	// Packets longer than the capture length lose their end, and with it any
+	// packets after it in the segment.
+	if pkt.Caplen < pkt.Len {
+		stats.packets.truncated++
+	}
+
+	// Ethernet frame has 14 bytes of stuff to ignore, so we start our root position here
+	var pos byte = 14
+
+	// Grab the src IP address of this packet from the IP header.
+	srcIP := pkt.Data[pos+12 : pos+16]
+	dstIP := pkt.Data[pos+16 : pos+20]
+
+	// The IP frame has the header length in bits 4-7 of byte 0 (relative).
+	pos += pkt.Data[pos] & 0x0F * 4
+
+	// Grab the source port from the TCP header.
+	srcPort := uint16(pkt.Data[pos])<<8 + uint16(pkt.Data[pos+1])
+	dstPort := uint16(pkt.Data[pos+2])<<8 + uint16(pkt.Data[pos+3])
+
+	// The flags tell us when connections end.
+	tcpflags := pkt.Data[pos+13]
+	window := uint16(pkt.Data[pos+14])<<8 + uint16(pkt.Data[pos+15])
+
+	// The TCP frame has the data offset in bits 4-7 of byte 12 (relative).
+	pos += byte(pkt.Data[pos+12]) >> 4 * 4
+
+	// If this is a 0-length payload, do nothing unless it's opening or closing
+	// the connection, or could be announcing a window. (Any way to change our
+	// filter to only dump packets with data?)
+	if len(pkt.Data[pos:]) <= 0 && tcpflags&(TCP_SYN|TCP_FIN|TCP_RST) == 0 && !trackStalls &&
+		oneWayAfter <= 0 {
+		return
+	}
+
+	// This is either an inbound or outbound packet. Determine by seeing which
+	// end contains our port. Either way, we want to put this on the channel of
+	// the remote end.
+	var clientIP []byte
+	var clientPort uint16
+	server, request, side, ok := serverPort(srcIP, dstIP, srcPort, dstPort)
+	if !ok {
+		// Let through by the filter we had before the targets changed.
+		targetStats.stray++
+		return
+	} else if request {
+		clientIP, clientPort = srcIP, srcPort
+	} else {
+		clientIP, clientPort = dstIP, dstPort
+	}
+
+	// Drop filtered clients before we build up any state for them.
+	if !clientAllowed(net.IP(clientIP)) {
+		stats.filtered.packets++
+		return
+	}
+	if !sampled(clientIP, clientPort) {
+		throttle.skipped++
+		return
+	}
+	src := fmt.Sprintf("%d.%d.%d.%d:%d", clientIP[0], clientIP[1], clientIP[2],
+		clientIP[3], clientPort)
+
+	// Get the data structure for this source, then do something. A new
+	// connection replaces whatever we had from the last one on this port.
+	rs, ok := chmap[src]
+	opening := request && tcpflags&(TCP_SYN|TCP_ACK) == TCP_SYN
+	if opening {
+		if ok && !rs.closed {
+			stats.evicted++
+		}
+		ok = false
+		delete(quits, src)
+	} else if !ok && quitLately(src, clock()) {
+		// A retransmission of the COM_QUIT, or the rest of the connection
+		// closing after it.
+		return
+	} else if len(pkt.Data[pos:]) == 0 {
+		// Nothing to parse, but a connection we know about may be stalling or
+		// going away.
+		if ok {
+			recordDirection(rs, request, 0)
+			handleWindow(rs, request, window, 0)
+		}
+		if ok && tcpflags&(TCP_FIN|TCP_RST) != 0 {
+			handleTeardown(rs, !request, tcpflags)
+			if tcpflags&TCP_RST != 0 {
+				delete(chmap, src)
+			}
+		}
+		return
+	}
+	if !ok {
+		srcip := src[0:strings.Index(src, ":")]
+		rs = &source{src: src, srcip: srcip, synced: false, trace: tracing(src), side: side}
+		if request {
+			rs.dst = fmt.Sprintf("%d.%d.%d.%d:%d", dstIP[0], dstIP[1], dstIP[2], dstIP[3], server)
+		} else {
+			rs.dst = fmt.Sprintf("%d.%d.%d.%d:%d", srcIP[0], srcIP[1], srcIP[2], srcIP[3], server)
+		}
+		rs.server = serverLabel(rs.dst)
+		rs.opened = clock()
+		stats.streams++
+		noteStream(rs)
+		chmap[src] = rs
+	}
+	if opening {
+		connectStarted(rs, "SYN")
+		return
+	}
+
+	// Now with a source, process the packet.
+	rs.lastSeen = clock()
+	if pkt.Caplen < pkt.Len {
+		blind.total += uint64(pkt.Len - pkt.Caplen)
+		recordBlind(rs, BLIND_TRUNCATED, int(pkt.Len-pkt.Caplen))
+	}
+	bidirectional := recordDirection(rs, request, len(pkt.Data[pos:]))
+	if !handleWindow(rs, request, window, len(pkt.Data[pos:])) && bidirectional {
+		processPacket(rs, request, pkt.Data[pos:])
+	}
+	if pkt.Caplen < pkt.Len && rs.synced {
+		desync(rs, DESYNC_TRUNCATED, "truncated capture")
+	}
+	if rs.quit {
+		handleQuit(src, rs)
+		return
+	}
+	if tcpflags&(TCP_FIN|TCP_RST) != 0 {
+		handleTeardown(rs, !request, tcpflags)
+		if tcpflags&TCP_RST != 0 {
+			delete(chmap, src)
+		}
+	}
+	checkMemory(false)
+}
+
+// cleanupQuery is canonical.Fingerprint, with insert columns folded if asked,
+// unless we've been asked to leave the queries alone.
+func cleanupQuery(query []byte) string {
+	if verbose && noclean {
+		return canonical.Tidy(string(query))
+	}
+	return foldInsertColumns(canonical.Fingerprint(string(query)), foldColumns)
+}
+
+// parseFormat takes a string and parses it out into the given format slice
+// that we later use to build up a string. This might actually be an overcomplicated
+// solution?
+func parseFormat(formatstr string) {
+	formatstr = strings.TrimSpace(formatstr)
+	if formatstr == "" {
+		formatstr = "#b:#k"
+	}
+
+	is_special := false
+	curstr := ""
+	do_append := F_NONE
+	for _, char := range formatstr {
+		if char == '#' {
+			if is_special {
+				curstr += string(char)
+				is_special = false
+			} else {
+				is_special = true
+			}
+			continue
+		}
+
+		if is_special {
+			switch strings.ToLower(string(char)) {
+			case "s":
+				do_append = F_SOURCE
+			case "i":
+				do_append = F_SOURCEIP
+			case "r":
+				do_append = F_ROUTE
+			case "q":
+				do_append = F_QUERY
+			case "u":
+				do_append = F_USER
+			case "d":
+				// The one token where case matters: #D is the server.
+				if char == 'D' {
+					do_append = F_SERVER
+				} else {
+					do_append = F_DATABASE
+				}
+			case "p":
+				do_append = F_PROGRAM
+			default:
+				curstr += "#" + string(char)
+			}
+			is_special = false
+		} else {
+			curstr += string(char)
+		}
+
+		if do_append != F_NONE {
+			if curstr != "" {
+				format = append(format, curstr, do_append)
+				curstr = ""
+			} else {
+				format = append(format, do_append)
+			}
+			do_append = F_NONE
+		}
+	}
+	if curstr != "" {
+		format = append(format, curstr)
+	}
+}
+
+func (self sortableSlice) Len() int {
+	return len(self)
+}
+
+func (self sortableSlice) Less(i, j int) bool {
+	return self[i].value < self[j].value
+}
+
+func (self sortableSlice) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
@@ -0,0 +1,77 @@
+/*
+ * stalls.go
+ *
+ * Clients that stop reading. When a client's receive buffer fills up it
+ * announces a zero window, and the server can't send it any more of the result
+ * until it reads some. The rest of the response trickles out for as long as
+ * the client takes, holding the server thread the whole time, which looks like
+ * a slow query from the outside even though the server did its part quickly.
+ *
+ * Our latency is to the first packet of the response, so stalls don't count
+ * against it. Instead we report them as their own component per query: how
+ * many executions stalled and for how long in total.
+ *
+ * Neither TCP keepalives (a single garbage byte from the client) nor the
+ * server's probes of a zero window are MySQL data, so those are skipped.
+ *
+ */
+
+package sniffer
+
+import (
+	"time"
+)
+
+var trackStalls bool = false
+
+// stallData is what we know about stalls for one query.
+type stallData struct {
+	count uint64 // executions that stalled
+	time  uint64 // nanoseconds stalled
+}
+
+// handleWindow looks at the window of a segment on a stream, before its payload
+// (if any) is parsed. It returns true if the payload isn't MySQL data.
+func handleWindow(rs *source, request bool, window uint16, payload int) bool {
+	if request {
+		if payload == 1 {
+			// A keepalive, since MySQL packets have a 4 byte header.
+			stats.stalls.keepalives++
+			return true
+		}
+		if !trackStalls {
+			return false
+		}
+		if window == 0 && rs.stallStart.IsZero() {
+			trace(rs, "client announced a zero window")
+			rs.stallStart = clock()
+			stats.stalls.count++
+		} else if window > 0 && !rs.stallStart.IsZero() {
+			stalled := clock().Sub(rs.stallStart)
+			trace(rs, "client window opened after %s", stalled)
+			rs.stallStart = time.Time{}
+			recordStall(rs, stalled)
+		}
+		return false
+	}
+
+	if trackStalls && payload == 1 && !rs.stallStart.IsZero() {
+		// The server probing whether the window has opened yet.
+		stats.stalls.probes++
+		return true
+	}
+	return false
+}
+
+// recordStall credits stalled time to the query whose response was being read.
+func recordStall(rs *source, stalled time.Duration) {
+	stats.stalls.time += uint64(stalled)
+	if rs.qdata == nil {
+		return
+	}
+	rs.qdata.stalls.time += uint64(stalled)
+	if rs.stalledOn != rs.qdata {
+		rs.qdata.stalls.count++
+		rs.stalledOn = rs.qdata
+	}
+}
@@ -0,0 +1,58 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/akrennmair/gopcap"
+)
+
+// windowPacket is tcpPacket announcing a window.
+func windowPacket(client [4]byte, request bool, window uint16, payload []byte) *pcap.Packet {
+	pkt := tcpPacket(client, 50000, request, TCP_ACK, payload)
+	pkt.Data[48], pkt.Data[49] = byte(window>>8), byte(window)
+	return pkt
+}
+
+func TestStalls(t *testing.T) {
+	defer func() { trackStalls, clock = false, time.Now }()
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	stats.stalls.count, stats.stalls.time, stats.stalls.keepalives, stats.stalls.probes = 0, 0, 0, 0
+	parseFormat("#q")
+	trackStalls = true
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+	client := [4]byte{10, 0, 0, 2}
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	row := []byte{1, 0, 0, 2, 0}
+
+	// The response starts 2ms in, then the client stops reading twice for a
+	// total of 3s, with the server probing and a keepalive in between.
+	handlePacket(windowPacket(client, true, 1000, query))
+	now = now.Add(2 * time.Millisecond)
+	handlePacket(windowPacket(client, false, 1000, []byte{1, 0, 0, 1, 1}))
+	handlePacket(windowPacket(client, true, 0, nil))
+	now = now.Add(time.Second)
+	handlePacket(windowPacket(client, false, 1000, []byte{'x'}))
+	handlePacket(windowPacket(client, true, 0, []byte{0}))
+	now = now.Add(time.Second)
+	handlePacket(windowPacket(client, true, 1000, nil))
+	handlePacket(windowPacket(client, false, 1000, row))
+	handlePacket(windowPacket(client, true, 0, nil))
+	now = now.Add(time.Second)
+	handlePacket(windowPacket(client, true, 1000, nil))
+
+	qdata := qbuf["select ?"]
+	if qdata == nil || qdata.count != 1 || qdata.stalls.count != 1 ||
+		time.Duration(qdata.stalls.time) != 3*time.Second {
+		t.Errorf("For select ?\n    Got %+v\n    Expected 1 execution stalled for 3s", qdata)
+	} else if _, avg, _ := calculateTimes(qdata.latencies()); avg != 2 {
+		t.Errorf("For latency\n    Got %0.2fms\n    Expected 2ms", avg)
+	}
+	if st := stats.stalls; st.count != 2 || st.probes != 1 || st.keepalives != 1 {
+		t.Errorf("For stall stats\n    Got %+v\n    Expected 2 stalls, 1 probe, 1 keepalive", st)
+	}
+	if qdata != nil && qdata.bytes != 8+5+5 {
+		t.Errorf("For bytes\n    Got %d\n    Expected %d without the probe", qdata.bytes, 8+5+5)
+	}
+}
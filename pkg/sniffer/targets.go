@@ -0,0 +1,317 @@
+/*
+ * targets.go
+ *
+ * Changing the servers we sniff while we run. The fleet behind us grows and
+ * shrinks, and restarting to change -P or -proxy loses everything we've
+ * gathered. SetTargets (POST /config/targets with -http-targets, or SIGHUP with
+ * -targets-file) replaces the set of server endpoints: the capture loop puts
+ * in the new BPF filter between packets, new endpoints are followed from their
+ * next packet, and the streams of removed ones are kept for TARGET_GRACE in
+ * case they come back, then dropped. Streams of the endpoints that stay are
+ * left alone.
+ *
+ * Targets are [host:]port, comma or space separated, and when sniffing a proxy
+ * each has its side in front: "frontend=6033, backend=10.0.0.5:3306".
+ *
+ */
+
+package sniffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TARGET_GRACE = time.Minute
+)
+
+// target is a server endpoint we sniff.
+type target struct {
+	side string // SIDE_FRONTEND or SIDE_BACKEND when sniffing a proxy
+	ip   net.IP // nil for any host
+	port uint16
+}
+
+func (self target) String() string {
+	s := strconv.Itoa(int(self.port))
+	if self.ip != nil {
+		s = self.ip.String() + ":" + s
+	}
+	if self.side != "" {
+		s = self.side + "=" + s
+	}
+	return s
+}
+
+// TargetChange is a change of targets, for the record.
+type TargetChange struct {
+	Time    time.Time `json:"time"`
+	Origin  string    `json:"origin"` // who asked for it
+	Added   []string  `json:"added"`
+	Removed []string  `json:"removed"`
+	Filter  string    `json:"filter"`
+}
+
+// retarget is a change of targets for the capture loop to make.
+type retarget struct {
+	targets []target
+	origin  string
+	done    chan error
+}
+
+// The targets, nil until they're first changed, which means -P or -proxy.
+var targets []target
+var targetChanges []TargetChange
+
+// When streams of removed targets go, if any are waiting to.
+var retireAt time.Time
+
+var targetStats struct {
+	stray   uint64 // packets for no target, let through as the filter changed
+	retired uint64 // streams dropped with their target
+}
+
+// With -http-targets, what POST /config/targets calls.
+var retargeter func(spec, origin string) error
+
+// parseTargets reads a list of targets.
+func parseTargets(spec string) ([]target, error) {
+	var list []target
+	for _, item := range strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		var t target
+		if i := strings.Index(item, "="); i >= 0 {
+			t.side, item = item[:i], item[i+1:]
+			if t.side != SIDE_FRONTEND && t.side != SIDE_BACKEND {
+				return nil, fmt.Errorf("Bad target side: %s", t.side)
+			}
+		}
+		if (t.side == "") != (proxyFrontend == nil) {
+			if t.side == "" {
+				return nil, fmt.Errorf("Target %s needs a side when sniffing a proxy", item)
+			}
+			return nil, fmt.Errorf("Target %s has a side but we aren't sniffing a proxy", item)
+		}
+		portstr := item
+		if i := strings.LastIndex(item, ":"); i >= 0 {
+			if t.ip = net.ParseIP(item[:i]).To4(); t.ip == nil {
+				return nil, fmt.Errorf("Bad target host: %s", item[:i])
+			}
+			portstr = item[i+1:]
+		}
+		p, err := strconv.ParseUint(portstr, 10, 16)
+		if err != nil || p == 0 {
+			return nil, fmt.Errorf("Bad target port: %s", portstr)
+		}
+		t.port = uint16(p)
+		list = append(list, t)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("No targets given")
+	}
+	return list, nil
+}
+
+// currentTargets is the targets we're sniffing.
+func currentTargets() []target {
+	if targets != nil {
+		return targets
+	}
+	if proxyFrontend == nil {
+		return []target{{port: port}}
+	}
+	var list []target
+	for _, side := range []string{SIDE_FRONTEND, SIDE_BACKEND} {
+		ports := proxyFrontend
+		if side == SIDE_BACKEND {
+			ports = proxyBackend
+		}
+		for p := range ports {
+			list = append(list, target{side: side, port: p})
+		}
+	}
+	return list
+}
+
+// matchTarget finds the target of an endpoint.
+func matchTarget(ip []byte, p uint16) (target, bool) {
+	for _, t := range targets {
+		if t.port == p && (t.ip == nil || t.ip.Equal(net.IP(ip))) {
+			return t, true
+		}
+	}
+	return target{}, false
+}
+
+// targetFilter is the BPF filter for the targets.
+func targetFilter() string {
+	var clauses []string
+	for _, t := range targets {
+		if t.ip == nil {
+			clauses = append(clauses, fmt.Sprintf("port %d", t.port))
+		} else {
+			clauses = append(clauses, fmt.Sprintf("(host %s and port %d)", t.ip, t.port))
+		}
+	}
+	sort.Strings(clauses)
+	return "tcp and (" + strings.Join(clauses, " or ") + ")"
+}
+
+// captureFilter is the whole BPF filter: the servers and, if we're only
+// interested in some clients, those clients so the kernel drops the rest.
+func captureFilter() string {
+	filter := portFilter()
+	if len(onlyClients) > 0 && len(skipClients) == 0 {
+		filter += " and (" + onlyClients.bpfClause() + ")"
+	}
+	return filter
+}
+
+// diffTargets returns the targets in one list and not the other, both ways.
+func diffTargets(old, new []target) (added, removed []string) {
+	had, has := make(map[string]bool), make(map[string]bool)
+	for _, t := range old {
+		had[t.String()] = true
+	}
+	for _, t := range new {
+		has[t.String()] = true
+		if !had[t.String()] {
+			added = append(added, t.String())
+		}
+	}
+	for _, t := range old {
+		if !has[t.String()] {
+			removed = append(removed, t.String())
+		}
+	}
+	return added, removed
+}
+
+// SetTargets replaces the servers we sniff with those in spec, once the
+// capture loop gets to it. The origin goes in the log.
+func (self *Sniffer) SetTargets(spec, origin string) error {
+	list, err := parseTargets(spec)
+	if err != nil {
+		return err
+	}
+	rt := &retarget{targets: list, origin: origin, done: make(chan error, 1)}
+	select {
+	case self.retarget <- rt:
+	case <-self.done:
+		return fmt.Errorf("The capture has ended")
+	}
+	return <-rt.done
+}
+
+// applyTargets puts in a change of targets, from the capture loop.
+func (self *Sniffer) applyTargets(rt *retarget) error {
+	parser.Lock()
+	defer parser.Unlock()
+
+	old := currentTargets()
+	targets = rt.targets
+	filter := captureFilter()
+	if err := self.iface.Setfilter(filter); err != nil {
+		targets = old
+		return fmt.Errorf("Failed to set port filter: %s", err.Error())
+	}
+
+	now := clock()
+	added, removed := diffTargets(old, targets)
+	if len(removed) > 0 {
+		retireAt = now.Add(TARGET_GRACE)
+	}
+	targetChanges = append(targetChanges, TargetChange{Time: now, Origin: rt.origin,
+		Added: added, Removed: removed, Filter: filter})
+	log.Printf("%s%s targets changed by %s: added %s, removed %s%s", COLOR_YELLOW,
+		now.Format("2006/01/02 15:04:05"), rt.origin, listOrNone(added), listOrNone(removed),
+		COLOR_DEFAULT)
+	return nil
+}
+
+// listOrNone joins a list for the log.
+func listOrNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ", ")
+}
+
+// retireTargets drops the streams of servers we no longer sniff, once they've
+// had their grace.
+func retireTargets(now time.Time) {
+	if retireAt.IsZero() || now.Before(retireAt) {
+		return
+	}
+	retireAt = time.Time{}
+	for src, rs := range chmap {
+		host, portstr, err := net.SplitHostPort(rs.dst)
+		if err != nil {
+			continue
+		}
+		p, _ := strconv.ParseUint(portstr, 10, 16)
+		if _, ok := matchTarget(net.ParseIP(host).To4(), uint16(p)); !ok {
+			delete(chmap, src)
+			targetStats.retired++
+		}
+	}
+}
+
+// serveTargets writes the targets and their changes, or changes them to those
+// POSTed as JSON, in the same form: {"targets": ["3306", "10.0.0.5:3307"]}.
+func serveTargets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		parser.Lock()
+		var current []string
+		for _, t := range currentTargets() {
+			current = append(current, t.String())
+		}
+		resp := struct {
+			Targets []string       `json:"targets"`
+			Changes []TargetChange `json:"changes"`
+		}{current, targetChanges}
+		parser.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(resp)
+	case http.MethodPost:
+		// A form on another site can post text, but it can't post JSON without
+		// asking us first, and we never say yes.
+		if !sameOrigin(r) {
+			http.Error(w, "cross origin", http.StatusForbidden)
+			return
+		}
+		mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediatype != "application/json" {
+			http.Error(w, "application/json only", http.StatusUnsupportedMediaType)
+			return
+		}
+		var req struct {
+			Targets []string `json:"targets"`
+		}
+		body := http.MaxBytesReader(w, r.Body, 1<<16)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := retargeter(strings.Join(req.Targets, ","), "http "+r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "GET or POST", http.StatusMethodNotAllowed)
+	}
+}
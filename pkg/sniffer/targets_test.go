@@ -0,0 +1,118 @@
+package sniffer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTargets(t *testing.T) {
+	proxyFrontend = nil
+	list, err := parseTargets("3306, 10.0.0.5:3307\n")
+	if err != nil || len(list) != 2 || list[1].String() != "10.0.0.5:3307" {
+		t.Errorf("For 3306, 10.0.0.5:3307\n    Got %v, %v\n    Expected both", list, err)
+	}
+	for _, spec := range []string{"", "x", "10.0.0.5:0", "host:3306", "backend=3306"} {
+		if _, err := parseTargets(spec); err == nil {
+			t.Errorf("For %q\n    Got no error\n    Expected an error", spec)
+		}
+	}
+
+	proxyFrontend, proxyBackend, _ = parseProxy("6033:3306")
+	defer func() { proxyFrontend, proxyBackend = nil, nil }()
+	if _, err := parseTargets("3306"); err == nil {
+		t.Errorf("For 3306 behind a proxy\n    Got no error\n    Expected an error")
+	}
+	list, err = parseTargets("frontend=6033 backend=10.0.0.5:3306")
+	if err != nil || len(list) != 2 || list[1].side != SIDE_BACKEND {
+		t.Errorf("For the proxy targets\n    Got %v, %v\n    Expected both", list, err)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	defer func() { clock, targets, retireAt = time.Now, nil, time.Time{} }()
+	now := time.Unix(1000, 0)
+	clock = func() time.Time { return now }
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	proxyFrontend, targets, targetStats.stray, targetStats.retired = nil, nil, 0, 0
+	parseFormat("#q")
+
+	if filter := captureFilter(); filter != "tcp port 3306" {
+		t.Errorf("For -P 3306\n    Got %s\n    Expected tcp port 3306", filter)
+	}
+
+	// A stream on 10.0.0.1:3306, then a target on another host instead.
+	client := [4]byte{10, 0, 1, 8}
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+	old := currentTargets()
+	targets, _ = parseTargets("10.0.0.5:3306")
+	added, removed := diffTargets(old, targets)
+	if len(added) != 1 || added[0] != "10.0.0.5:3306" || len(removed) != 1 || removed[0] != "3306" {
+		t.Errorf("For the change\n    Got added %v, removed %v\n    Expected one each", added,
+			removed)
+	}
+	if filter := captureFilter(); filter != "tcp and ((host 10.0.0.5 and port 3306))" {
+		t.Errorf("For the filter\n    Got %s\n    Expected the new host", filter)
+	}
+
+	// Packets the old filter let through are ignored, and the stream goes
+	// after its grace.
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+	if targetStats.stray != 1 {
+		t.Errorf("For the stray packet\n    Got %d\n    Expected 1", targetStats.stray)
+	}
+	retireAt = now.Add(TARGET_GRACE)
+	retireTargets(now)
+	if len(chmap) != 1 {
+		t.Errorf("For the grace\n    Got %d streams\n    Expected 1", len(chmap))
+	}
+	retireTargets(now.Add(TARGET_GRACE))
+	if len(chmap) != 0 || targetStats.retired != 1 {
+		t.Errorf("For the retired target\n    Got %d streams, %d retired\n    Expected 0, 1",
+			len(chmap), targetStats.retired)
+	}
+}
+
+func TestServeTargets(t *testing.T) {
+	var got string
+	retargeter = func(spec, origin string) error {
+		got = spec
+		return nil
+	}
+	defer func() { retargeter = nil }()
+	server := httptest.NewServer(httpHandler())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/config/targets", "application/json",
+		strings.NewReader(`{"targets": ["3306", "3307"]}`))
+	if err != nil || resp.StatusCode != http.StatusNoContent || got != "3306,3307" {
+		t.Errorf("For POST /config/targets\n    Got %v, %v, %q\n    Expected the targets set",
+			resp, err, got)
+	}
+
+	// What a form on another site could send.
+	got = ""
+	resp, err = http.Post(server.URL+"/config/targets", "text/plain",
+		strings.NewReader(`{"targets": ["3308"]}`))
+	if err != nil || resp.StatusCode != http.StatusUnsupportedMediaType || got != "" {
+		t.Errorf("For POST /config/targets as text\n    Got %v, %v, %q\n    Expected it refused",
+			resp, err, got)
+	}
+	req, _ := http.NewRequest("POST", server.URL+"/config/targets",
+		strings.NewReader(`{"targets": ["3308"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "http://evil.example")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusForbidden || got != "" {
+		t.Errorf("For POST /config/targets from another site\n    Got %v, %v, %q\n"+
+			"    Expected it refused", resp, err, got)
+	}
+	retargeter = nil
+	resp, err = http.Post(server.URL+"/api/status", "text/plain", nil)
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("For POST /api/status\n    Got %v, %v\n    Expected it refused", resp, err)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * teardown.go
+ *
+ * How connections end. A server resetting connections (max_connections,
+ * wait_timeout, crashes) is worth knowing about, and so are the queries that
+ * were running when it happened, which would otherwise never complete.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// TCP flags
+	TCP_FIN = 0x01
+	TCP_SYN = 0x02
+	TCP_RST = 0x04
+	TCP_ACK = 0x10
+
+	// How long after a COM_QUIT we ignore what comes from the connection, so
+	// a retransmission or its FINs don't make it a new stream, and how many
+	// quits between forgetting those long gone.
+	QUIT_LINGER = time.Minute
+	QUIT_SWEEP  = 1000
+)
+
+// The connections closed with COM_QUIT lately, and when.
+var quits map[string]time.Time
+var quitsSwept int
+
+// handleTeardown records the first FIN or RST we see on a stream, aborting the
+// query it had outstanding, if any.
+func handleTeardown(rs *source, fromServer bool, tcpflags byte) {
+	if rs.closed {
+		return
+	}
+	rs.closed = true
+
+	side, kind := "client", "FIN"
+	if fromServer {
+		side = "server"
+	}
+	if tcpflags&TCP_RST != 0 {
+		kind = "RST"
+	}
+	switch {
+	case fromServer && kind == "RST":
+		stats.teardowns.serverRst++
+	case fromServer:
+		stats.teardowns.serverFin++
+	case kind == "RST":
+		stats.teardowns.clientRst++
+	default:
+		stats.teardowns.clientFin++
+	}
+	trace(rs, "%s from %s", kind, side)
+
+	if rs.reqSent != nil && rs.qtext != "" {
+		trace(rs, "aborted %s", rs.qtext)
+		qdata, ok := qbuf[rs.qtext]
+		if !ok {
+			qdata = &queryData{interval: intervals}
+			qbuf[rs.qtext] = qdata
+		}
+		qdata.aborted++
+		stats.aborted++
+		rs.cmds.dropped++
+		concEnd(rs)
+		rs.reqSent, rs.qdata, rs.respTo = nil, nil, RESP_NONE
+	}
+}
+
+// handleQuit forgets a stream the client closed with COM_QUIT.
+func handleQuit(src string, rs *source) {
+	now := clock()
+	stats.teardowns.quit++
+	trace(rs, "COM_QUIT after %d queries", rs.queries)
+	if verbose {
+		log.Printf("%s closed with COM_QUIT after %d queries over %s", redactClient(src),
+			rs.queries, now.Sub(rs.opened))
+	}
+	rs.closed = true
+	concEnd(rs)
+	delete(chmap, src)
+
+	if quits == nil {
+		quits = make(map[string]time.Time)
+	}
+	quits[src] = now
+	if quitsSwept++; quitsSwept >= QUIT_SWEEP {
+		quitsSwept = 0
+		for other, at := range quits {
+			if now.Sub(at) >= QUIT_LINGER {
+				delete(quits, other)
+			}
+		}
+	}
+}
+
+// quitLately tells us whether a connection was closed with COM_QUIT lately.
+func quitLately(src string, now time.Time) bool {
+	at, ok := quits[src]
+	if ok && now.Sub(at) >= QUIT_LINGER {
+		delete(quits, src)
+		return false
+	}
+	return ok
+}
+
+// printAborted prints the queries that were cut off by their connection going
+// away most often.
+func printAborted(w io.Writer, displaycount int) {
+	if stats.aborted == 0 {
+		return
+	}
+
+	var tmp sortableSlice
+	for q, c := range qbuf {
+		if c.aborted > 0 {
+			tmp = append(tmp, sortable{float64(c.aborted), fmt.Sprintf("%s%6d  %s%s%s",
+				COLOR_RED, c.aborted, COLOR_WHITE, redactQuery(q), COLOR_DEFAULT)})
+		}
+	}
+	sort.Sort(sort.Reverse(tmp))
+
+	reportf(w, " ")
+	reportf(w, "%saborted  query%s", COLOR_RED, COLOR_DEFAULT)
+	for i := 0; i < len(tmp) && i < displaycount; i++ {
+		fmt.Fprintln(w, tmp[i].line)
+	}
+}
@@ -0,0 +1,90 @@
+package sniffer
+
+import (
+	"testing"
+
+	"github.com/akrennmair/gopcap"
+)
+
+// tcpPacket builds an ethernet frame carrying a TCP segment between a client
+// and the server port.
+func tcpPacket(client [4]byte, clientPort uint16, request bool, tcpflags byte,
+	payload []byte) *pcap.Packet {
+	data := make([]byte, 14+20+20)
+	ip, tcp := data[14:34], data[34:54]
+	ip[0] = 0x45
+	src, dst := client[:], []byte{10, 0, 0, 1}
+	sport, dport := clientPort, port
+	if !request {
+		src, dst, sport, dport = dst, src, dport, sport
+	}
+	copy(ip[12:16], src)
+	copy(ip[16:20], dst)
+	tcp[0], tcp[1], tcp[2], tcp[3] = byte(sport>>8), byte(sport), byte(dport>>8), byte(dport)
+	tcp[12] = 5 << 4
+	tcp[13] = tcpflags
+	data = append(data, payload...)
+	return &pcap.Packet{Caplen: uint32(len(data)), Len: uint32(len(data)), Data: data}
+}
+
+func TestTeardown(t *testing.T) {
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	stats.aborted, stats.teardowns.serverRst, stats.teardowns.clientFin = 0, 0, 0
+	parseFormat("#q")
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	client := [4]byte{10, 0, 0, 2}
+
+	// A query answered, then the client hangs up.
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, []byte{1, 0, 0, 1, 0}))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK|TCP_FIN, nil))
+
+	// A query the server resets the connection on.
+	handlePacket(tcpPacket(client, 50001, true, TCP_ACK, query))
+	handlePacket(tcpPacket(client, 50001, false, TCP_RST, nil))
+
+	if stats.teardowns.clientFin != 1 || stats.teardowns.serverRst != 1 {
+		t.Errorf("For teardowns\n    Got %d client FIN, %d server RST\n    Expected 1 and 1",
+			stats.teardowns.clientFin, stats.teardowns.serverRst)
+	}
+	if qdata := qbuf["select ?"]; qdata == nil || qdata.count != 1 || qdata.aborted != 1 {
+		t.Errorf("For query select ?\n    Got %+v\n    Expected 1 completed, 1 aborted", qdata)
+	}
+	if _, ok := chmap["10.0.0.2:50001"]; ok {
+		t.Errorf("Reset stream is still around")
+	}
+}
+
+func TestQuit(t *testing.T) {
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	quits, stats.teardowns.quit, stats.teardowns.clientFin = nil, 0, 0
+	parseFormat("#q")
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	quit := []byte{1, 0, 0, 0, COM_QUIT}
+	client := [4]byte{10, 0, 0, 2}
+
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, query))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, []byte{1, 0, 0, 1, 0}))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, quit))
+	if _, ok := chmap["10.0.0.2:50000"]; ok || stats.teardowns.quit != 1 {
+		t.Errorf("For a COM_QUIT\n    Got %d streams, %d quits\n    Expected the stream gone",
+			len(chmap), stats.teardowns.quit)
+	}
+
+	// Its retransmission and the FINs after it don't bring it back.
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, quit))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK|TCP_FIN, nil))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK|TCP_FIN, nil))
+	if len(chmap) != 0 || stats.teardowns.quit != 1 || stats.teardowns.clientFin != 0 {
+		t.Errorf("For the end of a connection after COM_QUIT\n    Got %d streams, %d quits, %d "+
+			"FINs\n    Expected nothing more", len(chmap), stats.teardowns.quit,
+			stats.teardowns.clientFin)
+	}
+
+	// A new connection on the port is a new stream.
+	handlePacket(tcpPacket(client, 50000, true, TCP_SYN, nil))
+	if _, ok := chmap["10.0.0.2:50000"]; !ok || quitLately("10.0.0.2:50000", clock()) {
+		t.Errorf("For a new connection on the port\n    Got %d streams\n    Expected a stream",
+			len(chmap))
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * think.go
+ *
+ * Think time: how long a connection sits idle between the end of one response
+ * and the next command on it. That's the application's own work between
+ * queries, unless it's waiting on its pool; when every connection a client
+ * has is handed straight back out the moment it's free, the gaps go to nearly
+ * nothing and the number of connections stays pinned at the pool's size.
+ * -report think shows the gaps per client, and flags the ones that look like
+ * that.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// A median gap under this is a client with no time to think.
+	THINK_QUEUED = time.Millisecond
+
+	// How many reports the connections of a client have to stay the same for,
+	// and how many gaps we need, before we call its pool exhausted.
+	THINK_INTERVALS = 3
+	THINK_SAMPLES   = 100
+)
+
+var reportThink bool = false
+
+// thinkData is the gaps between commands of a client.
+type thinkData struct {
+	count uint64
+	times [TIME_BUCKETS]uint64
+	conns []int // open connections at the last few reports
+}
+
+// thinkSent records the gap before a command, if the stream was idle.
+func thinkSent(rs *source) {
+	if rs.idleSince.IsZero() {
+		return
+	}
+	gap := uint64(clock().Sub(rs.idleSince).Nanoseconds())
+	rs.idleSince = time.Time{}
+	if gap == 0 {
+		// We use 0 to mean no reading.
+		gap = 1
+	}
+
+	client := clientOf(rs)
+	if client.think == nil {
+		client.think = &thinkData{}
+	}
+	client.think.count++
+	client.think.times[rand.Intn(TIME_BUCKETS)] = gap
+}
+
+// thinkIdle notes that a stream has nothing outstanding.
+func thinkIdle(rs *source) {
+	if reportThink {
+		rs.idleSince = clock()
+	}
+}
+
+// pinned says whether a client's connections have stayed the same over the
+// last few reports.
+func (self *thinkData) pinned() bool {
+	if len(self.conns) < THINK_INTERVALS || self.conns[0] == 0 {
+		return false
+	}
+	for _, conns := range self.conns[1:] {
+		if conns != self.conns[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// countConns notes how many connections each client has open now.
+func countConns() {
+	open := make(map[*clientData]int)
+	for _, rs := range chmap {
+		if !rs.closed && rs.client != nil {
+			open[rs.client]++
+		}
+	}
+	for _, client := range clients {
+		if client.think == nil {
+			continue
+		}
+		client.think.conns = append(client.think.conns, open[client])
+		if len(client.think.conns) > THINK_INTERVALS {
+			client.think.conns = client.think.conns[1:]
+		}
+	}
+}
+
+// printThink prints the think time of the busiest clients, flagging those
+// that look starved for connections.
+func printThink(w io.Writer, displaycount int) {
+	countConns()
+
+	var tmp sortableSlice
+	for id, client := range clients {
+		if client.think != nil {
+			tmp = append(tmp, sortable{float64(client.think.count), id})
+		}
+	}
+	if len(tmp) == 0 {
+		return
+	}
+	sort.Sort(sort.Reverse(tmp))
+
+	reportf(w, " ")
+	reportf(w, "%s    gaps  conns  %s   p10    p50    p90  %sclient%s", COLOR_YELLOW, COLOR_GREEN,
+		COLOR_WHITE, COLOR_DEFAULT)
+	for i := 0; i < len(tmp) && i < displaycount; i++ {
+		client := clients[tmp[i].line]
+		think := client.think
+		pcts := percentiles(think.times[:], 10, 50, 90)
+		conns := 0
+		if len(think.conns) > 0 {
+			conns = think.conns[len(think.conns)-1]
+		}
+		color, note := COLOR_GREEN, ""
+		if think.count >= THINK_SAMPLES && think.pinned() &&
+			pcts[1] < float64(THINK_QUEUED)/float64(time.Millisecond) {
+			color = COLOR_RED
+			note = fmt.Sprintf("  %s(pool exhausted?)", COLOR_RED)
+		}
+		reportf(w, "%s%8d  %5d  %s%6.2f %6.2f %6.2f  %s%s%s%s", COLOR_YELLOW, think.count,
+			conns, color, pcts[0], pcts[1], pcts[2], COLOR_WHITE, redactClient(client.id),
+			note, COLOR_DEFAULT)
+	}
+}
@@ -0,0 +1,59 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThinkTime(t *testing.T) {
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	clients, reportThink = make(map[string]*clientData), true
+	defer func() { clock, reportThink = time.Now, false }()
+	now := time.Unix(1000, 0)
+	clock = func() time.Time { return now }
+	parseFormat("#q")
+
+	client := [4]byte{10, 0, 1, 8}
+	query := append([]byte{9, 0, 0, 0, COM_QUERY}, "select 1"...)
+	ok := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+
+	// Two connections taking turns at a 1ms query with 5ms between rounds,
+	// so each waits 6ms between its answer and its next query.
+	for i := 0; i < THINK_SAMPLES; i++ {
+		for _, p := range []uint16{50000, 50001} {
+			handlePacket(tcpPacket(client, p, true, TCP_ACK, query))
+			now = now.Add(time.Millisecond)
+			handlePacket(tcpPacket(client, p, false, TCP_ACK, ok))
+		}
+		now = now.Add(5 * time.Millisecond)
+	}
+
+	think := clients["10.0.1.8"].think
+	if think == nil {
+		t.Fatalf("For the client\n    Got no think times\n    Expected some")
+	}
+	// The first query on each connection has no gap before it.
+	if think.count != 2*THINK_SAMPLES-2 {
+		t.Errorf("For the gaps\n    Got %d\n    Expected %d", think.count, 2*THINK_SAMPLES-2)
+	}
+	if pcts := percentiles(think.times[:], 50); pcts[0] != 6 {
+		t.Errorf("For the median\n    Got %0.2fms\n    Expected 6.00ms", pcts[0])
+	}
+
+	// Connections have to stay the same for a few reports to be pinned.
+	for i := 0; i < THINK_INTERVALS; i++ {
+		if think.pinned() {
+			t.Errorf("For report %d\n    Got pinned\n    Expected not yet", i)
+		}
+		countConns()
+	}
+	if !think.pinned() || think.conns[0] != 2 {
+		t.Errorf("For %v connections\n    Got pinned %t\n    Expected pinned at 2", think.conns,
+			think.pinned())
+	}
+	chmap["10.0.1.8:50001"].closed = true
+	countConns()
+	if think.pinned() {
+		t.Errorf("For %v connections\n    Got pinned\n    Expected not", think.conns)
+	}
+}
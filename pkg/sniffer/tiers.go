@@ -0,0 +1,381 @@
+/*
+ * tiers.go
+ *
+ * Two tiers of aggregation, so a server with no end of distinct queries (IN
+ * lists of every length, generated reports, ORMs inlining everything) can be
+ * watched for weeks without the aggregate growing with it. With -detail N only
+ * the N fingerprints with the most time lately have rows of their own; the rest
+ * are rolled up by verb and tables, as in "(other SELECT on orders)", with all
+ * the counters of a query but none of the texts.
+ *
+ * What's lately is total time decaying with a half life of TIER_HALF_LIFE. We
+ * keep the decayed time of a bounded number of the fingerprints in the tail as
+ * well, and one going over the least of the detailed rows (by a margin, so two
+ * close queries don't trade places all day) is promoted, the least being rolled
+ * into its bucket in its place. Other than that the tail's fingerprints are
+ * only counted, as an estimate of how many distinct ones there were.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// How quickly the time of a fingerprint stops counting towards its rank.
+	TIER_HALF_LIFE = 10 * time.Minute
+
+	// How much more time than the least of the detailed rows a fingerprint of
+	// the tail needs to take its place.
+	TIER_MARGIN = 1.2
+
+	// How many fingerprints of the tail we keep the time of, per detailed row,
+	// and how many of them we look at to find one to forget.
+	TIER_CANDIDATES = 4
+	TIER_SAMPLE     = 8
+
+	// How many buckets are shown under the table.
+	TIER_ROWS = 5
+
+	// Registers of the distinct count, a power of two.
+	DISTINCT_REGISTERS = 1024
+)
+
+var detailLimit int = 0
+
+var tiers struct {
+	buckets    map[string]*queryData
+	candidates map[string]*tierCandidate
+	distinct   distinctCounter
+
+	// The detailed row with the least time when we last looked, and in which
+	// interval that was.
+	barKey      string
+	barInterval uint64
+
+	promoted uint64
+	demoted  uint64
+}
+
+// tierScore is a total time that decays.
+type tierScore struct {
+	value float64
+	at    time.Time
+}
+
+// decayed is what the time is worth by now.
+func (self tierScore) decayed(now time.Time) float64 {
+	if self.at.IsZero() || !now.After(self.at) {
+		return self.value
+	}
+	return self.value * math.Exp2(-now.Sub(self.at).Seconds()/TIER_HALF_LIFE.Seconds())
+}
+
+// add counts the time of an execution.
+func (self *tierScore) add(reqtime uint64, now time.Time) {
+	self.value, self.at = self.decayed(now)+float64(reqtime), now
+}
+
+// tierCandidate is a fingerprint of the tail we keep the time of.
+type tierCandidate struct {
+	score  tierScore
+	bucket string
+}
+
+// resetTiers forgets the tail.
+func resetTiers() {
+	tiers.buckets = make(map[string]*queryData)
+	tiers.candidates = make(map[string]*tierCandidate)
+	tiers.distinct = distinctCounter{}
+	tiers.barKey, tiers.promoted, tiers.demoted = "", 0, 0
+}
+
+// tailBucket is the bucket a query of the tail is rolled up into.
+func tailBucket(query string) string {
+	verb := strings.ToUpper(queryVerb([]byte(query)))
+	if verb == "" {
+		return OTHER_QUERIES
+	}
+	tables := queryTables(lexQuery([]byte(query)))
+	if len(tables) == 0 {
+		return "(other " + verb + ")"
+	}
+	return "(other " + verb + " on " + strings.Join(tables, ",") + ")"
+}
+
+// tieredQuery finds where an execution of a query without a row goes: a row of
+// its own while there's room, or if it has had more time lately than the least
+// of the rows, and its bucket otherwise.
+func tieredQuery(text, query string, reqtime uint64) *queryData {
+	if tiers.buckets == nil {
+		resetTiers()
+	}
+	if len(qbuf) < detailLimit {
+		qdata := &queryData{interval: intervals, bucket: tailBucket(query)}
+		qbuf[text] = qdata
+		return qdata
+	}
+
+	now := clock()
+	cand := tiers.candidates[text]
+	if cand == nil {
+		cand = &tierCandidate{bucket: tailBucket(query)}
+		addCandidate(text, cand)
+	}
+	if bar := tierBar(); bar != nil &&
+		cand.score.decayed(now)+float64(reqtime) > bar.score.decayed(now)*TIER_MARGIN {
+		demote(tiers.barKey, bar)
+		delete(tiers.candidates, text)
+		tiers.promoted++
+		qdata := &queryData{interval: intervals, bucket: cand.bucket, score: cand.score}
+		qbuf[text] = qdata
+		return qdata
+	}
+
+	cand.score.add(reqtime, now)
+	tiers.distinct.add(text)
+	return tierBucket(cand.bucket)
+}
+
+// tierBucket returns a bucket, making it if it's new.
+func tierBucket(name string) *queryData {
+	bucket := tiers.buckets[name]
+	if bucket == nil {
+		bucket = &queryData{interval: intervals}
+		tiers.buckets[name] = bucket
+	}
+	return bucket
+}
+
+// addCandidate keeps the time of a fingerprint of the tail, forgetting the one
+// with the least of a few others if we keep as many as we can.
+func addCandidate(text string, cand *tierCandidate) {
+	if len(tiers.candidates) >= TIER_CANDIDATES*detailLimit {
+		now := clock()
+		least, seen := "", 0
+		for other, oc := range tiers.candidates {
+			if least == "" || oc.score.decayed(now) < tiers.candidates[least].score.decayed(now) {
+				least = other
+			}
+			if seen++; seen >= TIER_SAMPLE {
+				break
+			}
+		}
+		delete(tiers.candidates, least)
+	}
+	tiers.candidates[text] = cand
+}
+
+// tierBar returns the detailed row with the least time, which a fingerprint of
+// the tail has to beat, looking again once an interval.
+func tierBar() *queryData {
+	if bar := qbuf[tiers.barKey]; bar != nil && tiers.barInterval == intervals {
+		return bar
+	}
+	now := clock()
+	tiers.barKey, tiers.barInterval = "", intervals
+	var least float64
+	for key, qdata := range qbuf {
+		if score := qdata.score.decayed(now); tiers.barKey == "" || score < least {
+			tiers.barKey, least = key, score
+		}
+	}
+	return qbuf[tiers.barKey]
+}
+
+// demote rolls a detailed row into its bucket, keeping its time so it can come
+// back.
+func demote(key string, qdata *queryData) {
+	foldQuery(tierBucket(qdata.bucket), qdata)
+	delete(qbuf, key)
+	addCandidate(key, &tierCandidate{score: qdata.score, bucket: qdata.bucket})
+	tiers.distinct.add(key)
+	tiers.demoted++
+	tiers.barKey = ""
+}
+
+// foldQuery adds the counters of a query to another's.
+func foldQuery(dst, src *queryData) {
+	dst.roll()
+	src.roll()
+	dst.times = foldSamples(dst.times, src.times, dst.timed, src.timed)
+	if src.sizes != nil {
+		if dst.sizes == nil {
+			dst.sizes = &sizeStats{samples: make([]uint64, timeBuckets)}
+		}
+		dst.sizes.samples = foldSamples(dst.sizes.samples, src.sizes.samples, dst.sizes.count,
+			src.sizes.count)
+		dst.sizes.count += src.sizes.count
+		dst.sizes.outliers += src.sizes.outliers
+		if src.sizes.max > dst.sizes.max {
+			dst.sizes.max = src.sizes.max
+		}
+	}
+
+	if src.full != nil {
+		if dst.full == nil {
+			dst.full = &fullStats{samples: make([]uint64, timeBuckets)}
+		}
+		dst.full.samples = foldSamples(dst.full.samples, src.full.samples, dst.full.timed,
+			src.full.timed)
+		dst.full.timed += src.full.timed
+		dst.full.total += src.full.total
+		if src.full.max > dst.full.max {
+			dst.full.max = src.full.max
+		}
+	}
+
+	dst.count += src.count
+	dst.bytes += src.bytes
+	dst.aborted += src.aborted
+	dst.errors += src.errors
+	dst.warnings += src.warnings
+	dst.mark += src.mark
+	dst.bytesMark += src.bytesMark
+	dst.errorsMark += src.errorsMark
+	dst.prevDelta += src.prevDelta
+	dst.apdex.satisfied += src.apdex.satisfied
+	dst.apdex.tolerating += src.apdex.tolerating
+	dst.apdex.total += src.apdex.total
+	dst.lists.count += src.lists.count
+	dst.lists.total += src.lists.total
+	if src.lists.max > dst.lists.max {
+		dst.lists.max = src.lists.max
+	}
+	dst.columns.fold(src.columns)
+	dst.stalls.count += src.stalls.count
+	dst.stalls.time += src.stalls.time
+	dst.oks += src.oks
+	dst.rows += src.rows
+	dst.results += src.results
+	dst.sets += src.sets
+	dst.returned += src.returned
+	dst.fetches += src.fetches
+	dst.fetchTime += src.fetchTime
+	dst.timed += src.timed
+	dst.timeTotal += src.timeTotal
+	if src.timeMax > dst.timeMax {
+		dst.timeMax = src.timeMax
+	}
+	for fingerprint, n := range src.fingerprints {
+		if dst.fingerprints == nil {
+			dst.fingerprints = make(map[string]uint64)
+		}
+		dst.fingerprints[fingerprint] += n
+	}
+	for server, n := range src.servers {
+		if dst.servers == nil {
+			dst.servers = make(map[string]uint64)
+		}
+		dst.servers[server] += n
+	}
+}
+
+// foldSamples merges two samples of n and m values, each slot taking the
+// second's value in proportion to how many it stands for.
+func foldSamples(dst, src []uint64, n, m uint64) []uint64 {
+	if src == nil || m == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make([]uint64, len(src))
+	}
+	for i := range dst {
+		if i < len(src) && (dst[i] == 0 || uint64(rand.Int63n(int64(n+m))) < m) {
+			dst[i] = src[i]
+		}
+	}
+	return dst
+}
+
+// distinctCounter estimates how many distinct strings it was given, in a fixed
+// kilobyte (a HyperLogLog).
+type distinctCounter struct {
+	registers [DISTINCT_REGISTERS]uint8
+}
+
+func (self *distinctCounter) add(text string) {
+	// FNV leaves the high bits of similar texts alike, so mix them (the
+	// finalizer of MurmurHash3) before using them to pick a register.
+	hash := fingerprintHash(text)
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	index := hash >> (64 - 10)
+	rank := uint8(bits.LeadingZeros64(hash<<10|1<<9) + 1)
+	if rank > self.registers[index] {
+		self.registers[index] = rank
+	}
+}
+
+func (self *distinctCounter) estimate() uint64 {
+	m := float64(DISTINCT_REGISTERS)
+	var sum float64
+	zeros := 0
+	for _, rank := range self.registers {
+		sum += math.Exp2(-float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// tierMemory estimates what the tail holds.
+func tierMemory() uint64 {
+	size := uint64(DISTINCT_REGISTERS)
+	for name, bucket := range tiers.buckets {
+		size += queryMemory(name, bucket)
+	}
+	for text, cand := range tiers.candidates {
+		size += uint64(64 + len(text) + len(cand.bucket))
+	}
+	return size
+}
+
+// printTail shows the share of the tail and its busiest buckets under the table.
+func printTail(w io.Writer, elapsed float64) {
+	if detailLimit == 0 || len(tiers.buckets) == 0 {
+		return
+	}
+	var queries, total, tailQueries, tailTime uint64
+	for _, qdata := range qbuf {
+		queries, total = queries+qdata.count, total+qdata.timeTotal
+	}
+	rows := make(sortableSlice, 0, len(tiers.buckets))
+	for name, bucket := range tiers.buckets {
+		tailQueries, tailTime = tailQueries+bucket.count, tailTime+bucket.timeTotal
+		rows = append(rows, sortable{float64(bucket.timeTotal), name})
+	}
+	queries, total = queries+tailQueries, total+tailTime
+	sort.Sort(sort.Reverse(rows))
+
+	line := fmt.Sprintf("%d other fingerprints: %0.0f%% of queries", tiers.distinct.estimate(),
+		float64(tailQueries)/float64(queries)*100)
+	if total > 0 {
+		line += fmt.Sprintf(", %0.0f%% of time", float64(tailTime)/float64(total)*100)
+	}
+	reportf(w, " ")
+	reportf(w, "%s (%d promoted, %d demoted)", line, tiers.promoted, tiers.demoted)
+	for i, row := range rows {
+		if i == TIER_ROWS {
+			break
+		}
+		fmt.Fprintln(w, formatRow(copyRow(row.line, tiers.buckets[row.line]), elapsed))
+	}
+}
@@ -0,0 +1,112 @@
+package sniffer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTailBucket(t *testing.T) {
+	for _, test := range []struct{ query, expected string }{
+		{"select * from orders where id = ?", "(other SELECT on orders)"},
+		{"SELECT * FROM orders o JOIN customers c ON o.cid = c.id", "(other SELECT on customers,orders)"},
+		{"set names utf8", "(other SET)"},
+		{"/* nothing */", OTHER_QUERIES},
+	} {
+		if got := tailBucket(test.query); got != test.expected {
+			t.Errorf("For %s\n    Got %s\n    Expected %s", test.query, got, test.expected)
+		}
+	}
+}
+
+func TestTiersFormat(t *testing.T) {
+	defer func() {
+		detailLimit = 0
+		resetTiers()
+	}()
+	qbuf, format, detailLimit = make(map[string]*queryData), nil, 1
+	parseFormat("#s:#q")
+	resetTiers()
+
+	// The tail is bucketed by the statement, not the key with the client in
+	// front of it.
+	rs := &source{synced: true, src: "10.0.0.2:50000", srcip: "10.0.0.2"}
+	for _, query := range []string{"select a from t", "select b from t", "delete from u"} {
+		processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, query...)...))
+		processPacket(rs, false, mysqlPacket(1, 0xfe, 0, 0, 2, 0))
+	}
+	for _, name := range []string{"(other SELECT on t)", "(other DELETE on u)"} {
+		if bucket := tiers.buckets[name]; bucket == nil || bucket.count != 1 {
+			t.Errorf("For %s\n    Got %+v in %v\n    Expected one query", name, bucket,
+				tiers.buckets)
+		}
+	}
+}
+
+func TestTiers(t *testing.T) {
+	defer func() {
+		clock, detailLimit = time.Now, 0
+		resetTiers()
+	}()
+	now := time.Date(2015, 6, 17, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	qbuf, detailLimit = make(map[string]*queryData), 2
+	resetTiers()
+
+	// The first two get rows, the rest of the tail goes in buckets.
+	aggregate("select a from t", "select a from t", 0, 1000, 10, 0)
+	aggregate("select b from t", "select b from t", 0, 2000, 10, 0)
+	for i := 0; i < 100; i++ {
+		query := fmt.Sprintf("select c%d from t", i)
+		aggregate(query, query, 0, 10, 10, 0)
+	}
+	aggregate("delete from u", "delete from u", 0, 10, 10, 0)
+	bucket := tiers.buckets["(other SELECT on t)"]
+	if len(qbuf) != 2 || bucket == nil || bucket.count != 100 || bucket.timeTotal != 1000 ||
+		tiers.buckets["(other DELETE on u)"] == nil {
+		t.Fatalf("For 2 rows\n    Got %d rows, buckets %v\n    Expected 2, and the rest in "+
+			"buckets", len(qbuf), tiers.buckets)
+	}
+
+	// One of the tail taking over the least of the rows by the margin takes
+	// its place, and the least is rolled into its bucket.
+	now = now.Add(time.Minute)
+	aggregate("select c7 from t", "select c7 from t", 0, 1000, 10, 0)
+	if qbuf["select c7 from t"] != nil {
+		t.Errorf("For a query of the tail level with the least row\n    Got a row\n    " +
+			"Expected none")
+	}
+	aggregate("select c7 from t", "select c7 from t", 0, 1000, 10, 0)
+	if qbuf["select c7 from t"] == nil || qbuf["select a from t"] != nil ||
+		tiers.promoted != 1 || tiers.demoted != 1 {
+		t.Fatalf("For a query of the tail over the least row\n    Got rows %v, %d promoted, "+
+			"%d demoted\n    Expected it to replace select a", qbuf, tiers.promoted, tiers.demoted)
+	}
+	if bucket.count != 102 || bucket.timeTotal != 3000 {
+		t.Errorf("For the bucket of the least row\n    Got %d queries, %d ns\n    Expected 102, "+
+			"3000", bucket.count, bucket.timeTotal)
+	}
+	if qbuf["select c7 from t"].count != 1 || qbuf["select c7 from t"].score.value != 2000 {
+		t.Errorf("For the promoted query\n    Got %d executions, score %g\n    Expected 1, "+
+			"2000, with its time in the tail", qbuf["select c7 from t"].count,
+			qbuf["select c7 from t"].score.value)
+	}
+
+	// Time counts less the older it is.
+	score := tierScore{1000, now}
+	if decayed := score.decayed(now.Add(TIER_HALF_LIFE)); decayed != 500 {
+		t.Errorf("For a half life later\n    Got %g\n    Expected 500", decayed)
+	}
+
+	// The distinct count is an estimate, but a close one.
+	if n := tiers.distinct.estimate(); n < 95 || n > 108 {
+		t.Errorf("For 102 distinct queries in the tail\n    Got %d\n    Expected about that", n)
+	}
+	var counter distinctCounter
+	for i := 0; i < 50000; i++ {
+		counter.add(fmt.Sprintf("select * from t where id in (%d)", i))
+	}
+	if n := counter.estimate(); n < 47000 || n > 53000 {
+		t.Errorf("For 50000 distinct queries\n    Got %d\n    Expected about that", n)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * timeline.go
+ *
+ * Bucketing of queries by when they happened, so a long capture or log can
+ * show when the load came and went instead of just the totals.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	// How many of the busiest queries get their own timeline column.
+	TIMELINE_TOP = 5
+)
+
+var timelineBucket time.Duration
+
+// timeBucket is everything that completed in one bucket of time.
+type timeBucket struct {
+	count   uint64
+	latency uint64 // nanoseconds, over the queries we know the latency of
+	timed   uint64
+	queries map[string]uint64
+}
+
+// timeline maps the start of each bucket, in unix seconds, to the bucket.
+var timeline map[int64]*timeBucket = make(map[int64]*timeBucket)
+
+// recordTimeline puts a completed query in the bucket for the current time. A
+// reqtime of 0 means we don't know the latency.
+func recordTimeline(text string, reqtime uint64) {
+	key := clock().Truncate(timelineBucket).Unix()
+	bucket, ok := timeline[key]
+	if !ok {
+		bucket = &timeBucket{queries: make(map[string]uint64)}
+		timeline[key] = bucket
+	}
+	bucket.count++
+	bucket.queries[text]++
+	if reqtime > 0 {
+		bucket.latency += reqtime
+		bucket.timed++
+	}
+}
+
+// printTimeline prints the qps of each bucket, overall and for the busiest
+// queries over the whole timeline.
+func printTimeline(w io.Writer) {
+	if len(timeline) == 0 {
+		return
+	}
+
+	var keys sortableSlice
+	totals := make(map[string]uint64)
+	for key, bucket := range timeline {
+		keys = append(keys, sortable{float64(key), ""})
+		for text, count := range bucket.queries {
+			totals[text] += count
+		}
+	}
+	sort.Sort(keys)
+
+	var busiest sortableSlice
+	for text, count := range totals {
+		busiest = append(busiest, sortable{float64(count), text})
+	}
+	sort.Sort(sort.Reverse(busiest))
+	var top []string
+	for i := 0; i < len(busiest) && i < TIMELINE_TOP; i++ {
+		top = append(top, busiest[i].line)
+	}
+
+	reportf(w, " ")
+	header := fmt.Sprintf("%stimeline by %s     %s   qps     avg", COLOR_RED, timelineBucket,
+		COLOR_YELLOW)
+	for i := range top {
+		header += fmt.Sprintf("      #%d", i+1)
+	}
+	reportf(w, "%s%s", header, COLOR_DEFAULT)
+
+	secs := timelineBucket.Seconds()
+	for _, sorted := range keys {
+		key := int64(sorted.value)
+		bucket := timeline[key]
+		avg := 0.0
+		if bucket.timed > 0 {
+			avg = float64(bucket.latency) / float64(bucket.timed) / 1000000
+		}
+		line := fmt.Sprintf("%s%-19s  %s%8.2f %6.2fms%s", COLOR_WHITE,
+			time.Unix(key, 0).Format("2006/01/02 15:04:05"), COLOR_YELLOW,
+			float64(bucket.count)/secs, avg, COLOR_CYAN)
+		for _, text := range top {
+			line += fmt.Sprintf(" %8.2f", float64(bucket.queries[text])/secs)
+		}
+		reportf(w, "%s%s", line, COLOR_DEFAULT)
+	}
+	for i, text := range top {
+		reportf(w, "    %s#%d %s%s", COLOR_CYAN, i+1, redactQuery(text), COLOR_DEFAULT)
+	}
+}
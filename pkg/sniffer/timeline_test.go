@@ -0,0 +1,38 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	defer func() { clock, timelineBucket = time.Now, 0 }()
+	timeline, timelineBucket = make(map[int64]*timeBucket), time.Hour
+
+	base := time.Date(2015, 6, 17, 3, 0, 0, 0, time.UTC)
+	for i, offset := range []time.Duration{time.Minute, 30 * time.Minute, 6 * time.Hour} {
+		now := base.Add(offset)
+		clock = func() time.Time { return now }
+		recordTimeline("select ?", uint64(i+1)*1000000)
+	}
+	recordTimeline("update ?", 0)
+
+	for key, expected := range map[int64]uint64{
+		base.Unix():                    2,
+		base.Add(6 * time.Hour).Unix(): 2,
+		base.Add(3 * time.Hour).Unix(): 0,
+	} {
+		var got uint64
+		if bucket, ok := timeline[key]; ok {
+			got = bucket.count
+		}
+		if got != expected {
+			t.Errorf("For bucket %s\n    Got %d\n    Expected %d", time.Unix(key, 0).UTC(), got,
+				expected)
+		}
+	}
+	if bucket := timeline[base.Unix()]; bucket.latency != 3000000 || bucket.timed != 2 {
+		t.Errorf("For latency of first bucket\n    Got %d over %d\n    Expected %d over %d",
+			bucket.latency, bucket.timed, 3000000, 2)
+	}
+}
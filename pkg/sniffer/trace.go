@@ -0,0 +1,122 @@
+/*
+ * trace.go
+ *
+ * Protocol tracing for debugging the parser: every packet we look at on the
+ * traced connections, and every decision we make about them.
+ *
+ */
+
+package sniffer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// How much of each packet -trace-hex dumps.
+	TRACE_HEX_BYTES = 64
+)
+
+var traceAll bool = false
+var traceConn string
+var traceHex bool = false
+var tracer *log.Logger = log.New(os.Stderr, "", log.Lmicroseconds)
+
+// commandNames are the names of the MySQL commands, for tracing.
+var commandNames map[int]string = map[int]string{
+	0x00: "COM_SLEEP", 0x01: "COM_QUIT", 0x02: "COM_INIT_DB", 0x03: "COM_QUERY",
+	0x04: "COM_FIELD_LIST", 0x05: "COM_CREATE_DB", 0x06: "COM_DROP_DB",
+	0x07: "COM_REFRESH", 0x08: "COM_SHUTDOWN", 0x09: "COM_STATISTICS",
+	0x0a: "COM_PROCESS_INFO", 0x0b: "COM_CONNECT", 0x0c: "COM_PROCESS_KILL",
+	0x0d: "COM_DEBUG", 0x0e: "COM_PING", 0x0f: "COM_TIME", 0x10: "COM_DELAYED_INSERT",
+	0x11: "COM_CHANGE_USER", 0x12: "COM_BINLOG_DUMP", 0x13: "COM_TABLE_DUMP",
+	0x14: "COM_CONNECT_OUT", 0x15: "COM_REGISTER_SLAVE", 0x16: "COM_STMT_PREPARE",
+	0x17: "COM_STMT_EXECUTE", 0x18: "COM_STMT_SEND_LONG_DATA", 0x19: "COM_STMT_CLOSE",
+	0x1a: "COM_STMT_RESET", 0x1b: "COM_SET_OPTION", 0x1c: "COM_STMT_FETCH",
+	0x1d: "COM_DAEMON", 0x1e: "COM_BINLOG_DUMP_GTID", 0x1f: "COM_RESET_CONNECTION",
+}
+
+// startTracing sends the trace to the given file instead of stderr.
+func startTracing(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	tracer = log.New(file, "", log.Ldate|log.Lmicroseconds)
+	return nil
+}
+
+// tracing tells us whether a new stream should be traced.
+func tracing(src string) bool {
+	return traceAll || (traceConn != "" && src == traceConn)
+}
+
+// trace logs a parser decision for a stream, if it's being traced.
+func trace(rs *source, msg string, args ...interface{}) {
+	if rs.trace {
+		tracer.Printf("[%s] %s", rs.src, fmt.Sprintf(msg, args...))
+	}
+}
+
+// tracePacket logs the packet at the start of buf, which is going in the given
+// direction.
+func tracePacket(rs *source, request bool, buf []byte) {
+	if !rs.trace {
+		return
+	}
+	if len(buf) < 5 {
+		trace(rs, "%s partial packet, %d bytes", direction(request), len(buf))
+		return
+	}
+
+	size := int(buf[0]) | int(buf[1])<<8 | int(buf[2])<<16
+	what := ""
+	if request {
+		if name, ok := commandNames[int(buf[4])]; ok {
+			what = name
+		} else {
+			what = fmt.Sprintf("command 0x%02x", buf[4])
+		}
+	} else {
+		what = classifyResponse(buf[4], size)
+	}
+	trace(rs, "%s seq=%d len=%d %s (%d bytes in segment)", direction(request), buf[3],
+		size, what, len(buf))
+
+	if traceHex {
+		dump := buf
+		if len(dump) > TRACE_HEX_BYTES {
+			dump = dump[:TRACE_HEX_BYTES]
+		}
+		for _, line := range strings.Split(strings.TrimRight(hex.Dump(dump), "\n"), "\n") {
+			trace(rs, "    %s", line)
+		}
+	}
+}
+
+// classifyResponse names a server packet by its first byte.
+func classifyResponse(first byte, size int) string {
+	switch {
+	case first == 0x00:
+		return "OK"
+	case first == 0xff:
+		return "ERR"
+	case first == 0xfe && size < 9:
+		return "EOF"
+	case first == 0xfb:
+		return "LOCAL INFILE request"
+	default:
+		return "result set / data"
+	}
+}
+
+func direction(request bool) string {
+	if request {
+		return ">"
+	}
+	return "<"
+}
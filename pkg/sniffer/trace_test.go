@@ -0,0 +1,58 @@
+package sniffer
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTraceLogin(t *testing.T) {
+	var out bytes.Buffer
+	tracer = log.New(&out, "", 0)
+	defer func() { tracer = log.New(os.Stderr, "", log.Lmicroseconds) }()
+
+	file, err := os.Open("testdata/streams/login.txt")
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %s", err)
+	}
+	defer file.Close()
+	streams, _, err := readPayloads(file)
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %s", err)
+	}
+
+	qbuf, format = make(map[string]*queryData), nil
+	parseFormat("#q")
+	rs := &source{src: streams[0].name, trace: true}
+	for _, seg := range streams[0].segments {
+		processPacket(rs, seg.request, seg.data)
+	}
+
+	for _, expected := range []string{
+		"[10.0.0.3:50001] < seq=0 len=78 result set / data",
+		"handshake response, user app_rw",
+		"< seq=1 len=7 OK",
+		"> seq=0 len=34 COM_QUERY",
+		"synced",
+		"response after",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("For trace %s\n    Got %s\n    Expected %s", "login", out.String(), expected)
+		}
+	}
+}
+
+func TestTraceUntraced(t *testing.T) {
+	var out bytes.Buffer
+	tracer = log.New(&out, "", 0)
+	defer func() { tracer = log.New(os.Stderr, "", log.Lmicroseconds) }()
+
+	rs := &source{src: "10.0.0.1:1"}
+	tracePacket(rs, true, []byte{1, 0, 0, 0, COM_QUIT})
+	desync(rs, DESYNC_SEQUENCE, "testing")
+	if out.Len() != 0 {
+		t.Errorf("Untraced stream produced trace: %s", out.String())
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * transactions.go
+ *
+ * How long transactions stay open and how many statements they take. A code
+ * path that holds a transaction across dozens of statements (or a slow round
+ * trip to some other service) holds its locks all that time. We follow each
+ * stream's transaction from BEGIN or START TRANSACTION to COMMIT or ROLLBACK,
+ * and by the SERVER_STATUS_IN_TRANS flag of the OK and EOF packets ending the
+ * responses, which also catches those opened with autocommit off and ended by
+ * a statement that commits implicitly. A stream picked up in the middle of a
+ * transaction starts counting with the next one.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+	"math/rand"
+	"time"
+)
+
+const (
+	// Status flag in OK and EOF packets.
+	SERVER_STATUS_IN_TRANS = 0x0001
+)
+
+// txnState is where a stream is in its transaction.
+type txnState struct {
+	open       bool // one we're counting
+	known      bool // we've seen the stream out of a transaction
+	started    time.Time
+	statements uint64
+}
+
+var txns struct {
+	count      uint64
+	statements uint64
+	maxStmts   uint64
+	times      [TIME_BUCKETS]uint64
+}
+
+// txnBegin starts counting a transaction on a stream.
+func txnBegin(rs *source) {
+	rs.inTxn = true
+	rs.txn = txnState{open: true, known: true, started: clock()}
+}
+
+// txnEnd records the transaction of a stream, if we counted it from its start.
+func txnEnd(rs *source) {
+	rs.inTxn = false
+	if !rs.txn.open {
+		rs.txn.known = true
+		return
+	}
+	elapsed := uint64(clock().Sub(rs.txn.started).Nanoseconds())
+	trace(rs, "transaction of %d statements over after %0.2fms", rs.txn.statements,
+		float64(elapsed)/1000000)
+	txns.count++
+	txns.statements += rs.txn.statements
+	if rs.txn.statements > txns.maxStmts {
+		txns.maxStmts = rs.txn.statements
+	}
+	if elapsed > 0 {
+		txns.times[rand.Intn(TIME_BUCKETS)] = elapsed
+	}
+	rs.txn = txnState{known: true}
+}
+
+// txnStatement counts a statement towards the stream's transaction, or starts
+// or ends it.
+func txnStatement(rs *source, verb string, query []byte) {
+	switch verb {
+	case "begin", "start":
+		txnBegin(rs)
+	case "commit":
+		txnEnd(rs)
+	case "rollback":
+		// ROLLBACK TO SAVEPOINT stays in the transaction.
+		for _, token := range lexQuery(query) {
+			if token.text == "to" {
+				txnStatement(rs, "", query)
+				return
+			}
+		}
+		txnEnd(rs)
+	default:
+		if rs.txn.open && string(query) != EMPTY_STATEMENT {
+			rs.txn.statements++
+		}
+	}
+}
+
+// txnStatus follows the transaction by the status of the packet ending a
+// response.
+func txnStatus(rs *source, payload []byte) {
+	status, ok := parseStatus(payload)
+	if !ok || (len(payload) > 0 && payload[0] == 0xff) {
+		return
+	}
+	in := status&SERVER_STATUS_IN_TRANS != 0
+	switch {
+	case in && !rs.txn.open && rs.txn.known:
+		// Opened by the statement itself, with autocommit off.
+		txnBegin(rs)
+		rs.txn.statements = 1
+	case in:
+		// If we picked the stream up in the middle of one, it isn't counted.
+		rs.inTxn = true
+	case rs.inTxn:
+		// Committed by a statement that commits implicitly, like DDL.
+		txnEnd(rs)
+	default:
+		rs.txn.known = true
+	}
+}
+
+// printTransactions shows the statements and times of the transactions.
+func printTransactions(w io.Writer) {
+	if txns.count == 0 {
+		return
+	}
+	tmin, tavg, tmax := calculateTimes(txns.times[:])
+	reportf(w, " ")
+	reportf(w, "%stransactions: %d, %0.1f avg / %d max statements, %0.2fms min / %0.2fms avg / "+
+		"%0.2fms max open%s", COLOR_RED, txns.count, float64(txns.statements)/float64(txns.count),
+		txns.maxStmts, tmin, tavg, tmax, COLOR_DEFAULT)
+}
@@ -0,0 +1,55 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransactions(t *testing.T) {
+	defer func() { clock = time.Now }()
+	now := time.Unix(1434510000, 0)
+	clock = func() time.Time { return now }
+	qbuf, format, txns.count, txns.statements, txns.maxStmts = make(map[string]*queryData), nil,
+		0, 0, 0
+	txns.times = [TIME_BUCKETS]uint64{}
+	parseFormat("#q")
+	rs := &source{synced: true}
+	run := func(query string, status byte) {
+		processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, query...)...))
+		now = now.Add(10 * time.Millisecond)
+		processPacket(rs, false, mysqlPacket(1, 0, 0, 0, status, 0, 0, 0))
+	}
+
+	// Picked up in the middle of one, which isn't counted.
+	run("insert into t values (1)", 3)
+	run("commit", 2)
+	if txns.count != 0 || rs.inTxn {
+		t.Errorf("For a transaction we saw the end of\n    Got %d\n    Expected none", txns.count)
+	}
+
+	// From BEGIN to COMMIT, a rollback to a savepoint along the way.
+	run("begin", 3)
+	run("insert into t values (1)", 3)
+	run("savepoint a", 3)
+	run("rollback to savepoint a", 3)
+	run("update t set a = 2 where id = 1", 3)
+	run("commit", 2)
+	if _, avg, _ := calculateTimes(txns.times[:]); txns.count != 1 || txns.maxStmts != 4 ||
+		avg != 50 {
+		t.Errorf("For BEGIN to COMMIT\n    Got %d, %d statements, %0.2fms\n"+
+			"    Expected 1, 4 statements, 50ms", txns.count, txns.maxStmts, avg)
+	}
+
+	// With autocommit off, by the status, and ended by DDL (which counts with
+	// it, since we only know once it's over).
+	run("insert into t values (1)", 1)
+	if !rs.txn.open || !rs.inTxn {
+		t.Errorf("For a statement opening a transaction\n    Got %+v\n    Expected it open", rs.txn)
+	}
+	run("update t set a = 2 where id = 1", 1)
+	run("create table u (a int)", 0)
+	if txns.count != 2 || txns.statements != 7 || rs.inTxn {
+		t.Errorf("For a transaction by the status\n    Got %d, %d statements in all\n"+
+			"    Expected 2, 7", txns.count, txns.statements)
+	}
+}
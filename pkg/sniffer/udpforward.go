@@ -0,0 +1,118 @@
+/*
+ * udpforward.go
+ *
+ * Shipping query events over UDP, for aggregators that want the least overhead
+ * possible: no connections, no query text in the events, and nothing ever
+ * waits on the receiver. The format is in the udpwire package, which receivers
+ * can import to decode it.
+ *
+ */
+
+package sniffer
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/zorkian/mysql-sniffer/pkg/udpwire"
+)
+
+const (
+	// Enough to stay well under udpwire.MAX_DATAGRAM.
+	UDP_BATCH = 16
+	UDP_QUEUE = 16384
+)
+
+var (
+	udpQueue chan *queryEvent
+	udpStop  chan bool // closed to stop the forwarder
+	udpDone  chan bool // closed once it has
+)
+
+// forwardUDP queues an event to be sent. Like forwardEvent, this never blocks.
+func forwardUDP(ev *queryEvent) {
+	select {
+	case udpQueue <- ev:
+	default:
+		atomic.AddUint64(&stats.udp.dropped, 1)
+	}
+}
+
+// startUDPForwarder begins sending events to addr, with the text of every
+// fingerprint seen so far every dictEvery (if it isn't 0).
+func startUDPForwarder(addr string, dictEvery time.Duration) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	udpQueue, udpStop, udpDone = make(chan *queryEvent, UDP_QUEUE), make(chan bool), make(chan bool)
+	go runUDPForwarder(conn, dictEvery, udpQueue, udpStop, udpDone)
+	return nil
+}
+
+// stopUDPForwarder sends what's left of the batch and waits for the forwarder
+// to finish.
+func stopUDPForwarder() {
+	close(udpStop)
+	<-udpDone
+	udpQueue, udpStop, udpDone = nil, nil, nil
+}
+
+// runUDPForwarder sends events from queue in small batches, at least every
+// 100ms, until stop is closed.
+func runUDPForwarder(conn net.Conn, dictEvery time.Duration, queue chan *queryEvent,
+	stop, done chan bool) {
+	defer close(done)
+	defer conn.Close()
+	texts := make(map[uint64]string)
+	batch := make([]udpwire.Event, 0, UDP_BATCH)
+	flush := time.NewTicker(100 * time.Millisecond)
+	defer flush.Stop()
+	var dict <-chan time.Time
+	if dictEvery > 0 {
+		ticker := time.NewTicker(dictEvery)
+		defer ticker.Stop()
+		dict = ticker.C
+	}
+
+	send := func(datagram []byte, events int) {
+		if _, err := conn.Write(datagram); err != nil {
+			atomic.AddUint64(&stats.udp.dropped, uint64(events))
+		} else {
+			atomic.AddUint64(&stats.udp.sent, uint64(events))
+		}
+	}
+
+	for stopped := false; !stopped; {
+		select {
+		case ev := <-queue:
+			if dictEvery > 0 {
+				texts[ev.hash] = ev.text
+			}
+			batch = append(batch, udpwire.Event{Time: ev.time, Server: ev.server,
+				Address: ev.address, Client: ev.client, Hash: ev.hash, Latency: time.Duration(ev.latency),
+				Bytes: ev.bytes, ErrorCode: ev.errcode})
+			if len(batch) < UDP_BATCH {
+				continue
+			}
+		case <-flush.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-stop:
+			stopped = true
+			if len(batch) == 0 {
+				continue
+			}
+		case <-dict:
+			for _, datagram := range udpwire.EncodeDictionary(texts) {
+				send(datagram, 0)
+			}
+			continue
+		}
+
+		send(udpwire.EncodeEvents(batch), len(batch))
+		batch = batch[:0]
+	}
+}
@@ -0,0 +1,106 @@
+package sniffer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zorkian/mysql-sniffer/pkg/udpwire"
+)
+
+func TestUDPForward(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer listener.Close()
+	if err := startUDPForwarder(listener.LocalAddr().String(), 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed to start forwarder: %s", err.Error())
+	}
+	defer stopUDPForwarder()
+
+	forwardUDP(&queryEvent{time: time.Unix(1434510000, 0), server: "10.0.0.1:3306",
+		client: "10.0.0.2:50000", hash: fingerprintHash("select ?"), text: "select ?",
+		latency: 1000000, bytes: 10, errcode: 1205})
+
+	events, dict := readUDP(t, listener)
+	if len(events) != 1 || events[0].Client != "10.0.0.2:50000" || events[0].ErrorCode != 1205 ||
+		dict[events[0].Hash] != "select ?" {
+		t.Errorf("For forwarded events\n    Got %+v and %v\n    Expected select ? from 10.0.0.2",
+			events, dict)
+	}
+}
+
+func TestUDPForwardRedacted(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer listener.Close()
+	if err := startUDPForwarder(listener.LocalAddr().String(), 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed to start forwarder: %s", err.Error())
+	}
+	defer stopUDPForwarder()
+	redacting, qbuf, format = true, make(map[string]*queryData), nil
+	defer func() { redacting = false }()
+	parseFormat("#s:#q")
+
+	rs := &source{synced: true, src: "10.0.0.2:50000", srcip: "10.0.0.2", dst: "10.0.0.1:3306"}
+	query := "select name from users"
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, query...)...))
+	processPacket(rs, false, mysqlPacket(1, 0xfe, 0, 0, 2, 0))
+
+	events, dict := readUDP(t, listener)
+	if len(events) != 1 || events[0].Client != redactClient(rs.src) ||
+		dict[events[0].Hash] != redactQuery("select name from users") {
+		t.Errorf("For a redacted event\n    Got %+v and %v\n    Expected %s from %s", events,
+			dict, redactQuery("select name from users"), redactClient(rs.src))
+	}
+}
+
+func TestUDPForwardServerGroup(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer listener.Close()
+	if err := startUDPForwarder(listener.LocalAddr().String(), 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed to start forwarder: %s", err.Error())
+	}
+	defer stopUDPForwarder()
+	qbuf, format = make(map[string]*queryData), nil
+	parseFormat("#q")
+
+	rs := &source{synced: true, src: "10.0.0.2:50000", dst: "10.0.0.5:3306", server: "primary-1"}
+	processPacket(rs, true, mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...))
+	processPacket(rs, false, mysqlPacket(1, 0xfe, 0, 0, 2, 0))
+
+	events, _ := readUDP(t, listener)
+	if len(events) != 1 || events[0].Server != "primary-1" || events[0].Address != rs.dst {
+		t.Errorf("For an event to a server group\n    Got %+v\n    Expected primary-1 at %s",
+			events, rs.dst)
+	}
+}
+
+// readUDP reads datagrams until it has had events and a dictionary.
+func readUDP(t *testing.T, listener net.PacketConn) ([]udpwire.Event, map[uint64]string) {
+	var events []udpwire.Event
+	dict := make(map[uint64]string)
+	buf := make([]byte, udpwire.MAX_DATAGRAM)
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(events) == 0 || len(dict) == 0 {
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Failed to read: %s", err.Error())
+		}
+		msg, err := udpwire.Decode(buf[:n])
+		if err != nil {
+			t.Fatalf("Failed to decode: %s", err.Error())
+		}
+		events = append(events, msg.Events...)
+		for hash, text := range msg.Dictionary {
+			dict[hash] = text
+		}
+	}
+	return events, dict
+}
@@ -0,0 +1,109 @@
+/*
+ * users.go
+ *
+ * Load by MySQL account. Where many applications share hosts, the account is
+ * often the only way to tell which one is responsible for what. Connections we
+ * picked up mid-stream never told us who they are, and go under (unknown).
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+	"sort"
+)
+
+const UNKNOWN_USER = "(unknown)"
+
+var trackUsers bool = false
+
+type userData struct {
+	conns    uint64
+	count    uint64
+	bytes    uint64
+	errors   uint64
+	warnings uint64
+	total    uint64 // nanoseconds spent on queries
+	times    [TIME_BUCKETS]uint64
+
+	// Total nanoseconds by fingerprint.
+	fingerprints map[string]uint64
+}
+
+var users map[string]*userData = make(map[string]*userData)
+
+// userOf returns the account a stream is logged in as.
+func userOf(rs *source) *userData {
+	if rs.account != nil {
+		return rs.account
+	}
+
+	name := rs.user
+	if name == "" {
+		name = UNKNOWN_USER
+	}
+	user, ok := users[name]
+	if !ok {
+		user = &userData{fingerprints: make(map[string]uint64)}
+		users[name] = user
+	}
+	user.conns++
+	rs.account = user
+	return user
+}
+
+// recordUser adds a completed query to the stream's account.
+func recordUser(rs *source, randn int, reqtime uint64, bytes uint64, errcode int) {
+	user := userOf(rs)
+	user.count++
+	user.bytes += bytes
+	user.total += reqtime
+	user.times[randn] = reqtime
+	user.fingerprints[rs.qtext] += reqtime
+	if errcode != 0 {
+		user.errors++
+	}
+}
+
+// printUsers shows every account, busiest first, with the queries it spends the
+// most time on.
+func printUsers(w io.Writer, elapsed float64) {
+	if len(users) == 0 {
+		return
+	}
+
+	var tmp sortableSlice = make(sortableSlice, 0, len(users))
+	for name, user := range users {
+		tmp = append(tmp, sortable{float64(user.total), name})
+	}
+	sort.Sort(sort.Reverse(tmp))
+
+	reportf(w, " ")
+	reportf(w, "%sconns  queries       %sqps  %s   p50    p95    p99      "+
+		"%sbytes  %serr%%  warn/q  %suser%s", COLOR_YELLOW, COLOR_CYAN, COLOR_YELLOW,
+		COLOR_GREEN, COLOR_RED, COLOR_WHITE, COLOR_DEFAULT)
+	for _, item := range tmp {
+		user := users[item.line]
+		pcts := percentiles(user.times[:], 50, 95, 99)
+		var errs, warns float64
+		if user.count > 0 {
+			errs = float64(user.errors) / float64(user.count) * 100
+			warns = float64(user.warnings) / float64(user.count)
+		}
+		reportf(w, "%s%5d %8d %s%8.2f/s  %s%6.2f %6.2f %6.2f %s%10db  %s%5.2f %7.2f  %s%s%s",
+			COLOR_YELLOW, user.conns, user.count, COLOR_CYAN, float64(user.count)/elapsed,
+			COLOR_YELLOW, pcts[0], pcts[1], pcts[2], COLOR_GREEN, user.bytes, COLOR_RED, errs,
+			warns, COLOR_WHITE, redactUser(item.line), COLOR_DEFAULT)
+
+		var top sortableSlice = make(sortableSlice, 0, len(user.fingerprints))
+		for fingerprint, total := range user.fingerprints {
+			top = append(top, sortable{float64(total), fingerprint})
+		}
+		sort.Sort(sort.Reverse(top))
+		for i := 0; i < len(top) && i < 3; i++ {
+			reportf(w, "      %s%9.2fs  %s%s%s", COLOR_YELLOW, top[i].value/1e9, COLOR_WHITE,
+				redactQuery(top[i].line), COLOR_DEFAULT)
+		}
+	}
+}
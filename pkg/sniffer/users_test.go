@@ -0,0 +1,52 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func TestUsers(t *testing.T) {
+	users = make(map[string]*userData)
+	queries := []struct {
+		user    string
+		query   string
+		latency uint64
+		errcode int
+	}{
+		{"app", "select ?", 1000000, 0},
+		{"app", "select ?", 3000000, 0},
+		{"app", "update ?", 10000000, 1213},
+		{"", "select ?", 2000000, 0},
+	}
+	app := &source{user: "app"}
+	unknown := &source{}
+	for i, q := range queries {
+		rs := app
+		if q.user == "" {
+			rs = unknown
+		}
+		rs.qtext = q.query
+		recordUser(rs, i, q.latency, 100, q.errcode)
+	}
+
+	user, ok := users["app"]
+	if !ok {
+		t.Fatalf("For user app\n    Got nothing\n    Expected stats")
+	}
+	if user.conns != 1 || user.count != 3 || user.errors != 1 || user.total != 14000000 ||
+		user.fingerprints["update ?"] != 10000000 {
+		t.Errorf("For user app\n    Got %+v\n    Expected 1 conn, 3 queries, 1 error", *user)
+	}
+	if user, ok := users[UNKNOWN_USER]; !ok || user.count != 1 {
+		t.Errorf("For connections without a login\n    Got %v\n    Expected 1 query", users)
+	}
+}
+
+func TestSections(t *testing.T) {
+	defer func() { trackUsers, trackWarnings = false, false }()
+	if err := parseSections("users, warnings"); err != nil || !trackUsers || !trackWarnings {
+		t.Errorf("For sections users, warnings\n    Got %v\n    Expected both", err)
+	}
+	if err := parseSections("nope"); err == nil {
+		t.Errorf("For section nope\n    Got no error\n    Expected an error")
+	}
+}
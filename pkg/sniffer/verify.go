@@ -0,0 +1,142 @@
+/*
+ * verify.go
+ *
+ * With -verify we check as we go that the parser's books balance, so that a
+ * bug in following the protocol shows up as a violation (with what we knew of
+ * the stream at the time) rather than as numbers that are quietly off:
+ *
+ *     requests  every timed command a stream sent is answered, outstanding,
+ *               or dropped (cut off by the connection, lost to a desync, or
+ *               never answered before the next one)
+ *     bytes     the bytes counted against queries are no more than the
+ *               payload bytes we saw
+ *     phase     a response only moves through its phases the way the
+ *               protocol allows, packet by packet
+ *
+ * Each violation is counted, in the diagnostics too, and the first of each
+ * kind is logged with the stream's state and its last payloads.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	INVARIANT_REQUESTS = "requests"
+	INVARIANT_BYTES    = "bytes"
+	INVARIANT_PHASE    = "phase"
+)
+
+var verifying bool = false
+var violations map[string]uint64 = make(map[string]uint64)
+
+// How far over the payloads the bytes of the queries were when we last found
+// them over, so we count the next time they go further and not this one.
+var bytesExcess uint64
+
+// phaseNames are the response phases, for the context of a violation.
+var phaseNames = [...]string{"none", "first", "columns", "columns eof", "rows", "prepare",
+	"prepare eof", "infile", "done"}
+
+// phaseNext is, for each phase, the phases one packet of a response can take it
+// to. Ending the response is allowed from all of them.
+var phaseNext = [...]uint{
+	RES_FIRST: 1<<RES_NONE | 1<<RES_FIRST | 1<<RES_COLUMNS | 1<<RES_ROWS | 1<<RES_PREPARE |
+		1<<RES_INFILE,
+	RES_COLUMNS:     1<<RES_COLUMNS | 1<<RES_COLUMNS_EOF,
+	RES_COLUMNS_EOF: 1<<RES_ROWS | 1<<RES_FIRST,
+	RES_ROWS:        1<<RES_ROWS | 1<<RES_FIRST,
+	RES_PREPARE:     1<<RES_PREPARE | 1<<RES_PREPARE_EOF,
+	RES_PREPARE_EOF: 1<<RES_PREPARE | 1<<RES_PREPARE_EOF,
+}
+
+// phaseAllowed tells us whether a packet can take a response from one phase to
+// another.
+func phaseAllowed(from, to int) bool {
+	return to == RES_DONE || (from < len(phaseNext) && phaseNext[from]&(1<<uint(to)) != 0)
+}
+
+// pendingCommands is how many timed commands the stream is waiting on.
+func pendingCommands(rs *source) uint64 {
+	var n uint64
+	if rs.reqSent != nil {
+		n++
+	}
+	for _, cmd := range rs.queue {
+		if !cmd.sent.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+// verifyStream checks the books of a stream after a packet.
+func verifyStream(rs *source) {
+	if rs.resp.illegal != "" {
+		violated(rs, INVARIANT_PHASE, rs.resp.illegal)
+		rs.resp.illegal = ""
+	}
+	pending := pendingCommands(rs)
+	if rs.cmds.sent != rs.cmds.matched+pending+rs.cmds.dropped {
+		violated(rs, INVARIANT_REQUESTS, fmt.Sprintf("%d sent, but %d matched + %d pending + "+
+			"%d dropped", rs.cmds.sent, rs.cmds.matched, pending, rs.cmds.dropped))
+		// Balance them again, so we count the next violation and not this one.
+		rs.cmds.sent = rs.cmds.matched + pending + rs.cmds.dropped
+	}
+}
+
+// verifyTotals checks what's kept across streams.
+func verifyTotals() {
+	if collecting {
+		// The queries came from elsewhere.
+		return
+	}
+	var attributed uint64
+	for _, qdata := range qbuf {
+		attributed += qdata.bytes
+	}
+	for _, bucket := range tiers.buckets {
+		attributed += bucket.bytes
+	}
+	if attributed > blind.total+bytesExcess {
+		violated(nil, INVARIANT_BYTES, fmt.Sprintf("%s counted against %d queries, but only %s "+
+			"of payloads seen", formatBytes(attributed), len(qbuf), formatBytes(blind.total)))
+		bytesExcess = attributed - blind.total
+	}
+}
+
+// violated counts a broken invariant, logging the first of each kind with the
+// stream it broke on, if any.
+func violated(rs *source, invariant, detail string) {
+	violations[invariant]++
+	if violations[invariant] > 1 {
+		return
+	}
+
+	var dump strings.Builder
+	fmt.Fprintf(&dump, "%sINVARIANT %s BROKEN: %s%s\n", COLOR_RED, invariant, detail,
+		COLOR_DEFAULT)
+	if rs != nil {
+		fmt.Fprintf(&dump, "    stream %s -> %s, synced %t, side %q\n", rs.src, rs.dst,
+			rs.synced, rs.side)
+		phase := fmt.Sprintf("%d", rs.resp.phase)
+		if rs.resp.phase < len(phaseNames) {
+			phase = phaseNames[rs.resp.phase]
+		}
+		fmt.Fprintf(&dump, "    response to %s in phase %s, sequence %d, %d defs left\n",
+			commandNames[rs.resp.ptype], phase, rs.resp.seq, rs.resp.defs)
+		fmt.Fprintf(&dump, "    current %q, timed %t, %d commands queued\n", rs.qtext,
+			rs.reqSent != nil, len(rs.queue))
+		fmt.Fprintf(&dump, "    commands: %d sent, %d matched, %d dropped\n", rs.cmds.sent,
+			rs.cmds.matched, rs.cmds.dropped)
+		if len(rs.history) > 0 {
+			writePayloads(&dump, rs.src, rs.history)
+		}
+	}
+	log.Printf("%s", strings.TrimRight(dump.String(), "\n"))
+}
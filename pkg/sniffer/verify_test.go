@@ -0,0 +1,57 @@
+package sniffer
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyFixtures(t *testing.T) {
+	defer func() { verifying = false; log.SetOutput(os.Stderr) }()
+	log.SetOutput(io.Discard)
+	verifying, violations, bytesExcess, blind.total = true, make(map[string]uint64), 0, 0
+
+	files, _ := filepath.Glob("testdata/streams/*.txt")
+	for _, filename := range files {
+		replayFixture(t, filename)
+		verifyTotals()
+		if len(violations) > 0 {
+			t.Errorf("For %s\n    Got %v\n    Expected no invariants broken", filename,
+				violations)
+			violations = make(map[string]uint64)
+		}
+	}
+}
+
+func TestVerifyViolations(t *testing.T) {
+	defer func() { verifying = false; log.SetOutput(os.Stderr) }()
+	log.SetOutput(io.Discard)
+	verifying, violations, bytesExcess, blind.total = true, make(map[string]uint64), 0, 100
+	qbuf = map[string]*queryData{"select ?": {count: 1, bytes: 150}}
+
+	// A command that went missing, twice over the same books.
+	rs := &source{synced: true}
+	rs.cmds.sent, rs.cmds.matched = 3, 2
+	verifyStream(rs)
+	verifyStream(rs)
+	verifyTotals()
+	verifyTotals()
+
+	for _, test := range []struct{ from, to int }{{RES_COLUMNS, RES_FIRST},
+		{RES_PREPARE, RES_ROWS}} {
+		if phaseAllowed(test.from, test.to) {
+			t.Errorf("For a packet from %s to %s\n    Got allowed\n    Expected not",
+				phaseNames[test.from], phaseNames[test.to])
+		}
+	}
+	if !phaseAllowed(RES_ROWS, RES_FIRST) || !phaseAllowed(RES_COLUMNS, RES_DONE) {
+		t.Errorf("For more results and ending a response\n    Got not allowed\n" +
+			"    Expected allowed")
+	}
+	if violations[INVARIANT_REQUESTS] != 1 || violations[INVARIANT_BYTES] != 1 {
+		t.Errorf("For a missing command and bytes out of nowhere\n    Got %v\n"+
+			"    Expected one of each", violations)
+	}
+}
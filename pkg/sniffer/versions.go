@@ -0,0 +1,103 @@
+/*
+ * versions.go
+ *
+ * Which servers we saw and what they run. The server's greeting starts with
+ * the protocol version (10) and its version as text, like "5.6.24-log", so a
+ * port fronting several backends, or a capture from a proxy host, tells us
+ * which versions are in play. The status output lists the servers with their
+ * versions and how many streams went to each, those we never saw greet a
+ * client as "(unknown)".
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// Servers we keep, past which new ones are only counted.
+	SERVERS_SEEN = 1024
+
+	// What a server we haven't seen a greeting from runs.
+	UNKNOWN_VERSION = "(unknown)"
+)
+
+// serverSeen is a server address we saw streams to.
+type serverSeen struct {
+	version string
+	streams uint64
+}
+
+var serversSeen map[string]*serverSeen = make(map[string]*serverSeen)
+var serversUnseen uint64
+
+// parseGreeting returns the server version in a greeting, the packet with its
+// header, or false if it isn't one.
+func parseGreeting(data []byte) (string, bool) {
+	if len(data) < 6 || data[3] != 0 || data[4] != 10 {
+		return "", false
+	}
+	version, _, ok := nulString(data, 5)
+	if !ok || version == "" {
+		return "", false
+	}
+	for _, b := range []byte(version) {
+		if b < 0x20 || b >= 0x7f {
+			return "", false
+		}
+	}
+	return version, true
+}
+
+// noteStream counts a new stream to its server.
+func noteStream(rs *source) {
+	seen := serversSeen[rs.dst]
+	if seen == nil {
+		if len(serversSeen) >= SERVERS_SEEN {
+			serversUnseen++
+			return
+		}
+		seen = &serverSeen{version: UNKNOWN_VERSION}
+		serversSeen[rs.dst] = seen
+	}
+	seen.streams++
+}
+
+// noteVersion records the version in a stream's greeting.
+func noteVersion(rs *source, version string) {
+	trace(rs, "server version %s", version)
+	rs.version = version
+	if seen := serversSeen[rs.dst]; seen != nil {
+		seen.version = version
+	}
+}
+
+// printServers shows the servers we saw, busiest first.
+func printServers(w io.Writer, displaycount int) {
+	if len(serversSeen) == 0 {
+		return
+	}
+	var tmp sortableSlice
+	for addr, seen := range serversSeen {
+		tmp = append(tmp, sortable{float64(seen.streams), fmt.Sprintf("%s%8d  %s%-24s %s%s%s",
+			COLOR_YELLOW, seen.streams, COLOR_CYAN, seen.version, COLOR_WHITE, addr,
+			COLOR_DEFAULT)})
+	}
+	sort.Sort(sort.Reverse(tmp))
+
+	reportf(w, " ")
+	reportf(w, "%s%d servers seen%s", COLOR_RED, len(serversSeen), COLOR_DEFAULT)
+	reportf(w, "%s streams  %sversion                  %sserver%s", COLOR_YELLOW, COLOR_CYAN,
+		COLOR_WHITE, COLOR_DEFAULT)
+	for i := 0; i < len(tmp) && i < displaycount; i++ {
+		fmt.Fprintln(w, tmp[i].line)
+	}
+	if serversUnseen > 0 {
+		reportf(w, "%s%d streams to servers past the first %d%s", COLOR_YELLOW, serversUnseen,
+			SERVERS_SEEN, COLOR_DEFAULT)
+	}
+}
@@ -0,0 +1,46 @@
+package sniffer
+
+import (
+	"testing"
+)
+
+func TestServerVersions(t *testing.T) {
+	defer func() { port = 3306 }()
+	chmap, serversSeen, serversUnseen = make(map[string]*source), make(map[string]*serverSeen), 0
+	greeting := mysqlPacket(0, append([]byte{10}, "5.6.24-log\x00\x01\x00\x00\x00abcdefgh\x00"...)...)
+	query := mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...)
+
+	port = 3306
+	handlePacket(tcpPacket([4]byte{10, 0, 0, 2}, 50000, false, TCP_ACK, greeting))
+	handlePacket(tcpPacket([4]byte{10, 0, 0, 3}, 50000, true, TCP_ACK, query))
+	port = 3307
+	handlePacket(tcpPacket([4]byte{10, 0, 0, 2}, 50001, true, TCP_ACK, query))
+
+	if seen := serversSeen["10.0.0.1:3306"]; seen == nil || seen.version != "5.6.24-log" ||
+		seen.streams != 2 {
+		t.Errorf("For a server that greeted a client\n    Got %+v\n    Expected 5.6.24-log, "+
+			"2 streams", seen)
+	}
+	if seen := serversSeen["10.0.0.1:3307"]; seen == nil || seen.version != UNKNOWN_VERSION ||
+		seen.streams != 1 {
+		t.Errorf("For a server we only saw queries to\n    Got %+v\n    Expected an unknown "+
+			"version, 1 stream", seen)
+	}
+	if rs := chmap["10.0.0.2:50000"]; rs == nil || rs.version != "5.6.24-log" {
+		t.Errorf("For the stream greeted\n    Got %+v\n    Expected the version", rs)
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"an OK", mysqlPacket(0, 0, 0, 0, 2, 0, 0, 0)},
+		{"a greeting of another protocol", mysqlPacket(0, append([]byte{9}, "5.0\x00"...)...)},
+		{"an unterminated version", mysqlPacket(0, append([]byte{10}, "5.6.24"...)...)},
+		{"a binary version", mysqlPacket(0, 10, 1, 2, 3, 0)},
+	} {
+		if version, ok := parseGreeting(test.data); ok {
+			t.Errorf("For %s\n    Got version %q\n    Expected none", test.name, version)
+		}
+	}
+}
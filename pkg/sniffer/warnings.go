@@ -0,0 +1,82 @@
+/*
+ * warnings.go
+ *
+ * Warnings the server returns with queries. Applications almost never look at
+ * them, but they're in every OK and EOF packet, and some are worth knowing
+ * about: implicit type conversions in particular usually mean a predicate that
+ * can't use its index.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+var trackWarnings bool = false
+
+// scanWarnings looks through a segment of a response for the packets that carry
+// warning counts, crediting the query with the most any of them report. first
+// says whether this is the start of the response, since we have to follow the
+// packet boundaries from there.
+func scanWarnings(rs *source, data []byte, first bool) {
+	pos := rs.resSkip
+	if first {
+		pos, rs.qwarnings = 0, 0
+	} else if rs.resHeader != nil {
+		data = append(rs.resHeader, data...)
+	}
+	rs.resHeader = nil
+	for i := 0; pos+4 <= len(data); i++ {
+		plen := int(data[pos]) | int(data[pos+1])<<8 | int(data[pos+2])<<16
+		if pos+4+plen > len(data) {
+			pos += 4 + plen
+			break
+		}
+		if warnings, ok := parseWarnings(data[pos+4:pos+4+plen], first && i == 0); ok &&
+			warnings > rs.qwarnings {
+			if rs.qdata != nil {
+				rs.qdata.warnings += uint64(warnings - rs.qwarnings)
+			}
+			if trackUsers {
+				userOf(rs).warnings += uint64(warnings - rs.qwarnings)
+			}
+			rs.qwarnings = warnings
+		}
+		pos += 4 + plen
+	}
+
+	// How far into the next segment the next packet starts, or if the header
+	// was split, the part of it we have.
+	rs.resSkip = pos - len(data)
+	if rs.resSkip < 0 {
+		rs.resHeader = append([]byte(nil), data[pos:]...)
+		rs.resSkip = 0
+	}
+}
+
+// printWarnings prints the queries generating the most warnings.
+func printWarnings(w io.Writer, displaycount int, elapsed float64) {
+	var tmp sortableSlice
+	for q, c := range qbuf {
+		if c.warnings > 0 {
+			tmp = append(tmp, sortable{float64(c.warnings), fmt.Sprintf(
+				"%s%8d %8.2f/s %7.2f  %s%s%s", COLOR_RED, c.warnings,
+				float64(c.warnings)/elapsed, float64(c.warnings)/float64(c.count), COLOR_WHITE,
+				redactQuery(q), COLOR_DEFAULT)})
+		}
+	}
+	if len(tmp) == 0 {
+		return
+	}
+	sort.Sort(sort.Reverse(tmp))
+
+	reportf(w, " ")
+	reportf(w, "%swarnings     rate  per qry  query%s", COLOR_RED, COLOR_DEFAULT)
+	for i := 0; i < len(tmp) && i < displaycount; i++ {
+		fmt.Fprintln(w, tmp[i].line)
+	}
+}
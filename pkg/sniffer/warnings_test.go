@@ -0,0 +1,71 @@
+package sniffer
+
+import (
+	"strings"
+	"testing"
+)
+
+// mysqlPackets frames payloads as consecutive MySQL packets.
+func mysqlPackets(payloads ...[]byte) []byte {
+	var data []byte
+	for seq, payload := range payloads {
+		data = append(data, byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16),
+			byte(seq+1))
+		data = append(data, payload...)
+	}
+	return data
+}
+
+func warningsHelper(t *testing.T, what string, segments [][]byte, expected uint64) {
+	rs := &source{qdata: &queryData{}}
+	for i, segment := range segments {
+		scanWarnings(rs, segment, i == 0)
+	}
+	if rs.qdata.warnings != expected {
+		t.Errorf("For %s\n    Got %d\n    Expected %d", what, rs.qdata.warnings, expected)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	ok := mysqlPackets([]byte{0x00, 0x01, 0x00, 0x02, 0x00, 0x03, 0x00})
+	warningsHelper(t, "an OK packet", [][]byte{ok}, 3)
+
+	resultSet := mysqlPackets(
+		[]byte{0x01},
+		[]byte("\x03def\x00\x00\x00\x01a\x00\x0c\x3f\x00\x0b\x00\x00\x00\x03\x00\x00\x00\x00\x00"),
+		[]byte{0xfe, 0x00, 0x00, 0x02, 0x00},
+		[]byte{0x01, 0x00},
+		[]byte{0x01, 0x00},
+		[]byte{0xfe, 0x05, 0x00, 0x22, 0x00},
+	)
+	warningsHelper(t, "a result set", [][]byte{resultSet}, 5)
+	warningsHelper(t, "a split result set", [][]byte{resultSet[:20], resultSet[20:50],
+		resultSet[50:]}, 5)
+
+	// A row starting with 0 isn't an OK packet.
+	rows := mysqlPackets([]byte{0x01}, []byte{0x00, 0x00, 0x00, 0x00, 0x07, 0x00},
+		[]byte{0xfe, 0x00, 0x00, 0x02, 0x00})
+	warningsHelper(t, "rows starting with 0", [][]byte{rows}, 0)
+
+	// With CLIENT_DEPRECATE_EOF the result set ends with an OK packet.
+	deprecateEOF := mysqlPackets([]byte{0x01}, []byte{0x01, 0x00},
+		[]byte{0xfe, 0x00, 0x00, 0x02, 0x00, 0x04, 0x00})
+	warningsHelper(t, "a result set without EOFs", [][]byte{deprecateEOF}, 4)
+}
+
+func TestWarningsSort(t *testing.T) {
+	defer func() { trackWarnings = false }()
+	qbuf, trackWarnings = make(map[string]*queryData), true
+	qbuf["select ?"] = &queryData{count: 1000, warnings: 10}
+	qbuf["insert into t values (?)"] = &queryData{count: 10, warnings: 500}
+	qbuf["update t set a = ?"] = &queryData{count: 100}
+
+	rows := topRows(rankRows(nil, "warnings", 0, 10, nil), 3)
+	if len(rows) != 3 || rows[0].key != "insert into t values (?)" || rows[1].key != "select ?" {
+		t.Errorf("For -s warnings\n    Got %v\n    Expected the insert, then the select", rows)
+	}
+	row := formatRow(copyRow(rows[0].key, qbuf[rows[0].key]), 10)
+	if !strings.Contains(row, "50.00    50.00") {
+		t.Errorf("For the warnings columns\n    Got %q\n    Expected 50/s, 50 per query", row)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * websocket.go
+ *
+ * Just enough of RFC 6455 to stream text messages from the sniffer to a
+ * browser or a script: the handshake on both ends, and unfragmented frames.
+ * Servers don't mask what they send and clients always do.
+ *
+ */
+
+package sniffer
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	WS_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// Opcodes
+	WS_TEXT  = 0x1
+	WS_CLOSE = 0x8
+	WS_PING  = 0x9
+	WS_PONG  = 0xA
+
+	// The most we'll read in one frame; clients only send us control frames.
+	WS_MAX_FRAME = 1024 * 1024
+)
+
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool // whether we mask what we send
+}
+
+// wsAccept returns the Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func wsAccept(key string) string {
+	hash := sha1.Sum([]byte(key + WS_GUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// wsUpgrade completes the handshake for a request and takes over its connection.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "websocket only", http.StatusBadRequest)
+		return nil, errors.New("not a websocket request")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't upgrade", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: buf.Reader}, nil
+}
+
+// wsDial connects to a ws:// URL.
+func wsDial(rawurl string) (*wsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		u.RequestURI(), u.Host, key)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, errors.New("handshake failed: bad accept key")
+	}
+	return &wsConn{conn: conn, reader: reader, client: true}, nil
+}
+
+// writeFrame sends one unfragmented frame.
+func (self *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	if self.client {
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		header[1] |= 0x80
+		header = append(header, mask...)
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+	_, err := self.conn.Write(append(header, payload...))
+	return err
+}
+
+// readFrame reads one frame, unmasking it if need be.
+func (self *wsConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(self.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0]&0x80 == 0 {
+		return 0, nil, errors.New("fragmented frames aren't supported")
+	}
+	opcode, length := header[0]&0x0F, uint64(header[1]&0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(self.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(self.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > WS_MAX_FRAME {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too big", length)
+	}
+
+	var mask [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(self.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(self.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+// readMessage returns the next text message, answering pings along the way.
+// It returns io.EOF when the other end closes.
+func (self *wsConn) readMessage() ([]byte, error) {
+	for {
+		opcode, payload, err := self.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case WS_TEXT:
+			return payload, nil
+		case WS_PING:
+			if err := self.writeFrame(WS_PONG, payload); err != nil {
+				return nil, err
+			}
+		case WS_CLOSE:
+			self.writeFrame(WS_CLOSE, nil)
+			return nil, io.EOF
+		}
+	}
+}
+
+func (self *wsConn) Close() error {
+	return self.conn.Close()
+}
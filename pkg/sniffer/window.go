@@ -0,0 +1,106 @@
+/*
+ * window.go
+ *
+ * Reading only part of a capture file, by capture time. The ends of the window
+ * are either absolute (RFC3339) or offsets like +20m from the first packet in
+ * the file. Everything before the window is skipped, so streams already open
+ * when it starts have to sync up mid-stream like they would sniffing live.
+ *
+ * Files are normally read as fast as we can, but they can also be paced to
+ * unfold like the original traffic did, for watching or demos.
+ *
+ */
+
+package sniffer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var replaySpeed float64
+
+// When we paced the first packet, in wall and capture time.
+var paceWall, paceCapture time.Time
+
+// windowBound is one end of the window as given on the command line.
+type windowBound struct {
+	at       time.Time
+	offset   time.Duration
+	relative bool
+}
+
+var windowFrom, windowTo windowBound
+
+// The window in capture time, once we know when the file starts.
+var windowStart, windowEnd time.Time
+var windowResolved bool
+
+func parseWindowBound(val string) (windowBound, error) {
+	if val == "" {
+		return windowBound{}, nil
+	}
+	if strings.HasPrefix(val, "+") {
+		offset, err := time.ParseDuration(val[1:])
+		if err != nil {
+			return windowBound{}, err
+		}
+		return windowBound{offset: offset, relative: true}, nil
+	}
+	at, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return windowBound{}, fmt.Errorf("%s is neither RFC3339 nor an offset like +20m", val)
+	}
+	return windowBound{at: at}, nil
+}
+
+// resolve returns the time of the bound in a capture starting at first, or the
+// zero time if it isn't set.
+func (self windowBound) resolve(first time.Time) time.Time {
+	if self.relative {
+		return first.Add(self.offset)
+	}
+	return self.at
+}
+
+// windowCheck places a packet relative to the window: before it (skip the
+// packet), after it (stop reading), or in it.
+func windowCheck(when time.Time) (before, after bool) {
+	if !windowResolved {
+		windowStart, windowEnd = windowFrom.resolve(when), windowTo.resolve(when)
+		windowResolved = true
+	}
+	return !windowStart.IsZero() && when.Before(windowStart),
+		!windowEnd.IsZero() && when.After(windowEnd)
+}
+
+// pace waits until it's time to handle a packet captured at when, going by
+// replaySpeed, putting in changes of targets while it waits. It returns false
+// if the sniffer was stopped instead.
+func (self *Sniffer) pace(when time.Time) bool {
+	if replaySpeed <= 0 {
+		return true
+	}
+	if paceWall.IsZero() {
+		paceWall, paceCapture = time.Now(), when
+		return true
+	}
+	due := paceWall.Add(time.Duration(float64(when.Sub(paceCapture)) / replaySpeed))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-self.stop:
+			return false
+		case rt := <-self.retarget:
+			rt.done <- self.applyTargets(rt)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package sniffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	defer func() { windowFrom, windowTo, windowResolved = windowBound{}, windowBound{}, false }()
+	first := time.Date(2015, 6, 17, 14, 0, 0, 0, time.UTC)
+
+	var err error
+	if windowFrom, err = parseWindowBound("+20m"); err != nil {
+		t.Fatalf("Failed to parse offset: %s", err.Error())
+	}
+	if windowTo, err = parseWindowBound("2015-06-17T14:35:00Z"); err != nil {
+		t.Fatalf("Failed to parse time: %s", err.Error())
+	}
+	if _, err = parseWindowBound("14:35"); err == nil {
+		t.Errorf("For window bound 14:35\n    Got no error\n    Expected an error")
+	}
+
+	windowResolved = false
+	for _, packet := range []struct {
+		offset   time.Duration
+		expected string
+	}{
+		{0, "before"},
+		{19 * time.Minute, "before"},
+		{20 * time.Minute, "in"},
+		{35 * time.Minute, "in"},
+		{36 * time.Minute, "after"},
+	} {
+		offset, expected := packet.offset, packet.expected
+		before, after := windowCheck(first.Add(offset))
+		got := "in"
+		if before {
+			got = "before"
+		} else if after {
+			got = "after"
+		}
+		if got != expected {
+			t.Errorf("For packet at +%s\n    Got %s\n    Expected %s", offset, got, expected)
+		}
+		if offset == 0 && !windowStart.Equal(first.Add(20*time.Minute)) {
+			t.Errorf("For window start\n    Got %s\n    Expected %s", windowStart,
+				first.Add(20*time.Minute))
+		}
+	}
+}
+
+func TestPace(t *testing.T) {
+	defer func() { replaySpeed, paceWall = 0, time.Time{} }()
+	replaySpeed, paceWall = 10, time.Time{}
+
+	s := &Sniffer{stop: make(chan bool), retarget: make(chan *retarget)}
+	first := time.Date(2015, 6, 17, 14, 0, 0, 0, time.UTC)
+	began := time.Now()
+	s.pace(first)
+	s.pace(first.Add(500 * time.Millisecond))
+	if elapsed := time.Since(began); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("For 500ms of capture at 10x\n    Got %s\n    Expected about 50ms", elapsed)
+	}
+
+	// Stopping doesn't wait for the next packet's turn.
+	time.AfterFunc(20*time.Millisecond, func() { close(s.stop) })
+	began = time.Now()
+	if s.pace(first.Add(time.Hour)) || time.Since(began) > time.Second {
+		t.Errorf("For a stop while waiting\n    Got %s\n    Expected it to return false at once",
+			time.Since(began))
+	}
+}
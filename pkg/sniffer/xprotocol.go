@@ -0,0 +1,94 @@
+/*
+ * xprotocol.go
+ *
+ * The X Protocol (mysqlx, port 33060 by default), which we can't decode. Its
+ * frames are a 4 byte length and a message type, so a frame under 16MB reads
+ * as a classic packet at sequence 0 whose command is the message type, and a
+ * stream of them would otherwise be taken for COM_QUITs and COM_PROCESS_KILLs.
+ * Two things give it away:
+ *
+ *   - the client speaks first, opening with CapabilitiesGet, CapabilitiesSet
+ *     or AuthenticateStart, where a classic server would send its greeting
+ *   - the server sends frames at "sequence 0", which a classic server only
+ *     does for its greeting
+ *
+ * Streams found to be X Protocol are blind, their bytes counted but not parsed.
+ *
+ */
+
+package sniffer
+
+import (
+	"io"
+)
+
+const (
+	// Client messages opening a connection.
+	MYSQLX_CAPABILITIES_GET = 1
+	MYSQLX_CAPABILITIES_SET = 2
+	MYSQLX_AUTH_START       = 4
+)
+
+// xClientMessage says whether a type is one of Mysqlx.ClientMessages.
+func xClientMessage(mtype byte) bool {
+	switch {
+	case mtype >= 1 && mtype <= 7, mtype == 12, mtype >= 17 && mtype <= 20, mtype == 24,
+		mtype == 25, mtype >= 30 && mtype <= 32, mtype >= 40 && mtype <= 46:
+		return true
+	}
+	return false
+}
+
+// xServerMessage says whether a type is one of Mysqlx.ServerMessages.
+func xServerMessage(mtype byte) bool {
+	return mtype <= 4 || (mtype >= 11 && mtype <= 19)
+}
+
+// xFrames counts the X Protocol frames a segment is made of, end to end, or
+// returns 0 if it isn't.
+func xFrames(data []byte, valid func(byte) bool) int {
+	frames := 0
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return 0
+		}
+		size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16 | int(data[3])<<24
+		if size < 1 || size > len(data)-4 || !valid(data[4]) {
+			return 0
+		}
+		data = data[4+size:]
+		frames++
+	}
+	return frames
+}
+
+// xProtocol says whether a segment of a stream we haven't synced on shows it to
+// be X Protocol.
+func xProtocol(rs *source, request bool, data []byte) bool {
+	if request {
+		// Only on a connection we saw open, before any greeting.
+		if rs.connStart.IsZero() || rs.version != "" || rs.user != "" || len(data) < 5 {
+			return false
+		}
+		switch data[4] {
+		case MYSQLX_CAPABILITIES_GET, MYSQLX_CAPABILITIES_SET, MYSQLX_AUTH_START:
+			return xFrames(data, xClientMessage) > 0
+		}
+		return false
+	}
+	// A single frame could be the middle of a classic packet lining up.
+	return len(data) > 4 && data[3] == 0 && data[4] != 10 && xFrames(data, xServerMessage) > 1
+}
+
+// printXProtocol prints how many streams were X Protocol, for the status bar.
+func printXProtocol(w io.Writer) {
+	var conns uint64
+	for _, bd := range blind.servers {
+		conns += bd.conns[BLIND_XPROTOCOL]
+	}
+	if conns == 0 {
+		return
+	}
+	reportf(w, "%d x-protocol streams, %s not parsed", conns,
+		formatBytes(blind.bytes[BLIND_XPROTOCOL]))
+}
@@ -0,0 +1,58 @@
+package sniffer
+
+import (
+	"fmt"
+	"testing"
+)
+
+// xFrame builds an X Protocol frame.
+func xFrame(mtype byte, message ...byte) []byte {
+	size := len(message) + 1
+	return append([]byte{byte(size), byte(size >> 8), 0, 0, mtype}, message...)
+}
+
+func TestXProtocol(t *testing.T) {
+	port, chmap, qbuf, format = 3306, make(map[string]*source), make(map[string]*queryData), nil
+	blind.total, blind.bytes, blind.servers, blind.subnets = 0, [BLIND_CATEGORIES]uint64{}, nil, nil
+	commandCounts, querycount = [COM_LAST + 1]uint64{}, 0
+	parseFormat("#q")
+	client := [4]byte{10, 0, 2, 7}
+
+	// A session opening with CapabilitiesGet, which reads as a COM_QUIT.
+	handlePacket(tcpPacket(client, 50000, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, xFrame(MYSQLX_CAPABILITIES_GET)))
+	handlePacket(tcpPacket(client, 50000, false, TCP_ACK, xFrame(2, make([]byte, 40)...)))
+	// SQL_STMT_EXECUTE, which reads as COM_PROCESS_KILL.
+	handlePacket(tcpPacket(client, 50000, true, TCP_ACK, xFrame(12, 0x0a, 1, 'x')))
+
+	// One picked up mid-stream, with a notice and a StmtExecuteOk from the server.
+	handlePacket(tcpPacket(client, 50001, false, TCP_ACK,
+		append(xFrame(11, 8, 3, 0x10, 2), xFrame(17)...)))
+
+	// A classic connection, and a classic COM_QUIT on one picked up mid-stream.
+	greeting := mysqlPacket(0, append([]byte{10}, "8.0.21\x00"...)...)
+	handlePacket(tcpPacket(client, 50002, true, TCP_SYN, nil))
+	handlePacket(tcpPacket(client, 50002, false, TCP_ACK, greeting))
+	handlePacket(tcpPacket(client, 50002, true, TCP_ACK, makeHandshakeResponse("app")))
+	handlePacket(tcpPacket(client, 50002, false, TCP_ACK, mysqlPacket(2, 0, 0, 0, 2, 0, 0, 0)))
+	handlePacket(tcpPacket(client, 50002, true, TCP_ACK,
+		mysqlPacket(0, append([]byte{COM_QUERY}, "select 1"...)...)))
+	handlePacket(tcpPacket(client, 50003, true, TCP_ACK, mysqlPacket(0, COM_QUIT)))
+
+	for clientPort, expected := range map[int]bool{50000: true, 50001: true, 50002: false,
+		50003: false} {
+		rs := chmap[fmt.Sprintf("10.0.2.7:%d", clientPort)]
+		if got := rs != nil && rs.blind == BLIND_XPROTOCOL; got != expected {
+			t.Errorf("For the stream from port %d\n    Got X Protocol %t\n    Expected %t",
+				clientPort, got, expected)
+		}
+	}
+	if querycount != 1 || commandCounts[COM_PROCESS_KILL] != 0 || commandCounts[COM_QUIT] != 1 {
+		t.Errorf("For the commands\n    Got %d queries, %v\n    Expected the classic ones only",
+			querycount, commandCounts)
+	}
+	if blind.bytes[BLIND_XPROTOCOL] != 5+45+8+9+5 {
+		t.Errorf("For the X Protocol bytes\n    Got %d\n    Expected %d",
+			blind.bytes[BLIND_XPROTOCOL], 5+45+8+9+5)
+	}
+}
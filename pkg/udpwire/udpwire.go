@@ -0,0 +1,281 @@
+/*
+ * udpwire.go
+ *
+ * The datagrams mysql-sniffer sends with -udp-forward, for receivers to decode.
+ * Every datagram is one message:
+ *
+ *     version      byte (VERSION)
+ *     type         byte (MSG_EVENTS or MSG_DICTIONARY)
+ *
+ * followed for MSG_EVENTS by
+ *
+ *     count        uvarint
+ *     count times:
+ *       time       uvarint, unix nanoseconds
+ *       server     address
+ *       client     address
+ *       hash       8 bytes little endian, the fingerprint hash
+ *       latency    uvarint, nanoseconds
+ *       bytes      uvarint
+ *       flags      byte, FLAG_*
+ *       errcode    uvarint, only if FLAG_ERROR is set
+ *       address    address, only if FLAG_ADDRESS is set: the server's own
+ *                  when the server is a -server-group label
+ *
+ * and for MSG_DICTIONARY, which tells receivers the text behind the hashes, by
+ *
+ *     count        uvarint
+ *     count times:
+ *       hash       8 bytes little endian
+ *       text       uvarint length followed by that many bytes
+ *
+ * where an address is a byte with the length of the IP (4 or 16), the IP, and
+ * a 2 byte big endian port. What isn't an IP and port, like a client redacted
+ * with -redact, is a 0 byte and then the name as a uvarint length followed by
+ * that many bytes. Integers are unsigned varints as in encoding/binary.
+ *
+ */
+
+package udpwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	VERSION = 2
+
+	// Message types
+	MSG_EVENTS     = 0
+	MSG_DICTIONARY = 1
+
+	// Event flags
+	FLAG_ERROR   = 0x01
+	FLAG_ADDRESS = 0x02
+
+	// Senders keep datagrams under this size so they don't get fragmented.
+	MAX_DATAGRAM = 1400
+)
+
+// Event is one completed query.
+type Event struct {
+	Time      time.Time
+	Server    string // ip:port, or its -server-group label
+	Address   string // ip:port, if Server is a label
+	Client    string // ip:port, or a name if it was redacted
+	Hash      uint64
+	Latency   time.Duration
+	Bytes     uint64
+	ErrorCode int // 0 unless the query failed
+}
+
+// Message is a decoded datagram: either Events or Dictionary is set.
+type Message struct {
+	Type       byte
+	Events     []Event
+	Dictionary map[uint64]string
+}
+
+var errTruncated = errors.New("truncated datagram")
+
+type encoder struct {
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (self *encoder) putUvarint(val uint64) {
+	self.buf = append(self.buf, self.scratch[:binary.PutUvarint(self.scratch[:], val)]...)
+}
+
+func (self *encoder) putHash(hash uint64) {
+	self.buf = binary.LittleEndian.AppendUint64(self.buf, hash)
+}
+
+func (self *encoder) putAddress(addr string) {
+	if host, portstr, err := net.SplitHostPort(addr); err == nil {
+		port, err := strconv.ParseUint(portstr, 10, 16)
+		if ip := net.ParseIP(host); ip != nil && err == nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			self.buf = append(self.buf, byte(len(ip)))
+			self.buf = append(self.buf, ip...)
+			self.buf = binary.BigEndian.AppendUint16(self.buf, uint16(port))
+			return
+		}
+	}
+	self.buf = append(self.buf, 0)
+	self.putUvarint(uint64(len(addr)))
+	self.buf = append(self.buf, addr...)
+}
+
+// EncodeEvents builds an events datagram. It's up to the caller to keep batches
+// small enough to stay under MAX_DATAGRAM; events are 30-60 bytes each.
+func EncodeEvents(events []Event) []byte {
+	enc := &encoder{buf: make([]byte, 0, 2+len(events)*48)}
+	enc.buf = append(enc.buf, VERSION, MSG_EVENTS)
+	enc.putUvarint(uint64(len(events)))
+	for _, ev := range events {
+		enc.putUvarint(uint64(ev.Time.UnixNano()))
+		enc.putAddress(ev.Server)
+		enc.putAddress(ev.Client)
+		enc.putHash(ev.Hash)
+		enc.putUvarint(uint64(ev.Latency))
+		enc.putUvarint(ev.Bytes)
+		var flags byte
+		if ev.ErrorCode != 0 {
+			flags |= FLAG_ERROR
+		}
+		if ev.Address != "" {
+			flags |= FLAG_ADDRESS
+		}
+		enc.buf = append(enc.buf, flags)
+		if ev.ErrorCode != 0 {
+			enc.putUvarint(uint64(ev.ErrorCode))
+		}
+		if ev.Address != "" {
+			enc.putAddress(ev.Address)
+		}
+	}
+	return enc.buf
+}
+
+// EncodeDictionary builds dictionary datagrams for the texts, as many as it
+// takes to keep each under MAX_DATAGRAM. Texts too long to fit in one are cut
+// short.
+func EncodeDictionary(texts map[uint64]string) [][]byte {
+	const header = 2 + binary.MaxVarintLen64
+	const maxText = MAX_DATAGRAM - header - 8 - binary.MaxVarintLen64
+
+	var datagrams [][]byte
+	count, enc := 0, &encoder{}
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		out := &encoder{buf: make([]byte, 0, header+len(enc.buf))}
+		out.buf = append(out.buf, VERSION, MSG_DICTIONARY)
+		out.putUvarint(uint64(count))
+		datagrams = append(datagrams, append(out.buf, enc.buf...))
+		count, enc = 0, &encoder{}
+	}
+
+	for hash, text := range texts {
+		if len(text) > maxText {
+			text = text[:maxText]
+		}
+		if header+len(enc.buf)+8+binary.MaxVarintLen64+len(text) > MAX_DATAGRAM {
+			flush()
+		}
+		enc.putHash(hash)
+		enc.putUvarint(uint64(len(text)))
+		enc.buf = append(enc.buf, text...)
+		count++
+	}
+	flush()
+	return datagrams
+}
+
+// Decode reads a datagram.
+func Decode(datagram []byte) (*Message, error) {
+	buf := datagram
+	var err error
+	getBytes := func(n uint64) []byte {
+		if uint64(len(buf)) < n {
+			err, buf = errTruncated, nil
+			return nil
+		}
+		val := buf[:n]
+		buf = buf[n:]
+		return val
+	}
+	getByte := func() byte {
+		if val := getBytes(1); val != nil {
+			return val[0]
+		}
+		return 0
+	}
+	getUvarint := func() uint64 {
+		val, n := binary.Uvarint(buf)
+		if n <= 0 {
+			err, buf = errTruncated, nil
+			return 0
+		}
+		buf = buf[n:]
+		return val
+	}
+	getHash := func() uint64 {
+		if val := getBytes(8); val != nil {
+			return binary.LittleEndian.Uint64(val)
+		}
+		return 0
+	}
+	getAddress := func() string {
+		size := getByte()
+		if err != nil {
+			return ""
+		}
+		if size == 0 {
+			return string(getBytes(getUvarint()))
+		}
+		if size != net.IPv4len && size != net.IPv6len {
+			err, buf = fmt.Errorf("bad address length %d", size), nil
+			return ""
+		}
+		ip, port := net.IP(getBytes(uint64(size))), getBytes(2)
+		if err != nil {
+			return ""
+		}
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	}
+
+	header := getBytes(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != VERSION {
+		return nil, fmt.Errorf("unknown version %d", header[0])
+	}
+
+	msg := &Message{Type: header[1]}
+	count := getUvarint()
+	if count > uint64(len(buf)) {
+		return nil, errTruncated
+	}
+	switch msg.Type {
+	case MSG_EVENTS:
+		msg.Events = make([]Event, 0, count)
+		for i := uint64(0); i < count && err == nil; i++ {
+			ev := Event{Time: time.Unix(0, int64(getUvarint()))}
+			ev.Server, ev.Client = getAddress(), getAddress()
+			ev.Hash = getHash()
+			ev.Latency = time.Duration(getUvarint())
+			ev.Bytes = getUvarint()
+			flags := getByte()
+			if flags&FLAG_ERROR != 0 {
+				ev.ErrorCode = int(getUvarint())
+			}
+			if flags&FLAG_ADDRESS != 0 {
+				ev.Address = getAddress()
+			}
+			msg.Events = append(msg.Events, ev)
+		}
+	case MSG_DICTIONARY:
+		msg.Dictionary = make(map[uint64]string, count)
+		for i := uint64(0); i < count && err == nil; i++ {
+			hash := getHash()
+			msg.Dictionary[hash] = string(getBytes(getUvarint()))
+		}
+	default:
+		return nil, fmt.Errorf("unknown message type %d", msg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,110 @@
+package udpwire
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	events := []Event{
+		{Time: time.Unix(1434510000, 123456789), Server: "10.0.0.1:3306",
+			Client: "10.0.0.2:50000", Hash: 0x0123456789abcdef, Latency: 1500 * time.Microsecond,
+			Bytes: 1024},
+		{Time: time.Unix(1434510001, 0), Server: "[2001:db8::1]:3306",
+			Client: "[2001:db8::2]:40000", Hash: 42, Latency: time.Second, Bytes: 0,
+			ErrorCode: 1205},
+		{Time: time.Unix(1434510002, 0), Server: "primary-1", Address: "10.0.0.5:3306",
+			Client: "client-1354e4fb:50000", Hash: 43, Latency: time.Millisecond, Bytes: 10},
+	}
+	datagram := EncodeEvents(events[:2])
+	if len(datagram) > 110 {
+		t.Errorf("For two events\n    Got %d bytes\n    Expected at most 110", len(datagram))
+	}
+	datagram = EncodeEvents(events)
+
+	msg, err := Decode(datagram)
+	if err != nil {
+		t.Fatalf("Failed to decode: %s", err.Error())
+	}
+	if msg.Type != MSG_EVENTS || len(msg.Events) != len(events) {
+		t.Fatalf("For events\n    Got %+v\n    Expected %d events", msg, len(events))
+	}
+	for i := range events {
+		got, expected := msg.Events[i], events[i]
+		if !got.Time.Equal(expected.Time) {
+			t.Errorf("For event %d time\n    Got %s\n    Expected %s", i, got.Time, expected.Time)
+		}
+		got.Time = expected.Time
+		if got != expected {
+			t.Errorf("For event %d\n    Got %+v\n    Expected %+v", i, got, expected)
+		}
+	}
+
+	for i := 0; i < len(datagram); i++ {
+		if _, err := Decode(datagram[:i]); err == nil {
+			t.Errorf("For a datagram cut to %d bytes\n    Got no error\n    Expected an error", i)
+		}
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	texts := map[uint64]string{1: "select ?", 2: "update t set a = ?"}
+	for i := uint64(3); i < 100; i++ {
+		texts[i] = strings.Repeat("x", 100)
+	}
+	texts[100] = strings.Repeat("y", 5000)
+
+	got := make(map[uint64]string)
+	datagrams := EncodeDictionary(texts)
+	for _, datagram := range datagrams {
+		if len(datagram) > MAX_DATAGRAM {
+			t.Errorf("For a dictionary datagram\n    Got %d bytes\n    Expected at most %d",
+				len(datagram), MAX_DATAGRAM)
+		}
+		msg, err := Decode(datagram)
+		if err != nil {
+			t.Fatalf("Failed to decode: %s", err.Error())
+		}
+		for hash, text := range msg.Dictionary {
+			got[hash] = text
+		}
+	}
+
+	if len(got[100]) >= 5000 || !strings.HasPrefix(texts[100], got[100]) {
+		t.Errorf("For a long text\n    Got %d bytes\n    Expected it cut short", len(got[100]))
+	}
+	got[100] = texts[100]
+	if !reflect.DeepEqual(got, texts) {
+		t.Errorf("For the dictionary\n    Got %d entries\n    Expected %d", len(got), len(texts))
+	}
+}
+
+func TestGarbage(t *testing.T) {
+	// A dictionary entry claiming a string far longer than the datagram.
+	huge := []byte{VERSION, MSG_DICTIONARY, 1, 1, 2, 3, 4, 5, 6, 7, 8,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	if msg, err := Decode(huge); err != errTruncated || msg != nil {
+		t.Errorf("For a huge string length\n    Got %v, %v\n    Expected %v", msg, err,
+			errTruncated)
+	}
+
+	// Whatever arrives, decoding must fail or succeed but never panic.
+	datagram := EncodeEvents([]Event{{Server: "10.0.0.1:3306", Client: "client-1354e4fb:1",
+		ErrorCode: 1205}})
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		garbage := make([]byte, 2+random.Intn(64))
+		random.Read(garbage)
+		switch i % 3 {
+		case 1:
+			garbage[0], garbage[1] = VERSION, byte(random.Intn(2))
+		case 2:
+			garbage = append(garbage[:0], datagram...)
+			garbage[random.Intn(len(garbage))] = byte(random.Intn(256))
+		}
+		Decode(garbage)
+	}
+}